@@ -0,0 +1,151 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package artifact describes the files published for offline mirrors, so
+// that they can be fetched with BitTorrent or zsync
+package artifact
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bounds of the size of the pieces of torrents
+const (
+	minPieceLength = 256 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+)
+
+// Number of pieces above which larger pieces are used
+const maxPieces = 2000
+
+// TorrentOptions are the optional fields of a torrent
+type TorrentOptions struct {
+	// URLs of the trackers, the first one is the main tracker
+	Trackers []string
+	// URLs the file can be downloaded from over HTTP, see BEP 19
+	WebSeeds []string
+	Comment  string
+}
+
+// pieceLength returns the size of the pieces of a file of the length
+func pieceLength(length int64) int64 {
+	size := int64(minPieceLength)
+	for length/size > maxPieces && size < maxPieceLength {
+		size *= 2
+	}
+	return size
+}
+
+// WriteTorrent writes to w the metainfo of the file at path, see BEP 3
+func WriteTorrent(w io.Writer, path string, options TorrentOptions) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := pieceLength(info.Size())
+	var pieces strings.Builder
+	reader := bufio.NewReader(file)
+	for {
+		digest := sha1.New()
+		n, err := io.CopyN(digest, reader, size)
+		if n > 0 {
+			pieces.Write(digest.Sum(nil))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	metainfo := map[string]interface{}{
+		"created by":    "ostree-upload",
+		"creation date": time.Now().Unix(),
+		"info": map[string]interface{}{
+			"name":         filepath.Base(path),
+			"length":       info.Size(),
+			"piece length": size,
+			"pieces":       pieces.String(),
+		},
+	}
+	if len(options.Trackers) > 0 {
+		metainfo["announce"] = options.Trackers[0]
+		tiers := make([]interface{}, 0, len(options.Trackers))
+		for _, tracker := range options.Trackers {
+			tiers = append(tiers, []interface{}{tracker})
+		}
+		metainfo["announce-list"] = tiers
+	}
+	if len(options.WebSeeds) > 0 {
+		seeds := make([]interface{}, 0, len(options.WebSeeds))
+		for _, seed := range options.WebSeeds {
+			seeds = append(seeds, seed)
+		}
+		metainfo["url-list"] = seeds
+	}
+	if options.Comment != "" {
+		metainfo["comment"] = options.Comment
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := bencode(bw, metainfo); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// bencode writes value with the encoding of BitTorrent, dictionaries have
+// their keys sorted as the specification requires
+func bencode(w *bufio.Writer, value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		fmt.Fprintf(w, "%d:%s", len(v), v)
+	case int64:
+		fmt.Fprintf(w, "i%de", v)
+	case []interface{}:
+		w.WriteByte('l')
+		for _, item := range v {
+			if err := bencode(w, item); err != nil {
+				return err
+			}
+		}
+		w.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		w.WriteByte('d')
+		for _, key := range keys {
+			fmt.Fprintf(w, "%d:%s", len(key), key)
+			if err := bencode(w, v[key]); err != nil {
+				return err
+			}
+		}
+		w.WriteByte('e')
+	default:
+		return fmt.Errorf("cannot bencode %T", value)
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package artifact
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// Version of zsync whose control files are written
+const zsyncVersion = "0.6.2"
+
+// zsyncBlockSize returns the block size zsyncmake picks for a file of the
+// length
+func zsyncBlockSize(length int64) int {
+	if length < 100*1024*1024 {
+		return 2048
+	}
+	return 4096
+}
+
+// zsyncHashLengths returns how many blocks must match in a row and how
+// many bytes of the rolling and strong checksums of each block are stored,
+// computed like zsyncmake does so that clients match blocks as reliably
+func zsyncHashLengths(length int64, blockSize int) (int, int, int) {
+	seqMatches := 1
+	if length > int64(blockSize) {
+		seqMatches = 2
+	}
+
+	l := math.Log(float64(length))
+	blocks := math.Log(1 + float64(length/int64(blockSize)))
+
+	rsumLength := int(math.Ceil(((l+math.Log(float64(blockSize)))/math.Log(2) - 8.6) / float64(seqMatches) / 8))
+	if rsumLength > 4 {
+		rsumLength = 4
+	}
+	if rsumLength < 2 {
+		rsumLength = 2
+	}
+
+	checksumLength := int(math.Ceil((20 + (l+blocks)/math.Log(2)) / float64(seqMatches) / 8))
+	if minimum := int((7.9 + (20 + blocks/math.Log(2))) / 8); checksumLength < minimum {
+		checksumLength = minimum
+	}
+	if checksumLength > 16 {
+		checksumLength = 16
+	}
+
+	return seqMatches, rsumLength, checksumLength
+}
+
+// rsum returns the rolling checksum of a block, in network byte order
+func rsum(block []byte) [4]byte {
+	var a, b uint16
+	for i, c := range block {
+		a += uint16(c)
+		b += uint16(len(block)-i) * uint16(c)
+	}
+
+	var sum [4]byte
+	binary.BigEndian.PutUint16(sum[0:], a)
+	binary.BigEndian.PutUint16(sum[2:], b)
+	return sum
+}
+
+// WriteZsync writes to w the control file that lets zsync download the file
+// at path from url, reusing the blocks of an older version clients already
+// have; url is relative to the control file unless absolute
+func WriteZsync(w io.Writer, path, url string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	length := info.Size()
+	blockSize := zsyncBlockSize(length)
+	seqMatches, rsumLength, checksumLength := zsyncHashLengths(length, blockSize)
+
+	// The header ends with the digest of the whole file, so the checksums
+	// of the blocks are collected first
+	digest := sha1.New()
+	var sums bytes.Buffer
+	reader := bufio.NewReader(io.TeeReader(file, digest))
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(reader, block)
+		if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// The last block is padded with zeros
+		for i := n; i < blockSize; i++ {
+			block[i] = 0
+		}
+		weak := rsum(block)
+		strong := md4Sum(block)
+		sums.Write(weak[4-rsumLength:])
+		sums.Write(strong[:checksumLength])
+
+		if n < blockSize {
+			break
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "zsync: %s\n", zsyncVersion)
+	fmt.Fprintf(bw, "Filename: %s\n", filepath.Base(path))
+	fmt.Fprintf(bw, "MTime: %s\n", info.ModTime().Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	fmt.Fprintf(bw, "Blocksize: %d\n", blockSize)
+	fmt.Fprintf(bw, "Length: %d\n", length)
+	fmt.Fprintf(bw, "Hash-Lengths: %d,%d,%d\n", seqMatches, rsumLength, checksumLength)
+	fmt.Fprintf(bw, "URL: %s\n", url)
+	fmt.Fprintf(bw, "SHA-1: %s\n\n", hex.EncodeToString(digest.Sum(nil)))
+	if _, err := sums.WriteTo(bw); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
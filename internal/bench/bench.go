@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package bench measures how fast synthetic objects are pushed to a receiver
+package bench
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/internal/push"
+	"github.com/lirios/ostree-upload/internal/selftest"
+	"github.com/lirios/ostree-upload/internal/tracing"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Options controls the benchmark
+type Options struct {
+	// Number of file objects of the synthetic commit
+	Objects int
+	// Size in bytes of each file object
+	Size int64
+	// Branch the commit is pushed to, it must not exist on the server
+	Branch string
+	// Options of the push
+	Push push.Options
+}
+
+// findSpans returns the spans of the push with the name
+func findSpans(spans *tracetest.SpanRecorder, name string) []sdktrace.ReadOnlySpan {
+	found := []sdktrace.ReadOnlySpan{}
+	for _, span := range spans.Ended() {
+		if span.Name() == name {
+			found = append(found, span)
+		}
+	}
+
+	return found
+}
+
+// Run pushes a commit of synthetic objects to the receiver at url and reports
+// the throughput of negotiation, upload and finalize; when url is empty a
+// receiver is started in the process, to measure without network
+func Run(url, token string, options Options) error {
+	dir, err := ioutil.TempDir("", "ostree-upload-bench-")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Synthetic objects, random so that they are all different
+	logger.Actionf("Creating a commit of %d objects of %d bytes...", options.Objects, options.Size)
+	repo, err := ostree.CreateRepo(filepath.Join(dir, "client"))
+	if err != nil {
+		return fmt.Errorf("Failed to create client repository: %w", err)
+	}
+	rev, err := createCommit(repo, filepath.Join(dir, "tree"), options)
+	if err != nil {
+		return fmt.Errorf("Failed to create commit: %w", err)
+	}
+
+	if url == "" {
+		logger.Action("Starting the receiver...")
+		server, err := selftest.StartReceiver(filepath.Join(dir, "server"))
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+		url, token = server.URL, server.Token
+	}
+
+	// Time the phases with the spans of the push
+	spans := tracetest.NewSpanRecorder()
+	stop := tracing.Record(spans)
+	defer stop()
+
+	options.Push.AssumeYes = true
+	if err := push.StartClient(url, token, repo.Path(), []string{options.Branch}, options.Push); err != nil {
+		return fmt.Errorf("Failed to push: %w", err)
+	}
+
+	pushes := findSpans(spans, "push")
+	negotiations := findSpans(spans, "negotiation")
+	finalizes := findSpans(spans, "finalize")
+	if len(pushes) != 1 || len(negotiations) != 1 || len(finalizes) != 1 {
+		return fmt.Errorf("Failed to time the push of %s", rev)
+	}
+	negotiation := negotiations[0].EndTime().Sub(negotiations[0].StartTime())
+	upload := finalizes[0].StartTime().Sub(negotiations[0].EndTime())
+	finalize := finalizes[0].EndTime().Sub(finalizes[0].StartTime())
+	total := pushes[0].EndTime().Sub(pushes[0].StartTime())
+
+	objects := float64(intAttribute(negotiations[0], "objects"))
+	bytes := int64(options.Objects) * options.Size
+
+	logger.Actionf("Pushed %s to \"%s\":", rev, options.Branch)
+	logger.Infof("\tnegotiation: %v, %.0f objects/s", negotiation, perSecond(objects, negotiation))
+	logger.Infof("\tupload:      %v, %.2f MiB/s in %d requests", upload, perSecond(float64(bytes)/1024/1024, upload), len(findSpans(spans, "upload batch")))
+	logger.Infof("\tfinalize:    %v, %.0f objects/s", finalize, perSecond(objects, finalize))
+	logger.Infof("\ttotal:       %v", total)
+
+	return nil
+}
+
+// createCommit writes the synthetic objects to path and commits them
+func createCommit(repo *ostree.Repo, path string, options Options) (string, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return "", err
+	}
+
+	content := make([]byte, options.Size)
+	for i := 0; i < options.Objects; i++ {
+		if _, err := rand.Read(content); err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(filepath.Join(path, fmt.Sprintf("object-%08d", i)), content, 0644); err != nil {
+			return "", err
+		}
+	}
+
+	return repo.CommitDirectory(options.Branch, "ostree-upload benchmark", path)
+}
+
+// perSecond returns the rate of amount over the duration
+func perSecond(amount float64, duration time.Duration) float64 {
+	if duration <= 0 {
+		return 0
+	}
+
+	return amount / duration.Seconds()
+}
+
+// intAttribute returns the integer attribute of the span with the key
+func intAttribute(span sdktrace.ReadOnlySpan, key string) int64 {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value.AsInt64()
+		}
+	}
+	return 0
+}
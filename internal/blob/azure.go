@@ -0,0 +1,270 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package blob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of the Blob service API, the first one accepting blobs of up to
+// 5000 MiB in a single request
+const azureAPIVersion = "2019-12-12"
+
+// Resource the access tokens are requested for
+const azureStorageResource = "https://storage.azure.com/"
+
+// Default endpoints of Azure
+const (
+	azureAuthorityHost = "https://login.microsoftonline.com/"
+	azureIMDSToken     = "http://169.254.169.254/metadata/identity/oauth2/token"
+)
+
+// AzureContainer is a container of Azure Blob Storage
+type AzureContainer struct {
+	account   string
+	container string
+	endpoint  string
+
+	// Only one of them is set
+	key    []byte
+	sas    string
+	tokens *tokenSource
+}
+
+// NewAzureContainer returns the container of the storage account, accessed
+// with the credentials found in the environment like the Azure SDKs do:
+// the AZURE_STORAGE_KEY account key or the AZURE_STORAGE_SAS_TOKEN shared
+// access signature, otherwise a token of the service principal set with
+// AZURE_TENANT_ID, AZURE_CLIENT_ID and either AZURE_CLIENT_SECRET or
+// AZURE_FEDERATED_TOKEN_FILE as with workload identity, otherwise a token
+// of the managed identity.  endpoint is the one of the account on the
+// public cloud when empty.
+func NewAzureContainer(account, container, endpoint string) (*AzureContainer, error) {
+	if account == "" || container == "" {
+		return nil, errors.New("no storage account or container name")
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", account)
+	}
+	c := &AzureContainer{account: account, container: container, endpoint: strings.TrimSuffix(endpoint, "/")}
+
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AZURE_STORAGE_KEY: %v", err)
+		}
+		c.key = decoded
+		return c, nil
+	}
+	if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		c.sas = strings.TrimPrefix(sas, "?")
+		return c, nil
+	}
+
+	c.tokens = &tokenSource{fetch: azureToken}
+	return c, nil
+}
+
+// azureToken returns an access token of the service principal or of the
+// managed identity
+func azureToken() (string, time.Time, error) {
+	tenantID := os.Getenv("AZURE_TENANT_ID")
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	if tenantID != "" && clientID != "" {
+		values := url.Values{
+			"grant_type": {"client_credentials"},
+			"client_id":  {clientID},
+			"scope":      {azureStorageResource + ".default"},
+		}
+		if secret := os.Getenv("AZURE_CLIENT_SECRET"); secret != "" {
+			values.Set("client_secret", secret)
+		} else if tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); tokenFile != "" {
+			// Kubernetes rotates the token, read it each time
+			assertion, err := ioutil.ReadFile(tokenFile)
+			if err != nil {
+				return "", time.Time{}, err
+			}
+			values.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+			values.Set("client_assertion", strings.TrimSpace(string(assertion)))
+		} else {
+			return "", time.Time{}, errors.New("neither AZURE_CLIENT_SECRET nor AZURE_FEDERATED_TOKEN_FILE is set")
+		}
+
+		authority := os.Getenv("AZURE_AUTHORITY_HOST")
+		if authority == "" {
+			authority = azureAuthorityHost
+		}
+		request, err := postForm(strings.TrimSuffix(authority, "/")+"/"+url.PathEscape(tenantID)+"/oauth2/v2.0/token", values)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return fetchToken(request)
+	}
+
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureStorageResource}}
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	}
+	request, err := http.NewRequest(http.MethodGet, azureIMDSToken+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	request.Header.Set("Metadata", "true")
+
+	return fetchToken(request)
+}
+
+// newRequest returns an authenticated request for the blob name, length
+// is the size of the body
+func (c *AzureContainer) newRequest(method, name string, body io.Reader, length int64, headers map[string]string) (*http.Request, error) {
+	endpoint := fmt.Sprintf("%s/%s/%s", c.endpoint, url.PathEscape(c.container), escapeBlobName(name))
+	if c.sas != "" {
+		endpoint += "?" + c.sas
+	}
+
+	request, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = length
+	request.Header.Set("x-ms-version", azureAPIVersion)
+	request.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	switch {
+	case c.key != nil:
+		request.Header.Set("Authorization", "SharedKey "+c.account+":"+c.sign(request))
+	case c.tokens != nil:
+		token, err := c.tokens.get()
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return request, nil
+}
+
+// escapeBlobName escapes the name of a blob, keeping the slashes that
+// separate its virtual directories
+func escapeBlobName(name string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// sign returns the shared key signature of the request, see
+// https://docs.microsoft.com/rest/api/storageservices/authorize-with-shared-key
+func (c *AzureContainer) sign(request *http.Request) string {
+	length := ""
+	if request.ContentLength > 0 {
+		length = strconv.FormatInt(request.ContentLength, 10)
+	}
+
+	var b strings.Builder
+	b.WriteString(request.Method + "\n")
+	for _, name := range []string{"Content-Encoding", "Content-Language"} {
+		b.WriteString(request.Header.Get(name) + "\n")
+	}
+	b.WriteString(length + "\n")
+	for _, name := range []string{"Content-MD5", "Content-Type", "Date", "If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		b.WriteString(request.Header.Get(name) + "\n")
+	}
+
+	// Headers of the service, in lexicographical order
+	var msHeaders []string
+	for name := range request.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower)
+		}
+	}
+	sort.Strings(msHeaders)
+	for _, name := range msHeaders {
+		b.WriteString(name + ":" + strings.TrimSpace(request.Header.Get(name)) + "\n")
+	}
+
+	// Resource, followed by the query parameters
+	b.WriteString("/" + c.account + request.URL.EscapedPath())
+	query := request.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		b.WriteString("\n" + strings.ToLower(key) + ":" + strings.Join(values, ","))
+	}
+
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(b.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Put uploads the blob in a single request
+func (c *AzureContainer) Put(name string, r io.Reader, size int64, cacheControl string) error {
+	headers := map[string]string{
+		"x-ms-blob-type":          "BlockBlob",
+		"x-ms-blob-content-type":  "application/octet-stream",
+		"x-ms-blob-cache-control": cacheControl,
+	}
+	request, err := c.newRequest(http.MethodPut, name, io.LimitReader(r, size), size, headers)
+	if err != nil {
+		return err
+	}
+
+	response, err := uploadClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		return statusError(response)
+	}
+
+	return nil
+}
+
+// Exists reads the properties of the blob
+func (c *AzureContainer) Exists(name string) (bool, error) {
+	request, err := c.newRequest(http.MethodHead, name, nil, 0, nil)
+	if err != nil {
+		return false, err
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+
+	return false, statusError(response)
+}
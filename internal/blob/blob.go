@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package blob writes files to the object stores of cloud providers,
+// through their REST API
+package blob
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum time of a request that doesn't upload anything
+const requestTimeout = 30 * time.Second
+
+// Tokens are renewed this long before they expire
+const tokenExpiryMargin = 5 * time.Minute
+
+// Bucket is a container of objects in an object store
+type Bucket interface {
+	// Put writes size bytes read from r to the object name, readers see
+	// either the previous content or all of the new one
+	Put(name string, r io.Reader, size int64, cacheControl string) error
+	// Exists returns whether there is an object called name
+	Exists(name string) (bool, error)
+}
+
+// httpClient sends the requests that don't upload anything
+var httpClient = &http.Client{Timeout: requestTimeout}
+
+// uploadClient sends uploads, which take as long as they need
+var uploadClient = &http.Client{}
+
+// statusError returns an error describing an unexpected response
+func statusError(response *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	message := strings.TrimSpace(string(body))
+	if message == "" {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return fmt.Errorf("unexpected status %s: %s", response.Status, message)
+}
+
+// seconds is a duration in seconds, sent as a number or a string
+type seconds int64
+
+func (s *seconds) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(strings.Trim(string(data), "\""), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s", string(data))
+	}
+	*s = seconds(value)
+	return nil
+}
+
+// tokenResponse is the response of OAuth 2.0 token endpoints
+type tokenResponse struct {
+	AccessToken string  `json:"access_token"`
+	ExpiresIn   seconds `json:"expires_in"`
+}
+
+// fetchToken sends the request for an access token and decodes the response
+func fetchToken(request *http.Request) (string, time.Time, error) {
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", time.Time{}, statusError(response)
+	}
+
+	var token tokenResponse
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", time.Time{}, err
+	}
+	if token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("no access token returned by %s", request.URL.Host)
+	}
+
+	return token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn) * time.Second), nil
+}
+
+// postForm returns a request sending values to a token endpoint
+func postForm(endpoint string, values url.Values) (*http.Request, error) {
+	request, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return request, nil
+}
+
+// tokenSource returns an access token, fetching a new one when the
+// previous one is about to expire
+type tokenSource struct {
+	fetch func() (string, time.Time, error)
+
+	mutex  sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (s *tokenSource) get() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token != "" && time.Now().Add(tokenExpiryMargin).Before(s.expiry) {
+		return s.token, nil
+	}
+
+	token, expiry, err := s.fetch()
+	if err != nil {
+		return "", fmt.Errorf("failed to get an access token: %v", err)
+	}
+	s.token = token
+	s.expiry = expiry
+
+	return token, nil
+}
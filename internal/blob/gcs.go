@@ -0,0 +1,277 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package blob
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Scope of the access tokens, enough to read and write objects
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// Default endpoints of Google Cloud
+const (
+	gcsEndpoint      = "https://storage.googleapis.com"
+	googleTokenURL   = "https://oauth2.googleapis.com/token"
+	gceMetadataHost  = "metadata.google.internal"
+	gceMetadataToken = "/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// GCSBucket is a bucket of Google Cloud Storage
+type GCSBucket struct {
+	name     string
+	endpoint string
+	tokens   *tokenSource
+}
+
+// NewGCSBucket returns the bucket called name, accessed with the
+// application default credentials: the file pointed to by
+// GOOGLE_APPLICATION_CREDENTIALS or written by "gcloud auth
+// application-default login", otherwise the service account of the
+// metadata server as with workload identity.  endpoint is the one of
+// Google Cloud Storage when empty.
+func NewGCSBucket(name, endpoint string) (*GCSBucket, error) {
+	if name == "" {
+		return nil, errors.New("no bucket name")
+	}
+	if endpoint == "" {
+		endpoint = gcsEndpoint
+	}
+
+	fetch, err := googleCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	return &GCSBucket{name: name, endpoint: strings.TrimSuffix(endpoint, "/"), tokens: &tokenSource{fetch: fetch}}, nil
+}
+
+// googleCredentials returns how access tokens are fetched
+func googleCredentials() (func() (string, time.Time, error), error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		if configDir, err := os.UserConfigDir(); err == nil {
+			wellKnown := filepath.Join(configDir, "gcloud", "application_default_credentials.json")
+			if _, err := os.Stat(wellKnown); err == nil {
+				path = wellKnown
+			}
+		}
+	}
+	if path == "" {
+		return metadataToken, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %v", path, err)
+	}
+	tokenURL := file.TokenURI
+	if tokenURL == "" {
+		tokenURL = googleTokenURL
+	}
+
+	switch file.Type {
+	case "service_account":
+		key, err := parsePrivateKey(file.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key in %s: %v", path, err)
+		}
+		return func() (string, time.Time, error) {
+			return serviceAccountToken(tokenURL, file.ClientEmail, key)
+		}, nil
+	case "authorized_user":
+		return func() (string, time.Time, error) {
+			request, err := postForm(tokenURL, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {file.ClientID},
+				"client_secret": {file.ClientSecret},
+				"refresh_token": {file.RefreshToken},
+			})
+			if err != nil {
+				return "", time.Time{}, err
+			}
+			return fetchToken(request)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported credentials type \"%s\" in %s", file.Type, path)
+}
+
+// parsePrivateKey decodes the PEM encoded RSA key of a service account
+func parsePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+
+	return key, nil
+}
+
+// serviceAccountToken exchanges a JWT signed with the key of the service
+// account for an access token
+func serviceAccountToken(tokenURL, email string, key *rsa.PrivateKey) (string, time.Time, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   email,
+		"scope": gcsScope,
+		"aud":   tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	request, err := postForm(tokenURL, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return fetchToken(request)
+}
+
+// metadataToken returns a token of the service account of the instance or
+// of the Kubernetes service account with workload identity
+func metadataToken() (string, time.Time, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = gceMetadataHost
+	}
+
+	request, err := http.NewRequest(http.MethodGet, "http://"+host+gceMetadataToken+"?scopes="+url.QueryEscape(gcsScope), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	request.Header.Set("Metadata-Flavor", "Google")
+
+	return fetchToken(request)
+}
+
+// newRequest returns an authenticated request to the API
+func (b *GCSBucket) newRequest(method, endpoint string, body io.Reader) (*http.Request, error) {
+	token, err := b.tokens.get()
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	return request, nil
+}
+
+// Put uploads the object with its metadata in a single multipart request
+func (b *GCSBucket) Put(name string, r io.Reader, size int64, cacheControl string) error {
+	metadata, err := json.Marshal(map[string]string{"name": name, "cacheControl": cacheControl})
+	if err != nil {
+		return err
+	}
+
+	// The size is known, so the body is streamed with a length
+	boundary := multipart.NewWriter(ioutil.Discard).Boundary()
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "--%s\r\nContent-Type: application/json; charset=UTF-8\r\n\r\n%s\r\n", boundary, metadata)
+	fmt.Fprintf(&head, "--%s\r\nContent-Type: application/octet-stream\r\n\r\n", boundary)
+	tail := []byte(fmt.Sprintf("\r\n--%s--\r\n", boundary))
+	body := io.MultiReader(&head, io.LimitReader(r, size), bytes.NewReader(tail))
+
+	endpoint := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=multipart", b.endpoint, url.PathEscape(b.name))
+	request, err := b.newRequest(http.MethodPost, endpoint, body)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = int64(head.Len()) + size + int64(len(tail))
+	request.Header.Set("Content-Type", "multipart/related; boundary="+boundary)
+
+	response, err := uploadClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return statusError(response)
+	}
+
+	return nil
+}
+
+// Exists reads the name of the object
+func (b *GCSBucket) Exists(name string) (bool, error) {
+	endpoint := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?fields=name", b.endpoint, url.PathEscape(b.name), url.PathEscape(name))
+	request, err := b.newRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return false, err
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+
+	return false, statusError(response)
+}
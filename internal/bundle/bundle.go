@@ -0,0 +1,269 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package bundle serializes commits and their objects to a single signed
+// file, for receivers that cannot be reached over the network
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Version of the format of bundles
+const formatVersion = 1
+
+// Names of the entries of a bundle, objects come first and the manifest,
+// which needs their checksums, last
+const (
+	objectsDir       = "objects/"
+	manifestName     = "manifest.json"
+	manifestSigName  = "manifest.sig"
+	maxManifestBytes = 64 * 1024 * 1024
+)
+
+// Maximum number of objects listed when they don't match the manifest
+const maxListedMismatches = 10
+
+// Manifest describes the content of a bundle, it's signed and has the
+// checksum of each object so that the signature covers all of it
+type Manifest struct {
+	Version int `json:"version"`
+	// Mode of the repository the objects are named for
+	Mode    string    `json:"mode"`
+	Created time.Time `json:"created"`
+	// Branches updated by the bundle, the server revision is the one the
+	// receiver had when the bundle was made
+	Refs map[string]common.RevisionPair `json:"refs"`
+	// SHA-256 of each object, by name
+	Objects map[string]string `json:"objects"`
+	// Build information of the commits
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// ReadPrivateKey reads a PEM encoded Ed25519 private key, as written by
+// "openssl genpkey -algorithm ed25519"
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", path)
+	}
+
+	return privateKey, nil
+}
+
+// ReadPublicKey reads a PEM encoded Ed25519 public key, as written by
+// "openssl pkey -pubout"
+func ReadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", path)
+	}
+
+	return publicKey, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	return block, nil
+}
+
+// Writer writes a bundle
+type Writer struct {
+	tw      *tar.Writer
+	key     ed25519.PrivateKey
+	objects map[string]string
+}
+
+// NewWriter returns a writer of a bundle to w signed with key
+func NewWriter(w io.Writer, key ed25519.PrivateKey) *Writer {
+	return &Writer{tw: tar.NewWriter(w), key: key, objects: map[string]string{}}
+}
+
+// writeEntry writes an entry of size bytes read from r to the tarball
+func (w *Writer) writeEntry(name string, size int64, r io.Reader) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(w.tw, r)
+	return err
+}
+
+// AddObject adds the object called objectName with the content of the file
+// at path
+func (w *Writer) AddObject(objectName, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.New()
+	if err := w.writeEntry(objectsDir+objectName, info.Size(), io.TeeReader(file, digest)); err != nil {
+		return err
+	}
+	w.objects[objectName] = hex.EncodeToString(digest.Sum(nil))
+
+	return nil
+}
+
+// Close writes the manifest, with the objects added so far, and its
+// signature
+func (w *Writer) Close(manifest Manifest) error {
+	manifest.Version = formatVersion
+	manifest.Objects = w.objects
+	if manifest.Created.IsZero() {
+		manifest.Created = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	signature := ed25519.Sign(w.key, data)
+
+	if err := w.writeEntry(manifestName, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if err := w.writeEntry(manifestSigName, int64(len(signature)), bytes.NewReader(signature)); err != nil {
+		return err
+	}
+
+	return w.tw.Close()
+}
+
+// Read reads the bundle from r, handing each object to store as it's read,
+// and returns the manifest once its signature is verified with key and the
+// objects match it; store must not trust the objects before that
+func Read(r io.Reader, key ed25519.PublicKey, store func(objectName string, r io.Reader) error) (*Manifest, error) {
+	tr := tar.NewReader(r)
+	checksums := map[string]string{}
+	var data, signature []byte
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case strings.HasPrefix(header.Name, objectsDir):
+			objectName := strings.TrimPrefix(header.Name, objectsDir)
+			if err := ostree.ValidateObjectName(objectName); err != nil {
+				return nil, err
+			}
+			if _, ok := checksums[objectName]; ok {
+				return nil, fmt.Errorf("object %s is in the bundle twice", objectName)
+			}
+
+			digest := sha256.New()
+			if err := store(objectName, io.TeeReader(tr, digest)); err != nil {
+				return nil, fmt.Errorf("failed to store object %s: %v", objectName, err)
+			}
+			// Whatever store didn't read counts too
+			if _, err := io.Copy(digest, tr); err != nil {
+				return nil, err
+			}
+			checksums[objectName] = hex.EncodeToString(digest.Sum(nil))
+		case header.Name == manifestName:
+			if data, err = ioutil.ReadAll(io.LimitReader(tr, maxManifestBytes)); err != nil {
+				return nil, err
+			}
+		case header.Name == manifestSigName:
+			if signature, err = ioutil.ReadAll(io.LimitReader(tr, ed25519.SignatureSize+1)); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected file %s in the bundle", header.Name)
+		}
+	}
+
+	if data == nil || signature == nil {
+		return nil, errors.New("the bundle has no signed manifest, it might be truncated")
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return nil, errors.New("the signature of the bundle is not valid for the trusted key")
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if manifest.Version != formatVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", manifest.Version)
+	}
+
+	// Compare the objects with the signed manifest
+	var mismatches []string
+	for objectName, checksum := range manifest.Objects {
+		if checksums[objectName] != checksum {
+			mismatches = append(mismatches, objectName)
+		}
+	}
+	for objectName := range checksums {
+		if _, ok := manifest.Objects[objectName]; !ok {
+			mismatches = append(mismatches, objectName)
+		}
+	}
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		listed := mismatches
+		if len(listed) > maxListedMismatches {
+			listed = listed[:maxListedMismatches]
+		}
+		return nil, fmt.Errorf("%d objects don't match the manifest: %s", len(mismatches), strings.Join(listed, ", "))
+	}
+
+	return &manifest, nil
+}
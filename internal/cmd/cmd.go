@@ -5,20 +5,91 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	"github.com/lirios/ostree-upload/internal/bench"
+	"github.com/lirios/ostree-upload/internal/bundle"
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/doctor"
 	"github.com/lirios/ostree-upload/internal/logger"
-	"github.com/lirios/ostree-upload/internal/ostree"
 	"github.com/lirios/ostree-upload/internal/push"
 	"github.com/lirios/ostree-upload/internal/receiver"
+	"github.com/lirios/ostree-upload/internal/selftest"
+	"github.com/lirios/ostree-upload/internal/tracing"
+	"github.com/lirios/ostree-upload/internal/version"
+	"github.com/lirios/ostree-upload/pkg/client"
+	"github.com/lirios/ostree-upload/pkg/ostree"
 )
 
+// Logging options shared by all commands
+var (
+	logOptions logger.Options
+	logLevel   string
+	logMaxSize int64
+	traceSpans bool
+
+	// Flushes the spans that were not exported yet
+	shutdownTracing func(context.Context) error
+)
+
+// Time given to export the remaining spans on exit
+const tracingShutdownTimeout = 5 * time.Second
+
+// setupLogging configures the logger from the command line, verbose
+// enables debug messages regardless of the log level
+func setupLogging(verbose bool) error {
+	options := logOptions
+	options.MaxSize = logMaxSize * 1024 * 1024
+	if err := logger.Configure(options); err != nil {
+		return err
+	}
+
+	level, err := logger.ParseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	if verbose {
+		level = logger.LevelDebug
+	}
+	logger.SetLevel(level)
+
+	shutdown, err := tracing.Setup(context.Background(), traceSpans)
+	if err != nil {
+		return err
+	}
+	shutdownTracing = shutdown
+
+	return nil
+}
+
+// logOutputFile returns the file log messages are written to, if any
+func logOutputFile() string {
+	switch logOptions.Output {
+	case "", "stderr", "stdout", "syslog":
+		return ""
+	}
+	return logOptions.Output
+}
+
 // Generate token command
 func genTokenCmd() *cobra.Command {
 	var (
 		configPath string
+		repoPath   string
+		name       string
+		expiresIn  time.Duration
+		scopes     []string
+		refs       []string
 		verbose    bool
 	)
 
@@ -27,8 +98,14 @@ func genTokenCmd() *cobra.Command {
 		Short: "Creates a new API token",
 		Long:  "Generates a token that gives access to the API.",
 		Run: func(cmd *cobra.Command, args []string) {
-			// Toggle debug output
-			logger.SetVerbose(verbose)
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			// The configuration file can also be set from the environment
+			stringFromEnv(cmd, "config", "OSTREE_UPLOAD_CONFIG")
 
 			// Validate arguments
 			if len(configPath) == 0 {
@@ -49,6 +126,13 @@ func genTokenCmd() *cobra.Command {
 				logger.Fatalf("Failed to generate token: %v", err)
 				return
 			}
+			token.Repo = repoPath
+			token.Name = name
+			token.Scopes = scopes
+			token.Refs = refs
+			if expiresIn > 0 {
+				token.Expires = time.Now().UTC().Add(expiresIn).Format(time.RFC3339)
+			}
 
 			// Save token to the configuration
 			config.Tokens = append(config.Tokens, token)
@@ -62,7 +146,12 @@ func genTokenCmd() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().StringVarP(&configPath, "config", "c", "ostree-upload.yaml", "path to configuration file")
+	cmd.Flags().StringVarP(&configPath, "config", "c", "ostree-upload.yaml", "path to configuration file, also read from OSTREE_UPLOAD_CONFIG")
+	cmd.Flags().StringVarP(&repoPath, "repo", "r", "", "repository the token gives access to, instead of the one passed to receive")
+	cmd.Flags().StringVarP(&name, "name", "n", "", "name of the token, to tell tokens apart")
+	cmd.Flags().DurationVarP(&expiresIn, "expires-in", "", 0, "time after which the token expires, 0 to never expire")
+	cmd.Flags().StringSliceVarP(&scopes, "scope", "", []string{}, "operation the token allows, push, promote, admin, pull or the scope required by protected branches, all by default")
+	cmd.Flags().StringSliceVarP(&refs, "ref", "", []string{}, "pattern of the branches the token can update, all by default")
 	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
 
 	return cmd
@@ -72,96 +161,295 @@ func genTokenCmd() *cobra.Command {
 func receiveCmd() *cobra.Command {
 	var (
 		bindAddress string
+		basePath    string
 		configPath  string
 		verbose     bool
 		repoPath    string
+		pidFile     string
+		logFile     string
 	)
 
 	var cmd = &cobra.Command{
 		Use:   "receive",
 		Short: "Start the server",
 		Run: func(cmd *cobra.Command, args []string) {
-			// Toggle debug output
-			logger.SetVerbose(verbose)
+			// Logging
+			if logFile != "" {
+				logOptions.Output = logFile
+			}
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
 
-			// Queue
-			queue, err := receiver.NewQueue()
+			// The configuration file can also be set from the environment
+			stringFromEnv(cmd, "config", "OSTREE_UPLOAD_CONFIG")
+
+			// Open configuration file
+			config, err := receiver.OpenConfig(configPath)
 			if err != nil {
-				logger.Fatalf("Failed to create queue: %v", err)
+				logger.Fatalf("Cannot open configuration file: %v", err)
 				return
 			}
 
-			// Open repository
-			var repo *ostree.Repo
-			if _, err := os.Stat(repoPath); os.IsNotExist(err) {
-				repo, err = ostree.CreateRepo(repoPath)
-				if err != nil {
-					logger.Fatalf("Failed to create OSTree repository: %v", err)
-					return
+			// Bind the address as root and leave everything else to a
+			// worker running this command as an unprivileged user, in
+			// the sandbox
+			if config.UsesWorker() && !receiver.IsWorker() {
+				if pidFile != "" {
+					if err := writePidFile(pidFile); err != nil {
+						logger.Fatalf("Cannot write pid file: %v", err)
+						return
+					}
+				}
+				err := receiver.RunHelper(bindAddress, config, repoPath, logOutputFile())
+				if pidFile != "" {
+					os.Remove(pidFile)
 				}
-			} else {
-				repo, err = ostree.OpenRepo(repoPath)
 				if err != nil {
-					logger.Fatalf("Failed to open OSTree repository: %v", err)
-					return
+					logger.Fatal(err)
 				}
+				return
+			}
+			if receiver.IsWorker() {
+				// The pid file is the helper's
+				pidFile = ""
 			}
 
-			// Create temporary directory
-			if err = receiver.CreateTempDirectory(repo); err != nil {
-				logger.Fatalf("Failed to create temporary directory for OSTree repository: %v", err)
+			// Queue
+			queue, err := receiver.NewQueue()
+			if err != nil {
+				logger.Fatalf("Failed to create queue: %v", err)
 				return
 			}
 
-			// Open configuration file
-			config, err := receiver.OpenConfig(configPath)
+			// Open repository, tokens might give access to other repositories
+			// that are opened when they are used
+			repo, err := receiver.OpenOrCreateRepo(repoPath)
 			if err != nil {
-				logger.Fatalf("Cannot open configuration file: %v", err)
+				logger.Fatalf("Unable to use repository %s: %v", repoPath, err)
+				return
+			}
+
+			if err := receiver.OpenStorage(repo, config); err != nil {
+				logger.Fatal(err)
+				return
+			}
+			if err := config.Encryption.Load(); err != nil {
+				logger.Fatal(err)
+				return
+			}
+			if err := receiver.EnterSandbox(config); err != nil {
+				logger.Fatalf("Cannot sandbox the worker: %v", err)
+				return
+			}
+
+			// Publishes interrupted by a crash reference objects that
+			// are not reachable yet, deal with them before pruning
+			if err := receiver.RecoverPublishes(repo, config); err != nil {
+				logger.Fatalf("Failed to recover interrupted publishes: %v", err)
+				return
+			}
+			if err := receiver.RecoverSummary(repo, config); err != nil {
+				logger.Fatal(err)
 				return
 			}
 
 			// Prune the repository before we begin
 			logger.Infof("Pruning repository...")
-			total, pruned, size, err := repo.Prune(false, false)
+			var result *ostree.PruneResult
+			err = config.RunBackgroundJob(func() (err error) {
+				result, err = repo.Prune(ostree.PruneOptions{Depth: -1})
+				return err
+			})
 			if err != nil {
 				logger.Fatalf("Failed to prune repository: %v", err)
 				return
 			}
-			logger.Infof("Pruned %d/%d objects, %d bytes deleted", pruned, total, size)
+			logger.Infof("Pruned %d/%d objects, %d bytes deleted", result.Pruned, result.Total, result.Size)
+
+			appState := &receiver.AppState{Queue: queue, Repo: receiver.DebounceSummary(repo, config.SummaryDelay), Config: config}
+			if config.IntegrityCheck.Interval > 0 {
+				appState.StartIntegrityChecks(config.IntegrityCheck.Interval)
+			}
+			if config.StagingGC.Interval > 0 {
+				appState.StartStagingGC(config.StagingGC.Interval, config.StagingGC.MaxAge)
+			}
+			if config.Replication.Primary != "" {
+				if err := appState.StartReplication(); err != nil {
+					logger.Fatal(err)
+					return
+				}
+			}
+
+			// Init systems find the server with the pid file
+			if pidFile != "" {
+				if err := writePidFile(pidFile); err != nil {
+					logger.Fatalf("Cannot write pid file: %v", err)
+					return
+				}
+			}
+			handleSignals(appState, pidFile)
 
-			appState := &receiver.AppState{Queue: queue, Repo: repo, Config: config}
-			if err := receiver.StartServer(bindAddress, appState); err != nil {
+			if err := receiver.StartServer(bindAddress, basePath, appState); err != nil {
+				if pidFile != "" {
+					os.Remove(pidFile)
+				}
 				logger.Fatal(err)
 				return
 			}
 		},
 	}
 
-	cmd.Flags().StringVarP(&configPath, "config", "c", "ostree-upload.yaml", "path to configuration file")
+	cmd.Flags().StringVarP(&configPath, "config", "c", "ostree-upload.yaml", "path to configuration file, also read from OSTREE_UPLOAD_CONFIG")
 	cmd.Flags().StringVarP(&bindAddress, "address", "a", ":8080", "host name and port to bind")
+	cmd.Flags().StringVarP(&basePath, "base-path", "", "", "path the API is served at, when behind a reverse proxy")
 	cmd.Flags().StringVarP(&repoPath, "repo", "r", "repo", "path to OSTree repository")
+	cmd.Flags().StringVarP(&pidFile, "pid-file", "", "", "file to write the process identifier to, removed on exit")
+	cmd.Flags().StringVarP(&logFile, "log-file", "", "", "file to write log messages to, the same as --log-output=<PATH>")
 	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
 
 	return cmd
 }
 
+// Environment variables that set the push timeouts, by flag name
+var pushTimeoutVariables = map[string]string{
+	"connect-timeout":         "OSTREE_UPLOAD_CONNECT_TIMEOUT",
+	"request-timeout":         "OSTREE_UPLOAD_REQUEST_TIMEOUT",
+	"upload-timeout":          "OSTREE_UPLOAD_UPLOAD_TIMEOUT",
+	"publish-timeout":         "OSTREE_UPLOAD_PUBLISH_TIMEOUT",
+	"response-header-timeout": "OSTREE_UPLOAD_RESPONSE_HEADER_TIMEOUT",
+	"deadline":                "OSTREE_UPLOAD_DEADLINE",
+}
+
+// durationFromEnv sets the flag from the environment variable,
+// unless it was passed on the command line
+func durationFromEnv(cmd *cobra.Command, flag, variable string) error {
+	value := os.Getenv(variable)
+	if value == "" || cmd.Flags().Changed(flag) {
+		return nil
+	}
+
+	if _, err := time.ParseDuration(value); err != nil {
+		return fmt.Errorf("Invalid value for %s: %v", variable, err)
+	}
+
+	return cmd.Flags().Set(flag, value)
+}
+
+// stringFromEnv sets the flag from the environment variable,
+// unless it was passed on the command line
+func stringFromEnv(cmd *cobra.Command, flag, variable string) {
+	if value := os.Getenv(variable); value != "" && !cmd.Flags().Changed(flag) {
+		cmd.Flags().Set(flag, value)
+	}
+}
+
+// tlsFlags adds the flags that control which servers are trusted
+func tlsFlags(cmd *cobra.Command, options *client.TLSOptions) {
+	cmd.Flags().StringVarP(&options.CACert, "cacert", "", "", "PEM file with the certificate authorities to trust instead of the system ones")
+	cmd.Flags().StringSliceVarP(&options.PinnedKeys, "pin-sha256", "", []string{}, "base64 encoded SHA-256 digest of the public key of a certificate the server must present")
+	cmd.Flags().BoolVarP(&options.Insecure, "insecure", "", false, "don't verify the certificates of the server, for local testing only")
+}
+
+// requestFlags adds the flags that add credentials and headers to the requests
+func requestFlags(cmd *cobra.Command, options *client.RequestOptions) {
+	cmd.Flags().StringArrayVarP(&options.Headers, "header", "H", []string{}, "header added to every request, as \"Name: value\", can be repeated")
+	cmd.Flags().StringVarP(&options.BasicAuth, "basic-auth", "", "", "user:password for HTTP basic authentication with a reverse proxy, also read from OSTREE_UPLOAD_BASIC_AUTH")
+}
+
+// summaryMetadataOptions are the summary metadata set and removed on the
+// command line
+type summaryMetadataOptions struct {
+	set    map[string]string
+	remove []string
+}
+
+// summaryMetadataFlags adds the flags that change the summary metadata of the server
+func summaryMetadataFlags(cmd *cobra.Command, options *summaryMetadataOptions) {
+	cmd.Flags().StringToStringVarP(&options.set, "summary-metadata", "", map[string]string{}, "metadata merged into the summary of the server when publishing, as key=value pairs")
+	cmd.Flags().StringSliceVarP(&options.remove, "remove-summary-metadata", "", []string{}, "key removed from the summary metadata of the server when publishing, can be repeated")
+}
+
+// values returns the summary metadata sent to the server, keys removed
+// have a nil value
+func (o *summaryMetadataOptions) values() map[string]interface{} {
+	if len(o.set) == 0 && len(o.remove) == 0 {
+		return nil
+	}
+
+	values := make(map[string]interface{}, len(o.set)+len(o.remove))
+	for _, key := range o.remove {
+		values[key] = nil
+	}
+	for key, value := range o.set {
+		values[key] = value
+	}
+	return values
+}
+
+// basicAuthFromEnv reads the basic authentication credentials from the
+// environment, unless they were passed on the command line
+func basicAuthFromEnv(options *client.RequestOptions) {
+	if len(options.BasicAuth) == 0 {
+		options.BasicAuth = os.Getenv("OSTREE_UPLOAD_BASIC_AUTH")
+	}
+}
+
+// completeBranches completes the branches of the repository passed with
+// the --repo flag of the command
+func completeBranches(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	repoPath, err := cmd.Flags().GetString("repo")
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	repo, err := ostree.Open(repoPath)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	revs, err := repo.Refs()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	branches := []string{}
+	for ref := range revs {
+		if strings.HasPrefix(ref, toComplete) {
+			branches = append(branches, ref)
+		}
+	}
+	sort.Strings(branches)
+
+	return branches, cobra.ShellCompDirectiveNoFileComp
+}
+
 // Push command
 func pushCmd() *cobra.Command {
 	var (
-		url      string
-		repoPath string
-		token    string
-		branches []string
-		verbose  bool
-		prune    bool
+		url       string
+		repoPath  string
+		token     string
+		branches  []string
+		verbose   bool
+		batchSize int64
+		deltaSize int64
+		options   push.Options
+		summary   summaryMetadataOptions
+		signKey   string
 	)
 
 	var cmd = &cobra.Command{
 		Use:   "push",
 		Short: "Push objects to the remote OSTree repository",
 		Run: func(cmd *cobra.Command, args []string) {
-			// Toggle debug output
-			logger.SetVerbose(verbose)
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			// The server can also be set from the environment
+			stringFromEnv(cmd, "address", "OSTREE_UPLOAD_ADDRESS")
 
 			// Check the token
 			if len(token) == 0 {
@@ -171,37 +459,1590 @@ func pushCmd() *cobra.Command {
 				logger.Fatal("Token is mandatory")
 				return
 			}
+			basicAuthFromEnv(&options.Request)
+
+			// Pushing a commit needs to know which branch to update
+			if options.Commit != "" && options.ToRef == "" {
+				logger.Fatal("--to-ref is mandatory with --commit")
+				return
+			}
+			if options.ToRef != "" && options.Commit == "" {
+				logger.Fatal("--to-ref can only be used with --commit")
+				return
+			}
+			if options.Commit != "" && len(branches) > 0 {
+				logger.Fatal("--commit and --branch cannot be used together")
+				return
+			}
+			filtered := cmd.Flags().Changed("exclude-ref") || cmd.Flags().Changed("exclude-metadata") || cmd.Flags().Changed("match-metadata")
+			if filtered && (options.Commit != "" || len(branches) > 0) {
+				logger.Fatal("--exclude-ref, --exclude-metadata and --match-metadata cannot be used with --branch or --commit")
+				return
+			}
+
+			// Timeouts can also be set from the environment
+			for flag, variable := range pushTimeoutVariables {
+				if err := durationFromEnv(cmd, flag, variable); err != nil {
+					logger.Fatal(err)
+					return
+				}
+			}
 
-			if err := push.StartClient(url, token, repoPath, branches, prune); err != nil {
+			options.BatchSize = batchSize * 1024 * 1024
+			options.DeltaThreshold = deltaSize * 1024 * 1024
+			options.SummaryMetadata = summary.values()
+			if signKey != "" {
+				key, err := bundle.ReadPrivateKey(signKey)
+				if err != nil {
+					logger.Fatalf("Unable to read the signing key: %v", err)
+					return
+				}
+				options.ManifestKey = key
+			}
+			if err := push.StartClient(url, token, repoPath, branches, options); err != nil {
 				logger.Fatal(err)
 				return
 			}
 		},
 	}
 
-	cmd.Flags().StringVarP(&url, "address", "a", "http://localhost:8080", "host name and port of the server")
+	cmd.Flags().StringVarP(&url, "address", "a", "http://localhost:8080", "host name and port of the server, also read from OSTREE_UPLOAD_ADDRESS")
 	cmd.Flags().StringVarP(&repoPath, "repo", "r", "repo", "path to OSTree repository")
-	cmd.Flags().StringVarP(&token, "token", "t", "", "token to authenticate with the server")
-	cmd.Flags().BoolVarP(&prune, "prune", "", false, "prune repository before the transfer happens")
+	cmd.Flags().StringVarP(&token, "token", "t", "", "token to authenticate with the server, also read from OSTREE_UPLOAD_TOKEN")
+	cmd.Flags().BoolVarP(&options.Prune, "prune", "", false, "prune repository before the transfer happens")
+	cmd.Flags().BoolVarP(&options.ServerTraverse, "server-traverse", "", false, "let the server find the objects to upload instead of sending the list")
+	cmd.Flags().BoolVarP(&options.UseInventory, "inventory", "", false, "download the server objects inventory to negotiate fewer objects")
+	cmd.Flags().IntVarP(&options.Workers, "workers", "", 0, "number of workers enumerating objects, 0 for as many as CPUs")
+	cmd.Flags().Int64VarP(&batchSize, "batch-size", "", 64, "approximate size in MiB of each upload request, 0 to upload everything at once")
+	cmd.Flags().Int64VarP(&deltaSize, "delta-threshold", "", 0, "send objects of at least this size in MiB as deltas against their previous version, 0 to disable")
+	cmd.Flags().DurationVarP(&options.Timeouts.Connect, "connect-timeout", "", client.DefaultTimeouts.Connect, "maximum time to connect to the server, 0 for no limit")
+	cmd.Flags().DurationVarP(&options.Timeouts.Request, "request-timeout", "", client.DefaultTimeouts.Request, "maximum time for each request that neither uploads nor publishes, 0 for no limit")
+	cmd.Flags().DurationVarP(&options.Timeouts.Upload, "upload-timeout", "", client.DefaultTimeouts.Upload, "maximum time for each request uploading objects, 0 for no limit")
+	cmd.Flags().DurationVarP(&options.Timeouts.Publish, "publish-timeout", "", client.DefaultTimeouts.Publish, "maximum time for the server to publish the branches, 0 for no limit")
+	cmd.Flags().DurationVarP(&options.Timeouts.ResponseHeader, "response-header-timeout", "", client.DefaultTimeouts.ResponseHeader, "maximum time to wait for the server to respond to a request, 0 for no limit")
+	cmd.Flags().DurationVarP(&options.Deadline, "deadline", "", 0, "maximum time for the whole push, 0 for no limit")
+	cmd.Flags().BoolVarP(&options.AssumeYes, "yes", "y", false, "push without asking for confirmation")
+	cmd.Flags().BoolVarP(&options.Resume, "resume", "", false, "resume a previous push of the same revisions that didn't complete")
 	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
 	cmd.Flags().StringSliceVarP(&branches, "branch", "b", []string{}, "branch to upload")
+	cmd.RegisterFlagCompletionFunc("branch", completeBranches)
+	cmd.Flags().StringSliceVarP(&options.Filter.ExcludeRefs, "exclude-ref", "", []string{}, "pattern of branches not to upload when --branch is not used, can be repeated")
+	cmd.Flags().StringToStringVarP(&options.Filter.ExcludeMetadata, "exclude-metadata", "", map[string]string{}, "skip branches whose commit metadata matches these key=pattern pairs when --branch is not used")
+	cmd.Flags().StringToStringVarP(&options.Filter.MatchMetadata, "match-metadata", "", map[string]string{}, "only upload branches whose commit metadata matches all these key=pattern pairs when --branch is not used")
+	cmd.Flags().StringToStringVarP(&options.Metadata, "metadata", "", map[string]string{}, "build information stored by the server, as key=value pairs")
+	summaryMetadataFlags(cmd, &summary)
+	cmd.Flags().StringToStringVarP(&options.SBOMs, "sbom", "", map[string]string{}, "SPDX or CycloneDX SBOM of the commit of a branch stored by the server, as branch=path pairs")
+	cmd.Flags().StringSliceVarP(&options.Confirm, "confirm", "", []string{}, "protected branch whose update is confirmed, can be repeated")
+	cmd.Flags().StringVarP(&options.Commit, "commit", "", "", "commit to upload instead of the branch heads, requires --to-ref")
+	cmd.Flags().StringVarP(&options.ToRef, "to-ref", "", "", "remote branch that will point to the commit passed with --commit")
+	cmd.Flags().StringVarP(&options.Manifest, "manifest", "", "", "write a JSON manifest of the push to this file")
+	cmd.Flags().StringVarP(&signKey, "sign-key", "", "", "PEM file with the Ed25519 private key the server checks the pushed objects with")
+	cmd.Flags().BoolVarP(&options.Encrypt, "encrypt", "", false, "encrypt the objects so that only the server can read them, once it publishes them")
+	cmd.Flags().StringVarP(&options.HTTP3, "http3", "", client.HTTP3Never, "when to send requests over HTTP/3: never, auto once the server advertises it, or always")
+	cmd.Flags().StringVarP(&options.PullMissing, "pull-missing", "", "", "remote of the local repository to pull objects missing from it from")
+	tlsFlags(cmd, &options.TLS)
+	requestFlags(cmd, &options.Request)
 
 	return cmd
 }
 
-// Execute executes the root command.
-func Execute() error {
-	// Root command
-	var rootCmd = &cobra.Command{
-		Use:   "ostree-upload",
-		Short: "Transfer local OSTree objects to a remote repository",
+// Commit command
+func commitCmd() *cobra.Command {
+	var (
+		repoPath   string
+		branch     string
+		trees      []string
+		options    ostree.CommitOptions
+		pushCommit bool
+		url        string
+		token      string
+		verbose    bool
+		batchSize  int64
+		pushOpts   push.Options
+		summary    summaryMetadataOptions
+		sbom       string
+		signKey    string
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "commit",
+		Short: "Commit trees to a branch of the local OSTree repository, optionally pushing it",
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			// The server can also be set from the environment
+			stringFromEnv(cmd, "address", "OSTREE_UPLOAD_ADDRESS")
+
+			if branch == "" || len(trees) == 0 {
+				logger.Fatal("--branch and --tree are mandatory")
+				return
+			}
+			if err := ostree.ValidateRef(branch); err != nil {
+				logger.Fatal(err)
+				return
+			}
+			for _, tree := range trees {
+				if _, _, err := ostree.ParseTree(tree); err != nil {
+					logger.Fatal(err)
+					return
+				}
+			}
+
+			// Check the token before committing, so that a bad
+			// invocation doesn't leave a commit behind
+			if pushCommit {
+				if len(token) == 0 {
+					token = os.Getenv("OSTREE_UPLOAD_TOKEN")
+				}
+				if len(token) == 0 {
+					logger.Fatal("Token is mandatory")
+					return
+				}
+				basicAuthFromEnv(&pushOpts.Request)
+			}
+
+			repo, err := ostree.Open(repoPath)
+			if err != nil {
+				logger.Fatalf("Unable to open repository %s: %v", repoPath, err)
+				return
+			}
+
+			logger.Actionf("Committing to branch \"%s\"...", branch)
+			rev, err := repo.Commit(branch, trees, options)
+			if err != nil {
+				logger.Fatalf("Failed to commit: %v", err)
+				return
+			}
+			logger.Infof("Branch \"%s\" points to %s", branch, rev)
+
+			if !pushCommit {
+				return
+			}
+
+			pushOpts.BatchSize = batchSize * 1024 * 1024
+			pushOpts.SummaryMetadata = summary.values()
+			if sbom != "" {
+				pushOpts.SBOMs = map[string]string{branch: sbom}
+			}
+			if signKey != "" {
+				key, err := bundle.ReadPrivateKey(signKey)
+				if err != nil {
+					logger.Fatalf("Unable to read the signing key: %v", err)
+					return
+				}
+				pushOpts.ManifestKey = key
+			}
+			if err := push.StartClient(url, token, repoPath, []string{branch}, pushOpts); err != nil {
+				logger.Fatal(err)
+				return
+			}
+		},
 	}
 
-	rootCmd.AddCommand(
-		genTokenCmd(),
-		receiveCmd(),
-		pushCmd(),
+	cmd.Flags().StringVarP(&repoPath, "repo", "r", "repo", "path to OSTree repository")
+	cmd.Flags().StringVarP(&branch, "branch", "b", "", "branch to commit to")
+	cmd.RegisterFlagCompletionFunc("branch", completeBranches)
+	cmd.Flags().StringArrayVarP(&trees, "tree", "", []string{}, "content of the commit, dir=<PATH> or ref=<REV>, later trees override earlier ones")
+	cmd.Flags().StringVarP(&options.Subject, "subject", "s", "", "subject of the commit")
+	cmd.Flags().StringVarP(&options.Body, "body", "", "", "body of the commit message")
+	cmd.Flags().BoolVarP(&options.CanonicalPermissions, "canonical-permissions", "", false, "record files as owned by root with canonical permissions")
+	cmd.Flags().BoolVarP(&pushCommit, "push", "", false, "push the branch once committed")
+	cmd.Flags().StringVarP(&url, "address", "a", "http://localhost:8080", "host name and port of the server to push to, also read from OSTREE_UPLOAD_ADDRESS")
+	cmd.Flags().StringVarP(&token, "token", "t", "", "token to authenticate with the server, also read from OSTREE_UPLOAD_TOKEN")
+	cmd.Flags().Int64VarP(&batchSize, "batch-size", "", 64, "approximate size in MiB of each upload request, 0 to upload everything at once")
+	cmd.Flags().DurationVarP(&pushOpts.Timeouts.Connect, "connect-timeout", "", client.DefaultTimeouts.Connect, "maximum time to connect to the server, 0 for no limit")
+	cmd.Flags().DurationVarP(&pushOpts.Timeouts.Request, "request-timeout", "", client.DefaultTimeouts.Request, "maximum time for each request that neither uploads nor publishes, 0 for no limit")
+	cmd.Flags().DurationVarP(&pushOpts.Timeouts.Upload, "upload-timeout", "", client.DefaultTimeouts.Upload, "maximum time for each request uploading objects, 0 for no limit")
+	cmd.Flags().DurationVarP(&pushOpts.Timeouts.Publish, "publish-timeout", "", client.DefaultTimeouts.Publish, "maximum time for the server to publish the branches, 0 for no limit")
+	cmd.Flags().BoolVarP(&pushOpts.AssumeYes, "yes", "y", false, "push without asking for confirmation")
+	cmd.Flags().StringToStringVarP(&pushOpts.Metadata, "metadata", "", map[string]string{}, "build information stored by the server, as key=value pairs")
+	summaryMetadataFlags(cmd, &summary)
+	cmd.Flags().StringVarP(&sbom, "sbom", "", "", "SPDX or CycloneDX SBOM of the commit stored by the server when pushed")
+	cmd.Flags().StringSliceVarP(&pushOpts.Confirm, "confirm", "", []string{}, "protected branch whose update is confirmed, can be repeated")
+	cmd.Flags().StringVarP(&pushOpts.Manifest, "manifest", "", "", "write a JSON manifest of the push to this file")
+	cmd.Flags().StringVarP(&signKey, "sign-key", "", "", "PEM file with the Ed25519 private key the server checks the pushed objects with")
+	cmd.Flags().BoolVarP(&pushOpts.Encrypt, "encrypt", "", false, "encrypt the objects so that only the server can read them, once it publishes them")
+	cmd.Flags().StringVarP(&pushOpts.HTTP3, "http3", "", client.HTTP3Never, "when to send requests over HTTP/3: never, auto once the server advertises it, or always")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+	tlsFlags(cmd, &pushOpts.TLS)
+	requestFlags(cmd, &pushOpts.Request)
+
+	return cmd
+}
+
+// Checkout command
+func checkoutCmd() *cobra.Command {
+	var (
+		repoPath string
+		subpath  string
+		options  ostree.CheckoutOptions
+		verbose  bool
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "checkout <REV> [<PATH>] <DEST>",
+		Short: "Check out a commit of the local OSTree repository, or a path of it",
+		Args:  cobra.RangeArgs(2, 3),
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			rev, dest := args[0], args[len(args)-1]
+			if len(args) == 3 {
+				if subpath != "" {
+					logger.Fatal("The path to check out can't be passed with --subpath too")
+					return
+				}
+				subpath = args[1]
+			}
+			if subpath == "" {
+				subpath = "/"
+			}
+
+			repo, err := ostree.Open(repoPath)
+			if err != nil {
+				logger.Fatalf("Unable to open repository %s: %v", repoPath, err)
+				return
+			}
+
+			if err := repo.Checkout(rev, subpath, dest, options); err != nil {
+				logger.Fatalf("Failed to check out %s of %s: %v", subpath, rev, err)
+				return
+			}
+			logger.Infof("Checked out %s of %s to %s", subpath, rev, dest)
+		},
+	}
+
+	cmd.Flags().StringVarP(&repoPath, "repo", "r", "repo", "path to OSTree repository")
+	cmd.Flags().StringVarP(&subpath, "subpath", "", "", "path of the commit to check out instead of everything")
+	cmd.Flags().StringVarP(&options.Mode, "mode", "", ostree.CheckoutModeUser, "user to own files by the current user, none to keep the ownership of the commit (needs root)")
+	cmd.Flags().BoolVarP(&options.Union, "union", "", false, "overwrite the files of an existing destination")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+
+	return cmd
+}
+
+// List command
+func lsCmd() *cobra.Command {
+	var (
+		repoPath  string
+		recursive bool
+		verbose   bool
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "ls <REV> [<PATH>]",
+		Short: "List the files of a commit of the local OSTree repository",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			rev, path := args[0], "/"
+			if len(args) == 2 {
+				path = args[1]
+			}
+
+			repo, err := ostree.Open(repoPath)
+			if err != nil {
+				logger.Fatalf("Unable to open repository %s: %v", repoPath, err)
+				return
+			}
+
+			// Files are listed on the standard output, like ls -l
+			out := cmd.OutOrStdout()
+			err = repo.Walk(rev, path, func(info ostree.FileInfo) error {
+				line := fmt.Sprintf("%s %5d %5d %10d %s", info.Mode, info.UID, info.GID, info.Size, info.Path)
+				if info.SymlinkTarget != "" {
+					line += " -> " + info.SymlinkTarget
+				}
+				fmt.Fprintln(out, line)
+
+				if info.Mode.IsDir() && !recursive {
+					return ostree.SkipDir
+				}
+				return nil
+			})
+			if err != nil {
+				logger.Fatalf("Failed to list %s of %s: %v", path, rev, err)
+				return
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&repoPath, "repo", "r", "repo", "path to OSTree repository")
+	cmd.Flags().BoolVarP(&recursive, "recursive", "R", false, "list the content of directories too")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+
+	return cmd
+}
+
+// Cat command
+func catCmd() *cobra.Command {
+	var (
+		repoPath string
+		verbose  bool
 	)
 
-	return rootCmd.Execute()
+	var cmd = &cobra.Command{
+		Use:   "cat <REV> <PATH>",
+		Short: "Write the content of a file of a commit to the standard output",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			rev, path := args[0], args[1]
+
+			repo, err := ostree.Open(repoPath)
+			if err != nil {
+				logger.Fatalf("Unable to open repository %s: %v", repoPath, err)
+				return
+			}
+
+			if err := repo.Cat(rev, path, cmd.OutOrStdout()); err != nil {
+				logger.Fatalf("Failed to read %s of %s: %v", path, rev, err)
+				return
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&repoPath, "repo", "r", "repo", "path to OSTree repository")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+
+	return cmd
+}
+
+// Refs command
+func refsCmd() *cobra.Command {
+	var (
+		repoPath       string
+		remote         string
+		token          string
+		jsonOutput     bool
+		verbose        bool
+		timeouts       client.Timeouts
+		tlsOptions     client.TLSOptions
+		requestOptions client.RequestOptions
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "refs",
+		Short: "List the branches of the local repository or of a server with their revision",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			var revs map[string]string
+			if remote != "" {
+				if len(token) == 0 {
+					token = os.Getenv("OSTREE_UPLOAD_TOKEN")
+				}
+				if len(token) == 0 {
+					logger.Fatal("Token is mandatory")
+					return
+				}
+				basicAuthFromEnv(&requestOptions)
+
+				var err error
+				revs, err = push.RemoteRevisions(remote, token, timeouts, tlsOptions, requestOptions)
+				if err != nil {
+					logger.Fatal(err)
+					return
+				}
+			} else {
+				repo, err := ostree.Open(repoPath)
+				if err != nil {
+					logger.Fatalf("Unable to open repository %s: %v", repoPath, err)
+					return
+				}
+				revs, err = repo.Refs()
+				if err != nil {
+					logger.Fatalf("Failed to list the branches: %v", err)
+					return
+				}
+			}
+
+			// Branches are printed on the standard output, like git ls-remote
+			out := cmd.OutOrStdout()
+			if jsonOutput {
+				encoder := json.NewEncoder(out)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(revs); err != nil {
+					logger.Fatal(err)
+				}
+				return
+			}
+			branches := make([]string, 0, len(revs))
+			for branch := range revs {
+				branches = append(branches, branch)
+			}
+			sort.Strings(branches)
+			for _, branch := range branches {
+				fmt.Fprintf(out, "%s\t%s\n", revs[branch], branch)
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&repoPath, "repo", "r", "repo", "path to OSTree repository")
+	cmd.Flags().StringVarP(&remote, "remote", "", "", "address of a server to list the branches of instead of the local repository")
+	cmd.Flags().StringVarP(&token, "token", "t", "", "token to authenticate with the server, also read from OSTREE_UPLOAD_TOKEN")
+	cmd.Flags().BoolVarP(&jsonOutput, "json", "", false, "print a JSON object of the revision of each branch")
+	cmd.Flags().DurationVarP(&timeouts.Connect, "connect-timeout", "", client.DefaultTimeouts.Connect, "maximum time to connect to the server, 0 for no limit")
+	cmd.Flags().DurationVarP(&timeouts.Request, "request-timeout", "", client.DefaultTimeouts.Request, "maximum time for each request, 0 for no limit")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+	tlsFlags(cmd, &tlsOptions)
+	requestFlags(cmd, &requestOptions)
+
+	return cmd
+}
+
+// History command
+func logCmd() *cobra.Command {
+	var (
+		repoPath       string
+		remote         string
+		token          string
+		limit          int
+		publishes      bool
+		verbose        bool
+		timeouts       client.Timeouts
+		tlsOptions     client.TLSOptions
+		requestOptions client.RequestOptions
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "log <BRANCH>",
+		Short: "Show the commits of a local or remote branch",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			branch := args[0]
+			if publishes && remote == "" {
+				logger.Fatal("Publishes are only recorded by the server, pass --remote")
+				return
+			}
+
+			var commits []ostree.CommitInfo
+			if remote != "" {
+				if len(token) == 0 {
+					token = os.Getenv("OSTREE_UPLOAD_TOKEN")
+				}
+				if len(token) == 0 {
+					logger.Fatal("Token is mandatory")
+					return
+				}
+				basicAuthFromEnv(&requestOptions)
+
+				if publishes {
+					entries, err := push.RemotePublishes(remote, token, branch, limit, timeouts, tlsOptions, requestOptions)
+					if err != nil {
+						logger.Fatal(err)
+						return
+					}
+
+					// One line per update, like the reflog of git
+					out := cmd.OutOrStdout()
+					for _, entry := range entries {
+						from := entry.From
+						if from == "" {
+							from = "(new)"
+						}
+						fmt.Fprintf(out, "%s\t%s\t%s -> %s", entry.Time, entry.Action, from, entry.To)
+						if entry.Token != "" {
+							fmt.Fprintf(out, "\tby %s", entry.Token)
+						}
+						fmt.Fprintln(out)
+					}
+					return
+				}
+
+				var err error
+				commits, err = push.RemoteHistory(remote, token, branch, limit, timeouts, tlsOptions, requestOptions)
+				if err != nil {
+					logger.Fatal(err)
+					return
+				}
+			} else {
+				repo, err := ostree.Open(repoPath)
+				if err != nil {
+					logger.Fatalf("Unable to open repository %s: %v", repoPath, err)
+					return
+				}
+				rev, err := repo.ResolveRev(branch)
+				if err != nil {
+					logger.Fatalf("Unable to find branch \"%s\": %v", branch, err)
+					return
+				}
+				commits, err = ostree.History(repo, rev, limit)
+				if err != nil {
+					logger.Fatalf("Failed to read the history of \"%s\": %v", branch, err)
+					return
+				}
+			}
+
+			// Commits are printed on the standard output, like ostree log
+			out := cmd.OutOrStdout()
+			for _, commit := range commits {
+				fmt.Fprintf(out, "commit %s\n", commit.Rev)
+				if commit.Parent != "" {
+					fmt.Fprintf(out, "Parent:  %s\n", commit.Parent)
+				}
+				fmt.Fprintf(out, "Date:    %s\n\n", commit.Timestamp.UTC().Format(time.RFC3339))
+				fmt.Fprintf(out, "    %s\n\n", commit.Subject)
+			}
+			if last := commits[len(commits)-1]; last.Parent != "" && (limit <= 0 || len(commits) < limit) {
+				fmt.Fprintf(out, "<< History beyond this commit not available >>\n")
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&repoPath, "repo", "r", "repo", "path to OSTree repository")
+	cmd.Flags().StringVarP(&remote, "remote", "", "", "address of a server to read the branch from instead of the local repository")
+	cmd.Flags().StringVarP(&token, "token", "t", "", "token to authenticate with the server, also read from OSTREE_UPLOAD_TOKEN")
+	cmd.Flags().IntVarP(&limit, "limit", "n", 0, "maximum number of commits to show, 0 for all of them")
+	cmd.Flags().BoolVarP(&publishes, "publishes", "", false, "show when the server updated the branch instead of its commits")
+	cmd.Flags().DurationVarP(&timeouts.Connect, "connect-timeout", "", client.DefaultTimeouts.Connect, "maximum time to connect to the server, 0 for no limit")
+	cmd.Flags().DurationVarP(&timeouts.Request, "request-timeout", "", client.DefaultTimeouts.Request, "maximum time for each request, 0 for no limit")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+	tlsFlags(cmd, &tlsOptions)
+	requestFlags(cmd, &requestOptions)
+
+	return cmd
+}
+
+// Diff command
+func diffCmd() *cobra.Command {
+	var (
+		repoPath       string
+		remote         string
+		token          string
+		verbose        bool
+		timeouts       client.Timeouts
+		tlsOptions     client.TLSOptions
+		requestOptions client.RequestOptions
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "diff <OLD-REV> <NEW-REV> | --remote=<ADDR> <BRANCH>",
+		Short: "Show the files changed between two commits, or by pushing a branch",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			if (remote == "" && len(args) != 2) || (remote != "" && len(args) != 1) {
+				logger.Fatal("Pass two commits, or a branch with --remote")
+				return
+			}
+
+			repo, err := ostree.Open(repoPath)
+			if err != nil {
+				logger.Fatalf("Unable to open repository %s: %v", repoPath, err)
+				return
+			}
+
+			var oldRev, newRev string
+			if remote != "" {
+				if len(token) == 0 {
+					token = os.Getenv("OSTREE_UPLOAD_TOKEN")
+				}
+				if len(token) == 0 {
+					logger.Fatal("Token is mandatory")
+					return
+				}
+				basicAuthFromEnv(&requestOptions)
+
+				// Compare what the server publishes with the local branch
+				branch := args[0]
+				if newRev, err = repo.ResolveRev(branch); err != nil {
+					logger.Fatalf("Unable to find branch \"%s\": %v", branch, err)
+					return
+				}
+				revs, err := push.RemoteRevisions(remote, token, timeouts, tlsOptions, requestOptions)
+				if err != nil {
+					logger.Fatal(err)
+					return
+				}
+				oldRev = revs[branch]
+				if oldRev != "" {
+					if _, err := repo.GetCommitInfo(oldRev); err != nil {
+						logger.Fatalf("The server publishes commit %s which is not in the local repository", oldRev)
+						return
+					}
+				}
+			} else {
+				for i, rev := range args {
+					resolved, err := repo.ResolveRev(rev)
+					if err != nil {
+						logger.Fatalf("Unable to find \"%s\": %v", rev, err)
+						return
+					}
+					args[i] = resolved
+				}
+				oldRev, newRev = args[0], args[1]
+			}
+
+			changes, err := ostree.DiffCommits(repo, oldRev, newRev)
+			if err != nil {
+				logger.Fatalf("Failed to compare the commits: %v", err)
+				return
+			}
+
+			// Changes are printed on the standard output, like ostree diff
+			out := cmd.OutOrStdout()
+			counts := map[string]int{}
+			var sizeDelta int64
+			for _, change := range changes {
+				switch change.Kind {
+				case ostree.FileAdded:
+					fmt.Fprintf(out, "A    %s (%d bytes)\n", change.Path, change.NewSize)
+				case ostree.FileRemoved:
+					fmt.Fprintf(out, "D    %s (%d bytes)\n", change.Path, change.OldSize)
+				case ostree.FileModified:
+					fmt.Fprintf(out, "M    %s (%d -> %d bytes)\n", change.Path, change.OldSize, change.NewSize)
+				}
+				counts[change.Kind]++
+				sizeDelta += change.NewSize - change.OldSize
+			}
+			logger.Infof("%d added, %d removed, %d modified, %+d bytes", counts[ostree.FileAdded], counts[ostree.FileRemoved], counts[ostree.FileModified], sizeDelta)
+		},
+	}
+
+	cmd.Flags().StringVarP(&repoPath, "repo", "r", "repo", "path to OSTree repository")
+	cmd.Flags().StringVarP(&remote, "remote", "", "", "address of a server, to compare the local branch with the commit it publishes")
+	cmd.Flags().StringVarP(&token, "token", "t", "", "token to authenticate with the server, also read from OSTREE_UPLOAD_TOKEN")
+	cmd.Flags().DurationVarP(&timeouts.Connect, "connect-timeout", "", client.DefaultTimeouts.Connect, "maximum time to connect to the server, 0 for no limit")
+	cmd.Flags().DurationVarP(&timeouts.Request, "request-timeout", "", client.DefaultTimeouts.Request, "maximum time for each request, 0 for no limit")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+	tlsFlags(cmd, &tlsOptions)
+	requestFlags(cmd, &requestOptions)
+
+	return cmd
+}
+
+// Prune command
+func pruneCmd() *cobra.Command {
+	var (
+		repoPath string
+		dryRun   bool
+		refsOnly bool
+		depth    int
+		verbose  bool
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Delete the objects of the local OSTree repository that are not needed anymore",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			if depth < -1 {
+				logger.Fatal("Depth must be -1 or more")
+				return
+			}
+
+			repo, err := ostree.Open(repoPath)
+			if err != nil {
+				logger.Fatalf("Unable to open repository %s: %v", repoPath, err)
+				return
+			}
+
+			logger.Infof("Pruning repository %s...", repoPath)
+			result, err := repo.Prune(ostree.PruneOptions{DryRun: dryRun, RefsOnly: refsOnly, Depth: depth})
+			if err != nil {
+				logger.Fatalf("Failed to prune repository: %v", err)
+				return
+			}
+
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "Total objects: %d\n", result.Total)
+			if result.Pruned == 0 {
+				fmt.Fprintf(out, "No unreachable objects\n")
+			} else if dryRun {
+				fmt.Fprintf(out, "Would delete: %d objects, freeing %s\n", result.Pruned, common.FormatSize(result.Size))
+			} else {
+				fmt.Fprintf(out, "Deleted %d objects, %s freed\n", result.Pruned, common.FormatSize(result.Size))
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&repoPath, "repo", "r", "repo", "path to OSTree repository")
+	cmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "only report what would be deleted")
+	cmd.Flags().BoolVarP(&refsOnly, "refs-only", "", false, "only keep the objects reachable from refs, not the other commits")
+	cmd.Flags().IntVarP(&depth, "depth", "", -1, "number of parents of the commits of refs to keep, -1 for all of them")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+
+	return cmd
+}
+
+// Promote command
+func promoteCmd() *cobra.Command {
+	var (
+		url            string
+		token          string
+		from           string
+		to             string
+		confirm        []string
+		verbose        bool
+		timeouts       client.Timeouts
+		tlsOptions     client.TLSOptions
+		requestOptions client.RequestOptions
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "promote",
+		Short: "Point a remote branch to the commit of another remote branch",
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			// The server can also be set from the environment
+			stringFromEnv(cmd, "address", "OSTREE_UPLOAD_ADDRESS")
+
+			// Check the token
+			if len(token) == 0 {
+				token = os.Getenv("OSTREE_UPLOAD_TOKEN")
+			}
+			if len(token) == 0 {
+				logger.Fatal("Token is mandatory")
+				return
+			}
+			basicAuthFromEnv(&requestOptions)
+
+			if from == "" || to == "" {
+				logger.Fatal("--from and --to are mandatory")
+				return
+			}
+
+			if err := push.StartPromote(url, token, from, to, confirm, timeouts, tlsOptions, requestOptions); err != nil {
+				logger.Fatal(err)
+				return
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&url, "address", "a", "http://localhost:8080", "host name and port of the server, also read from OSTREE_UPLOAD_ADDRESS")
+	cmd.Flags().StringVarP(&token, "token", "t", "", "token to authenticate with the server, also read from OSTREE_UPLOAD_TOKEN")
+	cmd.Flags().StringVarP(&from, "from", "", "", "branch whose commit is promoted")
+	cmd.Flags().StringVarP(&to, "to", "", "", "branch that will point to the commit")
+	cmd.Flags().StringSliceVarP(&confirm, "confirm", "", []string{}, "protected branch whose update is confirmed, can be repeated")
+	cmd.Flags().DurationVarP(&timeouts.Connect, "connect-timeout", "", client.DefaultTimeouts.Connect, "maximum time to connect to the server, 0 for no limit")
+	cmd.Flags().DurationVarP(&timeouts.Request, "request-timeout", "", client.DefaultTimeouts.Request, "maximum time for each request, 0 for no limit")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+	tlsFlags(cmd, &tlsOptions)
+	requestFlags(cmd, &requestOptions)
+
+	return cmd
+}
+
+// Rollback command
+func rollbackCmd() *cobra.Command {
+	var (
+		url            string
+		token          string
+		branch         string
+		confirm        []string
+		verbose        bool
+		timeouts       client.Timeouts
+		tlsOptions     client.TLSOptions
+		requestOptions client.RequestOptions
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "rollback",
+		Short: "Point a remote branch back to the revision before its last publish",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			// The server can also be set from the environment
+			stringFromEnv(cmd, "address", "OSTREE_UPLOAD_ADDRESS")
+
+			// Check the token
+			if len(token) == 0 {
+				token = os.Getenv("OSTREE_UPLOAD_TOKEN")
+			}
+			if len(token) == 0 {
+				logger.Fatal("Token is mandatory")
+				return
+			}
+			basicAuthFromEnv(&requestOptions)
+
+			if branch == "" {
+				logger.Fatal("--ref is mandatory")
+				return
+			}
+
+			if err := push.StartRollback(url, token, branch, confirm, timeouts, tlsOptions, requestOptions); err != nil {
+				logger.Fatal(err)
+				return
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&url, "address", "a", "http://localhost:8080", "host name and port of the server, also read from OSTREE_UPLOAD_ADDRESS")
+	cmd.Flags().StringVarP(&token, "token", "t", "", "token to authenticate with the server, also read from OSTREE_UPLOAD_TOKEN")
+	cmd.Flags().StringVarP(&branch, "ref", "", "", "branch to roll back")
+	cmd.Flags().StringSliceVarP(&confirm, "confirm", "", []string{}, "protected branch whose update is confirmed, can be repeated")
+	cmd.Flags().DurationVarP(&timeouts.Connect, "connect-timeout", "", client.DefaultTimeouts.Connect, "maximum time to connect to the server, 0 for no limit")
+	cmd.Flags().DurationVarP(&timeouts.Request, "request-timeout", "", client.DefaultTimeouts.Request, "maximum time for each request, 0 for no limit")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+	tlsFlags(cmd, &tlsOptions)
+	requestFlags(cmd, &requestOptions)
+
+	return cmd
+}
+
+// Integrity check command
+func checkIntegrityCmd() *cobra.Command {
+	var (
+		url            string
+		token          string
+		verbose        bool
+		timeouts       client.Timeouts
+		tlsOptions     client.TLSOptions
+		requestOptions client.RequestOptions
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "check-integrity",
+		Short: "Check the objects of the repository of the server for corruption",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			// The server can also be set from the environment
+			stringFromEnv(cmd, "address", "OSTREE_UPLOAD_ADDRESS")
+
+			// Check the token
+			if len(token) == 0 {
+				token = os.Getenv("OSTREE_UPLOAD_TOKEN")
+			}
+			if len(token) == 0 {
+				logger.Fatal("Token is mandatory")
+				return
+			}
+			basicAuthFromEnv(&requestOptions)
+
+			logger.Action("Checking the integrity of the repository (this might take a while)...")
+			result, err := push.RemoteCheckIntegrity(url, token, timeouts, tlsOptions, requestOptions)
+			if err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "Checked %d objects of %d commits\n", result.Objects, result.Commits)
+			for _, objectName := range result.Corrupted {
+				fmt.Fprintf(out, "Corrupted: %s\n", objectName)
+			}
+			if result.Error != "" {
+				logger.Fatalf("The check didn't complete: %s", result.Error)
+				return
+			}
+			if len(result.Corrupted) > 0 {
+				logger.Fatalf("Found %d corrupted objects", len(result.Corrupted))
+				return
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&url, "address", "a", "http://localhost:8080", "host name and port of the server, also read from OSTREE_UPLOAD_ADDRESS")
+	cmd.Flags().StringVarP(&token, "token", "t", "", "token to authenticate with the server, also read from OSTREE_UPLOAD_TOKEN")
+	cmd.Flags().DurationVarP(&timeouts.Connect, "connect-timeout", "", client.DefaultTimeouts.Connect, "maximum time to connect to the server, 0 for no limit")
+	cmd.Flags().DurationVarP(&timeouts.Request, "request-timeout", "", client.DefaultTimeouts.Request, "maximum time for each request, 0 for no limit")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+	tlsFlags(cmd, &tlsOptions)
+	requestFlags(cmd, &requestOptions)
+
+	return cmd
+}
+
+// printQueueStatus describes an update in progress on the server
+func printQueueStatus(out io.Writer, entry *common.QueueStatusResponse) {
+	age := "unknown age"
+	if created, err := time.Parse(time.RFC3339, entry.Created); err == nil {
+		age = fmt.Sprintf("started %v ago", time.Since(created).Round(time.Second))
+	}
+	fmt.Fprintf(out, "Update %s, %s\n", entry.QueueID, age)
+	printRefs(out, entry.Refs)
+	fmt.Fprintf(out, "    %s\n\n", formatProgress(entry))
+}
+
+// printRefs prints the branches updated by a push, one per line
+func printRefs(out io.Writer, refs map[string]common.RevisionPair) {
+	branches := make([]string, 0, len(refs))
+	for branch := range refs {
+		branches = append(branches, branch)
+	}
+	sort.Strings(branches)
+	for _, branch := range branches {
+		revs := refs[branch]
+		if revs.Server == "" {
+			fmt.Fprintf(out, "    new branch \"%s\" at %s\n", branch, revs.Client)
+		} else {
+			fmt.Fprintf(out, "    branch \"%s\" from %s to %s\n", branch, revs.Server, revs.Client)
+		}
+	}
+}
+
+// formatProgress describes the progress of an entry of the update queue
+func formatProgress(entry *common.QueueStatusResponse) string {
+	if entry.Finalizing {
+		return fmt.Sprintf("publishing, %.1f%% (%d of %d objects)", entry.Percent, entry.PublishedObjects, entry.Objects)
+	}
+	return fmt.Sprintf("uploading, %.1f%% (%d of %d objects missing, %s received)", entry.Percent, entry.Missing, entry.Objects, common.FormatSize(uint64(entry.ReceivedBytes)))
+}
+
+// printEvent prints an event of the event stream of the server
+func printEvent(out io.Writer, event *common.Event) {
+	prefix := ""
+	if eventTime, err := time.Parse(time.RFC3339, event.Time); err == nil {
+		prefix = eventTime.Local().Format("15:04:05") + " "
+	}
+
+	switch event.Type {
+	case common.EventQueueCreated:
+		fmt.Fprintf(out, "%sUpdate %s started\n", prefix, event.QueueID)
+		printRefs(out, event.Refs)
+	case common.EventQueueProgress:
+		if event.Progress != nil {
+			fmt.Fprintf(out, "%sUpdate %s %s\n", prefix, event.QueueID, formatProgress(event.Progress))
+		}
+	case common.EventQueueFinalizing:
+		fmt.Fprintf(out, "%sUpdate %s is being published\n", prefix, event.QueueID)
+	case common.EventPublished:
+		if event.QueueID != "" {
+			fmt.Fprintf(out, "%sUpdate %s published\n", prefix, event.QueueID)
+		} else {
+			fmt.Fprintf(out, "%sBranches updated by %s\n", prefix, event.Action)
+		}
+		printRefs(out, event.Refs)
+	case common.EventPublishFailed:
+		fmt.Fprintf(out, "%sUpdate %s failed to publish: %s\n", prefix, event.QueueID, event.Error)
+	case common.EventQueueRemoved:
+		fmt.Fprintf(out, "%sUpdate %s is over\n", prefix, event.QueueID)
+	}
+}
+
+// Status command
+func statusCmd() *cobra.Command {
+	var (
+		url            string
+		token          string
+		verbose        bool
+		follow         bool
+		timeouts       client.Timeouts
+		tlsOptions     client.TLSOptions
+		requestOptions client.RequestOptions
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "status [<QUEUE ID>]",
+		Short: "Show the updates in progress on the server, or the progress of one of them",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			// The server can also be set from the environment
+			stringFromEnv(cmd, "address", "OSTREE_UPLOAD_ADDRESS")
+
+			// Check the token
+			if len(token) == 0 {
+				token = os.Getenv("OSTREE_UPLOAD_TOKEN")
+			}
+			if len(token) == 0 {
+				logger.Fatal("Token is mandatory")
+				return
+			}
+			basicAuthFromEnv(&requestOptions)
+
+			out := cmd.OutOrStdout()
+			if len(args) > 0 {
+				queueID := args[0]
+				entry, err := push.RemoteProgress(url, token, queueID, timeouts, tlsOptions, requestOptions)
+				if err != nil {
+					logger.Fatal(err)
+					return
+				}
+				printQueueStatus(out, entry)
+				if !follow {
+					return
+				}
+
+				// Until the update is over
+				failed := false
+				err = push.RemoteEvents(url, token, queueID, timeouts, tlsOptions, requestOptions, func(event *common.Event) (bool, error) {
+					printEvent(out, event)
+					switch event.Type {
+					case common.EventPublishFailed:
+						failed = true
+					case common.EventPublished:
+						failed = false
+					}
+					return event.Type == common.EventQueueRemoved, nil
+				})
+				if err != nil {
+					logger.Fatal(err)
+					return
+				}
+				if failed {
+					logger.Fatalf("Update %s failed to publish", queueID)
+				}
+				return
+			}
+
+			entries, err := push.RemoteStatus(url, token, timeouts, tlsOptions, requestOptions)
+			if err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			if len(entries) == 0 {
+				fmt.Fprintf(out, "No update in progress\n")
+			}
+			for i := range entries {
+				printQueueStatus(out, &entries[i])
+			}
+			if !follow {
+				return
+			}
+
+			// Until interrupted
+			err = push.RemoteEvents(url, token, "", timeouts, tlsOptions, requestOptions, func(event *common.Event) (bool, error) {
+				printEvent(out, event)
+				return false, nil
+			})
+			if err != nil {
+				logger.Fatal(err)
+				return
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&url, "address", "a", "http://localhost:8080", "host name and port of the server, also read from OSTREE_UPLOAD_ADDRESS")
+	cmd.Flags().StringVarP(&token, "token", "t", "", "token to authenticate with the server, also read from OSTREE_UPLOAD_TOKEN")
+	cmd.Flags().DurationVarP(&timeouts.Connect, "connect-timeout", "", client.DefaultTimeouts.Connect, "maximum time to connect to the server, 0 for no limit")
+	cmd.Flags().DurationVarP(&timeouts.Request, "request-timeout", "", client.DefaultTimeouts.Request, "maximum time for each request, 0 for no limit")
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "keep printing the events of the updates, until the update is over when a queue ID is given")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+	tlsFlags(cmd, &tlsOptions)
+	requestFlags(cmd, &requestOptions)
+
+	return cmd
+}
+
+// Staging area garbage collection command
+func gcStagingCmd() *cobra.Command {
+	var (
+		repoPath string
+		maxAge   time.Duration
+		dryRun   bool
+		verbose  bool
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "gc-staging",
+		Short: "Remove abandoned uploads from the staging area of a repository",
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			repo, err := ostree.Open(repoPath)
+			if err != nil {
+				logger.Fatalf("Unable to open repository %s: %v", repoPath, err)
+				return
+			}
+
+			// The receiver might not be running, only the age tells
+			// whether an upload was abandoned
+			result, err := receiver.CollectStaging(repo, nil, maxAge, dryRun)
+			if err != nil {
+				logger.Fatalf("Failed to clean up the staging area: %v", err)
+				return
+			}
+
+			if dryRun {
+				logger.Infof("Would remove %d files, %d bytes", result.Files, result.Bytes)
+			} else {
+				logger.Infof("Removed %d files, %d bytes reclaimed", result.Files, result.Bytes)
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&repoPath, "repo", "r", "repo", "path to OSTree repository")
+	cmd.Flags().DurationVarP(&maxAge, "max-age", "", receiver.DefaultStagingMaxAge, "remove files that were not modified for this long")
+	cmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "only report what would be removed")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+
+	return cmd
+}
+
+// Export bundle command
+func exportBundleCmd() *cobra.Command {
+	var (
+		repoPath string
+		output   string
+		keyPath  string
+		branches []string
+		verbose  bool
+		options  push.ExportOptions
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "export-bundle",
+		Short: "Write the objects a receiver without network access needs to a signed bundle",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			if output == "" || keyPath == "" {
+				logger.Fatal("--output and --key are mandatory")
+				return
+			}
+			if options.Commit != "" && options.ToRef == "" {
+				logger.Fatal("--to-ref is mandatory with --commit")
+				return
+			}
+			if options.ToRef != "" && options.Commit == "" {
+				logger.Fatal("--to-ref can only be used with --commit")
+				return
+			}
+			if options.Commit != "" && len(branches) > 0 {
+				logger.Fatal("--commit and --branch cannot be used together")
+				return
+			}
+			filtered := cmd.Flags().Changed("exclude-ref") || cmd.Flags().Changed("exclude-metadata") || cmd.Flags().Changed("match-metadata")
+			if filtered && (options.Commit != "" || len(branches) > 0) {
+				logger.Fatal("--exclude-ref, --exclude-metadata and --match-metadata cannot be used with --branch or --commit")
+				return
+			}
+
+			key, err := bundle.ReadPrivateKey(keyPath)
+			if err != nil {
+				logger.Fatalf("Cannot read the signing key: %v", err)
+				return
+			}
+			options.Key = key
+
+			if _, err := push.ExportBundle(repoPath, output, branches, options); err != nil {
+				logger.Fatal(err)
+				return
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&repoPath, "repo", "r", "repo", "path to OSTree repository")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "file the bundle is written to")
+	cmd.Flags().StringVarP(&keyPath, "key", "k", "", "PEM file with the Ed25519 private key the bundle is signed with")
+	cmd.Flags().StringVarP(&options.State, "state", "", "", "state of the receiver written by import-bundle, so that the bundle only has what it lacks")
+	cmd.Flags().IntVarP(&options.Workers, "workers", "", 0, "number of workers enumerating objects, 0 for as many as CPUs")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+	cmd.Flags().StringSliceVarP(&branches, "branch", "b", []string{}, "branch to export")
+	cmd.RegisterFlagCompletionFunc("branch", completeBranches)
+	cmd.Flags().StringSliceVarP(&options.Filter.ExcludeRefs, "exclude-ref", "", []string{}, "pattern of branches not to export when --branch is not used, can be repeated")
+	cmd.Flags().StringToStringVarP(&options.Filter.ExcludeMetadata, "exclude-metadata", "", map[string]string{}, "skip branches whose commit metadata matches these key=pattern pairs when --branch is not used")
+	cmd.Flags().StringToStringVarP(&options.Filter.MatchMetadata, "match-metadata", "", map[string]string{}, "only export branches whose commit metadata matches all these key=pattern pairs when --branch is not used")
+	cmd.Flags().StringToStringVarP(&options.Metadata, "metadata", "", map[string]string{}, "build information stored by the receiver, as key=value pairs")
+	cmd.Flags().StringVarP(&options.Commit, "commit", "", "", "commit to export instead of the branch heads, requires --to-ref")
+	cmd.Flags().StringVarP(&options.ToRef, "to-ref", "", "", "branch of the receiver that will point to the commit passed with --commit")
+
+	return cmd
+}
+
+// Import bundle command
+func importBundleCmd() *cobra.Command {
+	var (
+		configPath string
+		repoPath   string
+		keyPath    string
+		statePath  string
+		verbose    bool
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "import-bundle [<BUNDLE>]",
+		Short: "Publish the branches of a bundle written by export-bundle to the repository of the receiver",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			// The configuration file can also be set from the environment
+			stringFromEnv(cmd, "config", "OSTREE_UPLOAD_CONFIG")
+
+			if len(args) == 0 && statePath == "" {
+				logger.Fatal("Pass a bundle to import, --state or both")
+				return
+			}
+			if len(args) > 0 && keyPath == "" {
+				logger.Fatal("--trusted-key is mandatory to import a bundle")
+				return
+			}
+
+			repo, err := receiver.OpenOrCreateRepo(repoPath)
+			if err != nil {
+				logger.Fatalf("Unable to use repository %s: %v", repoPath, err)
+				return
+			}
+
+			if len(args) > 0 {
+				config, err := receiver.OpenConfig(configPath)
+				if err != nil {
+					logger.Fatalf("Cannot open configuration file: %v", err)
+					return
+				}
+				if err := receiver.OpenStorage(repo, config); err != nil {
+					logger.Fatal(err)
+					return
+				}
+				key, err := bundle.ReadPublicKey(keyPath)
+				if err != nil {
+					logger.Fatalf("Cannot read the trusted key: %v", err)
+					return
+				}
+
+				logger.Actionf("Importing %s...", args[0])
+				updated, err := receiver.ImportBundle(repo, config, args[0], key)
+				if err != nil {
+					logger.Fatalf("Failed to import the bundle: %v", err)
+					return
+				}
+				if len(updated) == 0 {
+					logger.Info("Nothing to update!")
+				}
+				for branch, revPair := range updated {
+					logger.Infof("Updated branch \"%s\" to %s", branch, revPair.Client)
+				}
+			}
+
+			// Tell the next bundle what the repository has now
+			if statePath != "" {
+				if err := receiver.WriteBundleState(repo, statePath); err != nil {
+					logger.Fatalf("Failed to write the state: %v", err)
+					return
+				}
+				logger.Infof("Wrote the state of the repository to %s", statePath)
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&configPath, "config", "c", "ostree-upload.yaml", "path to configuration file, also read from OSTREE_UPLOAD_CONFIG")
+	cmd.Flags().StringVarP(&repoPath, "repo", "r", "repo", "path to OSTree repository")
+	cmd.Flags().StringVarP(&keyPath, "trusted-key", "k", "", "PEM file with the Ed25519 public key bundles must be signed with")
+	cmd.Flags().StringVarP(&statePath, "state", "", "", "write the state of the repository to this file, for export-bundle")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+
+	return cmd
+}
+
+// Benchmark command
+func benchCmd() *cobra.Command {
+	var (
+		url       string
+		token     string
+		verbose   bool
+		size      int64
+		batchSize int64
+		options   bench.Options
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "bench",
+		Short: "Measure how fast synthetic objects are pushed to a server",
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			// Check the token, a local server doesn't need one
+			if len(token) == 0 {
+				token = os.Getenv("OSTREE_UPLOAD_TOKEN")
+			}
+			if len(url) > 0 && len(token) == 0 {
+				logger.Fatal("Token is mandatory")
+				return
+			}
+			basicAuthFromEnv(&options.Push.Request)
+
+			if options.Objects <= 0 || size < 0 {
+				logger.Fatal("--objects must be positive and --size can't be negative")
+				return
+			}
+			if options.Branch == "" {
+				options.Branch = fmt.Sprintf("ostree-upload/bench/%d", time.Now().Unix())
+			}
+
+			options.Size = size * 1024
+			options.Push.BatchSize = batchSize * 1024 * 1024
+			if err := bench.Run(url, token, options); err != nil {
+				logger.Fatal(err)
+				return
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&url, "address", "a", "", "host name and port of the server, a local server is started when empty")
+	cmd.Flags().StringVarP(&token, "token", "t", "", "token to authenticate with the server, also read from OSTREE_UPLOAD_TOKEN")
+	cmd.Flags().IntVarP(&options.Objects, "objects", "", 1000, "number of objects to push")
+	cmd.Flags().Int64VarP(&size, "size", "", 64, "size in KiB of each object")
+	cmd.Flags().StringVarP(&options.Branch, "branch", "b", "", "branch to create on the server, by default ostree-upload/bench/<TIMESTAMP>")
+	cmd.Flags().Int64VarP(&batchSize, "batch-size", "", 64, "approximate size in MiB of each upload request, 0 to upload everything at once")
+	cmd.Flags().IntVarP(&options.Push.Workers, "workers", "", 0, "number of workers enumerating objects, 0 for as many as CPUs")
+	cmd.Flags().DurationVarP(&options.Push.Timeouts.Connect, "connect-timeout", "", client.DefaultTimeouts.Connect, "maximum time to connect to the server, 0 for no limit")
+	cmd.Flags().DurationVarP(&options.Push.Timeouts.Request, "request-timeout", "", client.DefaultTimeouts.Request, "maximum time for each request that neither uploads nor publishes, 0 for no limit")
+	cmd.Flags().DurationVarP(&options.Push.Timeouts.Upload, "upload-timeout", "", client.DefaultTimeouts.Upload, "maximum time for each request uploading objects, 0 for no limit")
+	cmd.Flags().DurationVarP(&options.Push.Timeouts.Publish, "publish-timeout", "", client.DefaultTimeouts.Publish, "maximum time for the server to publish the branches, 0 for no limit")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+	tlsFlags(cmd, &options.Push.TLS)
+	requestFlags(cmd, &options.Push.Request)
+
+	return cmd
+}
+
+// Self-test command
+func selftestCmd() *cobra.Command {
+	var (
+		keep    bool
+		verbose bool
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "selftest",
+		Short: "Push a synthetic commit to a local server to check that everything works",
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			if err := selftest.Run(keep); err != nil {
+				logger.Fatal(err)
+				return
+			}
+		},
+	}
+
+	cmd.Flags().BoolVarP(&keep, "keep", "", false, "keep the repositories to inspect them")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+
+	return cmd
+}
+
+// Doctor command
+func doctorCmd() *cobra.Command {
+	var (
+		options doctor.Options
+		verbose bool
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the environment and suggest how to fix the problems found",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			// Logging
+			if err := setupLogging(verbose); err != nil {
+				logger.Fatal(err)
+				return
+			}
+
+			// Check what the other commands would use
+			stringFromEnv(cmd, "config", "OSTREE_UPLOAD_CONFIG")
+			stringFromEnv(cmd, "address", "OSTREE_UPLOAD_ADDRESS")
+
+			if len(options.Token) == 0 {
+				options.Token = os.Getenv("OSTREE_UPLOAD_TOKEN")
+			}
+			basicAuthFromEnv(&options.Request)
+
+			if err := doctor.Run(cmd.OutOrStdout(), options); err != nil {
+				logger.Fatal(err)
+				return
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&options.Repo, "repo", "r", "", "path to an OSTree repository to check")
+	cmd.Flags().StringVarP(&options.Config, "config", "c", "", "path to a receiver configuration file to check, also read from OSTREE_UPLOAD_CONFIG")
+	cmd.Flags().StringVarP(&options.Address, "address", "a", "", "host name and port of a server to connect to, also read from OSTREE_UPLOAD_ADDRESS")
+	cmd.Flags().StringVarP(&options.Token, "token", "t", "", "token to authenticate with the server, also read from OSTREE_UPLOAD_TOKEN")
+	cmd.Flags().DurationVarP(&options.Timeouts.Connect, "connect-timeout", "", client.DefaultTimeouts.Connect, "maximum time to connect to the server, 0 for no limit")
+	cmd.Flags().DurationVarP(&options.Timeouts.Request, "request-timeout", "", client.DefaultTimeouts.Request, "maximum time for each request, 0 for no limit")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+	tlsFlags(cmd, &options.TLS)
+	requestFlags(cmd, &options.Request)
+
+	return cmd
+}
+
+// libostreeVersion returns the version of libostree the program was built with
+func libostreeVersion() string {
+	if v := ostree.Version(); v != "" {
+		return v
+	}
+	return "none"
+}
+
+// Version command
+func versionCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "version",
+		Short: "Show the version of the program and of the libraries it was built with",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "Version:    %s\n", version.Version)
+			fmt.Fprintf(out, "Commit:     %s\n", version.Commit)
+			fmt.Fprintf(out, "Build date: %s\n", version.BuildDate)
+			fmt.Fprintf(out, "libostree:  %s\n", libostreeVersion())
+			fmt.Fprintf(out, "Go:         %s\n", runtime.Version())
+		},
+	}
+
+	return cmd
+}
+
+// Completion command
+func completionCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:       "completion <bash|zsh|fish>",
+		Short:     "Generate the completion script of a shell",
+		ValidArgs: []string{"bash", "zsh", "fish"},
+		Args:      cobra.ExactValidArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var err error
+			out := cmd.OutOrStdout()
+			switch args[0] {
+			case "bash":
+				err = cmd.Root().GenBashCompletion(out)
+			case "zsh":
+				err = cmd.Root().GenZshCompletion(out)
+			case "fish":
+				err = cmd.Root().GenFishCompletion(out, true)
+			}
+			if err != nil {
+				logger.Fatalf("Failed to generate the completion script: %v", err)
+				return
+			}
+		},
+	}
+
+	return cmd
+}
+
+// Execute executes the root command.
+func Execute() error {
+	// Root command
+	var rootCmd = &cobra.Command{
+		Use:     "ostree-upload",
+		Short:   "Transfer local OSTree objects to a remote repository",
+		Version: fmt.Sprintf("%s (commit %s, libostree %s)", version.Version, version.Commit, libostreeVersion()),
+	}
+	rootCmd.SetVersionTemplate("{{.Name}} {{.Version}}\n")
+
+	rootCmd.PersistentFlags().StringVarP(&logOptions.Format, "log-format", "", "console", "format of log messages: console or json")
+	rootCmd.PersistentFlags().StringVarP(&logOptions.Output, "log-output", "", "stderr", "where log messages go: stderr, stdout, syslog or a file path")
+	rootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "", "info", "minimum level of log messages: debug, info, warning or error")
+	rootCmd.PersistentFlags().Int64VarP(&logMaxSize, "log-max-size", "", 0, "size in MiB after which the log file is rotated, 0 to never rotate")
+	rootCmd.PersistentFlags().IntVarP(&logOptions.MaxBackups, "log-max-backups", "", 3, "number of rotated log files to keep")
+
+	rootCmd.PersistentFlags().BoolVarP(&traceSpans, "trace", "", false, "log the timing of operations with trace identifiers propagated between client and server, see also the OTEL_* environment variables")
+
+	rootCmd.AddCommand(
+		genTokenCmd(),
+		receiveCmd(),
+		pushCmd(),
+		commitCmd(),
+		checkoutCmd(),
+		lsCmd(),
+		catCmd(),
+		refsCmd(),
+		logCmd(),
+		diffCmd(),
+		pruneCmd(),
+		promoteCmd(),
+		rollbackCmd(),
+		statusCmd(),
+		checkIntegrityCmd(),
+		selftestCmd(),
+		doctorCmd(),
+		benchCmd(),
+		gcStagingCmd(),
+		exportBundleCmd(),
+		importBundleCmd(),
+		versionCmd(),
+		completionCmd(),
+	)
+
+	err := rootCmd.Execute()
+
+	if shutdownTracing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Warnf("Failed to export the remaining spans: %v", err)
+		}
+	}
+
+	return err
 }
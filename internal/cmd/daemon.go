@@ -0,0 +1,62 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/internal/receiver"
+)
+
+// writePidFile writes the process identifier to path, unless the file
+// belongs to a process that is still running
+func writePidFile(path string) error {
+	if data, err := ioutil.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() {
+			// Signal 0 only checks that the process exists
+			if err := syscall.Kill(pid, 0); err == nil || err == syscall.EPERM {
+				return fmt.Errorf("process %d of %s is still running", pid, path)
+			}
+		}
+	}
+
+	return ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// handleSignals reopens the log file on SIGHUP, as init systems and
+// logrotate expect, and on SIGINT and SIGTERM regenerates the summaries
+// still pending and removes the pid file before exiting
+func handleSignals(appState *receiver.AppState, pidFile string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				if err := logger.Reopen(); err != nil {
+					logger.Errorf("Failed to reopen the log file: %v", err)
+				}
+				continue
+			}
+
+			logger.Infof("Received %v, exiting", sig)
+			if err := appState.FlushSummaries(); err != nil {
+				logger.Errorf("Failed to regenerate the summaries: %v", err)
+			}
+			if pidFile != "" {
+				os.Remove(pidFile)
+			}
+			os.Exit(0)
+		}
+	}()
+}
@@ -0,0 +1,69 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package common
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// BloomFilter is a compact probabilistic set: Test never returns false
+// for an added key, but may return true for a key that was never added
+type BloomFilter struct {
+	M    uint64 `json:"m"`
+	K    uint64 `json:"k"`
+	Bits []byte `json:"bits"`
+}
+
+// NewBloomFilter creates a bloom filter sized for n keys with the
+// specified false positive rate
+func NewBloomFilter(n int, fpRate float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+
+	return &BloomFilter{M: m, K: k, Bits: make([]byte, (m+7)/8)}
+}
+
+// hashes returns two independent hashes of key, combined with double
+// hashing to compute the K bit positions
+func (b *BloomFilter) hashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+	h.Write([]byte{0})
+	h2 := h.Sum64() | 1
+
+	return h1, h2
+}
+
+// Add adds key to the set
+func (b *BloomFilter) Add(key string) {
+	h1, h2 := b.hashes(key)
+	for i := uint64(0); i < b.K; i++ {
+		bit := (h1 + i*h2) % b.M
+		b.Bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Test returns whether key is probably in the set
+func (b *BloomFilter) Test(key string) bool {
+	if b.M == 0 || uint64(len(b.Bits)) < (b.M+7)/8 {
+		return false
+	}
+
+	h1, h2 := b.hashes(key)
+	for i := uint64(0); i < b.K; i++ {
+		bit := (h1 + i*h2) % b.M
+		if b.Bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,107 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/zeebo/blake3"
+)
+
+// Checksum algorithms that verify the transfer of objects
+const (
+	ChecksumBLAKE3 = "blake3"
+	ChecksumSHA512 = "sha512"
+	ChecksumSHA256 = "sha256"
+)
+
+// ChecksumAlgorithms lists the supported checksum algorithms, fastest first
+var ChecksumAlgorithms = []string{ChecksumBLAKE3, ChecksumSHA512, ChecksumSHA256}
+
+// NewChecksumHash returns a hash computing a checksum with the algorithm
+func NewChecksumHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumBLAKE3:
+		return blake3.New(), nil
+	case ChecksumSHA512:
+		return sha512.New(), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	}
+
+	return nil, fmt.Errorf("unsupported checksum algorithm \"%s\"", algorithm)
+}
+
+// NegotiateChecksum returns the fastest of the algorithms we support that
+// is also in the list, or an empty string when there's none
+func NegotiateChecksum(algorithms []string) string {
+	supported := map[string]bool{}
+	for _, algorithm := range algorithms {
+		supported[algorithm] = true
+	}
+
+	for _, algorithm := range ChecksumAlgorithms {
+		if supported[algorithm] {
+			return algorithm
+		}
+	}
+
+	return ""
+}
+
+// FormatChecksum returns the checksum as "<algorithm>:<hex digest>"
+func FormatChecksum(algorithm string, sum []byte) string {
+	return fmt.Sprintf("%s:%s", algorithm, hex.EncodeToString(sum))
+}
+
+// ChecksumFile returns the checksum of the file at path computed with the
+// algorithm, formatted by FormatChecksum
+func ChecksumFile(algorithm, path string) (string, error) {
+	h, err := NewChecksumHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	return FormatChecksum(algorithm, h.Sum(nil)), nil
+}
+
+// ParseChecksum splits a checksum formatted by FormatChecksum, ok is false
+// for checksums without a supported algorithm, such as the
+// "<object>:<SHA-256>" checksums sent by older clients
+func ParseChecksum(checksum string) (algorithm string, sum []byte, ok bool) {
+	index := strings.Index(checksum, ":")
+	if index < 0 {
+		return "", nil, false
+	}
+
+	algorithm = checksum[:index]
+	if _, err := NewChecksumHash(algorithm); err != nil {
+		return "", nil, false
+	}
+
+	sum, err := hex.DecodeString(checksum[index+1:])
+	if err != nil {
+		return "", nil, false
+	}
+
+	return algorithm, sum, true
+}
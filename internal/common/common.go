@@ -4,41 +4,160 @@
 
 package common
 
-// RevisionPair is a pair of revisions
-type RevisionPair struct {
-	Server string `json:"server"`
-	Client string `json:"client"`
-}
+import "path"
 
 // Object represents an object that needs to be uploaded to the receiver
 type Object struct {
 	Rev        string `json:"rev"`
 	ObjectName string `json:"object_name"`
 	ObjectPath string `json:"object_path"`
-	Checksum   string `json:"checksum"`
+	Size       int64  `json:"size"`
 }
 
 // Objects maps object names to objects
 type Objects map[string]Object
 
-// InfoResponse contains OSTree repository information
-type InfoResponse struct {
-	Mode string            `json:"mode"`
-	Revs map[string]string `json:"revs"`
-}
+// Capabilities advertised by the receiver with API v2
+const (
+	// CapabilityInventory means the receiver serves a bloom filter of its objects
+	CapabilityInventory = "inventory"
+	// CapabilityServerTraverse means the receiver can find the missing objects by itself
+	CapabilityServerTraverse = "server-traverse"
+	// CapabilityDeltas means the receiver accepts objects uploaded as deltas
+	CapabilityDeltas = "deltas"
+	// CapabilityPromote means the receiver can point a branch to the commit of another
+	CapabilityPromote = "promote"
+	// CapabilityResume means the receiver can find the queue entry updating a branch
+	CapabilityResume = "resume"
+	// CapabilityWhoami means the receiver describes the token used to authenticate
+	CapabilityWhoami = "whoami"
+	// CapabilityTus means the receiver accepts objects with the tus resumable upload protocol
+	CapabilityTus = "tus"
+	// CapabilityHistory means the receiver returns the commits of a branch
+	CapabilityHistory = "history"
+	// CapabilityStatus means the receiver lists the entries of its update queue
+	CapabilityStatus = "status"
+	// CapabilityPublishes means the receiver returns the publishes of a branch
+	CapabilityPublishes = "publishes"
+	// CapabilityRollback means the receiver can point a branch back to its previous publish
+	CapabilityRollback = "rollback"
+	// CapabilityIntegrity means the receiver can check the integrity of its repository
+	CapabilityIntegrity = "integrity"
+	// CapabilityProgress means the receiver returns the progress of a queue entry
+	CapabilityProgress = "progress"
+	// CapabilityObjectsSince means the receiver compares the objects of a branch with an older commit
+	CapabilityObjectsSince = "objects-since"
+	// CapabilityReplication means the receiver can be the primary of other receivers
+	CapabilityReplication = "replication"
+	// CapabilityEvents means the receiver streams the events of its update queue
+	CapabilityEvents = "events"
+	// CapabilitySummaryMetadata means the receiver accepts metadata for its summary
+	CapabilitySummaryMetadata = "summary-metadata"
+	// CapabilitySBOM means the receiver stores the SBOMs of the commits pushed
+	CapabilitySBOM = "sbom"
+	// CapabilitySignedManifests means the receiver checks manifests signed by builders
+	CapabilitySignedManifests = "signed-manifests"
+	// CapabilityEncryption means the receiver accepts objects encrypted to its recipients
+	CapabilityEncryption = "encryption"
+)
 
-// QueueRequest contains local and remote branch revision
-type QueueRequest struct {
-	Refs    map[string]RevisionPair `json:"refs"`
-	Objects []string                `json:"objects"`
-}
+// Scopes of a token, tokens without scopes can do everything
+const (
+	// ScopePush allows to push commits
+	ScopePush = "push"
+	// ScopePromote allows to promote branches
+	ScopePromote = "promote"
+	// ScopeAdmin allows to maintain the repository, such as regenerating the summary
+	ScopeAdmin = "admin"
+	// ScopePull allows to pull from the repository served by the receiver
+	ScopePull = "pull"
+)
 
-// UpdateResponse contains the update queue identifier
-type UpdateResponse struct {
-	QueueID string `json:"id"`
-}
+// RefAllowed returns whether ref matches one of the patterns, written as
+// for path.Match, or there are no patterns
+func RefAllowed(patterns []string, ref string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
 
-// ObjectsResponse lists all missing objects
-type ObjectsResponse struct {
-	Objects []string `json:"objects"`
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, ref); matched {
+			return true
+		}
+	}
+
+	return false
 }
+
+// TokenHeader carries the token when the Authorization header is used by a
+// reverse proxy in front of the receiver
+const TokenHeader = "X-Ostree-Upload-Token"
+
+// SignatureHeader carries the signature of the manifest of a queue entry
+const SignatureHeader = "X-Ostree-Upload-Signature"
+
+// ChecksumHeader names the algorithm of the checksums sent after each
+// uploaded object
+const ChecksumHeader = "X-Ostree-Upload-Checksum"
+
+// Codecs responses can be compressed with, named as in Accept-Encoding
+const (
+	CompressionGzip   = "gzip"
+	CompressionZstd   = "zstd"
+	CompressionBrotli = "br"
+)
+
+// Media types of the SBOMs stored by the receiver
+const (
+	MediaTypeSPDXJSON      = "application/spdx+json"
+	MediaTypeSPDXTagValue  = "text/spdx"
+	MediaTypeCycloneDXJSON = "application/vnd.cyclonedx+json"
+	MediaTypeCycloneDXXML  = "application/vnd.cyclonedx+xml"
+)
+
+// Types of the events streamed by the receiver
+const (
+	// EventQueueCreated is sent when a push starts
+	EventQueueCreated = "queue_created"
+	// EventQueueProgress is sent as objects are uploaded and published
+	EventQueueProgress = "queue_progress"
+	// EventQueueFinalizing is sent when the branches start being published
+	EventQueueFinalizing = "queue_finalizing"
+	// EventQueueRemoved is sent when a push is over, published or not
+	EventQueueRemoved = "queue_removed"
+	// EventPublished is sent when branches are updated
+	EventPublished = "published"
+	// EventPublishFailed is sent when the branches of a push cannot be published
+	EventPublishFailed = "publish_failed"
+)
+
+// Statuses of the objects of an upload
+const (
+	// UploadStatusAccepted is the status of an object that was stored
+	UploadStatusAccepted = "accepted"
+	// UploadStatusAlreadyPresent is the status of an object that the
+	// receiver already had, its content was skipped
+	UploadStatusAlreadyPresent = "already_present"
+	// UploadStatusChecksumMismatch is the status of an object whose content
+	// doesn't match its checksum, it must be uploaded again
+	UploadStatusChecksumMismatch = "checksum_mismatch"
+)
+
+// Error codes of API v2 error responses
+const (
+	ErrorCodeBadRequest         = "bad_request"
+	ErrorCodeUnauthorized       = "unauthorized"
+	ErrorCodeForbidden          = "forbidden"
+	ErrorCodeNotFound           = "not_found"
+	ErrorCodeBranchBusy         = "branch_busy"
+	ErrorCodeChecksumMismatch   = "checksum_mismatch"
+	ErrorCodeUnprocessable      = "unprocessable"
+	ErrorCodeInternal           = "internal_error"
+	ErrorCodeServerBusy         = "server_busy"
+	ErrorCodePolicyViolation    = "policy_violation"
+	ErrorCodeBranchProtected    = "branch_protected"
+	ErrorCodeIncompleteCommit   = "incomplete_commit"
+	ErrorCodePushTooLarge       = "push_too_large"
+	ErrorCodeManifestRejected   = "manifest_rejected"
+	ErrorCodeEncryptionRequired = "encryption_required"
+)
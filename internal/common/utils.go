@@ -1,29 +0,0 @@
-// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
-//
-// SPDX-License-Identifier: AGPL-3.0-or-later
-
-package common
-
-import (
-	"crypto/sha256"
-	"fmt"
-	"io"
-	"os"
-)
-
-// CalculateChecksum calculates the SHA-256 checksum of the file and
-// returns the hex value
-func CalculateChecksum(path string) (string, error) {
-	f, err := os.Open(path)
-	defer f.Close()
-	if err != nil {
-		return "", err
-	}
-
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", err
-	}
-
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
-}
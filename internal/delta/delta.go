@@ -0,0 +1,282 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package delta implements an rsync-style transfer of files: the receiver
+// computes block signatures of a file it already has, the sender compares
+// them to the new file with a rolling checksum and sends only the blocks
+// that changed, then the receiver reconstructs the new file.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// DefaultBlockSize is the block size used when none is specified
+const DefaultBlockSize = 64 * 1024
+
+// Maximum amount of new data sent in a single literal operation
+const maxLiteralSize = 1024 * 1024
+
+// Delta operations
+const (
+	opCopy    byte = 1
+	opLiteral byte = 2
+)
+
+// Block contains the checksums of a block of the basis file
+type Block struct {
+	Weak   uint32 `json:"weak"`
+	Strong []byte `json:"strong"`
+}
+
+// Signature contains the checksums of all blocks of the basis file
+type Signature struct {
+	BlockSize int     `json:"block_size"`
+	Blocks    []Block `json:"blocks"`
+}
+
+// weakChecksum is the rsync rolling checksum of a block
+type weakChecksum struct {
+	a, b uint32
+	size uint32
+}
+
+func newWeakChecksum(data []byte) *weakChecksum {
+	c := &weakChecksum{size: uint32(len(data))}
+	for i, x := range data {
+		c.a += uint32(x)
+		c.b += uint32(len(data)-i) * uint32(x)
+	}
+	return c
+}
+
+func (c *weakChecksum) roll(out, in byte) {
+	c.a += uint32(in) - uint32(out)
+	c.b += c.a - c.size*uint32(out)
+}
+
+func (c *weakChecksum) sum() uint32 {
+	return (c.a & 0xffff) | (c.b << 16)
+}
+
+func strongChecksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:16]
+}
+
+// ComputeSignature calculates the block signatures of the basis file
+func ComputeSignature(basis io.Reader, blockSize int) (*Signature, error) {
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("invalid block size %d", blockSize)
+	}
+
+	signature := &Signature{BlockSize: blockSize, Blocks: []Block{}}
+	block := make([]byte, blockSize)
+
+	for {
+		n, err := io.ReadFull(basis, block)
+		if n > 0 {
+			data := block[:n]
+			signature.Blocks = append(signature.Blocks, Block{Weak: newWeakChecksum(data).sum(), Strong: strongChecksum(data)})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return signature, nil
+}
+
+// deltaWriter encodes delta operations
+type deltaWriter struct {
+	w       *bufio.Writer
+	literal []byte
+}
+
+func (d *deltaWriter) flushLiteral() error {
+	for len(d.literal) > 0 {
+		size := len(d.literal)
+		if size > maxLiteralSize {
+			size = maxLiteralSize
+		}
+
+		header := make([]byte, 5)
+		header[0] = opLiteral
+		binary.BigEndian.PutUint32(header[1:], uint32(size))
+		if _, err := d.w.Write(header); err != nil {
+			return err
+		}
+		if _, err := d.w.Write(d.literal[:size]); err != nil {
+			return err
+		}
+		d.literal = d.literal[size:]
+	}
+
+	d.literal = d.literal[:0]
+	return nil
+}
+
+func (d *deltaWriter) copyBlock(index int) error {
+	if err := d.flushLiteral(); err != nil {
+		return err
+	}
+
+	op := make([]byte, 9)
+	op[0] = opCopy
+	binary.BigEndian.PutUint64(op[1:], uint64(index))
+	_, err := d.w.Write(op)
+	return err
+}
+
+// WriteDelta compares the new file with the signature of the basis file and
+// writes the operations to reconstruct it: copies of basis blocks and new data
+func WriteDelta(w io.Writer, signature *Signature, newFile io.Reader) error {
+	data, err := ioutil.ReadAll(newFile)
+	if err != nil {
+		return err
+	}
+
+	// Index the basis blocks by weak checksum
+	blocks := map[uint32][]int{}
+	for i, block := range signature.Blocks {
+		blocks[block.Weak] = append(blocks[block.Weak], i)
+	}
+
+	findBlock := func(weak uint32, window []byte) int {
+		candidates, ok := blocks[weak]
+		if !ok {
+			return -1
+		}
+		strong := strongChecksum(window)
+		for _, i := range candidates {
+			if bytes.Equal(signature.Blocks[i].Strong, strong) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	dw := &deltaWriter{w: bufio.NewWriter(w)}
+	blockSize := signature.BlockSize
+	start := 0
+
+	for start < len(data) {
+		end := start + blockSize
+		if end > len(data) {
+			// The tail can only match the last, shorter, basis block
+			window := data[start:]
+			if index := findBlock(newWeakChecksum(window).sum(), window); index >= 0 {
+				if err := dw.copyBlock(index); err != nil {
+					return err
+				}
+			} else {
+				dw.literal = append(dw.literal, window...)
+			}
+			break
+		}
+
+		checksum := newWeakChecksum(data[start:end])
+		matched := false
+		for {
+			if index := findBlock(checksum.sum(), data[start:end]); index >= 0 {
+				if err := dw.copyBlock(index); err != nil {
+					return err
+				}
+				start = end
+				matched = true
+				break
+			}
+
+			if end >= len(data) {
+				break
+			}
+
+			// Slide the window by one byte
+			dw.literal = append(dw.literal, data[start])
+			checksum.roll(data[start], data[end])
+			start++
+			end++
+
+			if len(dw.literal) >= maxLiteralSize {
+				if err := dw.flushLiteral(); err != nil {
+					return err
+				}
+			}
+		}
+
+		if !matched {
+			dw.literal = append(dw.literal, data[start:end]...)
+			start = end
+		}
+	}
+
+	if err := dw.flushLiteral(); err != nil {
+		return err
+	}
+
+	return dw.w.Flush()
+}
+
+// ApplyDelta reconstructs the new file into w, reading copied blocks from basis
+func ApplyDelta(w io.Writer, basis io.ReaderAt, blockSize int, delta io.Reader) error {
+	if blockSize <= 0 {
+		return fmt.Errorf("invalid block size %d", blockSize)
+	}
+
+	r := bufio.NewReader(delta)
+	block := make([]byte, blockSize)
+
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case opCopy:
+			var index uint64
+			if err := binary.Read(r, binary.BigEndian, &index); err != nil {
+				return err
+			}
+
+			n, err := basis.ReadAt(block, int64(index)*int64(blockSize))
+			if n == 0 && err != nil {
+				return fmt.Errorf("failed to read block %d of the basis: %v", index, err)
+			}
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if _, err := w.Write(block[:n]); err != nil {
+				return err
+			}
+		case opLiteral:
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return err
+			}
+			if size > maxLiteralSize {
+				return errors.New("literal data too large")
+			}
+
+			if _, err := io.CopyN(w, r, int64(size)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown delta operation %d", op)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package doctor checks the environment the client and the receiver run in,
+// since most failures of a first run come from it rather than from a bug
+package doctor
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/receiver"
+	"github.com/lirios/ostree-upload/pkg/client"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Clock skew above which commits may be refused or history looks wrong
+const maxClockSkew = 30 * time.Second
+
+// Tokens expiring sooner than this are reported
+const tokenExpiryWarning = 7 * 24 * time.Hour
+
+// Options selects what is checked, checks of empty paths and addresses are
+// skipped
+type Options struct {
+	// Path of the repository to check
+	Repo string
+	// Path of the receiver configuration file to check
+	Config string
+	// Address of the receiver to connect to
+	Address string
+	// Token to authenticate with the receiver
+	Token    string
+	Timeouts client.Timeouts
+	TLS      client.TLSOptions
+	Request  client.RequestOptions
+}
+
+// report prints the result of each check with the fix of the problems found
+type report struct {
+	out      io.Writer
+	failures int
+}
+
+func (r *report) ok(format string, a ...interface{}) {
+	fmt.Fprintf(r.out, "[ OK ] %s\n", fmt.Sprintf(format, a...))
+}
+
+func (r *report) warn(message, fix string) {
+	fmt.Fprintf(r.out, "[WARN] %s\n", message)
+	if fix != "" {
+		fmt.Fprintf(r.out, "       fix: %s\n", fix)
+	}
+}
+
+func (r *report) fail(message, fix string) {
+	r.failures++
+	fmt.Fprintf(r.out, "[FAIL] %s\n", message)
+	if fix != "" {
+		fmt.Fprintf(r.out, "       fix: %s\n", fix)
+	}
+}
+
+// Run checks the environment and prints the results to out, it returns an
+// error when a check failed
+func Run(out io.Writer, options Options) error {
+	r := &report{out: out}
+
+	checkLibostree(r)
+	checkTempDir(r, os.TempDir(), "set TMPDIR to a writable directory")
+	if options.Repo != "" {
+		checkRepo(r, options.Repo)
+	}
+	if options.Config != "" {
+		checkConfig(r, options.Config)
+	}
+	if options.Address != "" {
+		checkReceiver(r, options)
+	}
+
+	if r.failures > 0 {
+		return fmt.Errorf("Checks failed: %d", r.failures)
+	}
+	return nil
+}
+
+func checkLibostree(r *report) {
+	if v := ostree.Version(); v != "" {
+		r.ok("Built with libostree %s", v)
+	} else {
+		r.fail("Built without libostree, repositories can't be opened", "build with cgo enabled and the ostree development files installed")
+	}
+}
+
+// checkTempDir checks that temporary files can be created in path
+func checkTempDir(r *report, path, fix string) {
+	file, err := ioutil.TempFile(path, "ostree-upload-doctor-")
+	if err != nil {
+		r.fail(fmt.Sprintf("Temporary directory %s is not writable: %v", path, err), fix)
+		return
+	}
+	file.Close()
+	os.Remove(file.Name())
+	r.ok("Temporary directory %s is writable", path)
+}
+
+func checkRepo(r *report, path string) {
+	if ostree.Version() == "" {
+		return
+	}
+
+	repo, err := ostree.Open(path)
+	if err != nil {
+		r.fail(fmt.Sprintf("Unable to open repository %s: %v", path, err), "pass the path of an OSTree repository with --repo, or create one with \"ostree init --repo="+path+" --mode=archive\"")
+		return
+	}
+	mode, err := repo.GetMode()
+	if err != nil {
+		r.fail(fmt.Sprintf("Unable to read the mode of repository %s: %v", path, err), "check the core section of "+filepath.Join(path, "config"))
+		return
+	}
+	r.ok("Repository %s is valid, mode %s", path, mode)
+
+	checkTempDir(r, filepath.Join(path, "tmp"), "make the repository writable by the current user")
+}
+
+func checkConfig(r *report, path string) {
+	config, err := receiver.OpenConfig(path)
+	if err != nil {
+		r.fail(fmt.Sprintf("Unable to read configuration file %s: %v", path, err), "fix the YAML syntax, or create the file with \"ostree-upload gentoken --config="+path+"\"")
+		return
+	}
+	r.ok("Configuration file %s is valid", path)
+
+	if len(config.Tokens) == 0 {
+		r.fail("The configuration file has no tokens, clients can't authenticate", "generate one with \"ostree-upload gentoken --config="+path+"\"")
+		return
+	}
+
+	valid := 0
+	seen := map[string]bool{}
+	for _, token := range config.Tokens {
+		name := token.Name
+		if name == "" {
+			name = "created on " + token.Created
+		}
+		switch {
+		case token.Token == "":
+			r.fail(fmt.Sprintf("Token %s is empty", name), "remove it or generate a new one with gentoken")
+		case seen[token.Token]:
+			r.warn(fmt.Sprintf("Token %s is listed more than once", name), "remove the duplicates")
+		case token.Expired():
+			r.warn(fmt.Sprintf("Token %s expired or has an invalid expiry \"%s\"", name, token.Expires), "generate a new token with gentoken, expiries are RFC 3339 dates")
+		default:
+			valid++
+			if token.Expires != "" {
+				if expires, err := time.Parse(time.RFC3339, token.Expires); err == nil && time.Until(expires) < tokenExpiryWarning {
+					r.warn(fmt.Sprintf("Token %s expires on %s", name, token.Expires), "generate a new token with gentoken and hand it to its users")
+				}
+			}
+		}
+		seen[token.Token] = true
+	}
+	if valid > 0 {
+		r.ok("%d of %d tokens are valid", valid, len(config.Tokens))
+	} else {
+		r.fail("No token is valid, clients can't authenticate", "generate one with \"ostree-upload gentoken --config="+path+"\"")
+	}
+}
+
+func checkReceiver(r *report, options Options) {
+	// The server only replies to authenticated requests
+	if options.Token == "" {
+		r.fail("No token to authenticate with "+options.Address, "pass --token or set OSTREE_UPLOAD_TOKEN")
+		return
+	}
+
+	ctx := context.Background()
+	c, err := client.New(options.Address, options.Token, client.WithTimeouts(options.Timeouts), client.WithTLS(options.TLS), client.WithRequestOptions(options.Request))
+	if err != nil {
+		r.fail(fmt.Sprintf("Invalid client options: %v", err), "check --address, --header, --basic-auth and the TLS options")
+		return
+	}
+
+	info, err := c.GetInfo(ctx)
+	if err != nil {
+		r.fail(fmt.Sprintf("Unable to connect to %s: %v", options.Address, err), connectionFix(err))
+		return
+	}
+	r.ok("Connected and authenticated to %s, repository mode %s with %d branches", options.Address, info.Mode, len(info.Revs))
+
+	if skew, err := c.ClockSkew(ctx); err != nil {
+		r.warn(fmt.Sprintf("Unable to compare the clocks: %v", err), "")
+	} else if skew > maxClockSkew || skew < -maxClockSkew {
+		r.warn(fmt.Sprintf("The clock of the server is %v off from the local one", skew), "synchronize the clocks with NTP, commits from the future may be refused")
+	} else {
+		r.ok("Clocks are synchronized within %v", maxClockSkew)
+	}
+
+	if !c.HasCapability(common.CapabilityWhoami) {
+		r.warn("The server can't describe tokens, what the token allows was not checked", "upgrade the receiver")
+		return
+	}
+	whoami, err := c.Whoami(ctx)
+	if err != nil {
+		r.fail(fmt.Sprintf("Unable to retrieve the token information: %v", err), connectionFix(err))
+		return
+	}
+
+	canPush := len(whoami.Scopes) == 0
+	for _, scope := range whoami.Scopes {
+		if scope == common.ScopePush {
+			canPush = true
+		}
+	}
+	if canPush {
+		r.ok("The token allows to push")
+	} else {
+		r.warn("The token doesn't allow to push", "generate a token with the push scope")
+	}
+	if whoami.Expires != "" {
+		if expires, err := time.Parse(time.RFC3339, whoami.Expires); err == nil && time.Until(expires) < tokenExpiryWarning {
+			r.warn(fmt.Sprintf("The token expires on %s", whoami.Expires), "ask for a new token")
+		}
+	}
+	if whoami.QuotaLimit > 0 {
+		usage := fmt.Sprintf("%s of the %s quota", common.FormatSize(uint64(whoami.QuotaUsed)), common.FormatSize(uint64(whoami.QuotaLimit)))
+		if whoami.QuotaUsed >= whoami.QuotaLimit {
+			r.warn("The repository takes "+usage, "prune the repository or ask for a larger quota")
+		} else {
+			r.ok("The repository takes %s", usage)
+		}
+	}
+}
+
+// connectionFix suggests how to fix the error of a request
+func connectionFix(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var opError *net.OpError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "pass the certificate authority of the server with --cacert"
+	case errors.As(err, &hostname):
+		return "use the host name the certificate of the server was issued for"
+	case errors.Is(err, client.ErrUnauthorized):
+		return "check the token, or generate a new one with gentoken on the server"
+	case errors.As(err, &opError):
+		return "check the address and that \"ostree-upload receive\" is running and reachable"
+	}
+	return "check the address and the logs of the server"
+}
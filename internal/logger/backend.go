@@ -0,0 +1,199 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a message
+type Level int
+
+// Levels, from the least to the most severe
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelAction
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+// String returns the name of the level, announcements are information messages
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo, LevelAction:
+		return "info"
+	case LevelWarn:
+		return "warning"
+	case LevelError:
+		return "error"
+	case LevelFatal:
+		return "fatal"
+	}
+
+	return fmt.Sprintf("level%d", int(l))
+}
+
+// ParseLevel returns the level with the specified name
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level \"%s\"", name)
+}
+
+// Backend writes messages somewhere, other logging libraries can be
+// plugged in by implementing it and passing it to SetBackend
+type Backend interface {
+	// Log writes a message with its fields
+	Log(level Level, message string, fields Fields)
+	// Close flushes and releases the destination
+	Close() error
+}
+
+// Escape sequence for colors
+var (
+	colorOff    = []byte("\033[0m")
+	colorRed    = []byte("\033[0;31m")
+	colorGreen  = []byte("\033[0;32m")
+	colorOrange = []byte("\033[0;33m")
+	colorBlue   = []byte("\033[0;34m")
+	colorPurple = []byte("\033[0;35m")
+	colorCyan   = []byte("\033[0;36m")
+	colorGray   = []byte("\033[0;37m")
+)
+
+// sortedKeys returns the keys of the fields in alphabetical order
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ConsoleBackend writes human readable messages, optionally with colors
+type ConsoleBackend struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	colors bool
+}
+
+// NewConsoleBackend creates a backend writing human readable messages to w
+func NewConsoleBackend(w io.Writer, colors bool) *ConsoleBackend {
+	return &ConsoleBackend{w: w, colors: colors}
+}
+
+// Log writes a message with its fields
+func (b *ConsoleBackend) Log(level Level, message string, fields Fields) {
+	var builder strings.Builder
+
+	if level == LevelAction {
+		builder.WriteString("\u2bc8 ")
+	}
+
+	var color []byte
+	if b.colors {
+		switch level {
+		case LevelDebug:
+			color = colorGray
+		case LevelAction:
+			color = colorBlue
+		case LevelWarn:
+			color = colorOrange
+		case LevelError, LevelFatal:
+			color = colorRed
+		}
+	}
+
+	builder.Write(color)
+	builder.WriteString(message)
+	for _, key := range sortedKeys(fields) {
+		fmt.Fprintf(&builder, " %s=%v", key, fields[key])
+	}
+	if color != nil {
+		builder.Write(colorOff)
+	}
+	builder.WriteString("\n")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	io.WriteString(b.w, builder.String())
+}
+
+// Close closes the destination if it can be closed
+func (b *ConsoleBackend) Close() error {
+	return closeWriter(b.w)
+}
+
+// JSONBackend writes a JSON object per message
+type JSONBackend struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewJSONBackend creates a backend writing a JSON object per line to w
+func NewJSONBackend(w io.Writer) *JSONBackend {
+	return &JSONBackend{w: w}
+}
+
+// Log writes a message with its fields
+func (b *JSONBackend) Log(level Level, message string, fields Fields) {
+	object := make(map[string]interface{}, len(fields)+3)
+	for key, value := range fields {
+		// Errors don't marshal to anything useful
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		object[key] = value
+	}
+	object["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	object["level"] = level.String()
+	object["message"] = message
+
+	js, err := json.Marshal(object)
+	if err != nil {
+		js, _ = json.Marshal(map[string]string{"level": level.String(), "message": message})
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.w.Write(append(js, '\n'))
+}
+
+// Close closes the destination if it can be closed
+func (b *JSONBackend) Close() error {
+	return closeWriter(b.w)
+}
+
+// closeWriter closes w unless it's a standard stream
+func closeWriter(w io.Writer) error {
+	if w == os.Stdout || w == os.Stderr {
+		return nil
+	}
+	if closer, ok := w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
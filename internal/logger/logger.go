@@ -6,93 +6,208 @@ package logger
 
 import (
 	"fmt"
-	"log"
+	"os"
+	"strings"
 	"sync"
 )
 
-// Escape sequence for colors
-var (
-	colorOff    = []byte("\033[0m")
-	colorRed    = []byte("\033[0;31m")
-	colorGreen  = []byte("\033[0;32m")
-	colorOrange = []byte("\033[0;33m")
-	colorBlue   = []byte("\033[0;34m")
-	colorPurple = []byte("\033[0;35m")
-	colorCyan   = []byte("\033[0;36m")
-	colorGray   = []byte("\033[0;37m")
-)
-
 // Global variables
 var mutex sync.RWMutex
-var verbose = false
+var backend Backend = NewConsoleBackend(os.Stderr, isTerminal(os.Stderr))
+var level = LevelInfo
 
 // SetVerbose set the verbose flag which enables debug messages
 func SetVerbose(value bool) {
+	if value {
+		SetLevel(LevelDebug)
+	} else {
+		SetLevel(LevelInfo)
+	}
+}
+
+// SetLevel sets the minimum level of the messages that are logged
+func SetLevel(value Level) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	level = value
+}
+
+// SetBackend replaces the backend messages are sent to
+func SetBackend(value Backend) {
 	mutex.Lock()
 	defer mutex.Unlock()
-	verbose = value
+	backend = value
+}
+
+// Fields are key-value pairs attached to a message
+type Fields map[string]interface{}
+
+// Entry logs messages with a set of fields
+type Entry struct {
+	fields Fields
+}
+
+// WithFields returns an entry that attaches fields to all of its messages
+func WithFields(fields Fields) *Entry {
+	return &Entry{fields: fields}
+}
+
+// WithField returns an entry that attaches a field to all of its messages
+func WithField(key string, value interface{}) *Entry {
+	return &Entry{fields: Fields{key: value}}
+}
+
+// WithFields returns an entry with the fields of e and the new ones
+func (e *Entry) WithFields(fields Fields) *Entry {
+	merged := Fields{}
+	for key, value := range e.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &Entry{fields: merged}
+}
+
+func (e *Entry) log(messageLevel Level, message string) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if messageLevel < level {
+		return
+	}
+	backend.Log(messageLevel, message, e.fields)
+}
+
+// Debug print an information message
+func (e *Entry) Debug(v ...interface{}) {
+	e.log(LevelDebug, fmt.Sprint(v...))
+}
+
+// Debugf print a formatted information message
+func (e *Entry) Debugf(format string, v ...interface{}) {
+	e.log(LevelDebug, fmt.Sprintf(format, v...))
+}
+
+// Action print an announcement message
+func (e *Entry) Action(v ...interface{}) {
+	e.log(LevelAction, fmt.Sprint(v...))
 }
 
+// Actionf print a formatted announcement message
+func (e *Entry) Actionf(format string, v ...interface{}) {
+	e.log(LevelAction, fmt.Sprintf(format, v...))
+}
+
+// Info print an information message
+func (e *Entry) Info(v ...interface{}) {
+	e.log(LevelInfo, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// Infof print a formatted information message
+func (e *Entry) Infof(format string, v ...interface{}) {
+	e.log(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+// Warn print an warning message
+func (e *Entry) Warn(v ...interface{}) {
+	e.log(LevelWarn, fmt.Sprint(v...))
+}
+
+// Warnf print a formatted warning message
+func (e *Entry) Warnf(format string, v ...interface{}) {
+	e.log(LevelWarn, fmt.Sprintf(format, v...))
+}
+
+// Error print an error message
+func (e *Entry) Error(v ...interface{}) {
+	e.log(LevelError, fmt.Sprint(v...))
+}
+
+// Errorf print a formatted error message
+func (e *Entry) Errorf(format string, v ...interface{}) {
+	e.log(LevelError, fmt.Sprintf(format, v...))
+}
+
+// Fatal print an error message and exit
+func (e *Entry) Fatal(v ...interface{}) {
+	e.log(LevelFatal, fmt.Sprint(v...))
+	exit()
+}
+
+// Fatalf print a formatted error message and exit
+func (e *Entry) Fatalf(format string, v ...interface{}) {
+	e.log(LevelFatal, fmt.Sprintf(format, v...))
+	exit()
+}
+
+// exit closes the backend, so that buffered messages are not lost, and exits
+func exit() {
+	mutex.Lock()
+	backend.Close()
+	mutex.Unlock()
+	os.Exit(1)
+}
+
+// Messages without fields
+var std = &Entry{}
+
 // Debug print an information message
 func Debug(v ...interface{}) {
-	if verbose {
-		log.Printf("%s%s%s", colorGray, fmt.Sprint(v...), colorOff)
-	}
+	std.Debug(v...)
 }
 
 // Debugf print a formatted information message
 func Debugf(format string, v ...interface{}) {
-	if verbose {
-		log.Printf("%s%s%s", colorGray, fmt.Sprintf(format, v...), colorOff)
-	}
+	std.Debugf(format, v...)
 }
 
 // Action print an announcement message
 func Action(v ...interface{}) {
-	log.Printf("\u2bc8 %s%s%s", colorBlue, fmt.Sprint(v...), colorOff)
+	std.Action(v...)
 }
 
 // Actionf print a formatted announcement message
 func Actionf(format string, v ...interface{}) {
-	log.Printf("\u2bc8 %s%s%s", colorBlue, fmt.Sprintf(format, v...), colorOff)
+	std.Actionf(format, v...)
 }
 
 // Info print an information message
 func Info(v ...interface{}) {
-	log.Println(v...)
+	std.Info(v...)
 }
 
 // Infof print a formatted information message
 func Infof(format string, v ...interface{}) {
-	log.Printf(format, v...)
+	std.Infof(format, v...)
 }
 
 // Warn print an warning message
 func Warn(v ...interface{}) {
-	log.Printf("%s%s%s", colorOrange, fmt.Sprint(v...), colorOff)
+	std.Warn(v...)
 }
 
 // Warnf print a formatted warning message
 func Warnf(format string, v ...interface{}) {
-	log.Printf("%s%s%s", colorOrange, fmt.Sprintf(format, v...), colorOff)
+	std.Warnf(format, v...)
 }
 
 // Error print an error message
 func Error(v ...interface{}) {
-	log.Printf("%s%s%s", colorRed, fmt.Sprint(v...), colorOff)
+	std.Error(v...)
 }
 
 // Errorf print a formatted error message
 func Errorf(format string, v ...interface{}) {
-	log.Printf("%s%s%s", colorRed, fmt.Sprintf(format, v...), colorOff)
+	std.Errorf(format, v...)
 }
 
 // Fatal print an error message and exit
 func Fatal(v ...interface{}) {
-	log.Fatalf("%s%s%s", colorRed, fmt.Sprint(v...), colorOff)
+	std.Fatal(v...)
 }
 
 // Fatalf print a formatted error message and exit
 func Fatalf(format string, v ...interface{}) {
-	log.Fatalf("%s%s%s", colorRed, fmt.Sprintf(format, v...), colorOff)
+	std.Fatalf(format, v...)
 }
@@ -0,0 +1,235 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Options configures where and how messages are logged
+type Options struct {
+	// Format is either "console" or "json"
+	Format string
+	// Output is "stderr", "stdout", "syslog" or the path of a file
+	Output string
+	// Maximum size in bytes of the log file before it's rotated, 0 to never rotate
+	MaxSize int64
+	// Number of rotated log files to keep
+	MaxBackups int
+}
+
+// File messages are written to, if any
+var logFile *RotatingFile
+
+// Configure replaces the backend according to the options
+func Configure(options Options) error {
+	mutex.Lock()
+	logFile = nil
+	mutex.Unlock()
+
+	// Syslog (and journald) have their own format
+	if options.Output == "syslog" {
+		b, err := NewSyslogBackend("ostree-upload")
+		if err != nil {
+			return fmt.Errorf("failed to connect to syslog: %v", err)
+		}
+		SetBackend(b)
+		return nil
+	}
+
+	var w io.Writer
+	switch options.Output {
+	case "", "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		file, err := NewRotatingFile(options.Output, options.MaxSize, options.MaxBackups)
+		if err != nil {
+			return err
+		}
+		w = file
+
+		mutex.Lock()
+		logFile = file
+		mutex.Unlock()
+	}
+
+	switch options.Format {
+	case "", "console":
+		// Only terminals understand colors
+		SetBackend(NewConsoleBackend(w, isTerminal(w)))
+	case "json":
+		SetBackend(NewJSONBackend(w))
+	default:
+		return fmt.Errorf("unknown log format \"%s\"", options.Format)
+	}
+
+	return nil
+}
+
+// Reopen opens the log file again, so that messages go to a new file once
+// the current one was moved away by a tool such as logrotate
+func Reopen() error {
+	mutex.RLock()
+	file := logFile
+	mutex.RUnlock()
+
+	if file == nil {
+		return nil
+	}
+	return file.Reopen()
+}
+
+// isTerminal returns whether w is a terminal, services usually log to a
+// pipe or a file where colors are garbage
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// RotatingFile is a log file that is renamed to <path>.1 when it grows
+// too large, previous files are renamed to <path>.2 and so on
+type RotatingFile struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewRotatingFile opens the log file for appending
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	if f.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+		for i := f.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+// Write appends p to the file, rotating it first when it would become too large
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Reopen closes the file and opens its path again
+func (f *RotatingFile) Reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Close closes the file
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
+
+// SyslogBackend sends messages to the system logger, which is
+// also how they reach journald
+type SyslogBackend struct {
+	w *syslog.Writer
+}
+
+// NewSyslogBackend connects to the system logger
+func NewSyslogBackend(tag string) (*SyslogBackend, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogBackend{w: w}, nil
+}
+
+// Log writes a message with its fields
+func (b *SyslogBackend) Log(level Level, message string, fields Fields) {
+	var builder strings.Builder
+	builder.WriteString(message)
+	for _, key := range sortedKeys(fields) {
+		fmt.Fprintf(&builder, " %s=%v", key, fields[key])
+	}
+	line := builder.String()
+
+	switch level {
+	case LevelDebug:
+		b.w.Debug(line)
+	case LevelWarn:
+		b.w.Warning(line)
+	case LevelError:
+		b.w.Err(line)
+	case LevelFatal:
+		b.w.Crit(line)
+	default:
+		b.w.Info(line)
+	}
+}
+
+// Close closes the connection to the system logger
+func (b *SyslogBackend) Close() error {
+	return b.w.Close()
+}
@@ -0,0 +1,316 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Command gen generates the API types of internal/common, and the copy of
+// the specification built into the receiver, from openapi.yaml
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Header of the generated files
+const header = `// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Code generated by internal/openapi/gen from openapi.yaml. DO NOT EDIT.
+
+`
+
+// Width of the generated comments
+const commentWidth = 76
+
+// Field names that are not capitalized like the others
+var initialisms = map[string]string{
+	"id":  "ID",
+	"url": "URL",
+}
+
+func main() {
+	specPath := flag.String("spec", "openapi.yaml", "path of the specification")
+	typesPath := flag.String("types", "../common/api_gen.go", "path of the generated types")
+	typesPackage := flag.String("package", "common", "package of the generated types")
+	embedPath := flag.String("embed", "spec_gen.go", "path of the generated copy of the specification")
+	flag.Parse()
+
+	data, err := ioutil.ReadFile(*specPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Keep the order of the properties for the fields
+	var spec yaml.MapSlice
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		log.Fatalf("Invalid specification %s: %v", *specPath, err)
+	}
+
+	types, err := generateTypes(spec, *typesPackage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(*typesPath, types, 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	embedded, err := generateEmbed(spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(*embedPath, embedded, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// value returns the value of key in m, nil if there is none
+func value(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if fmt.Sprint(item.Key) == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+// mapping returns the mapping of key in m, nil if there is none
+func mapping(m yaml.MapSlice, key string) yaml.MapSlice {
+	v, _ := value(m, key).(yaml.MapSlice)
+	return v
+}
+
+// str returns the string of key in m, empty if there is none
+func str(m yaml.MapSlice, key string) string {
+	v, _ := value(m, key).(string)
+	return v
+}
+
+// generateTypes returns the source of a struct for each schema of the
+// specification that isn't written by hand
+func generateTypes(spec yaml.MapSlice, packageName string) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	fmt.Fprintf(&buf, "package %s\n", packageName)
+
+	schemas := mapping(mapping(spec, "components"), "schemas")
+	for _, item := range schemas {
+		name := fmt.Sprint(item.Key)
+		schema, ok := item.Value.(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("schema %s is not a mapping", name)
+		}
+		if str(schema, "x-go-type") != "" {
+			continue
+		}
+		if str(schema, "type") != "object" {
+			return nil, fmt.Errorf("schema %s is not an object", name)
+		}
+
+		buf.WriteString("\n")
+		writeComment(&buf, "", str(schema, "description"))
+		fmt.Fprintf(&buf, "type %s struct {\n", name)
+
+		required := map[string]bool{}
+		if list, ok := value(schema, "required").([]interface{}); ok {
+			for _, property := range list {
+				required[fmt.Sprint(property)] = true
+			}
+		}
+
+		for _, property := range mapping(schema, "properties") {
+			jsonName := fmt.Sprint(property.Key)
+			propertySchema, ok := property.Value.(yaml.MapSlice)
+			if !ok {
+				return nil, fmt.Errorf("property %s of schema %s is not a mapping", jsonName, name)
+			}
+
+			goType, err := typeOf(propertySchema, required[jsonName])
+			if err != nil {
+				return nil, fmt.Errorf("property %s of schema %s: %v", jsonName, name, err)
+			}
+			tag := jsonName
+			if omitEmpty, ok := value(propertySchema, "x-go-omitempty").(bool); !required[jsonName] && (!ok || omitEmpty) {
+				tag += ",omitempty"
+			}
+
+			writeComment(&buf, "\t", str(propertySchema, "description"))
+			fmt.Fprintf(&buf, "\t%s %s `json:%s`\n", fieldName(jsonName, propertySchema), goType, strconv.Quote(tag))
+		}
+
+		buf.WriteString("}\n")
+	}
+
+	return format.Source(buf.Bytes())
+}
+
+// typeOf returns the Go type of a schema, optional objects are pointers
+func typeOf(schema yaml.MapSlice, required bool) (string, error) {
+	if ref := str(schema, "$ref"); ref != "" {
+		if !strings.HasPrefix(ref, "#/components/schemas/") {
+			return "", fmt.Errorf("unsupported reference %s", ref)
+		}
+		if required {
+			return path.Base(ref), nil
+		}
+		return "*" + path.Base(ref), nil
+	}
+
+	switch str(schema, "type") {
+	case "string":
+		if str(schema, "format") == "byte" {
+			return "[]byte", nil
+		}
+		return "string", nil
+	case "integer":
+		switch format := str(schema, "format"); format {
+		case "int64", "uint64", "uint32":
+			return format, nil
+		case "":
+			return "int", nil
+		default:
+			return "", fmt.Errorf("unsupported integer format %s", format)
+		}
+	case "number":
+		return "float64", nil
+	case "boolean":
+		return "bool", nil
+	case "array":
+		items := mapping(schema, "items")
+		if items == nil {
+			return "", fmt.Errorf("array without items")
+		}
+		itemType, err := typeOf(items, true)
+		if err != nil {
+			return "", err
+		}
+		return "[]" + itemType, nil
+	case "object":
+		additional := mapping(schema, "additionalProperties")
+		if additional == nil {
+			return "map[string]interface{}", nil
+		}
+		valueType, err := typeOf(additional, true)
+		if err != nil {
+			return "", err
+		}
+		return "map[string]" + valueType, nil
+	default:
+		return "", fmt.Errorf("unsupported type \"%s\"", str(schema, "type"))
+	}
+}
+
+// fieldName returns the name of the field of a property, capitalized from
+// its JSON name unless x-go-name is given
+func fieldName(jsonName string, schema yaml.MapSlice) string {
+	if name := str(schema, "x-go-name"); name != "" {
+		return name
+	}
+
+	var name strings.Builder
+	for _, word := range strings.Split(jsonName, "_") {
+		if initialism, ok := initialisms[word]; ok {
+			name.WriteString(initialism)
+		} else if word != "" {
+			name.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return name.String()
+}
+
+// writeComment writes a description as a comment wrapped at commentWidth
+func writeComment(buf *bytes.Buffer, indent, description string) {
+	line := ""
+	for _, word := range strings.Fields(description) {
+		if line != "" && len(line)+1+len(word) > commentWidth {
+			fmt.Fprintf(buf, "%s// %s\n", indent, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		fmt.Fprintf(buf, "%s// %s\n", indent, line)
+	}
+}
+
+// generateEmbed returns the source of the specification converted to JSON,
+// as served by the receiver
+func generateEmbed(spec yaml.MapSlice) ([]byte, error) {
+	var compact bytes.Buffer
+	if err := writeJSON(&compact, spec); err != nil {
+		return nil, err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, compact.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+
+	literal := "`" + indented.String() + "`"
+	if strings.Contains(indented.String(), "`") {
+		literal = strconv.Quote(indented.String())
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	buf.WriteString("package openapi\n\n")
+	buf.WriteString("// specJSON is the specification in JSON\n")
+	fmt.Fprintf(&buf, "const specJSON = %s\n", literal)
+
+	return format.Source(buf.Bytes())
+}
+
+// writeJSON writes a value decoded from YAML as JSON, keeping the order of
+// the keys of mappings
+func writeJSON(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		buf.WriteString("{")
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			key, err := json.Marshal(fmt.Sprint(item.Key))
+			if err != nil {
+				return err
+			}
+			buf.Write(key)
+			buf.WriteString(":")
+			if err := writeJSON(buf, item.Value); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("}")
+	case []interface{}:
+		buf.WriteString("[")
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			if err := writeJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("]")
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+
+	return nil
+}
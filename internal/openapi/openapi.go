@@ -0,0 +1,435 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package openapi holds the OpenAPI specification of the API of the
+// receiver, and checks requests against it
+package openapi
+
+//go:generate go run ./gen -spec openapi.yaml -types ../common/api_gen.go -package common -embed spec_gen.go
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Spec returns the specification in JSON
+func Spec() []byte {
+	return []byte(specJSON)
+}
+
+// Document is the part of an OpenAPI document needed to check requests
+type Document struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas       map[string]*Schema      `json:"schemas"`
+		Parameters    map[string]*Parameter   `json:"parameters"`
+		RequestBodies map[string]*RequestBody `json:"requestBodies"`
+	} `json:"components"`
+}
+
+// Operation is an operation of the specification
+type Operation struct {
+	OperationID string       `json:"operationId"`
+	Parameters  []*Parameter `json:"parameters"`
+	RequestBody *RequestBody `json:"requestBody"`
+}
+
+// Parameter is a parameter of an operation
+type Parameter struct {
+	Ref      string  `json:"$ref"`
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+// RequestBody is the body of the request of an operation
+type RequestBody struct {
+	Ref      string `json:"$ref"`
+	Required bool   `json:"required"`
+	Content  map[string]struct {
+		Schema *Schema `json:"schema"`
+	} `json:"content"`
+}
+
+// Schema is the subset of JSON schemas used by the specification
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Nullable             bool               `json:"nullable"`
+	Enum                 []interface{}      `json:"enum"`
+	Minimum              *float64           `json:"minimum"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*Schema `json:"properties"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+
+	// Resolved by load
+	target     *Schema
+	additional *Schema
+	closed     bool
+}
+
+// Keys of path items that are operations
+var methods = map[string]bool{
+	"get":     true,
+	"put":     true,
+	"post":    true,
+	"delete":  true,
+	"options": true,
+	"head":    true,
+	"patch":   true,
+}
+
+// route is the path template of an operation
+type route struct {
+	method    string
+	segments  []string
+	operation *Operation
+}
+
+// The specification built into the receiver
+var routes = mustLoad(specJSON)
+
+// mustLoad returns the routes of the specification, which is built in so
+// that it must be valid
+func mustLoad(data string) []route {
+	routes, err := load([]byte(data))
+	if err != nil {
+		panic(fmt.Sprintf("invalid OpenAPI specification: %v", err))
+	}
+	return routes
+}
+
+// load parses the specification and resolves its references
+func load(data []byte) ([]route, error) {
+	var document Document
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	var resolveSchema func(schema *Schema) error
+	resolveSchema = func(schema *Schema) error {
+		if schema == nil {
+			return nil
+		}
+		if schema.Ref != "" {
+			target, ok := document.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+			if !ok {
+				return fmt.Errorf("unknown schema %s", schema.Ref)
+			}
+			schema.target = target
+			return nil
+		}
+		for _, property := range schema.Properties {
+			if err := resolveSchema(property); err != nil {
+				return err
+			}
+		}
+		switch string(schema.AdditionalProperties) {
+		case "", "true":
+		case "false":
+			schema.closed = true
+		default:
+			schema.additional = &Schema{}
+			if err := json.Unmarshal(schema.AdditionalProperties, schema.additional); err != nil {
+				return err
+			}
+			if err := resolveSchema(schema.additional); err != nil {
+				return err
+			}
+		}
+		return resolveSchema(schema.Items)
+	}
+	for _, schema := range document.Components.Schemas {
+		if err := resolveSchema(schema); err != nil {
+			return nil, err
+		}
+	}
+
+	resolveParameter := func(parameter *Parameter) (*Parameter, error) {
+		if parameter.Ref != "" {
+			target, ok := document.Components.Parameters[strings.TrimPrefix(parameter.Ref, "#/components/parameters/")]
+			if !ok {
+				return nil, fmt.Errorf("unknown parameter %s", parameter.Ref)
+			}
+			parameter = target
+		}
+		return parameter, resolveSchema(parameter.Schema)
+	}
+
+	var routes []route
+	for path, item := range document.Paths {
+		// Parameters of all the operations of the path
+		var common []*Parameter
+		if data, ok := item["parameters"]; ok {
+			if err := json.Unmarshal(data, &common); err != nil {
+				return nil, err
+			}
+		}
+
+		for method, data := range item {
+			if !methods[method] {
+				continue
+			}
+			operation := &Operation{}
+			if err := json.Unmarshal(data, operation); err != nil {
+				return nil, fmt.Errorf("%s %s: %v", method, path, err)
+			}
+
+			parameters := append(append([]*Parameter{}, common...), operation.Parameters...)
+			for i, parameter := range parameters {
+				var err error
+				if parameters[i], err = resolveParameter(parameter); err != nil {
+					return nil, fmt.Errorf("%s %s: %v", method, path, err)
+				}
+			}
+			operation.Parameters = parameters
+
+			if body := operation.RequestBody; body != nil {
+				if body.Ref != "" {
+					target, ok := document.Components.RequestBodies[strings.TrimPrefix(body.Ref, "#/components/requestBodies/")]
+					if !ok {
+						return nil, fmt.Errorf("%s %s: unknown request body %s", method, path, body.Ref)
+					}
+					operation.RequestBody = target
+				}
+				for _, content := range operation.RequestBody.Content {
+					if err := resolveSchema(content.Schema); err != nil {
+						return nil, fmt.Errorf("%s %s: %v", method, path, err)
+					}
+				}
+			}
+
+			routes = append(routes, route{method: strings.ToUpper(method), segments: strings.Split(path, "/"), operation: operation})
+		}
+	}
+
+	return routes, nil
+}
+
+// FindOperation returns the operation for method on path, relative to the
+// base path of the receiver, nil when the specification doesn't have it
+func FindOperation(method, path string) *Operation {
+	segments := strings.Split(path, "/")
+
+	for _, route := range routes {
+		if route.method != method || len(route.segments) != len(segments) {
+			continue
+		}
+		matches := true
+		for i, segment := range route.segments {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				matches = segments[i] != ""
+			} else {
+				matches = segments[i] == segment
+			}
+			if !matches {
+				break
+			}
+		}
+		if matches {
+			return route.operation
+		}
+	}
+
+	return nil
+}
+
+// JSONBody returns the schema of the JSON body of the operation, nil if
+// it doesn't take one
+func (o *Operation) JSONBody() *Schema {
+	if o.RequestBody == nil {
+		return nil
+	}
+	content, ok := o.RequestBody.Content["application/json"]
+	if !ok {
+		return nil
+	}
+	return content.Schema
+}
+
+// ValidateParameters checks the query and header parameters of a request
+func (o *Operation) ValidateParameters(query url.Values, header http.Header) error {
+	for _, parameter := range o.Parameters {
+		var values []string
+		switch parameter.In {
+		case "query":
+			values = query[parameter.Name]
+		case "header":
+			values = header.Values(parameter.Name)
+		default:
+			continue
+		}
+
+		if len(values) == 0 || values[0] == "" {
+			if parameter.Required {
+				return fmt.Errorf("missing %s parameter %s", parameter.In, parameter.Name)
+			}
+			continue
+		}
+		if err := validateParameter(parameter, values[0]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateParameter checks the value of a parameter against its schema
+func validateParameter(parameter *Parameter, value string) error {
+	schema := parameter.Schema
+	if schema == nil {
+		return nil
+	}
+
+	var v interface{} = value
+	switch schema.Type {
+	case "integer", "number":
+		v = json.Number(value)
+	case "boolean":
+		switch value {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		}
+	}
+
+	return validate(schema, v, fmt.Sprintf("%s parameter %s", parameter.In, parameter.Name))
+}
+
+// ValidateBody checks the JSON body of a request against the schema of the
+// operation
+func (o *Operation) ValidateBody(body []byte) error {
+	schema := o.JSONBody()
+	if schema == nil {
+		return nil
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if o.RequestBody.Required {
+			return errors.New("body must not be empty")
+		}
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return fmt.Errorf("body is not valid JSON: %v", err)
+	}
+
+	return validate(schema, v, "body")
+}
+
+// ValidationError tells which value of a request doesn't match its schema
+type ValidationError struct {
+	// Location of the value, such as "body.refs[\"stable\"].client"
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s %s", e.Path, e.Message)
+}
+
+// validate checks a value decoded from JSON, with numbers as json.Number,
+// against schema; path is the location of the value
+func validate(schema *Schema, v interface{}, path string) error {
+	for schema.target != nil {
+		schema = schema.target
+	}
+
+	if v == nil {
+		if schema.Nullable || schema.Type == "" {
+			return nil
+		}
+		return &ValidationError{Path: path, Message: "must not be null"}
+	}
+
+	switch schema.Type {
+	case "string":
+		if _, ok := v.(string); !ok {
+			return &ValidationError{Path: path, Message: "must be a string"}
+		}
+	case "integer", "number":
+		message := "must be a number"
+		if schema.Type == "integer" {
+			message = "must be an integer"
+		}
+		number, ok := v.(json.Number)
+		if !ok {
+			return &ValidationError{Path: path, Message: message}
+		}
+		f, err := number.Float64()
+		if err != nil {
+			return &ValidationError{Path: path, Message: message}
+		}
+		if schema.Type == "integer" {
+			if _, err := number.Int64(); err != nil && !strings.HasPrefix(schema.Format, "uint") {
+				return &ValidationError{Path: path, Message: message}
+			}
+		}
+		if schema.Minimum != nil && f < *schema.Minimum {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("must be at least %v", *schema.Minimum)}
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return &ValidationError{Path: path, Message: "must be a boolean"}
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return &ValidationError{Path: path, Message: "must be an array"}
+		}
+		if schema.Items != nil {
+			for i, item := range items {
+				if err := validate(schema.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case "object":
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return &ValidationError{Path: path, Message: "must be an object"}
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				return &ValidationError{Path: path, Message: fmt.Sprintf("must have the %s property", name)}
+			}
+		}
+		for name, value := range object {
+			if property, ok := schema.Properties[name]; ok {
+				if err := validate(property, value, path+"."+name); err != nil {
+					return err
+				}
+			} else if schema.additional != nil {
+				if err := validate(schema.additional, value, fmt.Sprintf("%s[%q]", path, name)); err != nil {
+					return err
+				}
+			} else if schema.closed {
+				return &ValidationError{Path: path, Message: fmt.Sprintf("has unknown property %s", name)}
+			}
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		for _, allowed := range schema.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(v) {
+				return nil
+			}
+		}
+		return &ValidationError{Path: path, Message: "is not one of the allowed values"}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package push
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/lirios/ostree-upload/internal/bundle"
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/client"
+)
+
+// ExportOptions are the options of ExportBundle
+type ExportOptions struct {
+	Workers int
+	// Branches pushed when none is given
+	Filter client.BranchFilter
+	// Commit exported instead of the head of the branch, for ToRef
+	Commit string
+	ToRef  string
+	// Path of the state of the receiver, written by import-bundle; the
+	// bundle has the whole history of the branches without it
+	State string
+	// Key the bundle is signed with
+	Key ed25519.PrivateKey
+	// Build information of the commits
+	Metadata map[string]string
+}
+
+// ReadState reads the state of a receiver, the branches and the mode of
+// its repository as returned by the info endpoint
+func ReadState(path string) (*common.InfoResponse, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var state common.InfoResponse
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid state %s: %v", path, err)
+	}
+
+	return &state, nil
+}
+
+// ExportBundle writes to output the objects of the local repository at path
+// the receiver doesn't have to update its branches, negotiated against the
+// state of the receiver instead of its API; nothing is written when the
+// receiver is up to date, in which case false is returned
+func ExportBundle(path, output string, refs []string, options ExportOptions) (bool, error) {
+	// Pusher
+	var pusher *client.Pusher
+	var err error
+	if options.Commit != "" {
+		pusher, err = client.NewCommitPusher(path, options.Commit, options.ToRef, options.Workers)
+	} else {
+		pusher, err = client.NewPusher(path, refs, options.Filter, options.Workers)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	state := &common.InfoResponse{}
+	if options.State != "" {
+		if state, err = ReadState(options.State); err != nil {
+			return false, err
+		}
+	} else {
+		logger.Warnf("No state of the receiver was given, exporting the whole history of the branches")
+	}
+
+	// Name and convert objects for the receiver repository
+	if state.Mode != "" {
+		if err := pusher.SetRemoteMode(state.Mode); err != nil {
+			return false, err
+		}
+	}
+	defer pusher.Cleanup()
+
+	logger.Action("Looking for branches to update...")
+	updateRefs, err := pusher.CheckUpdate(state.Revs)
+	if err != nil {
+		return false, fmt.Errorf("Failed to determine the branches to update: %w", err)
+	}
+	if len(updateRefs) == 0 {
+		logger.Info("Nothing to update!")
+		return false, nil
+	}
+	for branch, revPair := range updateRefs {
+		if revPair.Server == "" {
+			logger.Infof("\tNew branch \"%s\"\n\t\t  to: %s", branch, revPair.Client)
+		} else {
+			logger.Infof("\tBranch \"%s\"\n\t\tfrom: %s\n\t\t  to: %s", branch, revPair.Server, revPair.Client)
+		}
+	}
+
+	// The objects of the commits the receiver has are all there, skip
+	// them when the local repository has those commits too
+	for branch, revPair := range updateRefs {
+		if revPair.Server == "" {
+			continue
+		}
+		if rev, objectNames := pusher.FindLocalAncestor(revPair.Server); rev == revPair.Server {
+			pusher.AddServerObjects(objectNames)
+		} else {
+			logger.Debugf("Commit %s of branch \"%s\" on the receiver is not complete locally", revPair.Server, branch)
+		}
+	}
+
+	objects, err := pusher.FindObjectsToPush(updateRefs)
+	if err != nil {
+		return false, err
+	}
+	if err := pusher.PrepareObjects(objects); err != nil {
+		return false, err
+	}
+
+	// Readers only see complete bundles
+	file, err := ioutil.TempFile(filepath.Dir(output), filepath.Base(output)+".*.part")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	logger.Actionf("Writing %d objects to %s...", len(objects), output)
+	names := make([]string, 0, len(objects))
+	for objectName := range objects {
+		names = append(names, objectName)
+	}
+	sort.Strings(names)
+
+	var size int64
+	writer := bundle.NewWriter(file, options.Key)
+	for _, objectName := range names {
+		object := objects[objectName]
+		if err := writer.AddObject(objectName, object.ObjectPath); err != nil {
+			return false, fmt.Errorf("Failed to add object %s: %w", objectName, err)
+		}
+		size += object.Size
+	}
+	manifest := bundle.Manifest{Mode: pusher.RemoteMode(), Refs: updateRefs, Metadata: options.Metadata}
+	if err := writer.Close(manifest); err != nil {
+		return false, err
+	}
+	if err := file.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Rename(file.Name(), output); err != nil {
+		return false, err
+	}
+
+	logger.Infof("Exported %d branches with %d objects, %s", len(updateRefs), len(objects), common.FormatSize(uint64(size)))
+
+	return true, nil
+}
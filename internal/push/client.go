@@ -5,43 +5,223 @@
 package push
 
 import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/delta"
 	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/internal/tracing"
+	"github.com/lirios/ostree-upload/pkg/client"
 )
 
+// Maximum number of object names sent to the server in a single request
+const objectsBatchSize = 10000
+
+// Minimum size of objects uploaded on their own with the tus protocol
+const resumableUploadThreshold = 16 * 1024 * 1024
+
+// Warn when the token expires sooner than this
+const tokenExpiryWarning = 7 * 24 * time.Hour
+
+// Options controls how objects are pushed
+type Options struct {
+	// Prune the local repository before the transfer
+	Prune bool
+	// Let the server traverse the commits instead of sending the list of objects
+	ServerTraverse bool
+	// Approximate size in bytes of each upload request, 0 for a single request
+	BatchSize int64
+	// Skip negotiation of objects that the server inventory probably has
+	UseInventory bool
+	// Number of workers enumerating objects, 0 for as many as CPUs
+	Workers int
+	// Minimum size in bytes of objects uploaded as deltas, 0 to disable deltas
+	DeltaThreshold int64
+	// Reattach to the queue entry of a previous push of the same revisions
+	Resume bool
+	// Timeouts of the requests to the server
+	Timeouts client.Timeouts
+	// Certificates of the server to trust
+	TLS client.TLSOptions
+	// Credentials and headers added to every request
+	Request client.RequestOptions
+	// When requests are sent over HTTP/3, client.HTTP3Never by default
+	HTTP3 string
+	// Maximum duration of the whole push, 0 for no limit
+	Deadline time.Duration
+	// Push without asking for confirmation
+	AssumeYes bool
+	// Commit to push instead of the heads of the local branches, the
+	// remote branch ToRef is updated to point to it
+	Commit string
+	ToRef  string
+	// Build information stored by the server with the push
+	Metadata map[string]string
+	// Metadata merged into the summary of the server, nil values remove keys
+	SummaryMetadata map[string]interface{}
+	// Paths of the SBOMs of the commits pushed, by branch
+	SBOMs map[string]string
+	// Key the manifest of the push is signed with, if any
+	ManifestKey ed25519.PrivateKey
+	// Encrypt the objects to the server, which only decrypts them when publishing
+	Encrypt bool
+	// Protected branches whose update is confirmed
+	Confirm []string
+	// Path of a file where a manifest of the push is written, if any
+	Manifest string
+	// Local branches pushed when none is given
+	Filter client.BranchFilter
+	// Remote of the local repository the objects missing from it are
+	// pulled from before pushing, if any
+	PullMissing string
+}
+
 // StartClient starts the client
-func StartClient(url, token, path string, refs []string, prune bool) error {
+func StartClient(url, token, path string, refs []string, options Options) (err error) {
 	// Pusher
-	pusher, err := NewPusher(path, refs)
+	var pusher *client.Pusher
+	if options.Commit != "" {
+		pusher, err = client.NewCommitPusher(path, options.Commit, options.ToRef, options.Workers)
+	} else {
+		pusher, err = client.NewPusher(path, refs, options.Filter, options.Workers)
+	}
 	if err != nil {
 		return err
 	}
 
+	// Abort the push when it takes too long
+	ctx := context.Background()
+	if options.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Deadline)
+		defer cancel()
+	}
+
+	ctx, span := tracing.StartSpan(ctx, "push")
+	defer func() { span.End(err) }()
+
+	// Describe the push once it completed
+	manifest := newManifest(url)
+	if options.Manifest != "" {
+		defer func() {
+			if err != nil {
+				return
+			}
+			if err = manifest.write(options.Manifest); err != nil {
+				err = fmt.Errorf("Failed to write the manifest: %w", err)
+			}
+		}()
+	}
+
 	// Client
-	client, err := NewClient(url, token)
+	c, err := client.New(url, token, client.WithTimeouts(options.Timeouts), client.WithTLS(options.TLS), client.WithRequestOptions(options.Request), client.WithHTTP3(options.HTTP3))
 	if err != nil {
 		return err
 	}
 
 	// Repository information
 	logger.Action("Receiving repository information...")
-	info, err := client.GetInfo()
+	info, err := c.GetInfo(ctx)
 	if err != nil {
-		return fmt.Errorf("Failed to retrieve repository information: %v", err)
+		return fmt.Errorf("Failed to retrieve repository information: %w", err)
+	}
+	if info.Version != "" {
+		logger.Debugf("Server version %s", info.Version)
+	}
+
+	// Name and convert objects for the server repository
+	if err := pusher.SetRemoteMode(info.Mode); err != nil {
+		return err
+	}
+	defer pusher.Cleanup()
+	if pusher.NeedsCompression() && options.DeltaThreshold > 0 {
+		logger.Warnf("Objects are compressed for the server, uploading whole objects")
+		options.DeltaThreshold = 0
+	}
+
+	// Don't use features the server doesn't have
+	if options.UseInventory && !c.HasCapability(common.CapabilityInventory) {
+		logger.Warnf("The server doesn't provide an inventory, negotiating all objects")
+		options.UseInventory = false
+	}
+	if options.ServerTraverse && !c.HasCapability(common.CapabilityServerTraverse) {
+		logger.Warnf("The server cannot traverse commits, sending the list of objects")
+		options.ServerTraverse = false
+	}
+	if options.DeltaThreshold > 0 && !c.HasCapability(common.CapabilityDeltas) {
+		logger.Warnf("The server doesn't accept deltas, uploading whole objects")
+		options.DeltaThreshold = 0
+	}
+	if options.Resume && !c.HasCapability(common.CapabilityResume) {
+		logger.Warnf("The server cannot resume pushes, starting from scratch")
+		options.Resume = false
+	}
+	if len(options.SummaryMetadata) > 0 && !c.HasCapability(common.CapabilitySummaryMetadata) {
+		return errors.New("The server doesn't accept summary metadata")
+	}
+	if len(options.SBOMs) > 0 && !c.HasCapability(common.CapabilitySBOM) {
+		return errors.New("The server doesn't store SBOMs")
+	}
+	if options.ManifestKey != nil && !c.HasCapability(common.CapabilitySignedManifests) {
+		logger.Warnf("The server doesn't check signed manifests, pushing without")
+		options.ManifestKey = nil
+	}
+	if options.Encrypt {
+		if !c.HasCapability(common.CapabilityEncryption) || len(info.EncryptionRecipients) == 0 {
+			return errors.New("The server doesn't accept encrypted objects")
+		}
+		if err := pusher.SetRecipients(info.EncryptionRecipients); err != nil {
+			return fmt.Errorf("Invalid encryption recipient: %w", err)
+		}
+
+		// The server can't read the objects before publishing
+		if options.ServerTraverse || options.UseInventory {
+			logger.Warnf("The server cannot traverse encrypted objects, sending the list of objects")
+			options.ServerTraverse = false
+			options.UseInventory = false
+		}
+		if options.DeltaThreshold > 0 {
+			logger.Warnf("Deltas would not be encrypted, uploading whole objects")
+			options.DeltaThreshold = 0
+		}
+	}
+
+	// Batches can grow past their size by one object, leave room for it
+	if info.MaxRequestSize > 0 && (options.BatchSize == 0 || options.BatchSize > info.MaxRequestSize/2) {
+		options.BatchSize = info.MaxRequestSize / 2
+		logger.Infof("The server accepts requests of at most %d MiB, uploading %d MiB at a time", info.MaxRequestSize/1024/1024, options.BatchSize/1024/1024)
 	}
 
 	// See if there's something to update
 	logger.Action("Looking for branches to update...")
 	updateRefs, err := pusher.CheckUpdate(info.Revs)
 	if err != nil {
-		return fmt.Errorf("Failed to determine the branches to update: %v", err)
+		return fmt.Errorf("Failed to determine the branches to update: %w", err)
 	}
 	if len(updateRefs) == 0 {
 		logger.Info("Nothing to update!")
 		return nil
 	}
+	for branch := range options.SBOMs {
+		if _, ok := updateRefs[branch]; !ok {
+			return fmt.Errorf("Cannot attach an SBOM to branch \"%s\" which is not updated", branch)
+		}
+	}
+
+	// Fail now rather than after uploading if the token won't do
+	if c.HasCapability(common.CapabilityWhoami) {
+		if err := checkToken(ctx, c, updateRefs); err != nil {
+			return err
+		}
+	}
 
 	// Update branches
 	logger.Action("About to update the following branches:")
@@ -53,61 +233,787 @@ func StartClient(url, token, path string, refs []string, prune bool) error {
 		}
 	}
 
-	if prune {
+	// Show what is about to be pushed, so that mistakes are caught
+	// before uploading anything; scripts and CI have nobody to ask
+	if !options.AssumeYes && isInteractive() {
+		if err := confirmCommits(pusher, updateRefs); err != nil {
+			return err
+		}
+	}
+
+	if options.Prune {
 		// Prune the repository before sending any object
 		logger.Action("Pruning repository (this might take a while)...")
 		if err = pusher.Prune(); err != nil {
-			return fmt.Errorf("Failed to prune repository: %v", err)
+			return fmt.Errorf("Failed to prune repository: %w", err)
 		}
 	}
 
-	// Collect commits and objects to upload
-	objects, err := pusher.FindObjectsToPush(updateRefs)
+	// Servers released before API v2 can only publish with the upload
+	if c.APIVersion() < 2 {
+		return pushLegacy(ctx, c, pusher, updateRefs, options, manifest)
+	}
+
+	// Objects of the commits, enumerated once for the whole push
+	var objects common.Objects
+
+	// Let the server refuse a push that is too large before uploading
+	request := client.QueueRequest{Refs: updateRefs, DeferPublish: true, Mode: pusher.LocalMode(), Metadata: options.Metadata, SummaryMetadata: options.SummaryMetadata, Confirm: options.Confirm, Encrypted: options.Encrypt}
+	if info.MaxPushSize > 0 || info.MaxPushObjects > 0 {
+		objects, err = findObjectsToPush(pusher, updateRefs, options.PullMissing)
+		if err != nil && !options.ServerTraverse {
+			return err
+		} else if err != nil {
+			logger.Warnf("Cannot measure the push: %v", err)
+		}
+		request.ObjectCount, request.Size = measurePush(objects)
+	}
+
+	// The manifest lists the checksums of the objects as they're uploaded
+	var checksums *client.UploadChecksums
+	if options.ManifestKey != nil {
+		if checksums, err = c.RecordChecksums(common.ChecksumSHA256); err != nil {
+			return err
+		}
+	}
+
+	// Start the process
+	queueCtx, queueSpan := tracing.StartSpan(ctx, "queue create")
+	var queueID string
+	resumed := false
+	entry, err := c.NewQueueEntry(queueCtx, request)
+	queueSpan.End(err)
+	if err == nil {
+		queueID = entry.QueueID
+	} else if errors.Is(err, client.ErrBranchBusy) && options.Resume {
+		logger.Action("Resuming the previous push...")
+		queueID, err = findQueueEntry(ctx, c, updateRefs)
+		if err != nil {
+			return fmt.Errorf("Cannot resume the previous push: %w", err)
+		}
+		resumed = true
+	} else if errors.Is(err, client.ErrBranchBusy) {
+		return fmt.Errorf("Another push is updating the same branches: %w", err)
+	} else if errors.Is(err, client.ErrBranchProtected) {
+		return protectedBranchError(err)
+	} else if errors.Is(err, client.ErrPushTooLarge) {
+		return fmt.Errorf("The server refused the push: %w", err)
+	} else if errors.Is(err, client.ErrEncryptionRequired) {
+		return fmt.Errorf("The server only accepts encrypted objects, pass --encrypt: %w", err)
+	}
 	if err != nil {
-		return fmt.Errorf("Failed to enumerate objects to upload: %v", err)
+		return fmt.Errorf("Failed to check which branches need to be updated: %w", err)
 	}
+	manifest.QueueID = queueID
+	logger.Infof("Queue entry %s, follow it with \"ostree-upload status %s\"", queueID, queueID)
 
-	// Now extract the list object names
-	objectNames := []string{}
+	// SBOMs are published together with the commits
+	if err := uploadSBOMs(ctx, c, queueID, updateRefs, options.SBOMs); err != nil {
+		c.DeleteQueueEntry(ctx, queueID)
+		return err
+	}
+
+	// Commits the server already has, for example after a publish that was
+	// interrupted or when pushing a commit of another branch, only need the
+	// branches to be updated, without enumerating their objects
+	refsOnly := false
+	if !options.ServerTraverse && c.HasCapability(common.CapabilityServerTraverse) {
+		refsOnly, err = hasCommits(ctx, c, queueID)
+		if err != nil {
+			c.DeleteQueueEntry(ctx, queueID)
+			return err
+		}
+	}
+
+	// Let the server find the objects it needs, otherwise negotiate
+	// the objects we found
+	if refsOnly {
+		logger.Info("The server already has the commits, updating the branches only")
+	} else if !options.ServerTraverse {
+		if objects, err = pushNegotiated(ctx, c, pusher, queueID, objects, updateRefs, options, manifest); err != nil {
+			c.DeleteQueueEntry(ctx, queueID)
+			return err
+		}
+	}
+
+	// The server inventory might have false positives, in that case the
+	// server will find out the objects we didn't send while traversing
+	if !refsOnly && (options.ServerTraverse || options.UseInventory) {
+		if err := pushTraversedOnServer(ctx, c, pusher, queueID, options, manifest); err != nil {
+			c.DeleteQueueEntry(ctx, queueID)
+			return err
+		}
+	}
+
+	// Vouch for what was uploaded, objects uploaded by the push that is
+	// resumed are in the staging area too
+	var previous common.Objects
+	if resumed && !refsOnly {
+		if objects == nil {
+			if objects, err = findObjectsToPush(pusher, updateRefs, options.PullMissing); err != nil {
+				c.DeleteQueueEntry(ctx, queueID)
+				return err
+			}
+		}
+		previous = objects
+	}
+	if options.ManifestKey != nil {
+		if err := sendManifest(ctx, c, pusher, queueID, updateRefs, manifest.sent, previous, checksums, options.ManifestKey); err != nil {
+			c.DeleteQueueEntry(ctx, queueID)
+			return err
+		}
+	}
+
+	// Update refs
+	logger.Action("Publishing...")
+	finalizeCtx, finalizeSpan := tracing.StartSpan(ctx, "finalize")
+	for attempt := 1; attempt <= client.Attempts; attempt++ {
+		err = c.Done(finalizeCtx, queueID)
+		if errors.Is(err, client.ErrIncompleteCommit) && attempt < client.Attempts {
+			// Send what the server found missing and publish again
+			if uploadErr := uploadMissingObjects(ctx, c, pusher, queueID, err, options, manifest); uploadErr != nil {
+				err = uploadErr
+				break
+			}
+			if options.ManifestKey != nil {
+				if manifestErr := sendManifest(ctx, c, pusher, queueID, updateRefs, manifest.sent, previous, checksums, options.ManifestKey); manifestErr != nil {
+					err = manifestErr
+					break
+				}
+			}
+			continue
+		}
+		if !errors.Is(err, client.ErrServerBusy) || attempt == client.Attempts {
+			break
+		}
+		logger.Warnf("The server is busy, publishing again (attempt %d/%d)", attempt, client.Attempts)
+		time.Sleep(client.RetryDelay(err, attempt))
+	}
+	finalizeSpan.End(err)
+	if err != nil {
+		return fmt.Errorf("Failed to publish: %w", err)
+	}
+	manifest.Refs = updateRefs
+
+	logger.Info("Done!")
+
+	return nil
+}
+
+// pushLegacy pushes to a server that only supports API v1: the queue
+// entry lists every object to push and the server publishes the branches
+// once the objects it needs are uploaded, all of them in a single request
+func pushLegacy(ctx context.Context, c *client.Client, pusher *client.Pusher, updateRefs map[string]common.RevisionPair, options Options, manifest *Manifest) error {
+	if len(options.Metadata) > 0 {
+		logger.Warnf("The server doesn't record push metadata, pushing without")
+	}
+
+	objects, err := pusher.FindObjectsToPush(updateRefs)
+	if err != nil {
+		return fmt.Errorf("Failed to enumerate objects to upload: %w", err)
+	}
+	manifest.Objects = len(objects)
+	objectNames := make([]string, 0, len(objects))
 	for objectName := range objects {
 		objectNames = append(objectNames, objectName)
 	}
 
-	// Start the process
-	queueID, err := client.NewQueueEntry(updateRefs, objectNames)
+	entry, err := c.NewQueueEntry(ctx, client.QueueRequest{Refs: updateRefs, Objects: objectNames})
 	if err != nil {
-		return fmt.Errorf("Failed to check which branches need to be updated: %v", err)
+		return fmt.Errorf("Failed to check which branches need to be updated: %w", err)
 	}
+	manifest.QueueID = entry.QueueID
 
-	// Check which objects we still need to upload
-	wantedObjectNames, err := client.SendObjectsList(queueID)
+	wantedObjectNames, err := c.SendObjectsList(ctx, entry.QueueID)
 	if err != nil {
-		client.DeleteQueueEntry(queueID)
-		return fmt.Errorf("Failed to retrieve the list of objects to upload: %v", err)
+		c.DeleteQueueEntry(ctx, entry.QueueID)
+		return fmt.Errorf("Failed to retrieve the list of objects to upload: %w", err)
 	}
-
-	// List of objects to upload
 	wantedObjects := common.Objects{}
+	for _, wantedObjectName := range wantedObjectNames {
+		if object, ok := objects[wantedObjectName]; ok {
+			wantedObjects[wantedObjectName] = object
+		}
+	}
+	if err := pusher.PrepareObjects(wantedObjects); err != nil {
+		c.DeleteQueueEntry(ctx, entry.QueueID)
+		return fmt.Errorf("Failed to prepare objects: %w", err)
+	}
+
+	logger.Actionf("Sending %d/%d objects and publishing...", len(wantedObjects), len(objects))
+	if _, err := c.Upload(ctx, entry.QueueID, wantedObjects); err != nil {
+		c.DeleteQueueEntry(ctx, entry.QueueID)
+		return fmt.Errorf("Failed to publish: %w", err)
+	}
+	manifest.addUploaded(wantedObjects)
+	manifest.Refs = updateRefs
+
+	logger.Info("Done!")
+
+	return nil
+}
+
+// measurePush returns the number and the size in bytes of the objects of
+// the commits to push, whether or not the server has them, or zeros when
+// they cannot be enumerated and the server cannot check them
+func measurePush(objects common.Objects) (int, int64) {
+	var size int64
+	for _, object := range objects {
+		size += object.Size
+	}
+	logger.Debugf("Pushing commits of %d objects, %d bytes", len(objects), size)
+
+	return len(objects), size
+}
+
+// findObjectsToPush enumerates the objects of the commits to push, fetching
+// those that were pruned from the local repository from pullMissing if set
+func findObjectsToPush(pusher *client.Pusher, updateRefs map[string]common.RevisionPair, pullMissing string) (common.Objects, error) {
+	objects, err := pusher.FindObjectsToPush(updateRefs)
+	var missing *client.MissingObjectsError
+	if errors.As(err, &missing) && pullMissing != "" {
+		logger.Warnf("%v", err)
+		logger.Actionf("Pulling %d commits from \"%s\"...", len(missing.Commits), pullMissing)
+		if err := pusher.PullCommits(pullMissing, missing.Commits); err != nil {
+			return nil, fmt.Errorf("Failed to pull the missing objects from \"%s\": %w", pullMissing, err)
+		}
+		objects, err = pusher.FindObjectsToPush(updateRefs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to enumerate objects to upload: %w", err)
+	}
+
+	return objects, nil
+}
+
+// sendManifest signs the manifest of the push with key and sends it, it
+// lists the objects sent by the push with the checksum recorded as they
+// were uploaded, and the objects a resumed push might have sent before
+func sendManifest(ctx context.Context, c *client.Client, pusher *client.Pusher, queueID string, updateRefs map[string]common.RevisionPair, sent, previous common.Objects, checksums *client.UploadChecksums, key ed25519.PrivateKey) error {
+	logger.Action("Signing the manifest of the push...")
+	objects := make(common.Objects, len(sent)+len(previous))
+	for objectName, object := range previous {
+		if _, ok := sent[objectName]; !ok {
+			objects[objectName] = object
+		}
+	}
+	if err := pusher.PrepareObjects(objects); err != nil {
+		return fmt.Errorf("Failed to prepare objects: %w", err)
+	}
+	for objectName, object := range sent {
+		objects[objectName] = object
+	}
+
+	// Objects sent as deltas or with resumable uploads are read again
+	manifest := common.QueueManifest{QueueID: queueID, Refs: updateRefs, Objects: make(map[string]string, len(objects))}
 	for objectName, object := range objects {
+		checksum, ok := checksums.Get(objectName)
+		if !ok {
+			var err error
+			if checksum, err = common.ChecksumFile(common.ChecksumSHA256, object.ObjectPath); err != nil {
+				return err
+			}
+		}
+		manifest.Objects[objectName] = checksum
+	}
+
+	if err := c.SendManifest(ctx, queueID, manifest, key); err != nil {
+		return fmt.Errorf("Failed to send the manifest: %w", err)
+	}
+
+	return nil
+}
+
+// uploadSBOMs uploads the SBOMs of the commits of the branches
+func uploadSBOMs(ctx context.Context, c *client.Client, queueID string, updateRefs map[string]common.RevisionPair, sboms map[string]string) error {
+	for branch, path := range sboms {
+		rev := updateRefs[branch].Client
+		logger.Actionf("Uploading the SBOM of branch \"%s\"...", branch)
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Failed to open the SBOM of branch \"%s\": %w", branch, err)
+		}
+		err = c.UploadSBOM(ctx, queueID, rev, file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to upload the SBOM of branch \"%s\": %w", branch, err)
+		}
+	}
+
+	return nil
+}
+
+// checkToken warns when the token is about to expire and returns an error
+// when it doesn't allow to push the branches
+func checkToken(ctx context.Context, c *client.Client, updateRefs map[string]common.RevisionPair) error {
+	whoami, err := c.Whoami(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to retrieve token information: %w", err)
+	}
+
+	if whoami.Expires != "" {
+		if expires, err := time.Parse(time.RFC3339, whoami.Expires); err == nil {
+			if left := time.Until(expires); left < tokenExpiryWarning {
+				logger.Warnf("The token expires in %d days, on %s", int(left.Hours()/24), whoami.Expires)
+			}
+		}
+	}
+
+	if whoami.QuotaLimit > 0 && whoami.QuotaUsed >= whoami.QuotaLimit {
+		return fmt.Errorf("The repository takes %s of its %s quota", common.FormatSize(uint64(whoami.QuotaUsed)), common.FormatSize(uint64(whoami.QuotaLimit)))
+	} else if whoami.QuotaLimit > 0 {
+		logger.Debugf("The repository takes %s of its %s quota", common.FormatSize(uint64(whoami.QuotaUsed)), common.FormatSize(uint64(whoami.QuotaLimit)))
+	}
+
+	allowed := len(whoami.Scopes) == 0
+	for _, scope := range whoami.Scopes {
+		if scope == common.ScopePush {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return errors.New("The token doesn't allow to push")
+	}
+
+	for branch := range updateRefs {
+		if !common.RefAllowed(whoami.Refs, branch) {
+			return fmt.Errorf("The token doesn't allow to update branch \"%s\"", branch)
+		}
+	}
+
+	return nil
+}
+
+// findQueueEntry returns the queue entry of a previous push that was updating
+// exactly the same branches to the same revisions
+func findQueueEntry(ctx context.Context, c *client.Client, updateRefs map[string]common.RevisionPair) (string, error) {
+	for branch := range updateRefs {
+		entry, err := c.FindQueueEntry(ctx, branch)
+		if err != nil {
+			return "", err
+		}
+
+		if len(entry.Refs) != len(updateRefs) {
+			return "", fmt.Errorf("queue entry %s is updating different branches", entry.QueueID)
+		}
+		for entryBranch, revPair := range entry.Refs {
+			if updateRefs[entryBranch] != revPair {
+				return "", fmt.Errorf("queue entry %s is updating branch \"%s\" to a different revision", entry.QueueID, entryBranch)
+			}
+		}
+
+		logger.Infof("Reattached to queue entry %s", entry.QueueID)
+		return entry.QueueID, nil
+	}
+
+	return "", errors.New("no branches to update")
+}
+
+// hasCommits returns whether the server has all the objects of the commits
+// of the queue entry, which is quick to find out for the server when they
+// are published since published objects are complete with their children
+func hasCommits(ctx context.Context, c *client.Client, queueID string) (bool, error) {
+	missingObjectNames, err := c.GetMissingObjects(ctx, queueID)
+	if err != nil {
+		return false, fmt.Errorf("Failed to check whether the server has the commits: %w", err)
+	}
+
+	return len(missingObjectNames) == 0, nil
+}
+
+// pushNegotiated enumerates the objects of the commits to push unless they
+// were, asks the server which of them are missing and uploads them, recording
+// them in the manifest; it returns the objects of the commits
+func pushNegotiated(ctx context.Context, c *client.Client, pusher *client.Pusher, queueID string, objects common.Objects, updateRefs map[string]common.RevisionPair, options Options, manifest *Manifest) (common.Objects, error) {
+	// Skip the objects the server has since a previous push, objects
+	// enumerated to measure the push include them
+	findServerObjects(ctx, c, pusher, updateRefs)
+	if objects != nil {
+		objects = pusher.WithoutServerObjects(objects)
+	} else {
+		var err error
+		if objects, err = findObjectsToPush(pusher, updateRefs, options.PullMissing); err != nil {
+			return nil, err
+		}
+	}
+	manifest.Objects = len(objects)
+
+	// Negotiate only the objects that are not in the server inventory,
+	// the others are most likely already there
+	objectNames := []string{}
+	if options.UseInventory {
+		logger.Action("Receiving objects inventory...")
+		inventory, err := c.GetInventory(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to retrieve objects inventory: %w", err)
+		}
+
+		for objectName := range objects {
+			if !inventory.Test(objectName) {
+				objectNames = append(objectNames, objectName)
+			}
+		}
+		logger.Infof("%d/%d objects are probably already on the server", len(objects)-len(objectNames), len(objects))
+	} else {
+		for objectName := range objects {
+			objectNames = append(objectNames, objectName)
+		}
+	}
+
+	// Check which objects we still need to upload, in batches small
+	// enough to fit in a request even for huge commits
+	negotiationCtx, span := tracing.StartSpan(ctx, "negotiation")
+	span.SetAttribute("objects", len(objectNames))
+	wantedObjects := common.Objects{}
+	for start := 0; start < len(objectNames); start += objectsBatchSize {
+		end := min(start+objectsBatchSize, len(objectNames))
+		logger.Debugf("Negotiating objects %d-%d of %d", start+1, end, len(objectNames))
+
+		wantedObjectNames, err := c.SendObjectsBatch(negotiationCtx, queueID, objectNames[start:end])
+		if err != nil {
+			span.End(err)
+			return nil, fmt.Errorf("Failed to retrieve the list of objects to upload: %w", err)
+		}
+
 		for _, wantedObjectName := range wantedObjectNames {
-			if objectName == wantedObjectName {
-				wantedObjects[objectName] = object
-				break
+			if object, ok := objects[wantedObjectName]; ok {
+				wantedObjects[wantedObjectName] = object
 			}
 		}
 	}
 
-	// Send objects and update refs
+	span.SetAttribute("wanted_objects", len(wantedObjects))
+	span.End(nil)
+
+	if err := pusher.PrepareObjects(wantedObjects); err != nil {
+		return nil, fmt.Errorf("Failed to prepare objects: %w", err)
+	}
+	if err := pusher.EncryptObjects(wantedObjects); err != nil {
+		return nil, fmt.Errorf("Failed to encrypt objects: %w", err)
+	}
+
+	// Send large objects as deltas against their previous version
+	if options.DeltaThreshold > 0 {
+		if err := uploadDeltas(ctx, c, pusher, queueID, updateRefs, wantedObjects, options.DeltaThreshold, manifest); err != nil {
+			return nil, err
+		}
+	}
+
+	// Send objects
 	logger.Actionf("Sending %d/%d objects...", len(wantedObjects), len(objects))
-	if err := client.Upload(queueID, wantedObjects); err != nil {
-		logger.Errorf("Failed to upload: %v", err)
-		if err := client.DeleteQueueEntry(queueID); err != nil {
-			logger.Errorf("Failed to delete entry \"%s\" from queue: %v", queueID, err)
+	if err := uploadBatches(ctx, c, queueID, wantedObjects, options.BatchSize); err != nil {
+		return nil, fmt.Errorf("Failed to upload: %w", err)
+	}
+	manifest.addUploaded(wantedObjects)
+
+	return objects, nil
+}
+
+// uploadMissingObjects uploads the objects that the server reported as
+// missing from the commits when publishing failed with err
+func uploadMissingObjects(ctx context.Context, c *client.Client, pusher *client.Pusher, queueID string, err error, options Options, manifest *Manifest) error {
+	var apiError *client.APIError
+	if !errors.As(err, &apiError) || len(apiError.Objects) == 0 {
+		return err
+	}
+	logger.Warnf("The server is missing %d objects of the commits, sending them", len(apiError.Objects))
+
+	objects, err := pusher.FindObjectsByName(apiError.Objects)
+	if err != nil {
+		return fmt.Errorf("Failed to find objects to upload: %w", err)
+	}
+	if err := pusher.PrepareObjects(objects); err != nil {
+		return fmt.Errorf("Failed to prepare objects: %w", err)
+	}
+	if err := pusher.EncryptObjects(objects); err != nil {
+		return fmt.Errorf("Failed to encrypt objects: %w", err)
+	}
+	if err := uploadBatches(ctx, c, queueID, objects, options.BatchSize); err != nil {
+		return fmt.Errorf("Failed to upload: %w", err)
+	}
+	manifest.addUploaded(objects)
+
+	return nil
+}
+
+// findServerObjects tells the pusher which objects the server has, from the
+// commits the branches point to on the server: when the local repository
+// has one of them or one of its ancestors, the objects are enumerated locally
+// and the server sends what changed since
+func findServerObjects(ctx context.Context, c *client.Client, pusher *client.Pusher, updateRefs map[string]common.RevisionPair) {
+	for branch, revPair := range updateRefs {
+		if revPair.Server == "" {
+			continue
 		}
-		return nil
+
+		rev, objectNames := pusher.FindLocalAncestor(revPair.Server)
+		if rev == "" {
+			logger.Debugf("No commit of branch \"%s\" on the server is complete locally", branch)
+			continue
+		}
+		if rev == revPair.Server {
+			pusher.AddServerObjects(objectNames)
+			continue
+		}
+		if !c.HasCapability(common.CapabilityObjectsSince) {
+			continue
+		}
+
+		// Objects of the older commit might have been pruned from the
+		// server, only those that are still used by the branch are there
+		result, err := c.ObjectsSince(ctx, branch, rev)
+		if err != nil {
+			// The server might not have the commit anymore
+			logger.Debugf("Cannot compare branch \"%s\" with commit %s on the server: %v", branch, rev, err)
+			continue
+		}
+		if result.Rev != revPair.Server {
+			// The branch was updated in the meantime
+			continue
+		}
+
+		removed := map[string]bool{}
+		for _, objectName := range result.Removed {
+			removed[objectName] = true
+		}
+		for _, objectName := range objectNames {
+			if !removed[objectName] {
+				result.Added = append(result.Added, objectName)
+			}
+		}
+		pusher.AddServerObjects(result.Added)
+		logger.Debugf("Found %d objects of branch \"%s\" on the server since %s", len(result.Added), branch, rev)
 	}
+}
 
-	logger.Info("Done!")
+// uploadDeltas uploads the objects at least as large as threshold that have a previous
+// version on the server as deltas, and removes them from the objects to upload
+func uploadDeltas(ctx context.Context, c *client.Client, pusher *client.Pusher, queueID string, updateRefs map[string]common.RevisionPair, objects common.Objects, threshold int64, manifest *Manifest) error {
+	basisObjects, err := pusher.FindBasisObjects(updateRefs)
+	if err != nil {
+		return fmt.Errorf("Failed to find basis objects for deltas: %w", err)
+	}
+
+	for objectName, object := range objects {
+		basisName, ok := basisObjects[objectName]
+		if !ok || object.Size < threshold {
+			continue
+		}
+
+		// Fall back to a regular upload if anything goes wrong
+		logger.Infof("Sending \"%s\" as a delta from \"%s\"...", objectName, basisName)
+		signature, err := c.GetSignature(ctx, basisName, delta.DefaultBlockSize)
+		if err != nil {
+			logger.Warnf("Cannot retrieve signature of \"%s\": %v", basisName, err)
+			continue
+		}
+		if err := c.UploadDelta(ctx, queueID, object, basisName, signature); err != nil {
+			logger.Warnf("Failed to send \"%s\" as a delta: %v", objectName, err)
+			continue
+		}
+
+		delete(objects, objectName)
+		manifest.addDelta(object)
+	}
+
+	return nil
+}
+
+// pushTraversedOnServer uploads the objects that the server asks for, round after
+// round, while it walks the commits with the objects uploaded so far
+func pushTraversedOnServer(ctx context.Context, c *client.Client, pusher *client.Pusher, queueID string, options Options, manifest *Manifest) error {
+	for {
+		// Check which objects the server needs now
+		wantedObjectNames, err := c.GetMissingObjects(ctx, queueID)
+		if err != nil {
+			return fmt.Errorf("Failed to retrieve the list of objects to upload: %w", err)
+		}
+		if len(wantedObjectNames) == 0 {
+			break
+		}
+
+		wantedObjects, err := pusher.FindObjectsByName(wantedObjectNames)
+		if err != nil {
+			return fmt.Errorf("Failed to find objects to upload: %w", err)
+		}
+		if err := pusher.PrepareObjects(wantedObjects); err != nil {
+			return fmt.Errorf("Failed to prepare objects: %w", err)
+		}
+		if err := pusher.EncryptObjects(wantedObjects); err != nil {
+			return fmt.Errorf("Failed to encrypt objects: %w", err)
+		}
+
+		logger.Actionf("Sending %d objects...", len(wantedObjects))
+		if err := uploadBatches(ctx, c, queueID, wantedObjects, options.BatchSize); err != nil {
+			return fmt.Errorf("Failed to upload: %w", err)
+		}
+		manifest.addUploaded(wantedObjects)
+	}
+
+	return nil
+}
+
+// uploadBatches uploads objects in requests of about batchSize bytes each,
+// or all of them in a single request when batchSize is 0; large objects are
+// uploaded on their own with the tus protocol when the server supports it
+func uploadBatches(ctx context.Context, c *client.Client, queueID string, objects common.Objects, batchSize int64) error {
+	// Fail before uploading anything if the server won't take an object
+	if c.MaxObjectSize() > 0 {
+		for objectName, object := range objects {
+			if object.Size > c.MaxObjectSize() {
+				return fmt.Errorf("Object %s is larger than the %d MiB accepted by the server", objectName, c.MaxObjectSize()/1024/1024)
+			}
+		}
+	}
+
+	if c.HasCapability(common.CapabilityTus) {
+		remaining := make(common.Objects, len(objects))
+		for objectName, object := range objects {
+			if object.Size < resumableUploadThreshold {
+				remaining[objectName] = object
+				continue
+			}
+
+			logger.Infof("Sending \"%s\" with a resumable upload...", objectName)
+			if err := c.UploadResumable(ctx, queueID, object, batchSize); err != nil {
+				return err
+			}
+		}
+		objects = remaining
+	}
+
+	batch := common.Objects{}
+	var size int64
+	sent := 0
+
+	for _, object := range client.UploadOrder(objects) {
+		objectName := object.ObjectName
+		batch[objectName] = object
+		size += object.Size
+
+		full := batchSize > 0 && size >= batchSize
+		if c.MaxRequestObjects() > 0 && len(batch) >= c.MaxRequestObjects() {
+			full = true
+		}
+		if full {
+			if err := uploadBatch(ctx, c, queueID, batch); err != nil {
+				return err
+			}
+
+			sent += len(batch)
+			logger.Infof("Sent %d/%d objects", sent, len(objects))
+
+			batch = common.Objects{}
+			size = 0
+		}
+	}
+
+	if len(batch) > 0 {
+		if err := uploadBatch(ctx, c, queueID, batch); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
+
+// uploadBatch uploads a batch of objects, retrying a few times with the
+// objects that failed before giving up
+func uploadBatch(ctx context.Context, c *client.Client, queueID string, batch common.Objects) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "upload batch")
+	span.SetAttribute("objects", len(batch))
+	defer func() { span.End(err) }()
+
+	for attempt := 1; attempt <= client.Attempts; attempt++ {
+		span.SetAttribute("attempts", attempt)
+		if _, err = c.Upload(ctx, queueID, batch); err == nil {
+			return nil
+		}
+
+		// Retrying won't help if the server doesn't accept us
+		if errors.Is(err, client.ErrUnauthorized) {
+			return err
+		}
+
+		// The server stored the other objects
+		var uploadError *client.UploadError
+		if errors.As(err, &uploadError) {
+			batch = uploadError.Failed
+		}
+
+		if attempt < client.Attempts {
+			logger.Warnf("Upload failed (attempt %d/%d): %v", attempt, client.Attempts, err)
+			time.Sleep(client.RetryDelay(err, attempt))
+		}
+	}
+
+	return err
+}
+
+// confirmCommits describes the commits of updateRefs and asks whether
+// they are to be pushed
+func confirmCommits(pusher *client.Pusher, updateRefs map[string]common.RevisionPair) error {
+	summaries, err := pusher.DescribeCommits(updateRefs)
+	if err != nil {
+		return fmt.Errorf("Failed to read the commits to push: %w", err)
+	}
+	for branch, commits := range summaries {
+		logger.Actionf("Commits on branch \"%s\":", branch)
+		for _, commit := range commits {
+			size := "unknown size"
+			if commit.HasSizeDelta {
+				size = formatSizeDelta(commit.SizeDelta)
+			}
+			logger.Infof("\t%s %s (%s)\n\t\t%s", commit.Rev[:10], commit.Timestamp.Format(time.RFC3339), size, commit.Subject)
+		}
+	}
+
+	ok, err := confirm("Push these commits?")
+	if err != nil {
+		return fmt.Errorf("Failed to read the confirmation: %w", err)
+	}
+	if !ok {
+		return errors.New("Push cancelled, pass --yes to skip the confirmation")
+	}
+
+	return nil
+}
+
+// isInteractive returns whether somebody can answer questions, that is
+// when the standard input is a terminal
+func isInteractive() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm asks a yes or no question on the terminal, anything but
+// yes is a no, including when there's nobody to answer
+func confirm(question string) (bool, error) {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err == io.EOF {
+		fmt.Fprintln(os.Stderr)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// formatSizeDelta returns a human readable signed size
+func formatSizeDelta(size int64) string {
+	sign := "+"
+	if size < 0 {
+		sign = "-"
+		size = -size
+	}
+
+	return sign + common.FormatSize(uint64(size))
+}
@@ -0,0 +1,24 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package push
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/pkg/client"
+)
+
+// protectedBranchError explains how to update a protected branch when err
+// was caused by a missing confirmation
+func protectedBranchError(err error) error {
+	var apiError *client.APIError
+	if errors.As(err, &apiError) && apiError.Code == common.ErrorCodeBranchProtected && apiError.Details["reason"] == "confirm" {
+		return fmt.Errorf("%w, pass --confirm=%s to update it", err, apiError.Details["branch"])
+	}
+
+	return err
+}
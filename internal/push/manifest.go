@@ -0,0 +1,77 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package push
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+)
+
+// Manifest describes a completed push, it's written to a file for CI
+// artifacts and release notes
+type Manifest struct {
+	Receiver string `json:"receiver"`
+	QueueID  string `json:"queue_id,omitempty"`
+	// Previous and new revision of each updated branch
+	Refs     map[string]common.RevisionPair `json:"refs"`
+	Started  string                         `json:"started"`
+	Finished string                         `json:"finished"`
+	// Duration of the push in seconds
+	Duration float64 `json:"duration"`
+	// Objects of the pushed commits, unknown when the server traverses them
+	Objects int `json:"objects,omitempty"`
+	// Objects uploaded whole and their total size in bytes
+	UploadedObjects int   `json:"uploaded_objects"`
+	UploadedBytes   int64 `json:"uploaded_bytes"`
+	// Objects uploaded as deltas against their previous version
+	DeltaObjects int `json:"delta_objects"`
+
+	started time.Time
+	// Objects sent by the push, whole or as deltas
+	sent common.Objects
+}
+
+// newManifest starts describing a push to the receiver
+func newManifest(receiver string) *Manifest {
+	now := time.Now()
+	return &Manifest{
+		Receiver: receiver,
+		Refs:     map[string]common.RevisionPair{},
+		Started:  now.UTC().Format(time.RFC3339),
+		started:  now,
+		sent:     common.Objects{},
+	}
+}
+
+// addUploaded records objects that were uploaded whole
+func (m *Manifest) addUploaded(objects common.Objects) {
+	for objectName, object := range objects {
+		m.UploadedObjects++
+		m.UploadedBytes += object.Size
+		m.sent[objectName] = object
+	}
+}
+
+// addDelta records an object that was uploaded as a delta
+func (m *Manifest) addDelta(object common.Object) {
+	m.DeltaObjects++
+	m.sent[object.ObjectName] = object
+}
+
+// write finishes the manifest and writes it to path as JSON
+func (m *Manifest) write(path string) error {
+	now := time.Now()
+	m.Finished = now.UTC().Format(time.RFC3339)
+	m.Duration = now.Sub(m.started).Seconds()
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,58 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/client"
+)
+
+// StartPromote points the branch to of the remote repository to the
+// commit of its branch from, without uploading anything; confirm lists the
+// protected branches whose update is confirmed
+func StartPromote(url, token, from, to string, confirm []string, timeouts client.Timeouts, tlsOptions client.TLSOptions, requestOptions client.RequestOptions) error {
+	ctx := context.Background()
+	c, err := client.New(url, token, client.WithTimeouts(timeouts), client.WithTLS(tlsOptions), client.WithRequestOptions(requestOptions))
+	if err != nil {
+		return err
+	}
+
+	// Repository information
+	logger.Action("Receiving repository information...")
+	if _, err := c.GetInfo(ctx); err != nil {
+		return fmt.Errorf("Failed to retrieve repository information: %w", err)
+	}
+	if !c.HasCapability(common.CapabilityPromote) {
+		return errors.New("The server cannot promote branches")
+	}
+
+	logger.Actionf("Promoting \"%s\" to \"%s\"...", from, to)
+	result, err := c.Promote(ctx, from, to, confirm)
+	if errors.Is(err, client.ErrBranchBusy) {
+		return fmt.Errorf("A push is updating the same branch: %w", err)
+	} else if errors.Is(err, client.ErrBranchProtected) {
+		return protectedBranchError(err)
+	} else if err != nil {
+		return fmt.Errorf("Failed to promote: %w", err)
+	}
+
+	switch result.PreviousRev {
+	case result.Rev:
+		logger.Infof("Branch \"%s\" already points to %s", result.Branch, result.Rev)
+	case "":
+		logger.Infof("\tNew branch \"%s\"\n\t\t  to: %s", result.Branch, result.Rev)
+	default:
+		logger.Infof("\tBranch \"%s\"\n\t\tfrom: %s\n\t\t  to: %s", result.Branch, result.PreviousRev, result.Rev)
+	}
+
+	logger.Info("Done!")
+
+	return nil
+}
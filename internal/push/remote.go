@@ -0,0 +1,196 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/client"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// connect creates a client and retrieves the information of the repository
+func connect(ctx context.Context, url, token string, timeouts client.Timeouts, tlsOptions client.TLSOptions, requestOptions client.RequestOptions) (*client.Client, *common.InfoResponse, error) {
+	c, err := client.New(url, token, client.WithTimeouts(timeouts), client.WithTLS(tlsOptions), client.WithRequestOptions(requestOptions))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := c.GetInfo(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to retrieve repository information: %w", err)
+	}
+
+	return c, info, nil
+}
+
+// RemoteRevisions returns the revision of each branch of the remote repository
+func RemoteRevisions(url, token string, timeouts client.Timeouts, tlsOptions client.TLSOptions, requestOptions client.RequestOptions) (map[string]string, error) {
+	ctx := context.Background()
+	_, info, err := connect(ctx, url, token, timeouts, tlsOptions, requestOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return info.Revs, nil
+}
+
+// RemoteHistory returns the commits of a branch of the remote repository
+// from the newest, at most limit of them or all when limit is 0
+func RemoteHistory(url, token, branch string, limit int, timeouts client.Timeouts, tlsOptions client.TLSOptions, requestOptions client.RequestOptions) ([]ostree.CommitInfo, error) {
+	ctx := context.Background()
+	c, _, err := connect(ctx, url, token, timeouts, tlsOptions, requestOptions)
+	if err != nil {
+		return nil, err
+	}
+	if !c.HasCapability(common.CapabilityHistory) {
+		return nil, errors.New("The server cannot return the history of branches")
+	}
+
+	result, err := c.History(ctx, branch, limit)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve the history of \"%s\": %w", branch, err)
+	}
+
+	commits := make([]ostree.CommitInfo, 0, len(result.Commits))
+	for _, commit := range result.Commits {
+		timestamp, err := time.Parse(time.RFC3339, commit.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid timestamp of commit %s: %w", commit.Rev, err)
+		}
+		commits = append(commits, ostree.CommitInfo{Rev: commit.Rev, Parent: commit.Parent, Subject: commit.Subject, Timestamp: timestamp})
+	}
+
+	return commits, nil
+}
+
+// RemotePublishes returns the updates of a branch by the server from the
+// newest, at most limit of them or all the recorded ones when limit is 0
+func RemotePublishes(url, token, branch string, limit int, timeouts client.Timeouts, tlsOptions client.TLSOptions, requestOptions client.RequestOptions) ([]common.PublishResponse, error) {
+	ctx := context.Background()
+	c, _, err := connect(ctx, url, token, timeouts, tlsOptions, requestOptions)
+	if err != nil {
+		return nil, err
+	}
+	if !c.HasCapability(common.CapabilityPublishes) {
+		return nil, errors.New("The server cannot return the publishes of branches")
+	}
+
+	result, err := c.Publishes(ctx, branch, limit)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve the publishes of \"%s\": %w", branch, err)
+	}
+
+	return result.Publishes, nil
+}
+
+// How often the result of an integrity check is polled
+const integrityPollInterval = 2 * time.Second
+
+// RemoteCheckIntegrity checks the integrity of the remote repository and
+// waits for the result
+func RemoteCheckIntegrity(url, token string, timeouts client.Timeouts, tlsOptions client.TLSOptions, requestOptions client.RequestOptions) (*common.IntegrityResponse, error) {
+	ctx := context.Background()
+	c, _, err := connect(ctx, url, token, timeouts, tlsOptions, requestOptions)
+	if err != nil {
+		return nil, err
+	}
+	if !c.HasCapability(common.CapabilityIntegrity) {
+		return nil, errors.New("The server cannot check the integrity of its repository")
+	}
+
+	result, err := c.CheckIntegrity(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start the integrity check: %w", err)
+	}
+	for result.Running {
+		time.Sleep(integrityPollInterval)
+		result, err = c.Integrity(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to retrieve the result of the integrity check: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+// RemoteStatus returns the entries of the update queue of the remote
+// repository updating branches the token allows, from the oldest
+func RemoteStatus(url, token string, timeouts client.Timeouts, tlsOptions client.TLSOptions, requestOptions client.RequestOptions) ([]common.QueueStatusResponse, error) {
+	ctx := context.Background()
+	c, _, err := connect(ctx, url, token, timeouts, tlsOptions, requestOptions)
+	if err != nil {
+		return nil, err
+	}
+	if !c.HasCapability(common.CapabilityStatus) {
+		return nil, errors.New("The server cannot list its update queue")
+	}
+
+	result, err := c.Status(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve the update queue: %w", err)
+	}
+
+	return result.Entries, nil
+}
+
+// RemoteProgress returns the progress of an entry of the update queue of
+// the remote
+func RemoteProgress(url, token, queueID string, timeouts client.Timeouts, tlsOptions client.TLSOptions, requestOptions client.RequestOptions) (*common.QueueStatusResponse, error) {
+	ctx := context.Background()
+	c, _, err := connect(ctx, url, token, timeouts, tlsOptions, requestOptions)
+	if err != nil {
+		return nil, err
+	}
+	if !c.HasCapability(common.CapabilityProgress) {
+		return nil, errors.New("The server cannot report the progress of an update")
+	}
+
+	result, err := c.Progress(ctx, queueID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve the progress of update %s: %w", queueID, err)
+	}
+
+	return result, nil
+}
+
+// Delay before following the event stream again once it was interrupted
+const eventsReconnectDelay = 5 * time.Second
+
+// RemoteEvents follows the event stream of the remote, only the events of
+// the queue entry queueID when it's not empty, and hands each event to
+// handle until it returns true or an error; the stream is followed again,
+// from where it was interrupted, when the connection is lost
+func RemoteEvents(url, token, queueID string, timeouts client.Timeouts, tlsOptions client.TLSOptions, requestOptions client.RequestOptions, handle func(event *common.Event) (bool, error)) error {
+	ctx := context.Background()
+	c, _, err := connect(ctx, url, token, timeouts, tlsOptions, requestOptions)
+	if err != nil {
+		return err
+	}
+	if !c.HasCapability(common.CapabilityEvents) {
+		return errors.New("The server cannot stream its events")
+	}
+
+	lastEventID := ""
+	for {
+		var done bool
+		lastEventID, done, err = c.Events(ctx, queueID, lastEventID, handle)
+		if done {
+			return err
+		}
+		var apiError *client.APIError
+		if errors.As(err, &apiError) {
+			return fmt.Errorf("Failed to follow the events: %w", err)
+		} else if err != nil {
+			logger.Warnf("Failed to follow the events, trying again in %v: %v", eventsReconnectDelay, err)
+		}
+		time.Sleep(eventsReconnectDelay)
+	}
+}
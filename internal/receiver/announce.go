@@ -0,0 +1,194 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Events people can be notified about
+const (
+	eventPublished = "published"
+	eventFailed    = "failed"
+)
+
+// AnnouncedBranch is a branch that was, or failed to be, updated
+type AnnouncedBranch struct {
+	Branch string
+	From   string
+	To     string
+	// Subject of the new commit
+	Subject string
+}
+
+// Announcement describes an update of branches for the people following them
+type Announcement struct {
+	Repo string
+	// Either "publish", "promote" or "rollback"
+	Action   string
+	Failed   bool
+	Error    string
+	QueueID  string
+	Branches []AnnouncedBranch
+	// Build information sent by the client
+	Metadata map[string]string
+}
+
+// Title returns a one line summary of the announcement
+func (a Announcement) Title() string {
+	names := make([]string, 0, len(a.Branches))
+	for _, branch := range a.Branches {
+		names = append(names, branch.Branch)
+	}
+	branches := strings.Join(names, ", ")
+
+	if a.Failed {
+		return fmt.Sprintf("Failed to %s %s", a.Action, branches)
+	}
+	switch a.Action {
+	case auditActionPromote:
+		return fmt.Sprintf("Promoted %s", branches)
+	case auditActionRollback:
+		return fmt.Sprintf("Rolled back %s", branches)
+	}
+	return fmt.Sprintf("Published %s", branches)
+}
+
+// Text returns the announcement as plain text
+func (a Announcement) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s in %s\n", a.Title(), a.Repo)
+	for _, branch := range a.Branches {
+		fmt.Fprintf(&b, "  %s: %s (%s)\n", branch.Branch, branch.Subject, shortRev(branch.To))
+	}
+	if a.Error != "" {
+		fmt.Fprintf(&b, "Error: %s\n", a.Error)
+	}
+
+	return b.String()
+}
+
+// shortRev abbreviates a revision like git does
+func shortRev(rev string) string {
+	if len(rev) > 12 {
+		return rev[:12]
+	}
+	return rev
+}
+
+// Notifier announces updates of branches, for example to a chat room
+type Notifier interface {
+	Notify(announcement Announcement) error
+}
+
+// Notification sends announcements about some branches to channels
+type Notification struct {
+	// Branches announced, written as for path.Match, all of them by default
+	Refs []string `yaml:"refs,omitempty"`
+	// Either "published" or "failed", both by default
+	Events []string              `yaml:"events,omitempty"`
+	Slack  *SlackNotifier        `yaml:"slack,omitempty"`
+	Matrix *MatrixNotifier       `yaml:"matrix,omitempty"`
+	Email  *EmailNotifier        `yaml:"email,omitempty"`
+	Status *CommitStatusNotifier `yaml:"commit_status,omitempty"`
+}
+
+// notifiers returns the channels that are configured
+func (n *Notification) notifiers() []Notifier {
+	var notifiers []Notifier
+	if n.Slack != nil {
+		notifiers = append(notifiers, n.Slack)
+	}
+	if n.Matrix != nil {
+		notifiers = append(notifiers, n.Matrix)
+	}
+	if n.Email != nil {
+		notifiers = append(notifiers, n.Email)
+	}
+	if n.Status != nil {
+		notifiers = append(notifiers, n.Status)
+	}
+
+	return notifiers
+}
+
+// wants returns whether the notification is about the event
+func (n *Notification) wants(event string) bool {
+	if len(n.Events) == 0 {
+		return true
+	}
+	for _, e := range n.Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newAnnouncement describes the update of refs, the commits are read from
+// the staging area of the queue entry when they are not published
+func newAnnouncement(repo ostree.Repository, action, queueID string, refs map[string]common.RevisionPair, metadata map[string]string, err error) Announcement {
+	announcement := Announcement{Repo: repo.Path(), Action: action, QueueID: queueID, Metadata: metadata}
+	if err != nil {
+		announcement.Failed = true
+		announcement.Error = err.Error()
+	}
+
+	for branch, revPair := range refs {
+		subject := ""
+		if info, err := readEntryCommit(repo, queueID, revPair.Client); err == nil {
+			subject = info.Subject
+		}
+		announcement.Branches = append(announcement.Branches, AnnouncedBranch{Branch: branch, From: revPair.Server, To: revPair.Client, Subject: subject})
+	}
+	sort.Slice(announcement.Branches, func(i, j int) bool {
+		return announcement.Branches[i].Branch < announcement.Branches[j].Branch
+	})
+
+	return announcement
+}
+
+// announce sends the announcement to the channels of the notifications
+// about its branches, in the background
+func announce(config *Config, announcement Announcement) {
+	event := eventPublished
+	if announcement.Failed {
+		event = eventFailed
+	}
+
+	for i := range config.Notifications {
+		notification := &config.Notifications[i]
+		if !notification.wants(event) {
+			continue
+		}
+
+		// Only the branches the notification is about
+		filtered := announcement
+		filtered.Branches = nil
+		for _, branch := range announcement.Branches {
+			if common.RefAllowed(notification.Refs, branch.Branch) {
+				filtered.Branches = append(filtered.Branches, branch)
+			}
+		}
+		if len(filtered.Branches) == 0 {
+			continue
+		}
+
+		for _, notifier := range notification.notifiers() {
+			go func(notifier Notifier) {
+				if err := notifier.Notify(filtered); err != nil {
+					logger.Errorf("Failed to send the announcement \"%s\": %v", filtered.Title(), err)
+				}
+			}(notifier)
+		}
+	}
+}
@@ -4,11 +4,114 @@
 
 package receiver
 
-import "github.com/lirios/ostree-upload/internal/ostree"
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
 
 // AppState represents the ostree-receiver context
 type AppState struct {
 	Queue  *Queue
-	Repo   *ostree.Repo
+	Repo   ostree.Repository
 	Config *Config
+
+	// Repositories of tokens with their own repository, by path
+	mutex   sync.Mutex
+	tenants map[string]*tenant
+}
+
+// tenant is a repository with its own update queue
+type tenant struct {
+	repo  ostree.Repository
+	queue *Queue
+}
+
+// OpenOrCreateRepo opens the repository at path, creating it if it doesn't
+// exist, together with the temporary directory used during uploads
+func OpenOrCreateRepo(path string) (*ostree.Repo, error) {
+	var repo *ostree.Repo
+	var err error
+
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		repo, err = ostree.CreateRepo(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OSTree repository: %v", err)
+		}
+	} else {
+		repo, err = ostree.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open OSTree repository: %v", err)
+		}
+	}
+
+	if err = CreateTempDirectory(repo); err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory for OSTree repository: %v", err)
+	}
+
+	return repo, nil
+}
+
+// repositories returns all the repositories opened so far with their queue
+func (s *AppState) repositories() []*tenant {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tenants := []*tenant{{repo: s.Repo, queue: s.Queue}}
+	for _, t := range s.tenants {
+		tenants = append(tenants, t)
+	}
+
+	return tenants
+}
+
+// Repository returns the repository and update queue the token gives access to,
+// repositories of tokens with their own are opened the first time they are used
+func (s *AppState) Repository(token *Token) (ostree.Repository, *Queue, error) {
+	if token == nil || token.Repo == "" {
+		return s.Repo, s.Queue, nil
+	}
+
+	path, err := filepath.Abs(token.Repo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if t, ok := s.tenants[path]; ok {
+		return t.repo, t.queue, nil
+	}
+
+	logger.Infof("Opening repository %s", path)
+	repo, err := OpenOrCreateRepo(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := OpenStorage(repo, s.Config); err != nil {
+		return nil, nil, err
+	}
+	if err := RecoverPublishes(repo, s.Config); err != nil {
+		return nil, nil, err
+	}
+	if err := RecoverSummary(repo, s.Config); err != nil {
+		return nil, nil, err
+	}
+	queue, err := NewQueue()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if s.tenants == nil {
+		s.tenants = map[string]*tenant{}
+	}
+	t := &tenant{repo: DebounceSummary(repo, s.Config.SummaryDelay), queue: queue}
+	s.tenants[path] = t
+
+	return t.repo, t.queue, nil
 }
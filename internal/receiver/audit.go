@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+)
+
+// Actions recorded in the audit log
+const (
+	auditActionPublish  = "publish"
+	auditActionPromote  = "promote"
+	auditActionRollback = "rollback"
+)
+
+// AuditRecord is a line of the audit log
+type AuditRecord struct {
+	Time     string                         `json:"time"`
+	Action   string                         `json:"action"`
+	Repo     string                         `json:"repo"`
+	QueueID  string                         `json:"queue,omitempty"`
+	Refs     map[string]common.RevisionPair `json:"refs"`
+	Metadata map[string]string              `json:"metadata,omitempty"`
+}
+
+// Serializes writes to the audit log
+var auditMutex sync.Mutex
+
+// writeAuditRecord appends a JSON object per line to the audit log, when
+// the configuration has one, and logs the record anyway
+func writeAuditRecord(config *Config, record AuditRecord) error {
+	record.Time = time.Now().UTC().Format(time.RFC3339)
+
+	fields := logger.Fields{"action": record.Action, "repo": record.Repo}
+	if record.QueueID != "" {
+		fields["queue"] = record.QueueID
+	}
+	for key, value := range record.Metadata {
+		fields["metadata."+key] = value
+	}
+	for branch, revPair := range record.Refs {
+		logger.WithFields(fields).Infof("Branch \"%s\" updated from \"%s\" to \"%s\"", branch, revPair.Server, revPair.Client)
+	}
+
+	if config.AuditLog == "" {
+		return nil
+	}
+
+	js, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	file, err := os.OpenFile(config.AuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(js, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
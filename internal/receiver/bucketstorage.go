@@ -0,0 +1,137 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/lirios/ostree-upload/internal/blob"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// GCSStorage is the bucket of Google Cloud Storage the repository is
+// published to
+type GCSStorage struct {
+	Bucket string `yaml:"bucket"`
+	// Directory of the repository in the bucket, the root by default
+	Prefix string `yaml:"prefix,omitempty"`
+	// Endpoint of the JSON API, for emulators and private endpoints
+	Endpoint string `yaml:"endpoint,omitempty"`
+}
+
+// AzureStorage is the container of Azure Blob Storage the repository is
+// published to
+type AzureStorage struct {
+	Account   string `yaml:"account"`
+	Container string `yaml:"container"`
+	// Directory of the repository in the container, the root by default
+	Prefix string `yaml:"prefix,omitempty"`
+	// Endpoint of the account, for Azurite and sovereign clouds
+	Endpoint string `yaml:"endpoint,omitempty"`
+}
+
+func init() {
+	RegisterStorageBackend("gcs", func(repo ostree.Repository, config *Config) (Storage, error) {
+		c := config.Storage.GCS
+		if c == nil {
+			return nil, errors.New("the gcs section is missing")
+		}
+		bucket, err := blob.NewGCSBucket(c.Bucket, c.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return newBucketStorage(repo, bucket, c.Prefix)
+	})
+	RegisterStorageBackend("azure", func(repo ostree.Repository, config *Config) (Storage, error) {
+		c := config.Storage.Azure
+		if c == nil {
+			return nil, errors.New("the azure section is missing")
+		}
+		container, err := blob.NewAzureContainer(c.Account, c.Container, c.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return newBucketStorage(repo, container, c.Prefix)
+	})
+}
+
+// bucketStorage publishes the repository to an object store, where OSTree
+// clients pull from: the repository directory is still the one libostree
+// works with, and each file is copied to the bucket once written there
+type bucketStorage struct {
+	*LocalStorage
+	bucket blob.Bucket
+	prefix string
+}
+
+// bucketStorage implements Storage
+var _ Storage = (*bucketStorage)(nil)
+
+// newBucketStorage returns the storage publishing repo to the bucket,
+// after checking the bucket can be written by uploading the configuration
+// of the repository
+func newBucketStorage(repo ostree.Repository, bucket blob.Bucket, prefix string) (*bucketStorage, error) {
+	s := &bucketStorage{LocalStorage: NewLocalStorage(repo), bucket: bucket, prefix: prefix}
+	if err := s.upload("config", mutableCacheControl); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// upload copies the file of the repository at name, relative to the
+// repository, to the bucket
+func (s *bucketStorage) upload(name, cacheControl string) error {
+	file, err := os.Open(filepath.Join(s.repo.Path(), filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := s.bucket.Put(path.Join(s.prefix, name), file, info.Size(), cacheControl); err != nil {
+		return fmt.Errorf("failed to upload \"%s\": %v", name, err)
+	}
+
+	return nil
+}
+
+// Promote moves the object to the repository and uploads it, objects are
+// uploaded again when a publish is resumed since the bucket might have
+// missed them
+func (s *bucketStorage) Promote(queueID, objectName string, flush bool) error {
+	if err := s.LocalStorage.Promote(queueID, objectName, flush); err != nil {
+		return err
+	}
+
+	name, err := filepath.Rel(s.repo.Path(), s.repo.GetObjectPath(objectName))
+	if err != nil {
+		return err
+	}
+
+	return s.upload(filepath.ToSlash(name), immutableCacheControl)
+}
+
+// PublishFiles uploads the files, those that don't exist are skipped
+func (s *bucketStorage) PublishFiles(names []string) error {
+	for _, name := range names {
+		if err := s.upload(name, mutableCacheControl); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
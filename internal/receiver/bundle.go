@@ -0,0 +1,163 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chilts/sid"
+
+	"github.com/lirios/ostree-upload/internal/bundle"
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// WriteBundleState writes the branches and the mode of the repository to
+// path, in the format of the info endpoint, so that export-bundle only puts
+// in the next bundle what the repository doesn't have
+func WriteBundleState(repo ostree.Repository, path string) error {
+	mode, err := repo.GetMode()
+	if err != nil {
+		return err
+	}
+	revs, err := repo.Refs()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(common.InfoResponse{Mode: mode, Revs: revs}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// ImportBundle publishes the branches of the bundle at path, whose
+// signature must be valid for key, as if a client pushed them: the objects
+// are staged, verified and checked against the configuration before the
+// branches are updated.  It returns the branches that were updated, those
+// already pointing to the commits of the bundle are skipped.
+func ImportBundle(repo ostree.Repository, config *Config, path string, key ed25519.PublicKey) (map[string]common.RevisionPair, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	queueID := sid.IdBase64()
+	if err := createEntryStaging(repo, queueID); err != nil {
+		return nil, fmt.Errorf("failed to create the staging area: %v", err)
+	}
+	defer func() {
+		if err := removeEntryStaging(repo, queueID); err != nil {
+			logger.Errorf("Failed to remove the staging area of %s: %v", queueID, err)
+		}
+	}()
+
+	// Stage objects as they are read, they are only verified once the
+	// manifest tells they belong to the bundle
+	storage := getStorage(repo)
+	objectNames := []string{}
+	manifest, err := bundle.Read(file, key, func(objectName string, r io.Reader) error {
+		writer, err := storage.CreateStaged(queueID, objectName)
+		if err != nil {
+			return err
+		}
+		defer writer.Close()
+
+		if _, err := io.Copy(writer, r); err != nil {
+			return err
+		}
+		if err := writer.Commit(); err != nil {
+			return err
+		}
+		objectNames = append(objectNames, objectName)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := repo.GetMode()
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Mode != mode {
+		return nil, fmt.Errorf("the bundle was made for a repository in %s mode, this one is in %s mode", manifest.Mode, mode)
+	}
+
+	// The bundle only has what the repository lacked when it was made
+	revs, err := repo.Refs()
+	if err != nil {
+		return nil, err
+	}
+	updateRefs := map[string]common.RevisionPair{}
+	for branch, revPair := range manifest.Refs {
+		if err := ostree.ValidateRef(branch); err != nil {
+			return nil, err
+		}
+		switch revs[branch] {
+		case revPair.Client:
+			logger.Infof("Branch \"%s\" already points to %s", branch, revPair.Client)
+		case revPair.Server:
+			updateRefs[branch] = revPair
+		default:
+			return nil, fmt.Errorf("branch \"%s\" was at %s when the bundle was made, it's at %s now", branch, revPair.Server, revs[branch])
+		}
+	}
+	if len(updateRefs) == 0 {
+		return updateRefs, nil
+	}
+
+	for _, objectName := range objectNames {
+		stagedPath, err := storage.StagedPath(queueID, objectName)
+		if err != nil {
+			return nil, err
+		}
+		if err := repo.VerifyObject(stagedPath, objectName); err != nil {
+			return nil, fmt.Errorf("failed to verify %s: %v", objectName, err)
+		}
+	}
+
+	entry := &QueueEntry{ID: queueID, UpdateRefs: updateRefs, Objects: objectNames, Metadata: manifest.Metadata, Created: time.Now()}
+	if err := checkEntryCommits(repo, entry); err != nil {
+		return nil, err
+	}
+	if err := checkCommitPolicy(repo, config.CommitPolicy, entry); err != nil {
+		return nil, err
+	}
+	if err := checkEntrySignatures(repo, config, entry); err != nil {
+		return nil, err
+	}
+
+	if err := publishBranches(repo, config, entry); err != nil {
+		return nil, err
+	}
+
+	return updateRefs, nil
+}
@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// IncompleteCommit is returned when the entry is published before all the
+// objects of its commits were uploaded
+type IncompleteCommit struct {
+	// Commit whose object is missing, if any
+	Branch string
+	Rev    string
+	Reason string
+	// Objects reachable from the commits that are missing
+	Missing []string
+}
+
+func (e *IncompleteCommit) Error() string {
+	if e.Branch == "" {
+		return fmt.Sprintf("commits are incomplete: %s", e.Reason)
+	}
+	return fmt.Sprintf("commit %s of branch \"%s\" is incomplete: %s", e.Rev, e.Branch, e.Reason)
+}
+
+// checkEntryCommits checks that the commit object of each branch of the
+// entry was uploaded, or is already in the repository, and can be read,
+// then walks the commits to check that every object they reference is
+// either uploaded or published, so that clients never pull a commit
+// that is missing objects
+func checkEntryCommits(repo ostree.Repository, entry *QueueEntry) error {
+	for branch, revPair := range entry.UpdateRefs {
+		if _, err := readEntryCommit(repo, entry.ID, revPair.Client); err != nil {
+			return &IncompleteCommit{Branch: branch, Rev: revPair.Client, Reason: fmt.Sprintf("cannot read the commit object: %v", err), Missing: []string{revPair.Client + ".commit"}}
+		}
+	}
+
+	missing, err := FindNeededObjects(repo, entry)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return &IncompleteCommit{Reason: fmt.Sprintf("%d objects are missing", len(missing)), Missing: missing}
+	}
+
+	return nil
+}
+
+// checkEntryComplete replies with an error and returns false unless all
+// the commits of the entry can be published
+func checkEntryComplete(w http.ResponseWriter, r *http.Request, repo ostree.Repository, entry *QueueEntry) bool {
+	err := checkEntryCommits(repo, entry)
+	if err == nil {
+		return true
+	}
+
+	var incomplete *IncompleteCommit
+	if errors.As(err, &incomplete) {
+		logger.Errorf("Refusing to publish queue entry %s: %v", entry.ID, err)
+		errorResponse := common.ErrorResponse{
+			Code:    common.ErrorCodeIncompleteCommit,
+			Message: incomplete.Error(),
+			Objects: incomplete.Missing,
+		}
+		if incomplete.Branch != "" {
+			errorResponse.Details = map[string]string{"branch": incomplete.Branch, "commit": incomplete.Rev}
+		}
+		writeError(w, r, http.StatusConflict, errorResponse)
+		return false
+	}
+
+	logger.Errorf("Cannot check the commits of queue entry %s: %v", entry.ID, err)
+	httpError(w, r, err.Error(), http.StatusInternalServerError)
+	return false
+}
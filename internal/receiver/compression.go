@@ -0,0 +1,170 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/go-chi/chi/middleware"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/lirios/ostree-upload/internal/common"
+)
+
+// Compression controls the compression of responses
+type Compression struct {
+	// Codecs in order of preference, the first one accepted by the client
+	// is used; an empty list disables the compression
+	Codecs []string `yaml:"codecs"`
+	// Level of the codecs, by name, the default level of a codec otherwise
+	Levels map[string]int `yaml:"levels,omitempty"`
+}
+
+// compressionCodec is a codec responses can be compressed with
+type compressionCodec struct {
+	minLevel, maxLevel, defaultLevel int
+	encoder                          func(level int) middleware.EncoderFunc
+}
+
+// Codecs by the name used in Accept-Encoding, the default levels favor
+// speed since responses are compressed on the fly
+var compressionCodecs = map[string]compressionCodec{
+	common.CompressionGzip: {
+		minLevel: gzip.BestSpeed, maxLevel: gzip.BestCompression, defaultLevel: 5,
+		encoder: func(level int) middleware.EncoderFunc {
+			return func(w io.Writer, _ int) io.Writer {
+				gw, err := gzip.NewWriterLevel(w, level)
+				if err != nil {
+					return nil
+				}
+				return gw
+			}
+		},
+	},
+	common.CompressionZstd: {
+		minLevel: 1, maxLevel: 22, defaultLevel: 3,
+		encoder: func(level int) middleware.EncoderFunc {
+			return func(w io.Writer, _ int) io.Writer {
+				zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1))
+				if err != nil {
+					return nil
+				}
+				return zw
+			}
+		},
+	},
+	common.CompressionBrotli: {
+		minLevel: brotli.BestSpeed, maxLevel: brotli.BestCompression, defaultLevel: 4,
+		encoder: func(level int) middleware.EncoderFunc {
+			return func(w io.Writer, _ int) io.Writer {
+				return brotli.NewWriterLevel(w, level)
+			}
+		},
+	},
+}
+
+// defaultCompression compresses responses with gzip
+var defaultCompression = Compression{Codecs: []string{common.CompressionGzip}}
+
+// validate checks that the codecs and their levels are supported
+func (c Compression) validate() error {
+	for _, name := range c.Codecs {
+		if _, ok := compressionCodecs[name]; !ok {
+			return fmt.Errorf("unsupported compression codec \"%s\"", name)
+		}
+	}
+	for name, level := range c.Levels {
+		codec, ok := compressionCodecs[name]
+		if !ok {
+			return fmt.Errorf("unsupported compression codec \"%s\"", name)
+		}
+		if level < codec.minLevel || level > codec.maxLevel {
+			return fmt.Errorf("compression level of %s must be between %d and %d", name, codec.minLevel, codec.maxLevel)
+		}
+	}
+
+	return nil
+}
+
+// level returns the compression level of a codec
+func (c Compression) level(name string) int {
+	if level, ok := c.Levels[name]; ok {
+		return level
+	}
+	return compressionCodecs[name].defaultLevel
+}
+
+// compression returns a middleware compressing responses of the given
+// content types, the usual text formats by default, with the codecs of the
+// configuration; the responses to the requests for which skip returns true
+// are sent as they are
+func compression(config Compression, skip func(r *http.Request) bool, types ...string) func(next http.Handler) http.Handler {
+	compressor := middleware.NewCompressor(compressionCodecs[common.CompressionGzip].defaultLevel, types...)
+
+	// Encoders set last are preferred
+	codecs := map[string]bool{}
+	for i := len(config.Codecs) - 1; i >= 0; i-- {
+		name := config.Codecs[i]
+		codec, ok := compressionCodecs[name]
+		if !ok {
+			continue
+		}
+		compressor.SetEncoder(name, codec.encoder(config.level(name)))
+		codecs[name] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		compressed := compressor.Handler(next)
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if len(codecs) == 0 || (skip != nil && skip(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The compressor also knows deflate, only let it choose
+			// among the codecs of the configuration
+			accepted := acceptedCodecs(r.Header.Get("Accept-Encoding"), codecs)
+			if accepted == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			r = r.Clone(r.Context())
+			r.Header.Set("Accept-Encoding", accepted)
+			compressed.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// acceptedCodecs returns the codecs of an Accept-Encoding header that are
+// also in codecs, leaving out those the client refuses with q=0
+func acceptedCodecs(header string, codecs map[string]bool) string {
+	var accepted []string
+	for _, item := range strings.Split(header, ",") {
+		parts := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if !codecs[name] {
+			continue
+		}
+		refused := false
+		for _, parameter := range parts[1:] {
+			parameter = strings.ReplaceAll(strings.TrimSpace(parameter), " ", "")
+			if strings.HasPrefix(parameter, "q=") && strings.Trim(strings.TrimPrefix(parameter, "q="), "0.") == "" {
+				refused = true
+			}
+		}
+		if !refused {
+			accepted = append(accepted, name)
+		}
+	}
+
+	return strings.Join(accepted, ",")
+}
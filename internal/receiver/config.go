@@ -7,14 +7,122 @@ package receiver
 import (
 	"io/ioutil"
 	"os"
+	"sync"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+// Durability controls what is flushed to disk when publishing,
+// everything is flushed by default
+type Durability struct {
+	SyncObjects bool `yaml:"fsync_objects"`
+	SyncDirs    bool `yaml:"fsync_dirs"`
+	SyncRefs    bool `yaml:"fsync_refs"`
+}
+
+// Concurrency limits how many requests are served at the same time,
+// 0 means no limit
+type Concurrency struct {
+	Uploads   int `yaml:"uploads,omitempty"`
+	Finalizes int `yaml:"finalizes,omitempty"`
+	// Seconds clients are asked to wait before trying again
+	RetryAfter int `yaml:"retry_after,omitempty"`
+}
+
+// TLS is the certificate served when TLS is enabled
+type TLS struct {
+	Cert string `yaml:"cert,omitempty"`
+	Key  string `yaml:"key,omitempty"`
+}
+
+// SecurityHeaders are the headers added to responses, since receivers are
+// often exposed directly to the internet
+type SecurityHeaders struct {
+	// Seconds browsers should only use HTTPS, sent over TLS, 0 disables HSTS
+	HSTSMaxAge int `yaml:"hsts_max_age"`
+	// Apply HSTS to subdomains too
+	HSTSIncludeSubdomains bool `yaml:"hsts_include_subdomains,omitempty"`
+	// Headers to add or override, an empty value removes a default header
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// StagingGC controls the removal of abandoned uploads from the staging area
+type StagingGC struct {
+	// How often abandoned uploads are looked for, 0 disables the removal
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Minimum age of the files that are removed
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+}
+
 // Config represents the configuration file
 type Config struct {
-	path   string
-	Tokens []*Token `yaml:"tokens"`
+	path            string
+	jobsOnce        sync.Once
+	jobs            *jobRunner
+	Tokens          []*Token   `yaml:"tokens"`
+	FinalizeWorkers int        `yaml:"finalize_workers,omitempty"`
+	Durability      Durability `yaml:"durability"`
+	// Only promote commits with a valid signature
+	VerifySignatures bool `yaml:"verify_signatures,omitempty"`
+	// Path of the file where publishes are recorded
+	AuditLog string `yaml:"audit_log,omitempty"`
+	// Store the build metadata sent by clients in the published commits
+	CommitMetadata bool `yaml:"commit_metadata,omitempty"`
+	// Merge the metadata sent by clients into the summary
+	SummaryMetadata bool `yaml:"summary_metadata,omitempty"`
+	// Maximum size in MiB of upload requests, 0 for no limit
+	MaxRequestSize int64 `yaml:"max_request_size,omitempty"`
+	// Maximum size in MiB of an object, 0 for no limit
+	MaxObjectSize int64 `yaml:"max_object_size,omitempty"`
+	// Maximum number of objects uploaded with a request, 0 for no limit
+	MaxRequestObjects int `yaml:"max_request_objects,omitempty"`
+	// Maximum size in MiB of the objects of the commits of a push, 0 for no limit
+	MaxPushSize int64 `yaml:"max_push_size,omitempty"`
+	// Maximum number of objects of the commits of a push, 0 for no limit
+	MaxPushObjects int `yaml:"max_push_objects,omitempty"`
+	// Maximum size in MiB of the objects of each repository, 0 for no limit
+	Quota       int64       `yaml:"quota,omitempty"`
+	Concurrency Concurrency `yaml:"concurrency,omitempty"`
+	// Serve HTTPS when a certificate is set
+	TLS             TLS             `yaml:"tls,omitempty"`
+	SecurityHeaders SecurityHeaders `yaml:"security_headers"`
+	StagingGC       StagingGC       `yaml:"staging_gc,omitempty"`
+	// Time without publishes after which the summary is regenerated,
+	// 0 regenerates it after each publish
+	SummaryDelay time.Duration `yaml:"summary_delay,omitempty"`
+	CommitPolicy CommitPolicy  `yaml:"commit_policy,omitempty"`
+	// Rules that make updates of some branches harder
+	ProtectedBranches []BranchProtection `yaml:"protected_branches,omitempty"`
+	IntegrityCheck    IntegrityCheck     `yaml:"integrity_check,omitempty"`
+	ServeRepo         ServeRepo          `yaml:"serve_repo,omitempty"`
+	// Endpoints notified when branches are updated
+	UpdateHooks []UpdateHook `yaml:"update_hooks,omitempty"`
+	// Channels where publishes are announced to people
+	Notifications []Notification `yaml:"notifications,omitempty"`
+	// Rules rewriting the branches sent by clients, the first one that
+	// applies is used
+	RefMappings []RefMapping `yaml:"ref_mappings,omitempty"`
+	// Where uploaded objects are stored
+	Storage StorageConfig `yaml:"storage,omitempty"`
+	// Mirror the repository to an IPFS node after each update
+	IPFS IPFSPublish `yaml:"ipfs,omitempty"`
+	// Files written after each publish for offline mirrors
+	OfflineArtifacts OfflineArtifacts `yaml:"offline_artifacts,omitempty"`
+	// Mirror the repository of another receiver
+	Replication Replication `yaml:"replication,omitempty"`
+	// Compression of responses, gzip by default
+	Compression Compression `yaml:"compression"`
+	// Priority of the heavy jobs, such as publishes
+	BackgroundJobs BackgroundJobs `yaml:"background_jobs,omitempty"`
+	// Builders whose signed manifests are required to publish
+	SignedManifests SignedManifests `yaml:"signed_manifests,omitempty"`
+	// Decryption of the objects clients encrypt
+	Encryption Encryption `yaml:"encryption,omitempty"`
+	// User the server runs as once it bound its address
+	Privileges Privileges `yaml:"privileges,omitempty"`
+	// Confinement of the worker serving requests
+	Sandbox Sandbox `yaml:"sandbox,omitempty"`
 }
 
 // CreateConfig creates the configuration file
@@ -44,10 +152,24 @@ func OpenConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
-	var config Config
+	config := Config{
+		Durability:      Durability{SyncObjects: true, SyncDirs: true, SyncRefs: true},
+		SecurityHeaders: SecurityHeaders{HSTSMaxAge: defaultHSTSMaxAge},
+		StagingGC:       StagingGC{MaxAge: DefaultStagingMaxAge},
+		Compression:     defaultCompression,
+	}
 	if err := yaml.Unmarshal(buf, &config); err != nil {
 		return nil, err
 	}
+	if err := config.Compression.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.BackgroundJobs.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.SignedManifests.load(); err != nil {
+		return nil, err
+	}
 
 	config.path = path
 
@@ -0,0 +1,190 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+
+	"github.com/lirios/ostree-upload/internal/delta"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// blockSizeParam returns the block_size query parameter or the default block size
+func blockSizeParam(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("block_size")
+	if value == "" {
+		return delta.DefaultBlockSize, nil
+	}
+
+	blockSize, err := strconv.Atoi(value)
+	if err != nil || blockSize <= 0 {
+		return 0, fmt.Errorf("invalid block size \"%s\"", value)
+	}
+
+	return blockSize, nil
+}
+
+// SignatureHandler returns the block signatures of an object in the repository,
+// that clients use as the basis of a delta upload of a similar object
+func SignatureHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	ctx := r.Context()
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	blockSize, err := blockSizeParam(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Open the object
+	objectName := chi.URLParam(r, "objectName")
+	if err := ostree.ValidateObjectName(objectName); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, err := getStorage(repo).OpenObject(objectName)
+	if err != nil {
+		logger.Errorf("Unable to open object \"%s\": %v", objectName, err)
+		httpError(w, r, fmt.Sprintf("object %s not found", objectName), http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	signature, err := delta.ComputeSignature(file, blockSize)
+	if err != nil {
+		logger.Errorf("Failed to compute signature of \"%s\": %v", objectName, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	EncodeJSONReply(w, r, signature)
+}
+
+// DeltaUploadHandler reconstructs an object from a delta against
+// a basis object that the repository already has
+func DeltaUploadHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if !limitRequestBody(w, r) {
+		return
+	}
+
+	// Get from context
+	ctx := r.Context()
+	queue, ok := ctx.Value(KeyQueue).(*Queue)
+	if !ok {
+		logger.Error("Unable to retrieve queue object from context")
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
+		return
+	}
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+	config, ok := ctx.Value(KeyConfig).(*Config)
+	if !ok {
+		logger.Error("Unable to retrieve configuration from context")
+		httpError(w, r, "no configuration found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Get the entry from the queue
+	entry, ok := getEntry(w, r, queue)
+	if !ok {
+		return
+	}
+
+	// Deltas would show what changed
+	if entry.Encrypted {
+		httpError(w, r, "objects of encrypted pushes cannot be uploaded as deltas", http.StatusBadRequest)
+		return
+	}
+
+	blockSize, err := blockSizeParam(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Open the basis
+	objectName := chi.URLParam(r, "objectName")
+	basisName := r.URL.Query().Get("basis")
+	if err := validateObjectNames(repo, []string{objectName, basisName}); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	storage := getStorage(repo)
+	basis, err := storage.OpenObject(basisName)
+	if err != nil {
+		logger.Errorf("Unable to open basis object \"%s\": %v", basisName, err)
+		httpError(w, r, fmt.Sprintf("basis object %s not found", basisName), http.StatusNotFound)
+		return
+	}
+	defer basis.Close()
+
+	// Reconstruct the object, it's only seen in the staging area once complete
+	logger.Debugf("Receiving \"%s\" as a delta from \"%s\"...", objectName, basisName)
+	objectFile, err := storage.CreateStaged(entry.ID, objectName)
+	if err != nil {
+		logger.Errorf("Unable to create %s: %v", objectName, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer objectFile.Close()
+
+	counter := &countingWriter{w: limitObjectSize(r, objectFile)}
+	err = config.RunBackgroundJob(func() error {
+		return delta.ApplyDelta(counter, basis, blockSize, r.Body)
+	})
+	if errors.Is(err, errObjectTooLarge) {
+		logger.Errorf("Object \"%s\" is too large", objectName)
+		objectTooLarge(w, r, objectName)
+		return
+	} else if err != nil {
+		logger.Errorf("Failed to apply delta to \"%s\": %v", objectName, err)
+		httpError(w, r, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := repo.VerifyObject(objectFile.Path(), objectName); err != nil {
+		logger.Errorf("Failed to verify \"%s\": %v", objectName, err)
+		writeChecksumMismatch(w, r, objectName)
+		return
+	}
+
+	if err := objectFile.Commit(); err != nil {
+		logger.Errorf("Failed to stage \"%s\": %v", objectName, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entry.AddObjects([]string{objectName})
+	emitQueueProgress(repo, entry)
+	entry.AddReceived(counter.n)
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
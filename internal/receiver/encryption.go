@@ -0,0 +1,194 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+
+	"filippo.io/age"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Encryption lets clients encrypt the objects they upload to the receiver,
+// which only decrypts them when publishing, so that embargoed releases
+// can't be read in the staging area or by proxies terminating TLS
+type Encryption struct {
+	// Files with the age identities objects are decrypted with
+	Identities []string `yaml:"identities,omitempty"`
+	// Command printing the age identities, for keys kept in a KMS
+	IdentityCommand []string `yaml:"identity_command,omitempty"`
+	// Refuse pushes whose objects are not encrypted
+	Required bool `yaml:"required,omitempty"`
+
+	identities []age.Identity
+	recipients []string
+}
+
+// Load reads the identities, running the identity command if any; it's
+// only done by the server since the key might come from a KMS
+func (e *Encryption) Load() error {
+	e.identities = nil
+	e.recipients = nil
+
+	var sources [][]byte
+	for _, path := range e.Identities {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("cannot read the encryption identities: %v", err)
+		}
+		sources = append(sources, data)
+	}
+	if len(e.IdentityCommand) > 0 {
+		cmd := exec.Command(e.IdentityCommand[0], e.IdentityCommand[1:]...)
+		cmd.Stderr = os.Stderr
+		data, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("identity command failed: %v", err)
+		}
+		sources = append(sources, data)
+	}
+
+	for _, data := range sources {
+		identities, err := age.ParseIdentities(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("invalid encryption identities: %v", err)
+		}
+		for _, identity := range identities {
+			x25519, ok := identity.(*age.X25519Identity)
+			if !ok {
+				return errors.New("only X25519 encryption identities are supported")
+			}
+			e.identities = append(e.identities, identity)
+			e.recipients = append(e.recipients, x25519.Recipient().String())
+		}
+	}
+
+	if e.Required && !e.enabled() {
+		return errors.New("encryption is required but there are no encryption identities")
+	}
+
+	return nil
+}
+
+// enabled returns whether objects can be uploaded encrypted
+func (e *Encryption) enabled() bool {
+	return len(e.identities) > 0
+}
+
+// checkEncryption replies with an error and returns false unless the
+// objects of a new queue entry are encrypted as the configuration wants
+func checkEncryption(w http.ResponseWriter, r *http.Request, config *Config, req *common.QueueRequest) bool {
+	if req.Encrypted && !config.Encryption.enabled() {
+		httpError(w, r, "encrypted objects are not accepted", http.StatusBadRequest)
+		return false
+	}
+	if !req.Encrypted && config.Encryption.Required {
+		logger.Error("Refusing a push whose objects are not encrypted")
+		writeError(w, r, http.StatusForbidden, common.ErrorResponse{
+			Code:    common.ErrorCodeEncryptionRequired,
+			Message: "objects must be encrypted to the recipients of the server",
+		})
+		return false
+	}
+
+	return true
+}
+
+// DecryptionError is returned when an encrypted object cannot be decrypted
+// or its content doesn't match its name
+type DecryptionError struct {
+	Object string
+	Reason string
+}
+
+func (e *DecryptionError) Error() string {
+	return fmt.Sprintf("cannot decrypt %s: %s", e.Object, e.Reason)
+}
+
+// decryptObject replaces a staged object with its decrypted content and
+// verifies it
+func decryptObject(repo ostree.Repository, config *Config, entry *QueueEntry, objectName string) error {
+	storage := getStorage(repo)
+	path, err := storage.StagedPath(entry.ID, objectName)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := age.Decrypt(file, config.Encryption.identities...)
+	if err != nil {
+		return &DecryptionError{Object: objectName, Reason: err.Error()}
+	}
+	objectFile, err := storage.CreateStaged(entry.ID, objectName)
+	if err != nil {
+		return err
+	}
+	defer objectFile.Close()
+	if _, err := io.Copy(objectFile, reader); err != nil {
+		return &DecryptionError{Object: objectName, Reason: err.Error()}
+	}
+	if err := repo.VerifyObject(objectFile.Path(), objectName); err != nil {
+		return &DecryptionError{Object: objectName, Reason: err.Error()}
+	}
+
+	return objectFile.Commit()
+}
+
+// decryptEntry decrypts the objects of the entry that are still encrypted
+func decryptEntry(repo ostree.Repository, config *Config, entry *QueueEntry) error {
+	objects := entry.EncryptedObjects()
+	if len(objects) == 0 {
+		return nil
+	}
+
+	logger.WithField("queue", entry.ID).Infof("Decrypting %d objects", len(objects))
+	return config.RunBackgroundJob(func() error {
+		for _, objectName := range objects {
+			if err := decryptObject(repo, config, entry, objectName); err != nil {
+				return err
+			}
+			entry.SetDecrypted(objectName)
+		}
+		return nil
+	})
+}
+
+// checkEntryDecrypted replies with an error and returns false unless all
+// the objects of the entry could be decrypted, before anything reads them
+func checkEntryDecrypted(w http.ResponseWriter, r *http.Request, repo ostree.Repository, config *Config, entry *QueueEntry) bool {
+	err := decryptEntry(repo, config, entry)
+	if err == nil {
+		return true
+	}
+
+	var decryptionError *DecryptionError
+	if errors.As(err, &decryptionError) {
+		logger.Errorf("Refusing to publish queue entry %s: %v", entry.ID, err)
+		writeError(w, r, http.StatusUnprocessableEntity, common.ErrorResponse{
+			Code:    common.ErrorCodeChecksumMismatch,
+			Message: decryptionError.Error(),
+			Details: map[string]string{"object": decryptionError.Object},
+		})
+		return false
+	}
+
+	logger.Errorf("Cannot decrypt the objects of queue entry %s: %v", entry.ID, err)
+	httpError(w, r, err.Error(), http.StatusInternalServerError)
+	return false
+}
@@ -0,0 +1,305 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Number of events kept for the clients that reconnect
+const eventBacklog = 256
+
+// Number of events waiting to be sent to a client before it's disconnected
+// for being too slow, it catches up with the backlog when it reconnects
+const eventClientBuffer = 64
+
+// Interval of the comments that keep idle streams open through proxies
+const eventKeepAlive = 15 * time.Second
+
+// Minimum time between the progress events of a queue entry
+const eventProgressInterval = 2 * time.Second
+
+// streamedEvent is an event with its identifier in the stream
+type streamedEvent struct {
+	id    int64
+	event common.Event
+}
+
+// eventBroker sends the events of a repository to the clients following
+// them
+type eventBroker struct {
+	mutex   sync.Mutex
+	lastID  int64
+	backlog []streamedEvent
+	clients map[chan streamedEvent]bool
+	// Time of the last progress event of each queue entry
+	progress map[string]time.Time
+}
+
+// Brokers of the repositories, by path
+var (
+	eventBrokersMutex sync.Mutex
+	eventBrokers      = map[string]*eventBroker{}
+)
+
+// getEventBroker returns the broker of the events of the repository
+func getEventBroker(repo ostree.Repository) *eventBroker {
+	eventBrokersMutex.Lock()
+	defer eventBrokersMutex.Unlock()
+
+	broker, ok := eventBrokers[repo.Path()]
+	if !ok {
+		broker = &eventBroker{clients: map[chan streamedEvent]bool{}, progress: map[string]time.Time{}}
+		eventBrokers[repo.Path()] = broker
+	}
+
+	return broker
+}
+
+// publish sends the event to the clients and adds it to the backlog,
+// clients that are too slow are disconnected
+func (b *eventBroker) publish(event common.Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lastID++
+	streamed := streamedEvent{id: b.lastID, event: event}
+	b.backlog = append(b.backlog, streamed)
+	if len(b.backlog) > eventBacklog {
+		b.backlog = b.backlog[len(b.backlog)-eventBacklog:]
+	}
+
+	for client := range b.clients {
+		select {
+		case client <- streamed:
+		default:
+			delete(b.clients, client)
+			close(client)
+		}
+	}
+}
+
+// subscribe returns the channel of the events of a new client, together
+// with the events of the backlog after lastID
+func (b *eventBroker) subscribe(lastID int64) (chan streamedEvent, []streamedEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var missed []streamedEvent
+	for _, streamed := range b.backlog {
+		if streamed.id > lastID {
+			missed = append(missed, streamed)
+		}
+	}
+
+	client := make(chan streamedEvent, eventClientBuffer)
+	b.clients[client] = true
+
+	return client, missed
+}
+
+// unsubscribe stops sending events to the client
+func (b *eventBroker) unsubscribe(client chan streamedEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.clients[client] {
+		delete(b.clients, client)
+		close(client)
+	}
+}
+
+// active returns whether clients follow the events, so that events that
+// are expensive to make are skipped otherwise
+func (b *eventBroker) active() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.clients) > 0
+}
+
+// throttleProgress returns whether a progress event of the queue entry is
+// due, and records it when it is
+func (b *eventBroker) throttleProgress(queueID string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	if last, ok := b.progress[queueID]; ok && now.Sub(last) < eventProgressInterval {
+		return false
+	}
+	b.progress[queueID] = now
+
+	return true
+}
+
+// forget removes what was recorded about the queue entry
+func (b *eventBroker) forget(queueID string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.progress, queueID)
+}
+
+// emitEvent sends the event to the clients following the events of the
+// repository
+func emitEvent(repo ostree.Repository, event common.Event) {
+	event.Time = time.Now().UTC().Format(time.RFC3339)
+	getEventBroker(repo).publish(event)
+}
+
+// emitQueueEvent sends an event about the queue entry with its progress
+func emitQueueEvent(repo ostree.Repository, eventType string, entry *QueueEntry) {
+	broker := getEventBroker(repo)
+	if eventType == common.EventQueueRemoved {
+		broker.forget(entry.ID)
+		emitEvent(repo, common.Event{Type: eventType, QueueID: entry.ID, Refs: entry.UpdateRefs})
+		return
+	}
+	if !broker.active() {
+		return
+	}
+
+	progress := queueStatus(repo, entry)
+	emitEvent(repo, common.Event{Type: eventType, QueueID: entry.ID, Refs: entry.UpdateRefs, Progress: &progress})
+}
+
+// emitQueueProgress sends the progress of the queue entry, at most every
+// eventProgressInterval
+func emitQueueProgress(repo ostree.Repository, entry *QueueEntry) {
+	broker := getEventBroker(repo)
+	if broker.active() && broker.throttleProgress(entry.ID) {
+		emitQueueEvent(repo, common.EventQueueProgress, entry)
+	}
+}
+
+// eventAllowed returns whether the token allows to see the event, events
+// about branches are only seen by tokens that allow all of them
+func eventAllowed(token *Token, event common.Event) bool {
+	for branch := range event.Refs {
+		if !token.AllowsRef(branch) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeEvent writes an event in the format of server-sent events
+func writeEvent(w http.ResponseWriter, streamed streamedEvent) error {
+	data, err := json.Marshal(streamed.event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", streamed.id, streamed.event.Type, data)
+	return err
+}
+
+// EventsHandler streams the events of the update queue and the publishes
+// as server-sent events, so that clients don't have to poll; the queue
+// parameter only streams the events of an entry, and clients that reconnect
+// with the Last-Event-ID header receive the events they missed
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	ctx := r.Context()
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+	token, ok := ctx.Value(KeyToken).(*Token)
+	if !ok {
+		logger.Error("Unable to retrieve token from context")
+		httpError(w, r, "no token found", http.StatusUnprocessableEntity)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, r, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var lastID int64
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		var err error
+		if lastID, err = strconv.ParseInt(value, 10, 64); err != nil {
+			httpError(w, r, "invalid Last-Event-ID header", http.StatusBadRequest)
+			return
+		}
+	}
+	queueID := r.URL.Query().Get("queue")
+	types := map[string]bool{}
+	if value := r.URL.Query().Get("types"); value != "" {
+		for _, eventType := range strings.Split(value, ",") {
+			types[eventType] = true
+		}
+	}
+
+	broker := getEventBroker(repo)
+	client, missed := broker.subscribe(lastID)
+	defer broker.unsubscribe(client)
+
+	// Proxies such as nginx would buffer the stream otherwise
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(streamed streamedEvent) error {
+		if queueID != "" && streamed.event.QueueID != queueID {
+			return nil
+		}
+		if len(types) > 0 && !types[streamed.event.Type] {
+			return nil
+		}
+		if !eventAllowed(token, streamed.event) {
+			return nil
+		}
+		return writeEvent(w, streamed)
+	}
+
+	for _, streamed := range missed {
+		if err := send(streamed); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case streamed, ok := <-client:
+			// Too slow, the client catches up when it reconnects
+			if !ok {
+				return
+			}
+			if err := send(streamed); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -6,37 +6,53 @@ package receiver
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"mime"
 	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/chilts/sid"
 	"github.com/go-chi/chi"
 
 	"github.com/lirios/ostree-upload/internal/common"
 	"github.com/lirios/ostree-upload/internal/logger"
-	"github.com/lirios/ostree-upload/internal/ostree"
+	"github.com/lirios/ostree-upload/internal/tracing"
+	"github.com/lirios/ostree-upload/internal/version"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// False positive rate of the objects inventory
+const inventoryFalsePositiveRate = 0.01
+
+// Limits of the build metadata attached to a queue entry
+const (
+	maxMetadataEntries   = 64
+	maxMetadataValueSize = 1024
 )
 
 // InfoHandler returns repository mode and resolve all branches
 func InfoHandler(w http.ResponseWriter, r *http.Request) {
 	// Get from context
 	ctx := r.Context()
-	repo, ok := ctx.Value(KeyRepository).(*ostree.Repo)
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
 	if !ok {
 		logger.Error("Unable to retrieve repository object from context")
-		http.Error(w, "no repository found", http.StatusUnprocessableEntity)
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
 		return
 	}
 
 	// Decode request
 	err := DecodeJSONBody(w, r, nil)
 	if err != nil {
-		HandleDecodeError(w, err)
+		HandleDecodeError(w, r, err)
 		return
 	}
 
@@ -44,22 +60,103 @@ func InfoHandler(w http.ResponseWriter, r *http.Request) {
 	mode, err := repo.GetMode()
 	if err != nil {
 		logger.Errorf("Failed to get repository mode: %v", err)
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		httpError(w, r, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
 
 	// List server-side revisions
-	refs, err := repo.ListRevisions()
+	refs, err := repo.Refs()
 	if err != nil {
 		logger.Errorf("Failed to list revisions: %v", err)
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		httpError(w, r, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
 
+	// Clients see the branches with the names they give them
+	if config, token := requestMapping(r); config != nil {
+		refs = unmapRefs(config, token, refs)
+	}
+
 	object := common.InfoResponse{Mode: mode, Revs: refs}
+	if APIVersion(r) >= 2 {
+		object.Capabilities = []string{
+			common.CapabilityInventory,
+			common.CapabilityServerTraverse,
+			common.CapabilityDeltas,
+			common.CapabilityPromote,
+			common.CapabilityResume,
+			common.CapabilityWhoami,
+			common.CapabilityTus,
+			common.CapabilityHistory,
+			common.CapabilityStatus,
+			common.CapabilityPublishes,
+			common.CapabilityRollback,
+			common.CapabilityIntegrity,
+			common.CapabilityObjectsSince,
+			common.CapabilityProgress,
+			common.CapabilityReplication,
+			common.CapabilityEvents,
+			common.CapabilitySBOM,
+		}
+		if config, ok := ctx.Value(KeyConfig).(*Config); ok {
+			object.MaxRequestSize = config.MaxRequestSize * 1024 * 1024
+			object.MaxObjectSize = config.MaxObjectSize * 1024 * 1024
+			object.MaxRequestObjects = config.MaxRequestObjects
+			object.MaxPushSize = config.MaxPushSize * 1024 * 1024
+			object.MaxPushObjects = config.MaxPushObjects
+			object.CompressionCodecs = config.Compression.Codecs
+			if config.SummaryMetadata {
+				object.Capabilities = append(object.Capabilities, common.CapabilitySummaryMetadata)
+			}
+			if config.SignedManifests.enabled() {
+				object.Capabilities = append(object.Capabilities, common.CapabilitySignedManifests)
+			}
+			if config.Encryption.enabled() {
+				object.Capabilities = append(object.Capabilities, common.CapabilityEncryption)
+				object.EncryptionRecipients = config.Encryption.recipients
+			}
+		}
+		object.ChecksumAlgorithms = common.ChecksumAlgorithms
+		object.Version = version.Version
+	}
 	EncodeJSONReply(w, r, object)
 }
 
+// InventoryHandler returns a bloom filter of the objects in the repository,
+// that clients use to avoid negotiating objects that are definitely missing
+func InventoryHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	ctx := r.Context()
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Decode request
+	err := DecodeJSONBody(w, r, nil)
+	if err != nil {
+		HandleDecodeError(w, r, err)
+		return
+	}
+
+	// List objects
+	objects, err := repo.ListObjects()
+	if err != nil {
+		logger.Errorf("Failed to list objects: %v", err)
+		httpError(w, r, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	filter := common.NewBloomFilter(len(objects), inventoryFalsePositiveRate)
+	for _, objectName := range objects {
+		filter.Add(objectName)
+	}
+
+	EncodeJSONReply(w, r, filter)
+}
+
 // CreateEntryHandler creates a new queue entry ready for the upload
 func CreateEntryHandler(w http.ResponseWriter, r *http.Request) {
 	// Get from context
@@ -67,7 +164,19 @@ func CreateEntryHandler(w http.ResponseWriter, r *http.Request) {
 	queue, ok := ctx.Value(KeyQueue).(*Queue)
 	if !ok {
 		logger.Error("Unable to retrieve queue object from context")
-		http.Error(w, "no queue found", http.StatusUnprocessableEntity)
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
+		return
+	}
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+	config, ok := ctx.Value(KeyConfig).(*Config)
+	if !ok {
+		logger.Error("Unable to retrieve configuration from context")
+		httpError(w, r, "no configuration found", http.StatusUnprocessableEntity)
 		return
 	}
 
@@ -75,14 +184,59 @@ func CreateEntryHandler(w http.ResponseWriter, r *http.Request) {
 	var req common.QueueRequest
 	err := DecodeJSONBody(w, r, &req)
 	if err != nil {
-		HandleDecodeError(w, err)
+		HandleDecodeError(w, r, err)
+		return
+	}
+
+	// Branches might be stored under other names
+	if req.Refs, err = mapRequestRefs(r, req.Refs); err != nil {
+		logger.Errorf("Invalid queue request: %v", err)
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Object names and revisions end up in paths
+	if err := validateQueueRequest(repo, &req); err != nil {
+		logger.Errorf("Invalid queue request: %v", err)
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The summary is shared by all the branches of the repository
+	if len(req.SummaryMetadata) > 0 && !config.SummaryMetadata {
+		httpError(w, r, "summary metadata are not accepted", http.StatusForbidden)
+		return
+	}
+
+	// The token might only allow to push some branches
+	branches := make([]string, 0, len(req.Refs))
+	for branch := range req.Refs {
+		branches = append(branches, branch)
+	}
+	if !checkTokenAccess(w, r, common.ScopePush, branches...) {
+		return
+	}
+	if !checkBranchProtection(w, r, config, req.Confirm, branches...) {
+		return
+	}
+
+	// Refuse pushes that are obviously wrong before anything is uploaded
+	if !checkPushLimits(w, r, config, &req) {
+		return
+	}
+	if !checkQuota(w, r, repo, config) {
+		return
+	}
+	if !checkEncryption(w, r, config, &req) {
 		return
 	}
 
 	// Forbid an update of the same branches
+	busyBranch := ""
 	err = queue.Walk(func(entry *QueueEntry) error {
 		for branch := range entry.UpdateRefs {
 			if _, ok := req.Refs[branch]; ok {
+				busyBranch = branch
 				return fmt.Errorf("branch \"%s\" is already being updated", branch)
 			}
 		}
@@ -91,54 +245,175 @@ func CreateEntryHandler(w http.ResponseWriter, r *http.Request) {
 	})
 	if err != nil {
 		logger.Errorf("Failed to walk the queue: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if busyBranch != "" && APIVersion(r) >= 2 {
+			writeError(w, r, http.StatusConflict, common.ErrorResponse{
+				Code:    common.ErrorCodeBranchBusy,
+				Message: err.Error(),
+				Details: map[string]string{"branch": busyBranch},
+			})
+			return
+		}
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// New queue entry
+	// New queue entry, with API v2 the branches are always published
+	// explicitly once all objects are uploaded
 	queueID := sid.IdBase64()
-	queueEntry := &QueueEntry{ID: queueID, UpdateRefs: req.Refs, Objects: req.Objects}
+	deferPublish := req.DeferPublish || APIVersion(r) >= 2
+	queueEntry := &QueueEntry{ID: queueID, UpdateRefs: req.Refs, Objects: uniqueObjects(req.Objects), DeferPublish: deferPublish, Metadata: req.Metadata, SummaryMetadata: req.SummaryMetadata, Encrypted: req.Encrypted, Created: time.Now()}
+	if token, ok := ctx.Value(KeyToken).(*Token); ok {
+		queueEntry.Token = token.Name
+	}
+	if err := createEntryStaging(repo, queueID); err != nil {
+		logger.Errorf("Failed to create temporary directory for entry \"%s\": %v", queueID, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	if err := queue.AddEntry(queueEntry); err != nil {
 		logger.Errorf("Failed to add entry \"%s\" to the queue: %v", queueID, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		removeEntryStaging(repo, queueID)
 		return
 	}
+	emitQueueEvent(repo, common.EventQueueCreated, queueEntry)
 
 	object := common.UpdateResponse{QueueID: queueID}
-	EncodeJSONReply(w, r, object)
+	if APIVersion(r) >= 2 {
+		EncodeJSONReplyWithStatus(w, r, http.StatusCreated, object)
+	} else {
+		EncodeJSONReply(w, r, object)
+	}
 }
 
-// DeleteEntryHandler deletes the entry from the queue
-func DeleteEntryHandler(w http.ResponseWriter, r *http.Request) {
+// FindEntryHandler returns the entry updating the branch passed with the ref
+// parameter, so that clients that lost the queue ID can resume the push
+func FindEntryHandler(w http.ResponseWriter, r *http.Request) {
 	// Get from context
 	ctx := r.Context()
 	queue, ok := ctx.Value(KeyQueue).(*Queue)
 	if !ok {
 		logger.Error("Unable to retrieve queue object from context")
-		http.Error(w, "no queue found", http.StatusUnprocessableEntity)
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
 		return
 	}
 
-	// Get the entry from the queue
+	branch := r.URL.Query().Get("ref")
+	if branch == "" {
+		httpError(w, r, "missing ref parameter", http.StatusBadRequest)
+		return
+	}
+	branch = mapRequestRef(r, branch)
+
+	// Only entries the token could have created are found, otherwise it
+	// could take over the uploads of other branches
+	if !checkTokenAccess(w, r, common.ScopePush, branch) {
+		return
+	}
+	token := ctx.Value(KeyToken).(*Token)
+
+	// Look for the entry updating the branch
+	var found *QueueEntry
+	err := queue.Walk(func(entry *QueueEntry) error {
+		if _, ok := entry.UpdateRefs[branch]; !ok {
+			return nil
+		}
+		for otherBranch := range entry.UpdateRefs {
+			if !token.AllowsRef(otherBranch) {
+				return nil
+			}
+		}
+		found = entry
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("Failed to walk the queue: %v", err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if found == nil {
+		httpError(w, r, fmt.Sprintf("no queue entry is updating branch \"%s\"", branch), http.StatusNotFound)
+		return
+	}
+
+	object := common.QueueEntryResponse{QueueID: found.ID, Refs: unmapRequestRefs(r, found.UpdateRefs)}
+	EncodeJSONReply(w, r, object)
+}
+
+// getEntry returns the queue entry of the request, replying with an error
+// when it can't be found or when the token doesn't allow to push to all the
+// branches it updates, so that tokens can't act on the entries of others
+func getEntry(w http.ResponseWriter, r *http.Request, queue *Queue) (*QueueEntry, bool) {
 	queueID := chi.URLParam(r, "queueID")
 	entry, err := queue.GetEntry(queueID)
 	if err != nil {
 		logger.Errorf("Unable to retrieve queue entry: %v", err)
-		http.Error(w, fmt.Sprintf("failed to get entry from queue: %v", err), http.StatusNotFound)
-		return
+		httpError(w, r, fmt.Sprintf("failed to get entry from queue: %v", err), http.StatusNotFound)
+		return nil, false
 	}
 	if entry == nil {
 		logger.Error("Unable to find queue entry")
-		http.Error(w, "queue entry not found", http.StatusNotFound)
+		httpError(w, r, "queue entry not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	if !checkTokenAccess(w, r, common.ScopePush, entryBranches(entry)...) {
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// entryBranches returns the sorted branches updated by the entry
+func entryBranches(entry *QueueEntry) []string {
+	branches := make([]string, 0, len(entry.UpdateRefs))
+	for branch := range entry.UpdateRefs {
+		branches = append(branches, branch)
+	}
+	sort.Strings(branches)
+	return branches
+}
+
+// DeleteEntryHandler deletes the entry from the queue
+func DeleteEntryHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	ctx := r.Context()
+	queue, ok := ctx.Value(KeyQueue).(*Queue)
+	if !ok {
+		logger.Error("Unable to retrieve queue object from context")
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Get the entry from the queue
+	entry, ok := getEntry(w, r, queue)
+	if !ok {
 		return
 	}
 
 	// Delete
 	if err := queue.RemoveEntry(entry); err != nil {
-		logger.Errorf("Unable to remove entry from queue: %v")
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		logger.Errorf("Unable to remove entry from queue: %v", err)
+		httpError(w, r, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
+	emitQueueEvent(repo, common.EventQueueRemoved, entry)
+
+	// Remove uploaded objects
+	if err := removeEntryStaging(repo, entry.ID); err != nil {
+		logger.Errorf("Failed to remove temporary directory of entry %s: %v", entry.ID, err)
+	}
+
+	if APIVersion(r) >= 2 {
+		w.WriteHeader(http.StatusNoContent)
+	}
 }
 
 // ObjectsHandler reads the complete list of missing objects passed by the client
@@ -149,99 +424,211 @@ func ObjectsHandler(w http.ResponseWriter, r *http.Request) {
 	queue, ok := ctx.Value(KeyQueue).(*Queue)
 	if !ok {
 		logger.Error("Unable to retrieve queue object from context")
-		http.Error(w, "no queue found", http.StatusUnprocessableEntity)
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
 		return
 	}
-	repo, ok := ctx.Value(KeyRepository).(*ostree.Repo)
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
 	if !ok {
 		logger.Error("Unable to retrieve repository object from context")
-		http.Error(w, "no repository found", http.StatusUnprocessableEntity)
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
 		return
 	}
 
 	// Get the entry from the queue
-	queueID := chi.URLParam(r, "queueID")
-	entry, err := queue.GetEntry(queueID)
+	entry, ok := getEntry(w, r, queue)
+	if !ok {
+		return
+	}
+
+	// Decode request
+	err := DecodeJSONBody(w, r, nil)
 	if err != nil {
-		logger.Errorf("Unable to retrieve queue entry: %v", err)
-		http.Error(w, fmt.Sprintf("failed to get entry from queue: %v", err), http.StatusNotFound)
+		HandleDecodeError(w, r, err)
 		return
 	}
-	if entry == nil {
-		logger.Error("Unable to find queue entry")
-		http.Error(w, "queue entry not found", http.StatusNotFound)
+
+	// Reply with the list of missing objects we will receive from the client
+	object := common.ObjectsResponse{Objects: findMissingObjects(repo, entry, entry.GetObjects())}
+	EncodeJSONReply(w, r, object)
+}
+
+// AddObjectsHandler reads a batch of objects needed by the queue entry and
+// returns those that were not previously uploaded, allowing clients to
+// negotiate commits with more objects than a single request can hold
+func AddObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	ctx := r.Context()
+	queue, ok := ctx.Value(KeyQueue).(*Queue)
+	if !ok {
+		logger.Error("Unable to retrieve queue object from context")
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
+		return
+	}
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Get the entry from the queue
+	entry, ok := getEntry(w, r, queue)
+	if !ok {
 		return
 	}
 
 	// Decode request
-	err = DecodeJSONBody(w, r, nil)
+	var req common.ObjectsRequest
+	err := DecodeJSONBody(w, r, &req)
 	if err != nil {
-		HandleDecodeError(w, err)
+		HandleDecodeError(w, r, err)
 		return
 	}
 
-	// List of missing objects we will receive from the client
-	missingObjects := []string{}
-	for _, objectName := range entry.Objects {
-		tempPath := GetTempObjectPath(repo, objectName)
-		objectPath := repo.GetObjectPath(objectName)
-
-		if _, err := os.Stat(tempPath); os.IsNotExist(err) {
-			if _, err := os.Stat(objectPath); os.IsNotExist(err) {
-				missingObjects = append(missingObjects, objectName)
-			}
-		}
+	// Object names end up in paths
+	if err := validateObjectNames(repo, req.Objects); err != nil {
+		logger.Errorf("Invalid objects batch: %v", err)
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Reply
-	object := common.ObjectsResponse{Objects: missingObjects}
+	// Remember the objects for the publish
+	entry.AddObjects(req.Objects)
+
+	// Reply with the missing subset of this batch
+	object := common.ObjectsResponse{Objects: findMissingObjects(repo, entry, req.Objects)}
 	EncodeJSONReply(w, r, object)
 }
 
 // UploadHandler receives objects from the client
 func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	if !limitRequestBody(w, r) {
+		return
+	}
 
 	// Get from context
 	ctx := r.Context()
 	queue, ok := ctx.Value(KeyQueue).(*Queue)
 	if !ok {
 		logger.Error("Unable to retrieve queue object from context")
-		http.Error(w, "no queue found", http.StatusUnprocessableEntity)
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
 		return
 	}
-	repo, ok := ctx.Value(KeyRepository).(*ostree.Repo)
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
 	if !ok {
 		logger.Error("Unable to retrieve repository object from context")
-		http.Error(w, "no repository found", http.StatusUnprocessableEntity)
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
 		return
 	}
 
-	// Get the entry from the queue
-	queueID := chi.URLParam(r, "queueID")
-	entry, err := queue.GetEntry(queueID)
-	if err != nil {
-		logger.Errorf("Unable to retrieve queue entry: %v", err)
-		http.Error(w, fmt.Sprintf("failed to get entry from queue: %v", err), http.StatusNotFound)
+	config, ok := ctx.Value(KeyConfig).(*Config)
+	if !ok {
+		logger.Error("Unable to retrieve configuration from context")
+		httpError(w, r, "no configuration found", http.StatusUnprocessableEntity)
 		return
 	}
-	if entry == nil {
-		logger.Error("Unable to find queue entry")
-		http.Error(w, "queue entry not found", http.StatusNotFound)
+
+	// Get the entry from the queue
+	entry, ok := getEntry(w, r, queue)
+	if !ok {
 		return
 	}
 
 	var mr *multipart.Reader
+	var err error
 	var part *multipart.Part
 
 	if mr, err = r.MultipartReader(); err != nil {
 		logger.Errorf("Multipart error: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Save checksums here for later comparison
-	checksums := map[string]string{}
+	// Objects received and verified, and what was done with each object:
+	// clients that publish explicitly upload again those that failed,
+	// otherwise a failure ends the request
+	received := []string{}
+	results := []common.UploadResult{}
+	perObject := entry.DeferPublish
+
+	// Clients hash each object as they send it and send the checksum of the
+	// transfer after it, with the algorithm of the header; older clients
+	// send "<object>:<SHA-256>" to API v1
+	algorithm := r.Header.Get(common.ChecksumHeader)
+	if algorithm == "" && APIVersion(r) < 2 {
+		algorithm = common.ChecksumSHA256
+	}
+	if algorithm != "" {
+		if _, err := common.NewChecksumHash(algorithm); err != nil {
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Object received last, waiting for the checksum of its transfer
+	var pending *pendingObject
+
+	// finish verifies and stages the pending object, expectedSum is the
+	// checksum of the transfer if the client sent one; it returns false
+	// when the request ends
+	finish := func(expectedSum []byte) bool {
+		object := pending
+		pending = nil
+		defer object.file.Close()
+
+		// Detect a corrupted transfer without parsing the object
+		if expectedSum != nil && !bytes.Equal(object.hash.Sum(nil), expectedSum) {
+			logger.Errorf("Transfer of \"%s\" is corrupted: %s checksum mismatch", object.name, algorithm)
+			if !perObject {
+				writeChecksumMismatch(w, r, object.name)
+				return false
+			}
+			results = append(results, common.UploadResult{Object: object.name, Status: common.UploadStatusChecksumMismatch, Message: fmt.Sprintf("%s checksum of the transfer mismatch", algorithm)})
+			return true
+		}
+
+		// If the content doesn't match the checksum in the object name we remove
+		// the object and report the error, so that the next time the object
+		// will be uploaded again; encrypted objects are verified once decrypted
+		if !entry.Encrypted {
+			if err := repo.VerifyObject(object.file.Path(), object.name); err != nil {
+				logger.Errorf("Failed to verify \"%s\": %v", object.name, err)
+				if !perObject {
+					writeChecksumMismatch(w, r, object.name)
+					return false
+				}
+				results = append(results, common.UploadResult{Object: object.name, Status: common.UploadStatusChecksumMismatch, Message: err.Error()})
+				return true
+			}
+		}
+
+		if err := object.file.Commit(); err != nil {
+			logger.Errorf("Failed to stage \"%s\": %v", object.name, err)
+			httpError(w, r, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		if entry.Encrypted {
+			entry.AddEncrypted(object.name)
+		}
+		entry.AddObjects([]string{object.name})
+		entry.AddReceived(object.size)
+		received = append(received, object.name)
+		results = append(results, common.UploadResult{Object: object.name, Status: common.UploadStatusAccepted})
+		return true
+	}
+
+	// Objects are closed as soon as they are received, a request can
+	// upload more objects than the process can open files
+	defer func() {
+		if pending != nil {
+			pending.file.Close()
+		}
+	}()
+
+	// Each object comes with its checksum
+	maxParts := 2 * config.MaxRequestObjects
+	parts := 0
 
 	// Read all parts
 	for {
@@ -251,120 +638,401 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 				break
 			} else {
 				logger.Errorf("Error reading part: %v", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				httpError(w, r, err.Error(), http.StatusBadRequest)
 				return
 			}
 		}
 
+		parts++
+		if maxParts > 0 && parts > maxParts {
+			logger.Errorf("Upload to queue entry %s has more than %d objects", entry.ID, config.MaxRequestObjects)
+			httpError(w, r, fmt.Sprintf("requests must not upload more than %d objects", config.MaxRequestObjects), http.StatusRequestEntityTooLarge)
+			return
+		}
+
 		if part.FormName() == "file" {
+			// The previous object came without checksum
+			if pending != nil && !finish(nil) {
+				return
+			}
+
 			// Receive file
-			objectName := part.FileName()
+			objectName := partObjectName(part)
+			if err := validateObjectNames(repo, []string{objectName}); err != nil {
+				logger.Errorf("Invalid object name: %v", err)
+				httpError(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
 			logger.Debugf("Receiving \"%s\"...", objectName)
 
-			// Create the destination file
-			objectPath := GetTempObjectPath(repo, objectName)
-			if _, err := os.Stat(objectPath); os.IsExist(err) {
-				msg := fmt.Sprintf("temporary file for object \"%s\" already exist", objectName)
-				logger.Errorf("Unable to complete upload: %s")
-				http.Error(w, msg, http.StatusUnprocessableEntity)
-				return
+			// Skip the content of objects we already have
+			if perObject && len(findMissingObjects(repo, entry, []string{objectName})) == 0 {
+				if _, err := io.Copy(ioutil.Discard, part); err != nil {
+					logger.Errorf("Failed to read \"%s\": %v", objectName, err)
+					httpError(w, r, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				entry.AddObjects([]string{objectName})
+				received = append(received, objectName)
+				results = append(results, common.UploadResult{Object: objectName, Status: common.UploadStatusAlreadyPresent})
+				continue
 			}
-			objectFile, err := os.Create(objectPath)
+
+			// The object is only seen in the staging area when it's complete
+			objectFile, err := getStorage(repo).CreateStaged(entry.ID, objectName)
 			if err != nil {
 				logger.Errorf("Unable to create %s: %v", objectName, err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				httpError(w, r, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			defer objectFile.Close()
+			pending = &pendingObject{name: objectName, file: objectFile}
 
-			// Write file and calculate checksum for a verification later
-			if _, err = io.Copy(objectFile, part); err != nil {
-				logger.Errorf("Failed to copy part to \"%s\": %v", objectName, err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+			// Write file, computing the checksum of the transfer as it arrives
+			writer := limitObjectSize(r, objectFile)
+			if algorithm != "" {
+				pending.hash, _ = common.NewChecksumHash(algorithm)
+				writer = io.MultiWriter(writer, pending.hash)
 			}
-			objectFile.Close()
-			checksum, err := common.CalculateChecksum(objectPath)
-			if err != nil {
-				logger.Errorf("Failed to calculate checksum of \"%s\": %v", objectName, err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if pending.size, err = io.Copy(writer, part); errors.Is(err, errObjectTooLarge) {
+				logger.Errorf("Object \"%s\" is too large", objectName)
+				objectTooLarge(w, r, objectName)
+				return
+			} else if err != nil {
+				logger.Errorf("Failed to copy part to \"%s\": %v", objectName, err)
+				httpError(w, r, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			checksums[objectName] = checksum
 		} else if part.FormName() == "checksum" {
-			// Read checksum calculate by the client
-			value := &bytes.Buffer{}
-			if _, err = io.Copy(value, part); err != nil {
+			value, err := ioutil.ReadAll(io.LimitReader(part, 1024))
+			if err != nil {
 				logger.Errorf("Failed to read checksum: %v", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				httpError(w, r, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			args := strings.Split(value.String(), ":")
-			if len(args) != 2 {
-				logger.Error("Failed to receive checksum: bad format")
-				http.Error(w, "bad checksum format", http.StatusUnprocessableEntity)
-				return
+
+			// Objects we already had were not received
+			if pending == nil {
+				continue
 			}
-			objectName := args[0]
-			checksum := args[1]
-			if objectName == "" || checksum == "" {
-				logger.Error("Failed to receive checksum: empty object name or checksum")
-				http.Error(w, "empty object name or checksum", http.StatusUnprocessableEntity)
+			expectedSum, err := transferChecksum(string(value), pending.name, algorithm)
+			if err != nil {
+				logger.Errorf("Invalid checksum of \"%s\": %v", pending.name, err)
+				httpError(w, r, err.Error(), http.StatusBadRequest)
 				return
 			}
-
-			// If the checksum doesn't match we remove the object and report the error,
-			// so that the next time the object will be uploaded again
-			if checksums[objectName] != checksum {
-				os.Remove(GetTempObjectPath(repo, objectName))
-				logger.Errorf("Object \"%s\" has a bad checksum (%s vs %s)", objectName, checksums[objectName], checksum)
-				http.Error(w, fmt.Sprintf("bad checksum for %s", objectName), http.StatusUnprocessableEntity)
+			if !finish(expectedSum) {
 				return
 			}
 		} else {
 			logger.Errorf("Received unsupported form field %s", part.FormName())
-			http.Error(w, fmt.Sprintf("unsupported form field %s", part.FormName()), http.StatusUnprocessableEntity)
+			httpError(w, r, fmt.Sprintf("unsupported form field %s", part.FormName()), http.StatusUnprocessableEntity)
 			return
 		}
 	}
+	if pending != nil && !finish(nil) {
+		return
+	}
+	emitQueueProgress(repo, entry)
+
+	// Clients that upload objects in several requests publish explicitly,
+	// acknowledge the objects we received so they can check nothing was lost
+	if entry.DeferPublish {
+		object := common.UploadResponse{Objects: received, Results: results}
+		EncodeJSONReply(w, r, object)
+		return
+	}
 
 	// Now publish the branches
-	if err = publishBranches(repo, entry); err != nil {
-		logger.Errorf("Cannot publish branches for queue entry %s: %v", queueID, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !checkEntryDecrypted(w, r, repo, config, entry) || !checkEntryComplete(w, r, repo, entry) || !checkEntryPolicy(w, r, repo, config, entry) {
+		return
+	}
+	_, span := tracing.StartSpan(r.Context(), "finalize")
+	span.SetAttribute("queue", entry.ID)
+	err = publishBranches(repo, config, entry)
+	span.End(err)
+	if err != nil {
+		logger.Errorf("Cannot publish branches for queue entry %s: %v", entry.ID, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Remove entry
+	if err := queue.RemoveEntry(entry); err != nil {
+		logger.Errorf("Failed to delete queue entry %s: %v", entry.ID, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	emitQueueEvent(repo, common.EventQueueRemoved, entry)
+	if err := removeEntryStaging(repo, entry.ID); err != nil {
+		logger.Errorf("Failed to remove temporary directory of entry %s: %v", entry.ID, err)
+	}
+}
+
+// MissingObjectsHandler traverses the commits of the queue entry on the server
+// and returns the objects it still needs, so that clients don't have to send
+// the list of objects; clients call it after each upload until the list is empty
+func MissingObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	ctx := r.Context()
+	queue, ok := ctx.Value(KeyQueue).(*Queue)
+	if !ok {
+		logger.Error("Unable to retrieve queue object from context")
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
+		return
+	}
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Get the entry from the queue
+	entry, ok := getEntry(w, r, queue)
+	if !ok {
+		return
+	}
+
+	// Decode request
+	err := DecodeJSONBody(w, r, nil)
+	if err != nil {
+		HandleDecodeError(w, r, err)
+		return
+	}
+
+	// The staged objects can only be read once decrypted
+	if entry.Encrypted && len(entry.EncryptedObjects()) > 0 {
+		httpError(w, r, "commits of encrypted pushes cannot be traversed before they're published", http.StatusConflict)
+		return
+	}
+
+	// Traverse
+	missingObjects, err := FindNeededObjects(repo, entry)
+	if err != nil {
+		logger.Errorf("Failed to find objects needed by queue entry %s: %v", entry.ID, err)
+		httpError(w, r, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Reply
+	object := common.ObjectsResponse{Objects: missingObjects}
+	EncodeJSONReply(w, r, object)
+}
+
+// DoneHandler publishes the branches of a queue entry whose objects were
+// uploaded in several requests and removes the entry from the queue
+func DoneHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	ctx := r.Context()
+	queue, ok := ctx.Value(KeyQueue).(*Queue)
+	if !ok {
+		logger.Error("Unable to retrieve queue object from context")
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
+		return
+	}
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	config, ok := ctx.Value(KeyConfig).(*Config)
+	if !ok {
+		logger.Error("Unable to retrieve configuration from context")
+		httpError(w, r, "no configuration found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Get the entry from the queue
+	entry, ok := getEntry(w, r, queue)
+	if !ok {
+		return
+	}
+
+	// Publish the branches
+	if !checkEntryDecrypted(w, r, repo, config, entry) || !checkEntryComplete(w, r, repo, entry) || !checkEntryPolicy(w, r, repo, config, entry) {
+		return
+	}
+	_, span := tracing.StartSpan(r.Context(), "finalize")
+	span.SetAttribute("queue", entry.ID)
+	err := publishBranches(repo, config, entry)
+	span.End(err)
+	if err != nil {
+		logger.Errorf("Cannot publish branches for queue entry %s: %v", entry.ID, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	// Remove entry
 	if err := queue.RemoveEntry(entry); err != nil {
-		logger.Errorf("Failed to delete queue entry %s: %v", queueID, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Errorf("Failed to delete queue entry %s: %v", entry.ID, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	emitQueueEvent(repo, common.EventQueueRemoved, entry)
+	if err := removeEntryStaging(repo, entry.ID); err != nil {
+		logger.Errorf("Failed to remove temporary directory of entry %s: %v", entry.ID, err)
+	}
+
+	if APIVersion(r) >= 2 {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// writeChecksumMismatch reports that the content of an object doesn't match its name
+func writeChecksumMismatch(w http.ResponseWriter, r *http.Request, objectName string) {
+	writeError(w, r, http.StatusUnprocessableEntity, common.ErrorResponse{
+		Code:    common.ErrorCodeChecksumMismatch,
+		Message: fmt.Sprintf("bad checksum for %s", objectName),
+		Details: map[string]string{"object": objectName},
+	})
+}
+
+// pendingObject is an uploaded object waiting for the checksum of its
+// transfer, which clients send after it
+type pendingObject struct {
+	name string
+	file StagedWriter
+	size int64
+	hash hash.Hash
+}
+
+// transferChecksum returns the checksum of the transfer of objectName
+// hashed with algorithm, from a "<algorithm>:<hex>" checksum or the
+// "<object>:<SHA-256>" checksum of older clients; it's nil when the
+// checksum can't be checked
+func transferChecksum(value, objectName, algorithm string) ([]byte, error) {
+	if checksumAlgorithm, sum, ok := common.ParseChecksum(value); ok {
+		if checksumAlgorithm != algorithm {
+			return nil, fmt.Errorf("%s checksum sent for objects hashed with %s", checksumAlgorithm, algorithm)
+		}
+		return sum, nil
+	}
+
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("bad checksum format")
+	}
+	if parts[0] != objectName {
+		return nil, fmt.Errorf("checksum of \"%s\" sent after \"%s\"", parts[0], objectName)
+	}
+	if algorithm != common.ChecksumSHA256 {
+		return nil, nil
+	}
+	sum, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("bad checksum format")
+	}
+
+	return sum, nil
 }
 
-func publishBranches(repo *ostree.Repo, entry *QueueEntry) error {
-	logger.Infof("Queue %s: publishing %d objects", entry.ID, len(entry.Objects))
-	for _, objectName := range entry.Objects {
-		// Create path where the object will be moved to
-		objectPath := repo.GetObjectPath(objectName)
-		path := filepath.Dir(objectPath)
-		if err := os.MkdirAll(path, 0755); err != nil {
-			return fmt.Errorf("failed to create directory \"%s\" for the objects: %v", path, err)
+// partObjectName returns the file name of a part as sent by the client,
+// FileName strips the directories and would hide a malicious name
+func partObjectName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+
+	return params["filename"]
+}
+
+// validateObjectNames checks that all object names are valid and that
+// file objects are named as in a repository with the mode of repo
+func validateObjectNames(repo ostree.Repository, objectNames []string) error {
+	mode, err := repo.GetMode()
+	if err != nil {
+		return err
+	}
+
+	for _, objectName := range objectNames {
+		if err := ostree.ValidateObjectName(objectName); err != nil {
+			return err
+		}
+		if ostree.ObjectNameForMode(objectName, mode) != objectName {
+			return fmt.Errorf("object \"%s\" cannot be stored in a repository in %s mode", objectName, mode)
 		}
+	}
 
-		// Move from the temporary location to the proper path only if it wasn't previously moved
-		if _, err := os.Stat(objectPath); os.IsNotExist(err) {
-			tempPath := GetTempObjectPath(repo, objectName)
-			if err := moveFile(tempPath, objectPath); err != nil {
-				return fmt.Errorf("unable to move \"%s\" to \"%s\": %v", tempPath, objectPath, err)
+	return nil
+}
+
+// validateQueueRequest checks the object names and revisions of a queue request,
+// and whether objects can be pushed from the repository of the client
+func validateQueueRequest(repo ostree.Repository, req *common.QueueRequest) error {
+	for branch, revPair := range req.Refs {
+		if err := ostree.ValidateChecksum(revPair.Client); err != nil {
+			return fmt.Errorf("branch \"%s\": %v", branch, err)
+		}
+		if revPair.Server != "" {
+			if err := ostree.ValidateChecksum(revPair.Server); err != nil {
+				return fmt.Errorf("branch \"%s\": %v", branch, err)
 			}
 		}
 	}
 
-	// Update refs
-	if err := UpdateRefs(repo, entry.UpdateRefs); err != nil {
+	if err := validateMetadata(req.Metadata); err != nil {
+		return err
+	}
+	if len(req.SummaryMetadata) > maxMetadataEntries {
+		return fmt.Errorf("too many summary metadata entries, at most %d are allowed", maxMetadataEntries)
+	}
+	if _, err := summaryMetadataValues(req.SummaryMetadata); err != nil {
 		return err
 	}
 
+	// Older clients don't send the mode of their repository
+	if req.Mode != "" {
+		mode, err := repo.GetMode()
+		if err != nil {
+			return err
+		}
+		if err := ostree.CheckModeCompatibility(req.Mode, mode); err != nil {
+			return err
+		}
+	}
+
+	return validateObjectNames(repo, req.Objects)
+}
+
+// validateMetadata checks that build metadata is small and its keys
+// are made of letters, digits, dots, dashes and underscores
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataEntries {
+		return fmt.Errorf("too many metadata entries, at most %d are allowed", maxMetadataEntries)
+	}
+
+	for key, value := range metadata {
+		if key == "" || strings.TrimFunc(key, isMetadataKeyRune) != "" {
+			return fmt.Errorf("invalid metadata key \"%s\"", key)
+		}
+		if len(value) > maxMetadataValueSize {
+			return fmt.Errorf("value of metadata key \"%s\" is longer than %d bytes", key, maxMetadataValueSize)
+		}
+	}
+
 	return nil
 }
+
+func isMetadataKeyRune(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_'
+}
+
+// findMissingObjects returns the objects that are neither in the repository
+// nor waiting in the temporary directory of the queue entry or of another
+// entry, which shares them
+func findMissingObjects(repo ostree.Repository, entry *QueueEntry, objectNames []string) []string {
+	storage := getStorage(repo)
+	missingObjects := []string{}
+	for _, objectName := range uniqueObjects(objectNames) {
+		if staged, err := storage.HasStaged(entry.ID, objectName); err == nil && !staged {
+			if has, err := storage.HasObject(objectName); err == nil && !has && !stageShared(storage, entry, objectName) {
+				missingObjects = append(missingObjects, objectName)
+			}
+		}
+	}
+
+	return missingObjects
+}
@@ -0,0 +1,879 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/pkg/ostree/ostreetest"
+)
+
+const testToken = "secret"
+
+// testChecksum is a valid checksum of an object the tests don't store
+const testChecksum = "5ac9b8bc3a6e4c3b7c28c0e7c9f9cd6cbf7b3c6f0e2dd8d5be0e4a4d8b0e0f2a"
+
+// Object names that must never end up in a path
+var maliciousObjectNames = []struct {
+	name       string
+	objectName string
+}{
+	{"parent directory", "../" + testChecksum + ".commit"},
+	{"parent directory in checksum", testChecksum[:61] + "/../.commit"},
+	{"absolute path", "/etc/passwd"},
+	{"absolute path with type", "/" + testChecksum[1:] + ".commit"},
+	{"short checksum", testChecksum[:63] + ".commit"},
+	{"uppercase checksum", strings.ToUpper(testChecksum) + ".commit"},
+	{"non hex checksum", "g" + testChecksum[1:] + ".commit"},
+	{"no type", testChecksum},
+	{"unknown suffix", testChecksum + ".exe"},
+	{"suffix with path", testChecksum + ".commit/../x"},
+	{"NUL byte", testChecksum[:63] + "\x00.commit"},
+	{"NUL byte in suffix", testChecksum + ".commit\x00"},
+}
+
+// newTestState returns the state of a receiver with a fake repository in
+// mode, which accepts testToken
+func newTestState(t *testing.T, mode string) (*AppState, *ostreetest.FakeRepo) {
+	t.Helper()
+
+	path := t.TempDir()
+	repo, err := ostreetest.NewFakeRepo(path, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Tokens: []*Token{{Token: testToken, Name: "test"}}}
+
+	// Repositories come with their temporary directory
+	if err := os.Mkdir(filepath.Join(path, "tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateTempDirectory(repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenStorage(repo, config); err != nil {
+		t.Fatal(err)
+	}
+	queue, err := NewQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &AppState{Queue: queue, Repo: repo, Config: config}, repo
+}
+
+// serve sends the request to the router of the receiver with testToken
+func serve(appState *AppState, request *http.Request) *httptest.ResponseRecorder {
+	request.Header.Set("Authorization", "Bearer "+testToken)
+	recorder := httptest.NewRecorder()
+	router("", appState).ServeHTTP(recorder, request)
+	return recorder
+}
+
+// createEntry creates a queue entry updating branch to rev
+func createEntry(t *testing.T, appState *AppState, branch, rev string, objects []string) string {
+	t.Helper()
+
+	body, err := json.Marshal(common.QueueRequest{
+		Refs:    map[string]common.RevisionPair{branch: {Client: rev}},
+		Objects: objects,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodPost, "/api/v2/queue", bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	response := serve(appState, request)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("creating the queue entry failed with %d: %s", response.Code, response.Body.String())
+	}
+
+	var reply common.UpdateResponse
+	if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply.QueueID
+}
+
+// apiVersions are the versions of the API served by the receiver
+var apiVersions = []string{"v1", "v2"}
+
+// uploadPath returns the path objects are uploaded to with an API version
+func uploadPath(version, queueID string) string {
+	if version == "v1" {
+		return "/api/v1/queue/" + queueID
+	}
+	return "/api/v2/queue/" + queueID + "/objects"
+}
+
+// uploadRequest returns a request uploading objects to path
+func uploadRequest(t *testing.T, path string, objects map[string][]byte) *http.Request {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for objectName, content := range objects {
+		// CreateFormFile would escape the file name
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="file"; filename="`+objectName+`"`)
+		header.Set("Content-Type", "application/octet-stream")
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest(http.MethodPut, path, body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	return request
+}
+
+func TestValidateObjectNames(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		objectNames []string
+		valid       bool
+	}{
+		{"none", "archive", nil, true},
+		{"archive objects", "archive", []string{testChecksum + ".commit", testChecksum + ".filez"}, true},
+		{"bare objects", "bare", []string{testChecksum + ".dirtree", testChecksum + ".file"}, true},
+		{"uncompressed file in archive", "archive", []string{testChecksum + ".file"}, false},
+		{"compressed file in bare", "bare", []string{testChecksum + ".filez"}, false},
+		{"one invalid", "archive", []string{testChecksum + ".commit", "../" + testChecksum + ".commit"}, false},
+	}
+	for _, test := range maliciousObjectNames {
+		tests = append(tests, struct {
+			name        string
+			mode        string
+			objectNames []string
+			valid       bool
+		}{test.name, "archive", []string{test.objectName}, false})
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo, err := ostreetest.NewFakeRepo(t.TempDir(), test.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = validateObjectNames(repo, test.objectNames)
+			if test.valid && err != nil {
+				t.Errorf("validateObjectNames(%q) = %v, want no error", test.objectNames, err)
+			} else if !test.valid && err == nil {
+				t.Errorf("validateObjectNames(%q) = nil, want an error", test.objectNames)
+			}
+		})
+	}
+}
+
+func TestCreateEntryRejectsObjectNames(t *testing.T) {
+	for _, version := range apiVersions {
+		for _, test := range maliciousObjectNames {
+			t.Run(version+"/"+test.name, func(t *testing.T) {
+				appState, _ := newTestState(t, "archive")
+
+				body, err := json.Marshal(common.QueueRequest{
+					Refs:    map[string]common.RevisionPair{"main": {Client: testChecksum}},
+					Objects: []string{test.objectName},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				request := httptest.NewRequest(http.MethodPost, "/api/"+version+"/queue", bytes.NewReader(body))
+				request.Header.Set("Content-Type", "application/json")
+				if response := serve(appState, request); response.Code != http.StatusBadRequest {
+					t.Errorf("creating an entry with %q replied %d, want %d", test.objectName, response.Code, http.StatusBadRequest)
+				}
+			})
+		}
+	}
+}
+
+func TestNegotiateRejectsObjectNames(t *testing.T) {
+	for _, version := range apiVersions {
+		for _, test := range maliciousObjectNames {
+			t.Run(version+"/"+test.name, func(t *testing.T) {
+				appState, _ := newTestState(t, "archive")
+				queueID := createEntry(t, appState, "main", testChecksum, nil)
+
+				body, err := json.Marshal(common.ObjectsRequest{Objects: []string{test.objectName}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				request := httptest.NewRequest(http.MethodPost, "/api/"+version+"/queue/"+queueID+"/objects", bytes.NewReader(body))
+				request.Header.Set("Content-Type", "application/json")
+				if response := serve(appState, request); response.Code != http.StatusBadRequest {
+					t.Errorf("negotiating %q replied %d, want %d: %s", test.objectName, response.Code, http.StatusBadRequest, response.Body.String())
+				}
+
+				entry, err := appState.Queue.GetEntry(queueID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if objects := entry.GetObjects(); len(objects) > 0 {
+					t.Errorf("negotiating %q added %q to the entry", test.objectName, objects)
+				}
+			})
+		}
+	}
+}
+
+func TestUploadRejectsObjectNames(t *testing.T) {
+	for _, version := range apiVersions {
+		for _, test := range maliciousObjectNames {
+			t.Run(version+"/"+test.name, func(t *testing.T) {
+				appState, repo := newTestState(t, "archive")
+				queueID := createEntry(t, appState, "main", testChecksum, nil)
+
+				request := uploadRequest(t, uploadPath(version, queueID), map[string][]byte{test.objectName: []byte("content")})
+				if response := serve(appState, request); response.Code != http.StatusBadRequest {
+					t.Errorf("uploading %q replied %d, want %d: %s", test.objectName, response.Code, http.StatusBadRequest, response.Body.String())
+				}
+
+				if objects, err := repo.ListObjects(); err != nil {
+					t.Fatal(err)
+				} else if len(objects) > 0 {
+					t.Errorf("uploading %q stored %q", test.objectName, objects)
+				}
+			})
+		}
+	}
+}
+
+// Object names in paths are refused whether or not they're escaped, or
+// never reach the handler when the router cleans the path
+func TestObjectPathsRejectObjectNames(t *testing.T) {
+	for _, version := range apiVersions {
+		for _, test := range maliciousObjectNames {
+			t.Run(version+"/"+test.name, func(t *testing.T) {
+				appState, repo := newTestState(t, "archive")
+				queueID := createEntry(t, appState, "main", testChecksum, nil)
+
+				escaped := url.PathEscape(test.objectName)
+				requests := map[string]*http.Request{
+					"signature": httptest.NewRequest(http.MethodGet, "/api/"+version+"/objects/"+escaped+"/signature", nil),
+					"delta":     httptest.NewRequest(http.MethodPut, "/api/"+version+"/queue/"+queueID+"/delta/"+escaped+"?basis="+testChecksum+".filez", strings.NewReader("delta")),
+					"basis":     httptest.NewRequest(http.MethodPut, "/api/"+version+"/queue/"+queueID+"/delta/"+testChecksum+".filez?basis="+url.QueryEscape(test.objectName), strings.NewReader("delta")),
+				}
+				if version == "v2" {
+					requests["tus offset"] = httptest.NewRequest(http.MethodHead, "/api/v2/queue/"+queueID+"/uploads/"+escaped, nil)
+					requests["tus patch"] = httptest.NewRequest(http.MethodPatch, "/api/v2/queue/"+queueID+"/uploads/"+escaped, strings.NewReader("content"))
+				}
+				for name, request := range requests {
+					request.Header.Set("Tus-Resumable", tusVersion)
+					request.Header.Set("Upload-Offset", "0")
+					request.Header.Set("Content-Type", "application/offset+octet-stream")
+					if response := serve(appState, request); response.Code < 400 || response.Code >= 500 {
+						t.Errorf("%s of %q replied %d, want a client error: %s", name, test.objectName, response.Code, response.Body.String())
+					}
+				}
+
+				if objects, err := repo.ListObjects(); err != nil {
+					t.Fatal(err)
+				} else if len(objects) > 0 {
+					t.Errorf("requests with %q stored %q", test.objectName, objects)
+				}
+			})
+		}
+	}
+}
+
+// Objects referenced by uploaded objects are not looked up when their
+// names are invalid, the server would otherwise probe arbitrary paths
+func TestMissingRejectsObjectNames(t *testing.T) {
+	for _, version := range apiVersions {
+		for _, test := range maliciousObjectNames {
+			t.Run(version+"/"+test.name, func(t *testing.T) {
+				appState, repo := newTestState(t, "archive")
+				commit := newTestCommit("", "hello")
+				commit.describe(repo)
+				commitName := commit.rev + ".commit"
+				repo.SetChildren(commitName, []string{test.objectName})
+
+				queueID := createEntry(t, appState, "main", commit.rev, nil)
+				upload(t, appState, queueID, map[string][]byte{commitName: commit.objects[commitName]})
+
+				response := serve(appState, httptest.NewRequest(http.MethodGet, "/api/"+version+"/queue/"+queueID+"/missing", nil))
+				if response.Code == http.StatusOK {
+					t.Errorf("finding the objects missing from a commit referencing %q replied %d: %s", test.objectName, response.Code, response.Body.String())
+				}
+
+				entry, err := appState.Queue.GetEntry(queueID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, objectName := range entry.GetObjects() {
+					if objectName == test.objectName {
+						t.Errorf("finding missing objects added %q to the entry", test.objectName)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestTusCreateRejectsObjectNames(t *testing.T) {
+	for _, test := range maliciousObjectNames {
+		t.Run(test.name, func(t *testing.T) {
+			appState, _ := newTestState(t, "archive")
+			queueID := createEntry(t, appState, "main", testChecksum, nil)
+
+			request := httptest.NewRequest(http.MethodPost, "/api/v2/queue/"+queueID+"/uploads", nil)
+			request.Header.Set("Tus-Resumable", tusVersion)
+			request.Header.Set("Upload-Length", "7")
+			request.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(test.objectName)))
+			response := serve(appState, request)
+			if response.Code != http.StatusBadRequest {
+				t.Errorf("creating the upload of %q replied %d, want %d", test.objectName, response.Code, http.StatusBadRequest)
+			}
+			if location := response.Header().Get("Location"); location != "" {
+				t.Errorf("creating the upload of %q returned location %s", test.objectName, location)
+			}
+		})
+	}
+}
+
+func TestTusPatchRejectsUnknownUploads(t *testing.T) {
+	appState, _ := newTestState(t, "archive")
+	queueID := createEntry(t, appState, "main", testChecksum, nil)
+
+	// Uploads are only found once created with a valid name
+	for _, objectName := range []string{"..", "..%2F..%2Fconfig", "%2Fetc%2Fpasswd"} {
+		request := httptest.NewRequest(http.MethodPatch, "/api/v2/queue/"+queueID+"/uploads/"+objectName, strings.NewReader("content"))
+		request.Header.Set("Tus-Resumable", tusVersion)
+		request.Header.Set("Upload-Offset", "0")
+		request.Header.Set("Content-Type", "application/offset+octet-stream")
+		response := serve(appState, request)
+		if response.Code < 400 {
+			t.Errorf("patching upload %s replied %d, want an error", objectName, response.Code)
+		}
+		io.Copy(io.Discard, response.Body)
+	}
+}
+
+// testCommit is a commit with a single file, and the objects a client uploads
+type testCommit struct {
+	rev      string
+	objects  map[string][]byte
+	commit   ostreetest.Commit
+	children map[string][]string
+}
+
+// newTestCommit returns a commit of parent with a file with the content
+func newTestCommit(parent, content string) *testCommit {
+	file := ostreetest.ObjectName([]byte(content), "filez")
+	dirmeta := ostreetest.ObjectName([]byte("dirmeta"), "dirmeta")
+	dirtree := ostreetest.ObjectName([]byte("dirtree "+file), "dirtree")
+	commitContent := []byte("commit " + parent + " " + dirtree)
+	commit := ostreetest.ObjectName(commitContent, "commit")
+	rev := strings.TrimSuffix(commit, ".commit")
+
+	return &testCommit{
+		rev: rev,
+		objects: map[string][]byte{
+			file:    []byte(content),
+			dirmeta: []byte("dirmeta"),
+			dirtree: []byte("dirtree " + file),
+			commit:  commitContent,
+		},
+		commit: ostreetest.Commit{
+			Parent:  parent,
+			Subject: "Add " + content,
+			Objects: []string{dirtree, dirmeta, file},
+			Files:   map[string]string{"/file": file},
+		},
+		children: map[string][]string{
+			commit:  {dirtree, dirmeta},
+			dirtree: {file},
+		},
+	}
+}
+
+// objectNames returns the names of the objects of the commit
+func (c *testCommit) objectNames() []string {
+	objectNames := []string{}
+	for objectName := range c.objects {
+		objectNames = append(objectNames, objectName)
+	}
+	sort.Strings(objectNames)
+	return objectNames
+}
+
+// describe lets repo read the commit once its objects are uploaded, the
+// fake keeps commits and the children of objects in memory
+func (c *testCommit) describe(repo *ostreetest.FakeRepo) {
+	repo.AddCommit(c.rev, c.commit)
+	for objectName, children := range c.children {
+		repo.SetChildren(objectName, children)
+	}
+}
+
+// missingObjects returns the objects the receiver needs for a queue entry
+func missingObjects(t *testing.T, appState *AppState, queueID string) []string {
+	t.Helper()
+
+	response := serve(appState, httptest.NewRequest(http.MethodGet, "/api/v2/queue/"+queueID+"/missing", nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("finding missing objects failed with %d: %s", response.Code, response.Body.String())
+	}
+	var reply common.ObjectsResponse
+	if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(reply.Objects)
+	return reply.Objects
+}
+
+// negotiate sends object names to a queue entry and returns those that the
+// receiver needs
+func negotiate(t *testing.T, appState *AppState, queueID string, objectNames []string) []string {
+	t.Helper()
+
+	body, err := json.Marshal(common.ObjectsRequest{Objects: objectNames})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodPost, "/api/v2/queue/"+queueID+"/objects", bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	response := serve(appState, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("negotiating objects failed with %d: %s", response.Code, response.Body.String())
+	}
+	var reply common.ObjectsResponse
+	if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(reply.Objects)
+	return reply.Objects
+}
+
+// publish publishes the branches of a queue entry
+func publish(appState *AppState, queueID string) *httptest.ResponseRecorder {
+	return serve(appState, httptest.NewRequest(http.MethodPost, "/api/v2/queue/"+queueID+"/commit", nil))
+}
+
+// upload uploads objects to a queue entry and returns the result of each
+func upload(t *testing.T, appState *AppState, queueID string, objects map[string][]byte) map[string]string {
+	t.Helper()
+
+	response := serve(appState, uploadRequest(t, uploadPath("v2", queueID), objects))
+	if response.Code != http.StatusOK {
+		t.Fatalf("uploading failed with %d: %s", response.Code, response.Body.String())
+	}
+	var reply common.UploadResponse
+	if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	results := map[string]string{}
+	for _, result := range reply.Results {
+		results[result.Object] = result.Status
+	}
+	return results
+}
+
+func TestPush(t *testing.T) {
+	appState, repo := newTestState(t, "archive")
+	commit := newTestCommit("", "hello")
+	commit.describe(repo)
+
+	queueID := createEntry(t, appState, "main", commit.rev, nil)
+	if missing := negotiate(t, appState, queueID, commit.objectNames()); !reflect.DeepEqual(missing, commit.objectNames()) {
+		t.Fatalf("missing objects are %q, want %q", missing, commit.objectNames())
+	}
+
+	results := upload(t, appState, queueID, commit.objects)
+	for _, objectName := range commit.objectNames() {
+		if results[objectName] != common.UploadStatusAccepted {
+			t.Errorf("uploading %s returned %q, want %q", objectName, results[objectName], common.UploadStatusAccepted)
+		}
+	}
+	if missing := negotiate(t, appState, queueID, commit.objectNames()); len(missing) > 0 {
+		t.Fatalf("objects %q are still missing after uploading them", missing)
+	}
+
+	if response := publish(appState, queueID); response.Code != http.StatusNoContent {
+		t.Fatalf("publishing replied %d: %s", response.Code, response.Body.String())
+	}
+
+	refs, err := repo.Refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs["main"] != commit.rev {
+		t.Errorf("branch main points to %q, want %s", refs["main"], commit.rev)
+	}
+	objects, err := repo.ListObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(objects, commit.objectNames()) {
+		t.Errorf("repository has objects %q, want %q", objects, commit.objectNames())
+	}
+	if _, err := appState.Queue.GetEntry(queueID); err == nil {
+		t.Errorf("queue entry %s is still there after publishing", queueID)
+	}
+}
+
+func TestPushServerTraverse(t *testing.T) {
+	appState, repo := newTestState(t, "archive")
+	commit := newTestCommit("", "hello")
+	commit.describe(repo)
+	queueID := createEntry(t, appState, "main", commit.rev, nil)
+
+	// The receiver finds the children of the metadata objects once
+	// they are uploaded
+	file := commit.commit.Files["/file"]
+	steps := [][]string{
+		{commit.rev + ".commit"},
+		commit.children[commit.rev+".commit"],
+		{file},
+	}
+	for _, expected := range steps {
+		expected = append([]string{}, expected...)
+		sort.Strings(expected)
+		missing := missingObjects(t, appState, queueID)
+		if !reflect.DeepEqual(missing, expected) {
+			t.Fatalf("missing objects are %q, want %q", missing, expected)
+		}
+
+		objects := map[string][]byte{}
+		for _, objectName := range missing {
+			objects[objectName] = commit.objects[objectName]
+		}
+		upload(t, appState, queueID, objects)
+	}
+	if missing := missingObjects(t, appState, queueID); len(missing) > 0 {
+		t.Fatalf("objects %q are still missing after uploading them", missing)
+	}
+
+	if response := publish(appState, queueID); response.Code != http.StatusNoContent {
+		t.Fatalf("publishing replied %d: %s", response.Code, response.Body.String())
+	}
+	if refs, _ := repo.Refs(); refs["main"] != commit.rev {
+		t.Errorf("branch main points to %q, want %s", refs["main"], commit.rev)
+	}
+}
+
+func TestPushOnlyMissingObjects(t *testing.T) {
+	appState, repo := newTestState(t, "archive")
+	parent := newTestCommit("", "hello")
+	parent.describe(repo)
+	for objectName, content := range parent.objects {
+		objectPath := repo.GetObjectPath(objectName)
+		if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(objectPath, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo.SetRefImmediate("", "main", parent.rev)
+
+	// The new commit shares the file and the dirmeta with its parent
+	commit := newTestCommit(parent.rev, "hello")
+	commit.describe(repo)
+	queueID := createEntry(t, appState, "main", commit.rev, nil)
+
+	expected := []string{}
+	for _, objectName := range commit.objectNames() {
+		if _, ok := parent.objects[objectName]; !ok {
+			expected = append(expected, objectName)
+		}
+	}
+	if missing := negotiate(t, appState, queueID, commit.objectNames()); !reflect.DeepEqual(missing, expected) {
+		t.Errorf("missing objects are %q, want %q", missing, expected)
+	}
+}
+
+func TestUploadChecksumMismatch(t *testing.T) {
+	appState, repo := newTestState(t, "archive")
+	commit := newTestCommit("", "hello")
+	commit.describe(repo)
+	queueID := createEntry(t, appState, "main", commit.rev, nil)
+
+	file := commit.commit.Files["/file"]
+	results := upload(t, appState, queueID, map[string][]byte{file: []byte("tampered")})
+	if results[file] != common.UploadStatusChecksumMismatch {
+		t.Errorf("uploading tampered %s returned %q, want %q", file, results[file], common.UploadStatusChecksumMismatch)
+	}
+	if missing := negotiate(t, appState, queueID, []string{file}); !reflect.DeepEqual(missing, []string{file}) {
+		t.Errorf("missing objects are %q after a bad upload, want %q", missing, []string{file})
+	}
+}
+
+// legacyUpload uploads objects to a queue entry created with API v1, sending
+// "<object>:<SHA-256>" after each object as released clients do;
+// checksums overrides the checksum of some objects
+func legacyUpload(t *testing.T, appState *AppState, commit *testCommit, checksums map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := json.Marshal(common.QueueRequest{
+		Refs: map[string]common.RevisionPair{"main": {Client: commit.rev}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/queue", bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	// API v1 replies 200 to new queue entries
+	response := serve(appState, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("creating the queue entry failed with %d: %s", response.Code, response.Body.String())
+	}
+	var reply common.UpdateResponse
+	if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+
+	uploadBody := &bytes.Buffer{}
+	writer := multipart.NewWriter(uploadBody)
+	for _, objectName := range commit.objectNames() {
+		content := commit.objects[objectName]
+		part, err := writer.CreateFormFile("file", objectName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		checksum, ok := checksums[objectName]
+		if !ok {
+			sum := sha256.Sum256(content)
+			checksum = hex.EncodeToString(sum[:])
+		}
+		if err := writer.WriteField("checksum", objectName+":"+checksum); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	request = httptest.NewRequest(http.MethodPut, "/api/v1/queue/"+reply.QueueID, uploadBody)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	return serve(appState, request)
+}
+
+func TestLegacyUpload(t *testing.T) {
+	appState, repo := newTestState(t, "archive")
+	commit := newTestCommit("", "hello")
+	commit.describe(repo)
+
+	if response := legacyUpload(t, appState, commit, nil); response.Code != http.StatusOK {
+		t.Fatalf("legacy upload replied %d: %s", response.Code, response.Body.String())
+	}
+	refs, err := repo.Refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs["main"] != commit.rev {
+		t.Errorf("branch main points to %q, want %s", refs["main"], commit.rev)
+	}
+}
+
+func TestLegacyUploadChecksumMismatch(t *testing.T) {
+	appState, repo := newTestState(t, "archive")
+	commit := newTestCommit("", "hello")
+	commit.describe(repo)
+
+	// The transfer of the last object is corrupted
+	objectNames := commit.objectNames()
+	response := legacyUpload(t, appState, commit, map[string]string{objectNames[len(objectNames)-1]: testChecksum})
+	if response.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("legacy upload with a bad checksum replied %d, want %d: %s", response.Code, http.StatusUnprocessableEntity, response.Body.String())
+	}
+	if refs, _ := repo.Refs(); refs["main"] != "" {
+		t.Errorf("branch main was updated to %s by a corrupted upload", refs["main"])
+	}
+}
+
+func TestPublishIncompleteEntry(t *testing.T) {
+	appState, repo := newTestState(t, "archive")
+	commit := newTestCommit("", "hello")
+	commit.describe(repo)
+	queueID := createEntry(t, appState, "main", commit.rev, nil)
+
+	// Everything but the file
+	objects := map[string][]byte{}
+	for objectName, content := range commit.objects {
+		if objectName != commit.commit.Files["/file"] {
+			objects[objectName] = content
+		}
+	}
+	upload(t, appState, queueID, objects)
+
+	if response := publish(appState, queueID); response.Code != http.StatusConflict {
+		t.Fatalf("publishing an incomplete entry replied %d, want %d: %s", response.Code, http.StatusConflict, response.Body.String())
+	}
+	if refs, _ := repo.Refs(); refs["main"] != "" {
+		t.Errorf("branch main was updated to %s by an incomplete entry", refs["main"])
+	}
+}
+
+func TestCreateEntryBranchBusy(t *testing.T) {
+	appState, _ := newTestState(t, "archive")
+	createEntry(t, appState, "main", testChecksum, nil)
+
+	body, err := json.Marshal(common.QueueRequest{Refs: map[string]common.RevisionPair{"main": {Client: testChecksum}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodPost, "/api/v2/queue", bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	response := serve(appState, request)
+	if response.Code != http.StatusConflict {
+		t.Fatalf("updating a busy branch replied %d, want %d", response.Code, http.StatusConflict)
+	}
+	var reply common.ErrorResponse
+	if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Code != common.ErrorCodeBranchBusy {
+		t.Errorf("updating a busy branch returned error %q, want %q", reply.Code, common.ErrorCodeBranchBusy)
+	}
+}
+
+func TestDeleteEntry(t *testing.T) {
+	appState, repo := newTestState(t, "archive")
+	queueID := createEntry(t, appState, "main", testChecksum, nil)
+
+	response := serve(appState, httptest.NewRequest(http.MethodDelete, "/api/v2/queue/"+queueID, nil))
+	if response.Code >= 300 {
+		t.Fatalf("deleting the queue entry replied %d: %s", response.Code, response.Body.String())
+	}
+	if _, err := appState.Queue.GetEntry(queueID); err == nil {
+		t.Errorf("queue entry %s is still there after deleting it", queueID)
+	}
+	if _, err := os.Stat(GetEntryTempDirectory(repo, queueID)); !os.IsNotExist(err) {
+		t.Errorf("temporary directory of queue entry %s was not removed: %v", queueID, err)
+	}
+}
+
+func TestTokenRefs(t *testing.T) {
+	appState, _ := newTestState(t, "archive")
+	appState.Config.Tokens[0].Refs = []string{"stable/*"}
+
+	tests := []struct {
+		branch string
+		status int
+	}{
+		{"stable/x86_64", http.StatusCreated},
+		{"main", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		body, err := json.Marshal(common.QueueRequest{Refs: map[string]common.RevisionPair{test.branch: {Client: testChecksum}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := httptest.NewRequest(http.MethodPost, "/api/v2/queue", bytes.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		if response := serve(appState, request); response.Code != test.status {
+			t.Errorf("updating branch %s replied %d, want %d", test.branch, response.Code, test.status)
+		}
+	}
+}
+
+// whoami returns the description of testToken
+func whoami(t *testing.T, appState *AppState) common.WhoamiResponse {
+	t.Helper()
+
+	response := serve(appState, httptest.NewRequest(http.MethodGet, "/api/v2/whoami", nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("whoami failed with %d: %s", response.Code, response.Body.String())
+	}
+	var reply common.WhoamiResponse
+	if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestWhoamiQuota(t *testing.T) {
+	appState, repo := newTestState(t, "archive")
+	if reply := whoami(t, appState); reply.QuotaLimit != 0 || reply.QuotaUsed != 0 {
+		t.Errorf("whoami without quota replied %d of %d bytes", reply.QuotaUsed, reply.QuotaLimit)
+	}
+
+	appState.Config.Quota = 1
+	content := bytes.Repeat([]byte("x"), 512*1024)
+	if _, err := repo.AddObject(content, "filez"); err != nil {
+		t.Fatal(err)
+	}
+	reply := whoami(t, appState)
+	if reply.QuotaLimit != 1024*1024 || reply.QuotaUsed != int64(len(content)) {
+		t.Errorf("whoami replied %d of %d bytes, want %d of %d", reply.QuotaUsed, reply.QuotaLimit, len(content), 1024*1024)
+	}
+	createEntry(t, appState, "main", testChecksum, nil)
+
+	// Pushes are refused once the quota is used
+	if _, err := repo.AddObject(append(content, 'y'), "filez"); err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(common.QueueRequest{Refs: map[string]common.RevisionPair{"stable": {Client: testChecksum}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodPost, "/api/v2/queue", bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	if response := serve(appState, request); response.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("pushing over the quota replied %d, want %d: %s", response.Code, http.StatusRequestEntityTooLarge, response.Body.String())
+	}
+}
+
+func TestWrongToken(t *testing.T) {
+	appState, _ := newTestState(t, "archive")
+
+	// Prefixes and extensions of the token are not the token
+	for _, token := range []string{testToken[:len(testToken)-1], testToken + "x", ""} {
+		request := httptest.NewRequest(http.MethodGet, "/api/v2/whoami", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		router("", appState).ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("token %q replied %d, want %d", token, recorder.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	appState, _ := newTestState(t, "archive")
+
+	for _, token := range []string{"", "wrong"} {
+		request := httptest.NewRequest(http.MethodGet, "/api/v2/info", nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		router("", appState).ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("request with token %q replied %d, want %d", token, recorder.Code, http.StatusUnauthorized)
+		}
+	}
+}
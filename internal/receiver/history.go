@@ -0,0 +1,83 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Maximum number of commits returned by HistoryHandler
+const maxHistoryLength = 1000
+
+// HistoryHandler returns the commits of a branch from the newest, as far
+// as the repository has them
+func HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	repo, ok := r.Context().Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	branch := r.URL.Query().Get("ref")
+	if branch == "" {
+		httpError(w, r, "missing ref parameter", http.StatusBadRequest)
+		return
+	}
+	branch = mapRequestRef(r, branch)
+	if err := ostree.ValidateRef(branch); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := maxHistoryLength
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			httpError(w, r, fmt.Sprintf("invalid limit \"%s\"", value), http.StatusBadRequest)
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	refs, err := repo.Refs()
+	if err != nil {
+		logger.Errorf("Failed to list revisions: %v", err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rev, ok := refs[branch]
+	if !ok {
+		httpError(w, r, fmt.Sprintf("branch \"%s\" not found", branch), http.StatusNotFound)
+		return
+	}
+
+	commits, err := ostree.History(repo, rev, limit)
+	if err != nil {
+		logger.Errorf("Failed to read the history of \"%s\": %v", branch, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	object := common.HistoryResponse{Branch: branch, Commits: make([]common.CommitResponse, 0, len(commits))}
+	for _, commit := range commits {
+		object.Commits = append(object.Commits, common.CommitResponse{
+			Rev:       commit.Rev,
+			Parent:    commit.Parent,
+			Subject:   commit.Subject,
+			Timestamp: commit.Timestamp.UTC().Format(time.RFC3339),
+		})
+	}
+	EncodeJSONReply(w, r, object)
+}
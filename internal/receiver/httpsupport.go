@@ -13,6 +13,7 @@ import (
 	"strings"
 
 	"github.com/golang/gddo/httputil/header"
+	"github.com/lirios/ostree-upload/internal/common"
 	"github.com/lirios/ostree-upload/internal/logger"
 )
 
@@ -34,6 +35,125 @@ func HTTPError(w http.ResponseWriter, code int) {
 	http.Error(w, http.StatusText(code), code)
 }
 
+// APIVersion returns the version of the API called by the request
+func APIVersion(r *http.Request) int {
+	if version, ok := r.Context().Value(KeyAPIVersion).(int); ok {
+		return version
+	}
+	return 1
+}
+
+// errorCodeForStatus returns the error code reported for an HTTP status
+// when there isn't a more specific one
+func errorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnsupportedMediaType, http.StatusRequestEntityTooLarge:
+		return common.ErrorCodeBadRequest
+	case http.StatusUnauthorized:
+		return common.ErrorCodeUnauthorized
+	case http.StatusForbidden:
+		return common.ErrorCodeForbidden
+	case http.StatusNotFound:
+		return common.ErrorCodeNotFound
+	case http.StatusConflict:
+		return common.ErrorCodeBranchBusy
+	case http.StatusUnprocessableEntity:
+		return common.ErrorCodeUnprocessable
+	case http.StatusServiceUnavailable:
+		return common.ErrorCodeServerBusy
+	}
+
+	return common.ErrorCodeInternal
+}
+
+// limitRequestBody enforces the maximum size of upload requests from the
+// configuration, it replies with an error and returns false when the
+// request is known to be too large
+func limitRequestBody(w http.ResponseWriter, r *http.Request) bool {
+	config, ok := r.Context().Value(KeyConfig).(*Config)
+	if !ok || config.MaxRequestSize <= 0 {
+		return true
+	}
+
+	maxSize := config.MaxRequestSize * 1024 * 1024
+	if r.ContentLength > maxSize {
+		httpError(w, r, fmt.Sprintf("request body must not be larger than %d MiB", config.MaxRequestSize), http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	return true
+}
+
+// errObjectTooLarge is returned when writing more than the maximum object size
+var errObjectTooLarge = errors.New("object is too large")
+
+// limitedWriter fails with errObjectTooLarge instead of writing more than n bytes
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, errObjectTooLarge
+	}
+	n, err := l.w.Write(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// limitObjectSize returns a writer that enforces the maximum object size
+// from the configuration, so that a client can't fill the disk with a
+// single object or with a delta that expands indefinitely
+func limitObjectSize(r *http.Request, w io.Writer) io.Writer {
+	config, ok := r.Context().Value(KeyConfig).(*Config)
+	if !ok || config.MaxObjectSize <= 0 {
+		return w
+	}
+
+	return &limitedWriter{w: w, n: config.MaxObjectSize * 1024 * 1024}
+}
+
+// objectTooLarge replies that an object is larger than the maximum object size
+func objectTooLarge(w http.ResponseWriter, r *http.Request, objectName string) {
+	config, _ := r.Context().Value(KeyConfig).(*Config)
+	writeError(w, r, http.StatusRequestEntityTooLarge, common.ErrorResponse{
+		Code:    common.ErrorCodeBadRequest,
+		Message: fmt.Sprintf("object %s must not be larger than %d MiB", objectName, config.MaxObjectSize),
+		Details: map[string]string{"object": objectName},
+	})
+}
+
+// httpError sends an error back to the client, as plain text with API v1
+// and as a JSON object from API v2 onwards
+func httpError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	writeError(w, r, status, common.ErrorResponse{Code: errorCodeForStatus(status), Message: message})
+}
+
+// writeError sends an error with a specific code and details back to the client,
+// API v1 clients only receive the message
+func writeError(w http.ResponseWriter, r *http.Request, status int, errorResponse common.ErrorResponse) {
+	if APIVersion(r) < 2 {
+		http.Error(w, errorResponse.Message, status)
+		return
+	}
+
+	js, err := json.Marshal(errorResponse)
+	if err != nil {
+		http.Error(w, errorResponse.Message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// Maximum size of JSON request bodies
+const maxJSONBodySize = 10 * 1024 * 1024
+
 // DecodeJSONBody decodes the body and returns an error or nil if it succeeds
 func DecodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 	// If the Content-Type header is present, check that it has the value application/json
@@ -47,7 +167,7 @@ func DecodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) err
 
 	// Enforce a maximum read from the response body: a body larger
 	// than that will now result in Decode() returning a "http: request body too large" error
-	r.Body = http.MaxBytesReader(w, r.Body, 10*1024*1024)
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBodySize)
 	defer r.Body.Close()
 
 	// Decode the request and return an error for unknown fields
@@ -108,23 +228,29 @@ func DecodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) err
 
 // EncodeJSONReply encodes a JSON reply
 func EncodeJSONReply(w http.ResponseWriter, r *http.Request, object interface{}) {
+	EncodeJSONReplyWithStatus(w, r, http.StatusOK, object)
+}
+
+// EncodeJSONReplyWithStatus encodes a JSON reply with the specified status code
+func EncodeJSONReplyWithStatus(w http.ResponseWriter, r *http.Request, code int, object interface{}) {
 	js, err := json.Marshal(object)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
 	w.Write(js)
 }
 
 // HandleDecodeError sends the error to the client
-func HandleDecodeError(w http.ResponseWriter, err error) {
+func HandleDecodeError(w http.ResponseWriter, r *http.Request, err error) {
 	var mr *MalformedRequest
 	if errors.As(err, &mr) {
-		http.Error(w, mr.Message, mr.Status)
+		httpError(w, r, mr.Message, mr.Status)
 	} else {
 		logger.Error(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
 	}
 }
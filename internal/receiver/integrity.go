@@ -0,0 +1,362 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Number of publishes whose commits are checked by default
+const defaultIntegrityRecent = 10
+
+// Number of older objects checked by default at each run
+const defaultIntegritySample = 1000
+
+// Path of the state of the integrity checks relative to the repository,
+// next to the publish log
+const integrityStateName = "ostree-upload/integrity.json"
+
+// IntegrityCheck controls the verification of the published objects, so
+// that corruption is found before clients pull it
+type IntegrityCheck struct {
+	// How often the objects are checked, 0 only checks them on demand
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Number of the latest publishes whose commits are checked
+	Recent int `yaml:"recent,omitempty"`
+	// Number of other objects checked at each run, a different part of
+	// the repository each time
+	Sample int `yaml:"sample,omitempty"`
+	// URL notified with a POST request when corruption is found
+	Webhook string `yaml:"webhook,omitempty"`
+}
+
+// Integrity checks since the receiver started, for the metrics
+var (
+	integrityRuns         int64
+	integrityCorrupted    int64
+	integrityLastFinished int64
+)
+
+// integrityState is the progress of the integrity checks of a repository,
+// saved so that the sample keeps rotating across restarts
+type integrityState struct {
+	mutex   sync.Mutex
+	running bool
+	// Position in the list of objects where the next sample starts
+	Cursor int                       `json:"cursor"`
+	Last   *common.IntegrityResponse `json:"last,omitempty"`
+}
+
+// States of the integrity checks, by repository path
+var (
+	integrityStatesMutex sync.Mutex
+	integrityStates      = map[string]*integrityState{}
+)
+
+// getIntegrityState returns the state of the integrity checks of the
+// repository, reading it the first time
+func getIntegrityState(repo ostree.Repository) *integrityState {
+	integrityStatesMutex.Lock()
+	defer integrityStatesMutex.Unlock()
+
+	if state, ok := integrityStates[repo.Path()]; ok {
+		return state
+	}
+
+	state := &integrityState{}
+	if data, err := ioutil.ReadFile(filepath.Join(repo.Path(), integrityStateName)); err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			logger.Warnf("Ignoring invalid integrity check state of %s: %v", repo.Path(), err)
+		}
+	}
+	integrityStates[repo.Path()] = state
+
+	return state
+}
+
+// save writes the state next to the publish log, called with the mutex held
+func (s *integrityState) save(repo ostree.Repository) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(repo.Path(), integrityStateName)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// status returns the result of the last check, or of the running one
+func (s *integrityState) status() common.IntegrityResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var status common.IntegrityResponse
+	if s.Last != nil {
+		status = *s.Last
+	}
+	status.Running = s.running
+	if status.Corrupted == nil {
+		status.Corrupted = []string{}
+	}
+
+	return status
+}
+
+// start marks a check as running, it returns false if one already is
+func (s *integrityState) start() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.running {
+		return false
+	}
+	s.running = true
+	return true
+}
+
+// CheckIntegrity verifies the objects of the commits of the latest recent
+// publishes and of the branches, then sample other objects starting where
+// the previous check stopped; corrupted and missing objects are listed in
+// the result.  It fails when a check of the repository is already running.
+func CheckIntegrity(repo ostree.Repository, recent, sample int) (*common.IntegrityResponse, error) {
+	state := getIntegrityState(repo)
+	if !state.start() {
+		return nil, fmt.Errorf("an integrity check of %s is already running", repo.Path())
+	}
+
+	result := &common.IntegrityResponse{Started: time.Now().UTC().Format(time.RFC3339), Corrupted: []string{}}
+	err := checkIntegrity(repo, state, recent, sample, result)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.Finished = time.Now().UTC().Format(time.RFC3339)
+
+	state.mutex.Lock()
+	state.running = false
+	state.Last = result
+	if saveErr := state.save(repo); saveErr != nil {
+		logger.Errorf("Failed to save the integrity check state of %s: %v", repo.Path(), saveErr)
+	}
+	state.mutex.Unlock()
+
+	atomic.AddInt64(&integrityRuns, 1)
+	atomic.AddInt64(&integrityCorrupted, int64(len(result.Corrupted)))
+	atomic.StoreInt64(&integrityLastFinished, time.Now().Unix())
+
+	return result, err
+}
+
+func checkIntegrity(repo ostree.Repository, state *integrityState, recent, sample int, result *common.IntegrityResponse) error {
+	// Commits clients are most likely to pull
+	revs := map[string]bool{}
+	branches, err := repo.Refs()
+	if err != nil {
+		return fmt.Errorf("failed to list revisions: %v", err)
+	}
+	for _, rev := range branches {
+		revs[rev] = true
+	}
+	records, err := readPublishRecords(repo, "", recent)
+	if err != nil {
+		return fmt.Errorf("failed to read the publish log: %v", err)
+	}
+	for _, record := range records {
+		revs[record.To] = true
+	}
+
+	checked := map[string]bool{}
+	verify := func(objectName string) {
+		if checked[objectName] {
+			return
+		}
+		checked[objectName] = true
+		result.Objects++
+
+		if err := repo.VerifyObject(repo.GetObjectPath(objectName), objectName); err != nil {
+			logger.Errorf("Object %s of %s is corrupted: %v", objectName, repo.Path(), err)
+			result.Corrupted = append(result.Corrupted, objectName)
+		}
+	}
+
+	for rev := range revs {
+		// Commits of older publishes might have been pruned since, unlike
+		// the commits of the branches
+		commitName := rev + ".commit"
+		if has, err := getStorage(repo).HasObject(commitName); err == nil && !has && !branchesContain(branches, rev) {
+			continue
+		}
+
+		result.Commits++
+		objects, err := repo.Traverse(rev, 0)
+		if err != nil {
+			// Missing or unreadable metadata objects stop the traversal
+			logger.Errorf("Failed to traverse commit %s of %s: %v", rev, repo.Path(), err)
+			result.Corrupted = append(result.Corrupted, commitName)
+			checked[commitName] = true
+			continue
+		}
+		for _, objectName := range objects {
+			verify(objectName)
+		}
+	}
+
+	// Older objects, a different part of the repository each time
+	if sample <= 0 {
+		return nil
+	}
+	objects, err := repo.ListObjects()
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil
+	}
+
+	state.mutex.Lock()
+	cursor := state.Cursor % len(objects)
+	state.mutex.Unlock()
+
+	n := sample
+	if n > len(objects) {
+		n = len(objects)
+	}
+	for i := 0; i < n; i++ {
+		verify(objects[(cursor+i)%len(objects)])
+	}
+
+	state.mutex.Lock()
+	state.Cursor = (cursor + n) % len(objects)
+	state.mutex.Unlock()
+
+	return nil
+}
+
+// branchesContain returns whether a branch points to rev
+func branchesContain(branches map[string]string, rev string) bool {
+	for _, branchRev := range branches {
+		if branchRev == rev {
+			return true
+		}
+	}
+
+	return false
+}
+
+// integrityAlert is the body of the request sent to the webhook
+type integrityAlert struct {
+	Event     string   `json:"event"`
+	Repo      string   `json:"repo"`
+	Time      string   `json:"time"`
+	Corrupted []string `json:"corrupted"`
+}
+
+// runIntegrityCheck checks the repository with the settings of the
+// configuration and raises an alert when corruption is found
+func runIntegrityCheck(repo ostree.Repository, config *Config) {
+	recent := config.IntegrityCheck.Recent
+	if recent <= 0 {
+		recent = defaultIntegrityRecent
+	}
+	sample := config.IntegrityCheck.Sample
+	if sample <= 0 {
+		sample = defaultIntegritySample
+	}
+
+	logger.Infof("Checking the integrity of %s", repo.Path())
+	result, err := CheckIntegrity(repo, recent, sample)
+	if result == nil {
+		logger.Warn(err)
+		return
+	} else if err != nil {
+		logger.Errorf("Failed to check the integrity of %s: %v", repo.Path(), err)
+	}
+	if len(result.Corrupted) == 0 {
+		logger.Infof("Checked %d objects of %d commits of %s, no corruption found", result.Objects, result.Commits, repo.Path())
+		return
+	}
+
+	logger.Errorf("Found %d corrupted objects in %s", len(result.Corrupted), repo.Path())
+	if config.IntegrityCheck.Webhook != "" {
+		alert := integrityAlert{Event: "integrity_failure", Repo: repo.Path(), Time: result.Finished, Corrupted: result.Corrupted}
+		if err := postJSON(config.IntegrityCheck.Webhook, nil, alert); err != nil {
+			logger.Errorf("Failed to notify %s: %v", config.IntegrityCheck.Webhook, err)
+		}
+	}
+}
+
+// StartIntegrityChecks checks the integrity of all the repositories every
+// interval, for as long as the receiver runs
+func (s *AppState) StartIntegrityChecks(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			for _, t := range s.repositories() {
+				runIntegrityCheck(t.repo, s.Config)
+			}
+		}
+	}()
+}
+
+// IntegrityCheckHandler starts a check of the integrity of the repository
+// in the background, clients follow it with IntegrityStatusHandler
+func IntegrityCheckHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	ctx := r.Context()
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+	config, ok := ctx.Value(KeyConfig).(*Config)
+	if !ok {
+		logger.Error("Unable to retrieve configuration from context")
+		httpError(w, r, "no configuration found", http.StatusUnprocessableEntity)
+		return
+	}
+	if !checkTokenAccess(w, r, common.ScopeAdmin) {
+		return
+	}
+
+	// A check that is already running is reported instead
+	state := getIntegrityState(repo)
+	if !state.status().Running {
+		go runIntegrityCheck(repo, config)
+	}
+
+	object := state.status()
+	object.Running = true
+	EncodeJSONReplyWithStatus(w, r, http.StatusAccepted, object)
+}
+
+// IntegrityStatusHandler returns the result of the last integrity check of
+// the repository, or whether one is running
+func IntegrityStatusHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := r.Context().Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+	if !checkTokenAccess(w, r, common.ScopeAdmin) {
+		return
+	}
+
+	EncodeJSONReply(w, r, getIntegrityState(repo).status())
+}
@@ -0,0 +1,283 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Defaults of the IPFS publishing
+const (
+	defaultIPFSAPI       = "http://127.0.0.1:5001"
+	defaultIPFSPath      = "/ostree-upload"
+	defaultIPFSKeyPrefix = "ostree-upload"
+)
+
+// Maximum time of a request to the IPFS node that doesn't add a file,
+// publishing an IPNS name can take a while
+const ipfsRequestTimeout = 2 * time.Minute
+
+// IPFSPublish mirrors the repository to the files of an IPFS node after
+// each update and points an IPNS name per branch to it, so that clients
+// can pull from the IPFS network
+type IPFSPublish struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// URL of the RPC API of the node, http://127.0.0.1:5001 by default
+	API string `yaml:"api,omitempty"`
+	// Directory of the files of the node where the repositories are
+	// mirrored, /ostree-upload by default
+	Path string `yaml:"path,omitempty"`
+	// Branches whose IPNS name is updated, written as for path.Match,
+	// all of them by default
+	Refs []string `yaml:"refs,omitempty"`
+	// Prefix of the names of the keys of the IPNS names, "ostree-upload"
+	// by default
+	KeyPrefix string `yaml:"key_prefix,omitempty"`
+}
+
+// ipfsNode talks to the RPC API of an IPFS node
+type ipfsNode struct {
+	api    string
+	client *http.Client
+}
+
+// call sends a request to the command of the API with the arguments and
+// the optional body, and decodes the JSON response into result if not nil
+func (n *ipfsNode) call(command string, args url.Values, body io.Reader, contentType string, result interface{}) error {
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(n.api, "/")+"/api/v0/"+command+"?"+args.Encode(), body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	client := n.client
+	if body != nil {
+		// Files take as long as they need
+		client = &http.Client{}
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var message struct{ Message string }
+		if err := json.NewDecoder(response.Body).Decode(&message); err == nil && message.Message != "" {
+			return fmt.Errorf("%s failed: %s", command, message.Message)
+		}
+		return fmt.Errorf("%s failed with status %s", command, response.Status)
+	}
+	if result == nil {
+		return nil
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// writeFile copies the local file to the path of the files of the node,
+// creating its parent directories
+func (n *ipfsNode) writeFile(localPath, mfsPath string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Stream the file instead of loading it in memory
+	reader, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		part, err := form.CreateFormFile("file", filepath.Base(localPath))
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	args := url.Values{
+		"arg":         {mfsPath},
+		"create":      {"true"},
+		"parents":     {"true"},
+		"truncate":    {"true"},
+		"raw-leaves":  {"true"},
+		"cid-version": {"1"},
+	}
+	err = n.call("files/write", args, reader, form.FormDataContentType(), nil)
+	reader.Close()
+
+	return err
+}
+
+// ipfsKey is a key of the node, its identifier is the IPNS name
+type ipfsKey struct {
+	Name string
+	ID   string `json:"Id"`
+}
+
+// keyID returns the identifier of the key called name, generating it when
+// the node doesn't have it yet
+func (n *ipfsNode) keyID(name string) (string, error) {
+	var list struct {
+		Keys []ipfsKey
+	}
+	if err := n.call("key/list", nil, nil, "", &list); err != nil {
+		return "", err
+	}
+	for _, key := range list.Keys {
+		if key.Name == name {
+			return key.ID, nil
+		}
+	}
+
+	var key ipfsKey
+	if err := n.call("key/gen", url.Values{"arg": {name}, "type": {"ed25519"}}, nil, "", &key); err != nil {
+		return "", err
+	}
+	logger.Infof("Generated IPFS key \"%s\" with IPNS name %s", name, key.ID)
+
+	return key.ID, nil
+}
+
+// IPFS publishes are serialized by repository, by path
+var (
+	ipfsMutexesMutex sync.Mutex
+	ipfsMutexes      = map[string]*sync.Mutex{}
+)
+
+// ipfsMutex returns the mutex serializing the IPFS publishes of repo
+func ipfsMutex(repo ostree.Repository) *sync.Mutex {
+	ipfsMutexesMutex.Lock()
+	defer ipfsMutexesMutex.Unlock()
+
+	mutex, ok := ipfsMutexes[repo.Path()]
+	if !ok {
+		mutex = &sync.Mutex{}
+		ipfsMutexes[repo.Path()] = mutex
+	}
+
+	return mutex
+}
+
+// ipfsKeyName returns the name of the key of the IPNS name of the branch
+func ipfsKeyName(config IPFSPublish, repo ostree.Repository, branch string) string {
+	prefix := config.KeyPrefix
+	if prefix == "" {
+		prefix = defaultIPFSKeyPrefix
+	}
+
+	return fmt.Sprintf("%s-%s-%s", prefix, filepath.Base(repo.Path()), strings.Replace(branch, "/", "_", -1))
+}
+
+// publishToIPFS adds the objects, refs and summary to the IPFS node and
+// updates the IPNS names of the branches in the background, so that a slow
+// or unreachable node doesn't delay publishing
+func publishToIPFS(repo ostree.Repository, config *Config, objects []string, refs map[string]common.RevisionPair) {
+	if !config.IPFS.Enabled {
+		return
+	}
+
+	go func() {
+		mutex := ipfsMutex(repo)
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if err := publishToIPFSNow(repo, config.IPFS, objects, refs); err != nil {
+			logger.Errorf("Failed to publish %s to IPFS: %v", repo.Path(), err)
+		}
+	}()
+}
+
+// publishToIPFSNow mirrors the files to the node, then points the IPNS name
+// of each branch to the new root of the repository
+func publishToIPFSNow(repo ostree.Repository, config IPFSPublish, objects []string, refs map[string]common.RevisionPair) error {
+	api := config.API
+	if api == "" {
+		api = defaultIPFSAPI
+	}
+	mfsRoot := config.Path
+	if mfsRoot == "" {
+		mfsRoot = defaultIPFSPath
+	}
+	mfsRepo := path.Join("/", mfsRoot, filepath.Base(repo.Path()))
+	node := &ipfsNode{api: api, client: &http.Client{Timeout: ipfsRequestTimeout}}
+
+	// Detached metadata, such as signatures, changes after the commit is
+	// published
+	objects = append([]string{}, objects...)
+	for _, revPair := range refs {
+		objects = append(objects, revPair.Client+".commitmeta")
+	}
+
+	names := []string{"config"}
+	for _, objectName := range objects {
+		name, err := filepath.Rel(repo.Path(), repo.GetObjectPath(objectName))
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(name))
+	}
+	for branch := range refs {
+		names = append(names, "refs/heads/"+branch)
+	}
+	names = append(names, summaryFiles...)
+
+	added := 0
+	for _, name := range names {
+		err := node.writeFile(filepath.Join(repo.Path(), filepath.FromSlash(name)), path.Join(mfsRepo, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to add \"%s\": %v", name, err)
+		}
+		added++
+	}
+
+	var root struct{ Cid string }
+	if err := node.call("files/flush", url.Values{"arg": {mfsRepo}}, nil, "", &root); err != nil {
+		return err
+	}
+	logger.Infof("Added %d files of %s to IPFS, the repository is /ipfs/%s", added, repo.Path(), root.Cid)
+
+	for branch := range refs {
+		if !common.RefAllowed(config.Refs, branch) {
+			continue
+		}
+
+		keyName := ipfsKeyName(config, repo, branch)
+		id, err := node.keyID(keyName)
+		if err != nil {
+			return fmt.Errorf("failed to get the key \"%s\": %v", keyName, err)
+		}
+		args := url.Values{"arg": {"/ipfs/" + root.Cid}, "key": {keyName}, "allow-offline": {"true"}}
+		if err := node.call("name/publish", args, nil, "", nil); err != nil {
+			return fmt.Errorf("failed to update the IPNS name of branch \"%s\": %v", branch, err)
+		}
+		logger.Infof("Pointed /ipns/%s of branch \"%s\" to /ipfs/%s", id, branch, root.Cid)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/lirios/ostree-upload/internal/logger"
+)
+
+// IO scheduling classes of background jobs
+const (
+	IOClassBestEffort = "best-effort"
+	IOClassIdle       = "idle"
+)
+
+// BackgroundJobs lowers the priority of the heavy jobs of the receiver,
+// moving the objects of publishes, reconstructing objects from deltas and
+// pruning, so that they don't starve the requests served by the same host
+type BackgroundJobs struct {
+	// Nice value of the jobs, from 0 to 19, 0 keeps the one of the receiver
+	Nice int `yaml:"nice,omitempty"`
+	// IO scheduling class of the jobs, the one of the receiver by default
+	IOClass string `yaml:"io_class,omitempty"`
+	// Priority within the best-effort class, from 0 (highest) to 7
+	IOPriority int `yaml:"io_priority,omitempty"`
+	// Number of jobs running at the same time, 0 for no limit
+	Concurrency int `yaml:"concurrency,omitempty"`
+}
+
+// validate checks the priorities
+func (b BackgroundJobs) validate() error {
+	if b.Nice < 0 || b.Nice > 19 {
+		return fmt.Errorf("nice value of background jobs must be between 0 and 19")
+	}
+	switch b.IOClass {
+	case "", IOClassBestEffort, IOClassIdle:
+	default:
+		return fmt.Errorf("unsupported IO class \"%s\" of background jobs", b.IOClass)
+	}
+	if b.IOPriority < 0 || b.IOPriority > 7 {
+		return fmt.Errorf("IO priority of background jobs must be between 0 and 7")
+	}
+
+	return nil
+}
+
+// lowersPriority returns whether jobs run with a priority other than the
+// one of the receiver
+func (b BackgroundJobs) lowersPriority() bool {
+	return b.Nice > 0 || b.IOClass != ""
+}
+
+// jobRunner runs background jobs within the budget of the configuration
+type jobRunner struct {
+	config   BackgroundJobs
+	slots    chan struct{}
+	warnOnce sync.Once
+}
+
+// jobResult is what a job returned, or the panic that ended it
+type jobResult struct {
+	err   error
+	panic interface{}
+}
+
+// run runs fn on a thread of its own with the priority of background jobs,
+// once fewer jobs than the budget are running, and waits for it
+func (j *jobRunner) run(fn func() error) error {
+	if j.slots != nil {
+		j.slots <- struct{}{}
+		defer func() { <-j.slots }()
+	}
+	if !j.config.lowersPriority() {
+		return fn()
+	}
+
+	results := make(chan jobResult, 1)
+	go func() {
+		// The priority of a thread can't be raised again, so the thread
+		// is not handed to other goroutines and ends with this one
+		runtime.LockOSThread()
+
+		defer func() {
+			if p := recover(); p != nil {
+				results <- jobResult{panic: p}
+			}
+		}()
+
+		if err := setThreadPriority(j.config); err != nil {
+			j.warnOnce.Do(func() {
+				logger.Warnf("Unable to lower the priority of background jobs: %v", err)
+			})
+		}
+		results <- jobResult{err: fn()}
+	}()
+
+	result := <-results
+	if result.panic != nil {
+		panic(result.panic)
+	}
+	return result.err
+}
+
+// RunBackgroundJob runs fn with the priority and within the concurrency
+// budget of background jobs
+func (c *Config) RunBackgroundJob(fn func() error) error {
+	c.jobsOnce.Do(func() {
+		c.jobs = &jobRunner{config: c.BackgroundJobs}
+		if c.BackgroundJobs.Concurrency > 0 {
+			c.jobs.slots = make(chan struct{}, c.BackgroundJobs.Concurrency)
+		}
+	})
+
+	return c.jobs.run(fn)
+}
@@ -0,0 +1,42 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Arguments of ioprio_set(2)
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+	ioprioClassBE    = 2
+	ioprioClassIdle  = 3
+)
+
+// setThreadPriority sets the nice value and the IO priority of the calling
+// thread, which Linux schedules on its own
+func setThreadPriority(config BackgroundJobs) error {
+	tid := syscall.Gettid()
+
+	if config.Nice > 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, config.Nice); err != nil {
+			return fmt.Errorf("failed to set the nice value: %v", err)
+		}
+	}
+
+	if config.IOClass != "" {
+		ioprio := ioprioClassBE<<ioprioClassShift | config.IOPriority
+		if config.IOClass == IOClassIdle {
+			ioprio = ioprioClassIdle << ioprioClassShift
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio)); errno != 0 {
+			return fmt.Errorf("failed to set the IO priority: %v", errno)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build !linux
+// +build !linux
+
+package receiver
+
+import "errors"
+
+// setThreadPriority is only implemented on Linux, where each thread has
+// its own priorities
+func setThreadPriority(config BackgroundJobs) error {
+	return errors.New("only supported on Linux")
+}
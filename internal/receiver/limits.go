@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/lirios/ostree-upload/internal/common"
+)
+
+// Seconds clients are asked to wait when the receiver is busy
+const defaultRetryAfter = 10
+
+// limiter caps how many requests of a kind are served at the same time
+type limiter struct {
+	name     string
+	max      int64
+	active   int64
+	rejected int64
+}
+
+// acquire returns false if the limit was reached, otherwise the
+// caller must call release when done
+func (l *limiter) acquire() bool {
+	if atomic.AddInt64(&l.active, 1) > l.max && l.max > 0 {
+		atomic.AddInt64(&l.active, -1)
+		atomic.AddInt64(&l.rejected, 1)
+		return false
+	}
+	return true
+}
+
+func (l *limiter) release() {
+	atomic.AddInt64(&l.active, -1)
+}
+
+// serverLimits are the limits of concurrent requests of the receiver
+type serverLimits struct {
+	uploads    *limiter
+	finalizes  *limiter
+	retryAfter int
+}
+
+func newServerLimits(config *Config) *serverLimits {
+	retryAfter := config.Concurrency.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+
+	return &serverLimits{
+		uploads:    &limiter{name: "uploads", max: int64(config.Concurrency.Uploads)},
+		finalizes:  &limiter{name: "finalizes", max: int64(config.Concurrency.Finalizes)},
+		retryAfter: retryAfter,
+	}
+}
+
+// limitConcurrency replies with 503 Service Unavailable when the limiter
+// is full, so that clients come back later instead of swamping the receiver
+func (s *serverLimits) limitConcurrency(l *limiter) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if !l.acquire() {
+				w.Header().Set("Retry-After", strconv.Itoa(s.retryAfter))
+				writeError(w, r, http.StatusServiceUnavailable, common.ErrorResponse{
+					Code:    common.ErrorCodeServerBusy,
+					Message: fmt.Sprintf("too many concurrent %s, retry later", l.name),
+					Details: map[string]string{"retry_after": strconv.Itoa(s.retryAfter)},
+				})
+				return
+			}
+			defer l.release()
+
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// MetricsHandler reports the utilization of the receiver in the
+// Prometheus text format
+func (s *serverLimits) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP ostree_upload_active_requests Requests being served, by kind.")
+	fmt.Fprintln(w, "# TYPE ostree_upload_active_requests gauge")
+	for _, l := range []*limiter{s.uploads, s.finalizes} {
+		fmt.Fprintf(w, "ostree_upload_active_requests{kind=\"%s\"} %d\n", l.name, atomic.LoadInt64(&l.active))
+	}
+
+	fmt.Fprintln(w, "# HELP ostree_upload_max_requests Maximum concurrent requests, by kind, 0 for no limit.")
+	fmt.Fprintln(w, "# TYPE ostree_upload_max_requests gauge")
+	for _, l := range []*limiter{s.uploads, s.finalizes} {
+		fmt.Fprintf(w, "ostree_upload_max_requests{kind=\"%s\"} %d\n", l.name, l.max)
+	}
+
+	fmt.Fprintln(w, "# HELP ostree_upload_rejected_requests_total Requests rejected because the receiver was busy, by kind.")
+	fmt.Fprintln(w, "# TYPE ostree_upload_rejected_requests_total counter")
+	for _, l := range []*limiter{s.uploads, s.finalizes} {
+		fmt.Fprintf(w, "ostree_upload_rejected_requests_total{kind=\"%s\"} %d\n", l.name, atomic.LoadInt64(&l.rejected))
+	}
+
+	fmt.Fprintln(w, "# HELP ostree_upload_integrity_checks_total Integrity checks of the repositories.")
+	fmt.Fprintln(w, "# TYPE ostree_upload_integrity_checks_total counter")
+	fmt.Fprintf(w, "ostree_upload_integrity_checks_total %d\n", atomic.LoadInt64(&integrityRuns))
+
+	fmt.Fprintln(w, "# HELP ostree_upload_integrity_corrupted_objects_total Corrupted or missing objects found by integrity checks.")
+	fmt.Fprintln(w, "# TYPE ostree_upload_integrity_corrupted_objects_total counter")
+	fmt.Fprintf(w, "ostree_upload_integrity_corrupted_objects_total %d\n", atomic.LoadInt64(&integrityCorrupted))
+
+	fmt.Fprintln(w, "# HELP ostree_upload_integrity_last_check_timestamp_seconds Time the last integrity check finished, 0 if none did.")
+	fmt.Fprintln(w, "# TYPE ostree_upload_integrity_last_check_timestamp_seconds gauge")
+	fmt.Fprintf(w, "ostree_upload_integrity_last_check_timestamp_seconds %d\n", atomic.LoadInt64(&integrityLastFinished))
+
+	fmt.Fprintln(w, "# HELP ostree_upload_replication_failures_total Replications from the primary that failed.")
+	fmt.Fprintln(w, "# TYPE ostree_upload_replication_failures_total counter")
+	fmt.Fprintf(w, "ostree_upload_replication_failures_total %d\n", atomic.LoadInt64(&replicationFailures))
+
+	fmt.Fprintln(w, "# HELP ostree_upload_replication_conflicts Branches not replicated because they were updated on the secondary.")
+	fmt.Fprintln(w, "# TYPE ostree_upload_replication_conflicts gauge")
+	fmt.Fprintf(w, "ostree_upload_replication_conflicts %d\n", atomic.LoadInt64(&replicationConflicts))
+
+	fmt.Fprintln(w, "# HELP ostree_upload_replication_last_success_timestamp_seconds Time the repository last matched the primary, 0 if it never did.")
+	fmt.Fprintln(w, "# TYPE ostree_upload_replication_last_success_timestamp_seconds gauge")
+	fmt.Fprintf(w, "ostree_upload_replication_last_success_timestamp_seconds %d\n", atomic.LoadInt64(&replicationLastSuccess))
+}
@@ -0,0 +1,214 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/lirios/ostree-upload/internal/bundle"
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Maximum size of a manifest, which lists every object of a push
+const maxManifestSize = 64 * 1024 * 1024
+
+// SignedManifests makes the receiver only publish pushes whose manifest is
+// signed by a trusted builder, so that a stolen token isn't enough to
+// publish arbitrary content
+type SignedManifests struct {
+	// PEM files with the Ed25519 public keys of the builders, manifests are
+	// required when there's at least one
+	PublicKeys []string `yaml:"public_keys,omitempty"`
+
+	keys []ed25519.PublicKey
+}
+
+// load reads the public keys
+func (s *SignedManifests) load() error {
+	s.keys = nil
+	for _, path := range s.PublicKeys {
+		key, err := bundle.ReadPublicKey(path)
+		if err != nil {
+			return fmt.Errorf("invalid manifest public key: %v", err)
+		}
+		s.keys = append(s.keys, key)
+	}
+
+	return nil
+}
+
+// enabled returns whether manifests are required
+func (s *SignedManifests) enabled() bool {
+	return len(s.keys) > 0
+}
+
+// verify returns whether signature is valid for data with one of the keys
+func (s *SignedManifests) verify(data, signature []byte) bool {
+	for _, key := range s.keys {
+		if ed25519.Verify(key, data, signature) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ManifestError is returned when a push doesn't match its signed manifest
+type ManifestError struct {
+	Reason string
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("signed manifest rejected: %s", e.Reason)
+}
+
+// writeManifestError reports that a push was refused because of its manifest
+func writeManifestError(w http.ResponseWriter, r *http.Request, err *ManifestError) {
+	writeError(w, r, http.StatusForbidden, common.ErrorResponse{
+		Code:    common.ErrorCodeManifestRejected,
+		Message: err.Error(),
+	})
+}
+
+// checkEntryManifest checks that the objects uploaded for the entry are
+// those of its signed manifest, before anything is published
+func checkEntryManifest(repo ostree.Repository, config *Config, entry *QueueEntry) error {
+	if !config.SignedManifests.enabled() {
+		return nil
+	}
+
+	manifest := entry.Manifest()
+	if manifest == nil {
+		return &ManifestError{Reason: "the push has no signed manifest"}
+	}
+
+	storage := getStorage(repo)
+	for _, objectName := range entry.GetObjects() {
+		staged, err := storage.HasStaged(entry.ID, objectName)
+		if err != nil {
+			return err
+		}
+		if !staged {
+			continue
+		}
+
+		expected, ok := manifest.Objects[objectName]
+		if !ok {
+			return &ManifestError{Reason: fmt.Sprintf("object %s is not in the manifest", objectName)}
+		}
+		path, err := storage.StagedPath(entry.ID, objectName)
+		if err != nil {
+			return err
+		}
+		checksum, err := common.ChecksumFile(common.ChecksumSHA256, path)
+		if err != nil {
+			return err
+		}
+		if checksum != expected {
+			return &ManifestError{Reason: fmt.Sprintf("object %s doesn't match the manifest", objectName)}
+		}
+	}
+
+	return nil
+}
+
+// sameRefs returns whether two sets of branches are updated the same way
+func sameRefs(a, b map[string]common.RevisionPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for branch, revPair := range a {
+		if other, ok := b[branch]; !ok || other != revPair {
+			return false
+		}
+	}
+
+	return true
+}
+
+// QueueManifestHandler receives the manifest of a queue entry signed by the
+// builder, the objects are checked against it before they're published
+func QueueManifestHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// Get from context
+	ctx := r.Context()
+	queue, ok := ctx.Value(KeyQueue).(*Queue)
+	if !ok {
+		logger.Error("Unable to retrieve queue object from context")
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
+		return
+	}
+	config, ok := ctx.Value(KeyConfig).(*Config)
+	if !ok {
+		logger.Error("Unable to retrieve configuration from context")
+		httpError(w, r, "no configuration found", http.StatusUnprocessableEntity)
+		return
+	}
+	if !config.SignedManifests.enabled() {
+		httpError(w, r, "signed manifests are not checked", http.StatusForbidden)
+		return
+	}
+
+	// Get the entry from the queue
+	entry, ok := getEntry(w, r, queue)
+	if !ok {
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxManifestSize+1))
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxManifestSize {
+		httpError(w, r, fmt.Sprintf("manifest must not be larger than %d MiB", maxManifestSize/1024/1024), http.StatusRequestEntityTooLarge)
+		return
+	}
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get(common.SignatureHeader))
+	if err != nil {
+		httpError(w, r, fmt.Sprintf("invalid signature: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !config.SignedManifests.verify(data, signature) {
+		logger.Errorf("Manifest of queue entry %s is not signed by a trusted key", entry.ID)
+		writeManifestError(w, r, &ManifestError{Reason: "it's not signed by a trusted key"})
+		return
+	}
+
+	var manifest common.QueueManifest
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&manifest); err != nil {
+		httpError(w, r, fmt.Sprintf("invalid manifest: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// The manifest is only good for the push it was signed for, with the
+	// branches named as the client names them
+	refs, err := mapRequestRefs(r, manifest.Refs)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if manifest.QueueID != entry.ID || !sameRefs(refs, entry.UpdateRefs) {
+		logger.Errorf("Manifest of queue entry %s is for another push", entry.ID)
+		writeManifestError(w, r, &ManifestError{Reason: "it's for another push"})
+		return
+	}
+
+	entry.SetManifest(&manifest)
+	logger.Debugf("Queue entry %s has a signed manifest of %d objects", entry.ID, len(manifest.Objects))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,171 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SlackNotifier posts announcements to a Slack incoming webhook
+type SlackNotifier struct {
+	Webhook string `yaml:"webhook"`
+}
+
+// Notify posts the announcement to the webhook
+func (n *SlackNotifier) Notify(announcement Announcement) error {
+	message := map[string]string{"text": announcement.Text()}
+	return postJSON(n.Webhook, nil, message)
+}
+
+// MatrixNotifier sends announcements to a Matrix room
+type MatrixNotifier struct {
+	// URL of the homeserver, such as https://matrix.org
+	Homeserver string `yaml:"homeserver"`
+	// Identifier of the room, such as !abcdef:matrix.org
+	Room string `yaml:"room"`
+	// Access token of the user the announcements are sent as
+	AccessToken string `yaml:"access_token"`
+}
+
+// Makes the transaction identifiers of Matrix messages unique
+var matrixTransactions int64
+
+// Notify sends the announcement to the room as a notice
+func (n *MatrixNotifier) Notify(announcement Announcement) error {
+	txnID := fmt.Sprintf("ostree-upload-%d-%d", time.Now().UnixNano(), atomic.AddInt64(&matrixTransactions, 1))
+	endpoint := fmt.Sprintf("%s/_matrix/client/r0/rooms/%s/send/m.room.message/%s", strings.TrimSuffix(n.Homeserver, "/"), url.PathEscape(n.Room), txnID)
+	headers := map[string]string{"Authorization": "Bearer " + n.AccessToken}
+	message := map[string]string{"msgtype": "m.notice", "body": announcement.Text()}
+
+	// The transaction identifier makes retries idempotent
+	return sendJSON("PUT", endpoint, headers, message)
+}
+
+// EmailNotifier sends announcements by email
+type EmailNotifier struct {
+	// Host name and port of the SMTP server
+	Server string `yaml:"server"`
+	// Credentials, when the server requires authentication
+	Username string   `yaml:"username,omitempty"`
+	Password string   `yaml:"password,omitempty"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// Notify sends the announcement to the recipients
+func (n *EmailNotifier) Notify(announcement Announcement) error {
+	var auth smtp.Auth
+	if n.Username != "" {
+		host, _, err := net.SplitHostPort(n.Server)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", n.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "[ostree-upload] "+announcement.Title()))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.Replace(announcement.Text(), "\n", "\r\n", -1))
+
+	return smtp.SendMail(n.Server, auth, n.From, n.To, message.Bytes())
+}
+
+// Keys of the build metadata identifying the source commit of a push
+const (
+	metadataCIProvider = "ci.provider"
+	metadataCIRepo     = "ci.repo"
+	metadataCISha      = "ci.sha"
+)
+
+// Maximum length of the description of a commit status on GitHub
+const maxStatusDescriptionLength = 140
+
+// StatusProvider is the API of a GitHub or GitLab instance
+type StatusProvider struct {
+	// URL of the API, github.com and gitlab.com by default
+	URL   string `yaml:"url,omitempty"`
+	Token string `yaml:"token"`
+}
+
+// CommitStatusNotifier sets the status of the source commit of a push on
+// GitHub or GitLab, as given by the ci.provider, ci.repo and ci.sha build
+// metadata, so that the commit links to the image it produced
+type CommitStatusNotifier struct {
+	GitHub *StatusProvider `yaml:"github,omitempty"`
+	GitLab *StatusProvider `yaml:"gitlab,omitempty"`
+	// Name of the status, "ostree-upload" by default
+	Context string `yaml:"context,omitempty"`
+}
+
+// Notify sets the status of the source commit, announcements without the
+// build metadata are ignored
+func (n *CommitStatusNotifier) Notify(announcement Announcement) error {
+	provider := announcement.Metadata[metadataCIProvider]
+	repo := announcement.Metadata[metadataCIRepo]
+	sha := announcement.Metadata[metadataCISha]
+	if provider == "" || repo == "" || sha == "" {
+		return nil
+	}
+
+	context := n.Context
+	if context == "" {
+		context = "ostree-upload"
+	}
+	description := announcement.Title()
+	if len(description) > maxStatusDescriptionLength {
+		description = description[:maxStatusDescriptionLength-3] + "..."
+	}
+
+	switch provider {
+	case "github":
+		if n.GitHub == nil {
+			return fmt.Errorf("no GitHub credentials to set the status of %s@%s", repo, sha)
+		}
+		state := "success"
+		if announcement.Failed {
+			state = "failure"
+		}
+		baseURL := n.GitHub.URL
+		if baseURL == "" {
+			baseURL = "https://api.github.com"
+		}
+		endpoint := fmt.Sprintf("%s/repos/%s/statuses/%s", strings.TrimSuffix(baseURL, "/"), repo, url.PathEscape(sha))
+		headers := map[string]string{"Authorization": "token " + n.GitHub.Token, "Accept": "application/vnd.github.v3+json"}
+		status := map[string]string{"state": state, "context": context, "description": description}
+		return postJSON(endpoint, headers, status)
+	case "gitlab":
+		if n.GitLab == nil {
+			return fmt.Errorf("no GitLab credentials to set the status of %s@%s", repo, sha)
+		}
+		state := "success"
+		if announcement.Failed {
+			state = "failed"
+		}
+		baseURL := n.GitLab.URL
+		if baseURL == "" {
+			baseURL = "https://gitlab.com"
+		}
+		// Projects are identified by their URL encoded path
+		endpoint := fmt.Sprintf("%s/api/v4/projects/%s/statuses/%s", strings.TrimSuffix(baseURL, "/"), url.PathEscape(repo), url.PathEscape(sha))
+		headers := map[string]string{"PRIVATE-TOKEN": n.GitLab.Token}
+		status := map[string]string{"state": state, "name": context, "description": description}
+		return postJSON(endpoint, headers, status)
+	}
+
+	return fmt.Errorf("unknown CI provider \"%s\"", provider)
+}
@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Maximum time to deliver a notification
+const notifyTimeout = 10 * time.Second
+
+// Attempts to deliver a notification before giving up
+const notifyAttempts = 3
+
+// UpdateHook is an endpoint notified when branches are updated, such as a
+// fleet management service, so that devices check for updates right away
+// instead of polling
+type UpdateHook struct {
+	URL string `yaml:"url"`
+	// Branches the endpoint is notified about, written as for path.Match,
+	// all of them by default
+	Refs []string `yaml:"refs,omitempty"`
+	// Headers added to the requests, for example to authenticate
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// updateNotification is the body of the request sent to update hooks
+type updateNotification struct {
+	Event  string `json:"event"`
+	Action string `json:"action"`
+	Repo   string `json:"repo"`
+	Time   string `json:"time"`
+	// Increases with each update of the repository, so that devices can
+	// ignore notifications older than the summary they have
+	Epoch int64 `json:"epoch"`
+	// New revision of each updated branch
+	Refs map[string]string `json:"refs"`
+}
+
+// Last epoch of each repository, by path
+var (
+	epochsMutex sync.Mutex
+	epochs      = map[string]int64{}
+)
+
+// nextEpoch returns the epoch of a new update of the repository, the Unix
+// time in nanoseconds unless updates are closer than the clock resolution
+func nextEpoch(repo ostree.Repository) int64 {
+	epochsMutex.Lock()
+	defer epochsMutex.Unlock()
+
+	epoch := time.Now().UnixNano()
+	if last := epochs[repo.Path()]; epoch <= last {
+		epoch = last + 1
+	}
+	epochs[repo.Path()] = epoch
+
+	return epoch
+}
+
+// notifyUpdate tells the secondaries, the event stream and the update hooks
+// about the branches that were updated, by the queue entry queueID when it's
+// not empty; hooks in the background so that slow endpoints don't delay
+// publishing
+func notifyUpdate(repo ostree.Repository, config *Config, action, queueID string, refs map[string]common.RevisionPair) {
+	epoch := nextEpoch(repo)
+	wakeReplicas(repo, epoch)
+	emitEvent(repo, common.Event{Type: common.EventPublished, QueueID: queueID, Action: action, Refs: refs})
+	if len(config.UpdateHooks) == 0 {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	for _, hook := range config.UpdateHooks {
+		notification := updateNotification{Event: "refs_updated", Action: action, Repo: repo.Path(), Time: now, Epoch: epoch, Refs: map[string]string{}}
+		for branch, revPair := range refs {
+			if common.RefAllowed(hook.Refs, branch) {
+				notification.Refs[branch] = revPair.Client
+			}
+		}
+		if len(notification.Refs) == 0 {
+			continue
+		}
+
+		go func(hook UpdateHook) {
+			if err := postJSON(hook.URL, hook.Headers, notification); err != nil {
+				logger.Errorf("Failed to notify %s of the update: %v", hook.URL, err)
+			}
+		}(hook)
+	}
+}
+
+// postJSON sends object as JSON to url with a POST request, trying again
+// a few times when the endpoint is not reachable or fails
+func postJSON(url string, headers map[string]string, object interface{}) error {
+	return sendJSON("POST", url, headers, object)
+}
+
+// sendJSON sends object as JSON to url with a request of the method,
+// trying again a few times when the endpoint is not reachable or fails
+func sendJSON(method, url string, headers map[string]string, object interface{}) error {
+	data, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	for attempt := 1; ; attempt++ {
+		err = sendOnce(client, method, url, headers, data)
+		if err == nil || attempt == notifyAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func sendOnce(client *http.Client, method, url string, headers map[string]string, data []byte) error {
+	request, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// ObjectsSinceHandler compares the objects of the commit a branch points to
+// with those of an older commit the client has, so that clients know which
+// objects the server has without enumerating the whole history of the branch
+func ObjectsSinceHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	repo, ok := r.Context().Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	branch := r.URL.Query().Get("ref")
+	since := r.URL.Query().Get("since")
+	if branch == "" || since == "" {
+		httpError(w, r, "missing ref or since parameter", http.StatusBadRequest)
+		return
+	}
+	branch = mapRequestRef(r, branch)
+	if err := ostree.ValidateRef(branch); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := ostree.ValidateChecksum(since); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	refs, err := repo.Refs()
+	if err != nil {
+		logger.Errorf("Failed to list revisions: %v", err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rev, ok := refs[branch]
+	if !ok {
+		httpError(w, r, fmt.Sprintf("branch \"%s\" not found", branch), http.StatusNotFound)
+		return
+	}
+
+	// Published commits are complete, unless they were pruned since
+	if has, err := getStorage(repo).HasObject(since + ".commit"); err != nil || !has {
+		httpError(w, r, fmt.Sprintf("commit %s not found", since), http.StatusNotFound)
+		return
+	}
+
+	objects, err := repo.Traverse(rev, 0)
+	if err != nil {
+		logger.Errorf("Failed to traverse commit %s: %v", rev, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sinceObjects, err := repo.Traverse(since, 0)
+	if err != nil {
+		logger.Errorf("Failed to traverse commit %s: %v", since, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	object := common.ObjectsSinceResponse{Rev: rev, Since: since, Added: objectsDifference(objects, sinceObjects), Removed: objectsDifference(sinceObjects, objects)}
+	EncodeJSONReply(w, r, object)
+}
+
+// objectsDifference returns the object names of a that are not in b
+func objectsDifference(a, b []string) []string {
+	inB := make(map[string]bool, len(b))
+	for _, objectName := range b {
+		inB[objectName] = true
+	}
+
+	result := []string{}
+	for _, objectName := range a {
+		if !inB[objectName] {
+			result = append(result, objectName)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,263 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/artifact"
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// OfflineArtifacts are the files written after each publish for mirrors
+// that fetch updates out-of-band, such as air-gapped ones
+type OfflineArtifacts struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Directory where the artifacts are written
+	Dir string `yaml:"dir"`
+	// Branches artifacts are written for, written as for path.Match, all
+	// of them by default
+	Refs []string `yaml:"refs,omitempty"`
+	// Add all the objects of the commit instead of those that are not in
+	// the previous commit of the branch
+	Full bool `yaml:"full,omitempty"`
+	// Number of commits whose artifacts are kept for each branch, all of
+	// them when 0
+	Keep int `yaml:"keep,omitempty"`
+	// URLs of the BitTorrent trackers
+	Trackers []string `yaml:"trackers,omitempty"`
+	// URL where the directory is served, torrents use it as web seed
+	WebSeed string `yaml:"web_seed,omitempty"`
+}
+
+// Extensions of the files written for each commit
+const (
+	offlineTarExt     = ".tar"
+	offlineZsyncExt   = ".tar.zsync"
+	offlineTorrentExt = ".tar.torrent"
+)
+
+// writeOfflineArtifacts writes the artifacts of the branches in the
+// background, since they take a while for large commits
+func writeOfflineArtifacts(repo ostree.Repository, config *Config, refs map[string]common.RevisionPair) {
+	if !config.OfflineArtifacts.Enabled {
+		return
+	}
+
+	go func() {
+		for branch, revPair := range refs {
+			if !common.RefAllowed(config.OfflineArtifacts.Refs, branch) {
+				continue
+			}
+			if err := writeBranchArtifacts(repo, config.OfflineArtifacts, branch, revPair); err != nil {
+				logger.Errorf("Failed to write the offline artifacts of branch \"%s\": %v", branch, err)
+			}
+		}
+	}()
+}
+
+// offlineObjects returns the objects an offline mirror needs to update
+// the branch, sorted
+func offlineObjects(repo ostree.Repository, full bool, revPair common.RevisionPair) ([]string, error) {
+	objects, err := repo.Traverse(revPair.Client, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	if !full && revPair.Server != "" {
+		previous, err := repo.Traverse(revPair.Server, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, objectName := range previous {
+			known[objectName] = true
+		}
+	}
+
+	needed := []string{}
+	seen := map[string]bool{}
+	for _, objectName := range append(objects, revPair.Client+".commitmeta") {
+		if !known[objectName] && !seen[objectName] {
+			seen[objectName] = true
+			needed = append(needed, objectName)
+		}
+	}
+	sort.Strings(needed)
+
+	return needed, nil
+}
+
+// writeBranchArtifacts writes a tarball with the objects of the commit,
+// laid out as a repository that mirrors pull from, followed by its zsync
+// control file and torrent
+func writeBranchArtifacts(repo ostree.Repository, config OfflineArtifacts, branch string, revPair common.RevisionPair) error {
+	if config.Dir == "" {
+		return errors.New("no directory set")
+	}
+
+	mode, err := repo.GetMode()
+	if err != nil {
+		return err
+	}
+	objects, err := offlineObjects(repo, config.Full, revPair)
+	if err != nil {
+		return err
+	}
+
+	relDir := filepath.Join(filepath.Base(repo.Path()), filepath.FromSlash(branch))
+	dir := filepath.Join(config.Dir, relDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tarPath := filepath.Join(dir, revPair.Client+offlineTarExt)
+
+	// Mirrors only see complete tarballs
+	file, err := ioutil.TempFile(dir, revPair.Client+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	now := time.Now()
+	tw := tar.NewWriter(file)
+	writeEntry := func(name string, size int64, r io.Reader) error {
+		header := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: now, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	}
+
+	repoConfig := fmt.Sprintf("[core]\nrepo_version=1\nmode=%s\n", mode)
+	if err := writeEntry("config", int64(len(repoConfig)), strings.NewReader(repoConfig)); err != nil {
+		return err
+	}
+	added := 0
+	for _, objectName := range objects {
+		objectPath := repo.GetObjectPath(objectName)
+		object, err := os.Open(objectPath)
+		if os.IsNotExist(err) && strings.HasSuffix(objectName, ".commitmeta") {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		info, err := object.Stat()
+		if err == nil {
+			name, _ := filepath.Rel(repo.Path(), objectPath)
+			err = writeEntry(filepath.ToSlash(name), info.Size(), object)
+		}
+		object.Close()
+		if err != nil {
+			return fmt.Errorf("failed to add object %s: %v", objectName, err)
+		}
+		added++
+	}
+	ref := revPair.Client + "\n"
+	if err := writeEntry("refs/heads/"+branch, int64(len(ref)), strings.NewReader(ref)); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), tarPath); err != nil {
+		return err
+	}
+
+	if err := writeArtifactFile(filepath.Join(dir, revPair.Client+offlineZsyncExt), func(w io.Writer) error {
+		return artifact.WriteZsync(w, tarPath, filepath.Base(tarPath))
+	}); err != nil {
+		return fmt.Errorf("failed to write the zsync control file: %v", err)
+	}
+
+	options := artifact.TorrentOptions{Trackers: config.Trackers, Comment: fmt.Sprintf("%s %s", branch, revPair.Client)}
+	if config.WebSeed != "" {
+		options.WebSeeds = []string{strings.TrimSuffix(config.WebSeed, "/") + "/" + filepath.ToSlash(filepath.Join(relDir, filepath.Base(tarPath)))}
+	}
+	if err := writeArtifactFile(filepath.Join(dir, revPair.Client+offlineTorrentExt), func(w io.Writer) error {
+		return artifact.WriteTorrent(w, tarPath, options)
+	}); err != nil {
+		return fmt.Errorf("failed to write the torrent: %v", err)
+	}
+
+	logger.Infof("Wrote the offline artifacts of branch \"%s\" at %s with %d objects to %s", branch, revPair.Client, added, dir)
+
+	return pruneOfflineArtifacts(dir, config.Keep)
+}
+
+// writeArtifactFile writes the file at path with write, replacing it only
+// once complete
+func writeArtifactFile(path string, write func(w io.Writer) error) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := write(file); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// pruneOfflineArtifacts removes the artifacts of the oldest commits of the
+// directory of a branch, keeping those of the last keep ones
+func pruneOfflineArtifacts(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	tarballs := []os.FileInfo{}
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), offlineTarExt) {
+			tarballs = append(tarballs, info)
+		}
+	}
+	if len(tarballs) <= keep {
+		return nil
+	}
+
+	// Newest first
+	sort.Slice(tarballs, func(i, j int) bool {
+		return tarballs[i].ModTime().After(tarballs[j].ModTime())
+	})
+	for _, info := range tarballs[keep:] {
+		rev := strings.TrimSuffix(info.Name(), offlineTarExt)
+		for _, ext := range []string{offlineTarExt, offlineZsyncExt, offlineTorrentExt} {
+			if err := os.Remove(filepath.Join(dir, rev+ext)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
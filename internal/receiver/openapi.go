@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/golang/gddo/httputil/header"
+
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/internal/openapi"
+)
+
+// OpenAPIHandler serves the OpenAPI specification of the API
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openapi.Spec())
+}
+
+// requestPath returns the path of a request to the API, relative to the base
+// path, from the path relative to the router of its API version
+func requestPath(r *http.Request) string {
+	path := r.URL.Path
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePath != "" {
+		path = rctx.RoutePath
+	}
+	return fmt.Sprintf("/api/v%d%s", APIVersion(r), path)
+}
+
+// validateRequests rejects the requests that don't match the OpenAPI
+// specification before the handlers see them, requests the specification
+// doesn't describe are left to the router
+func validateRequests(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		path := requestPath(r)
+		operation := openapi.FindOperation(r.Method, path)
+		if operation == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err := operation.ValidateParameters(r.URL.Query(), r.Header); err != nil {
+			logger.Debugf("Invalid request %s %s: %v", r.Method, path, err)
+			httpError(w, r, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if operation.JSONBody() != nil && r.Body != nil {
+			if r.Header.Get("Content-Type") != "" {
+				value, _ := header.ParseValueAndParams(r.Header, "Content-Type")
+				if value != "application/json" {
+					httpError(w, r, "Content-Type header is not application/json", http.StatusUnsupportedMediaType)
+					return
+				}
+			}
+
+			// The handler decodes the body again
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxJSONBodySize))
+			r.Body.Close()
+			if err != nil && err.Error() == "http: request body too large" {
+				httpError(w, r, "Request body must not be larger than 10 MiB", http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				httpError(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := operation.ValidateBody(body); err != nil {
+				logger.Debugf("Invalid request %s %s: %v", r.Method, path, err)
+				httpError(w, r, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
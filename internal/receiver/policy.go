@@ -0,0 +1,220 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// CommitPolicy rejects pushed commits whose timestamp doesn't make sense,
+// usually because the clock of the builder is wrong
+type CommitPolicy struct {
+	// How far in the future timestamps can be, 0 for no limit
+	MaxFutureSkew time.Duration `yaml:"max_future_skew,omitempty"`
+	// How far in the past timestamps can be, 0 for no limit
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+	// Refuse commits older than the one the branch points to
+	Monotonic bool `yaml:"monotonic,omitempty"`
+}
+
+// PolicyViolation is returned when a commit is refused by the policy
+type PolicyViolation struct {
+	Branch string
+	Rev    string
+	Reason string
+}
+
+func (e *PolicyViolation) Error() string {
+	return fmt.Sprintf("commit %s of branch \"%s\" refused: %s", e.Rev, e.Branch, e.Reason)
+}
+
+// checkCommitPolicy checks the commits the entry is going to publish, which
+// are either in the staging area or already in the repository
+func checkCommitPolicy(repo ostree.Repository, policy CommitPolicy, entry *QueueEntry) error {
+	if policy.MaxFutureSkew <= 0 && policy.MaxAge <= 0 && !policy.Monotonic {
+		return nil
+	}
+
+	now := time.Now()
+	for branch, revPair := range entry.UpdateRefs {
+		info, err := readEntryCommit(repo, entry.ID, revPair.Client)
+		if err != nil {
+			return fmt.Errorf("failed to read commit %s: %v", revPair.Client, err)
+		}
+
+		if policy.MaxFutureSkew > 0 && info.Timestamp.After(now.Add(policy.MaxFutureSkew)) {
+			return &PolicyViolation{Branch: branch, Rev: revPair.Client, Reason: fmt.Sprintf("timestamp %s is in the future", info.Timestamp.UTC().Format(time.RFC3339))}
+		}
+		if policy.MaxAge > 0 && info.Timestamp.Before(now.Add(-policy.MaxAge)) {
+			return &PolicyViolation{Branch: branch, Rev: revPair.Client, Reason: fmt.Sprintf("timestamp %s is older than %v", info.Timestamp.UTC().Format(time.RFC3339), policy.MaxAge)}
+		}
+
+		if policy.Monotonic && revPair.Server != "" {
+			current, err := repo.GetCommitInfo(revPair.Server)
+			if err != nil {
+				return fmt.Errorf("failed to read commit %s: %v", revPair.Server, err)
+			}
+			if info.Timestamp.Before(current.Timestamp) {
+				return &PolicyViolation{Branch: branch, Rev: revPair.Client, Reason: fmt.Sprintf("timestamp %s is older than the one of the published commit %s", info.Timestamp.UTC().Format(time.RFC3339), revPair.Server)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// readEntryCommit describes a commit uploaded for the entry, or already
+// in the repository when it was published before
+func readEntryCommit(repo ostree.Repository, queueID, rev string) (*ostree.CommitInfo, error) {
+	storage := getStorage(repo)
+	if staged, err := storage.HasStaged(queueID, rev+".commit"); err == nil && staged {
+		path, err := storage.StagedPath(queueID, rev+".commit")
+		if err != nil {
+			return nil, err
+		}
+		return repo.ReadCommitInfo(path, rev)
+	}
+
+	return repo.GetCommitInfo(rev)
+}
+
+// checkEntryPolicy replies with an error and returns false unless the
+// objects of the entry match its signed manifest, and its commits comply
+// with the policy and the protection of the branches
+func checkEntryPolicy(w http.ResponseWriter, r *http.Request, repo ostree.Repository, config *Config, entry *QueueEntry) bool {
+	// Nothing is promoted unless the builder vouches for it
+	err := checkEntryManifest(repo, config, entry)
+	if err == nil {
+		err = checkCommitPolicy(repo, config.CommitPolicy, entry)
+	}
+	if err == nil {
+		err = checkEntrySignatures(repo, config, entry)
+	}
+	if err == nil {
+		return true
+	}
+
+	var violation *PolicyViolation
+	if errors.As(err, &violation) {
+		logger.Errorf("Refusing queue entry %s: %v", entry.ID, err)
+		writePolicyViolation(w, r, violation)
+		return false
+	}
+	var manifestError *ManifestError
+	if errors.As(err, &manifestError) {
+		logger.Errorf("Refusing queue entry %s: %v", entry.ID, err)
+		writeManifestError(w, r, manifestError)
+		return false
+	}
+
+	logger.Errorf("Cannot check the commits of queue entry %s: %v", entry.ID, err)
+	httpError(w, r, err.Error(), http.StatusInternalServerError)
+	return false
+}
+
+// writePolicyViolation reports that a commit was refused by the policy
+func writePolicyViolation(w http.ResponseWriter, r *http.Request, violation *PolicyViolation) {
+	writeError(w, r, http.StatusUnprocessableEntity, common.ErrorResponse{
+		Code:    common.ErrorCodePolicyViolation,
+		Message: violation.Error(),
+		Details: map[string]string{"branch": violation.Branch, "commit": violation.Rev},
+	})
+}
+
+// checkPushLimits replies with an error and returns false when the push
+// requested is larger than the configuration allows, as measured by the
+// client, so that it's refused before its objects are uploaded
+func checkPushLimits(w http.ResponseWriter, r *http.Request, config *Config, req *common.QueueRequest) bool {
+	if config.MaxPushSize > 0 && req.Size > config.MaxPushSize*1024*1024 {
+		logger.Errorf("Refusing a push of %d bytes", req.Size)
+		writeError(w, r, http.StatusRequestEntityTooLarge, common.ErrorResponse{
+			Code:    common.ErrorCodePushTooLarge,
+			Message: fmt.Sprintf("push of %d MiB is larger than the %d MiB allowed", req.Size/1024/1024, config.MaxPushSize),
+			Details: map[string]string{"size": strconv.FormatInt(req.Size, 10), "max_size": strconv.FormatInt(config.MaxPushSize*1024*1024, 10)},
+		})
+		return false
+	}
+
+	// Older clients only list the objects
+	count := req.ObjectCount
+	if len(req.Objects) > count {
+		count = len(req.Objects)
+	}
+	if config.MaxPushObjects > 0 && count > config.MaxPushObjects {
+		logger.Errorf("Refusing a push of %d objects", count)
+		writeError(w, r, http.StatusRequestEntityTooLarge, common.ErrorResponse{
+			Code:    common.ErrorCodePushTooLarge,
+			Message: fmt.Sprintf("push of %d objects has more than the %d objects allowed", count, config.MaxPushObjects),
+			Details: map[string]string{"objects": strconv.Itoa(count), "max_objects": strconv.Itoa(config.MaxPushObjects)},
+		})
+		return false
+	}
+
+	return true
+}
+
+// repoUsage returns the size in bytes of the objects of the repository
+func repoUsage(repo ostree.Repository) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(filepath.Join(repo.Path(), "objects"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	return size, err
+}
+
+// checkQuota replies with an error and returns false when the objects of
+// the repository already take all of its quota, so that pushes are refused
+// before their objects are uploaded
+func checkQuota(w http.ResponseWriter, r *http.Request, repo ostree.Repository, config *Config) bool {
+	if config.Quota <= 0 {
+		return true
+	}
+
+	used, err := repoUsage(repo)
+	if err != nil {
+		logger.Errorf("Cannot measure the repository: %v", err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if used >= config.Quota*1024*1024 {
+		logger.Errorf("Refusing a push, the repository takes %d bytes", used)
+		writeError(w, r, http.StatusRequestEntityTooLarge, common.ErrorResponse{
+			Code:    common.ErrorCodePushTooLarge,
+			Message: fmt.Sprintf("the repository takes %d MiB of its %d MiB quota", used/1024/1024, config.Quota),
+			Details: map[string]string{"quota_used": strconv.FormatInt(used, 10), "quota_limit": strconv.FormatInt(config.Quota*1024*1024, 10)},
+		})
+		return false
+	}
+
+	return true
+}
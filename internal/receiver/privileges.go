@@ -0,0 +1,201 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/lirios/ostree-upload/internal/logger"
+)
+
+// Environment variable telling the worker the file descriptor of the
+// listener bound by the helper
+const workerListenerVariable = "OSTREE_UPLOAD_LISTENER_FD"
+
+// Privileges makes the server bind its address as root and serve requests
+// as an unprivileged worker, so that neither the parsing of requests nor
+// the writes to the repositories are done as root
+type Privileges struct {
+	// User the worker runs as, privileges are only dropped when it's set
+	User string `yaml:"user,omitempty"`
+	// Group the worker runs as, the group of the user by default
+	Group string `yaml:"group,omitempty"`
+	// Run the worker in a mount namespace where only the repositories, the
+	// log file, the audit log, the offline artifacts, the temporary
+	// directory and Writable can be written to; Linux only
+	PrivateMounts bool `yaml:"private_mounts,omitempty"`
+	// Other paths the worker writes to, with PrivateMounts or when the
+	// sandbox restricts writes
+	Writable []string `yaml:"writable,omitempty"`
+}
+
+// Enabled returns whether the server drops its privileges
+func (p Privileges) Enabled() bool {
+	return p.User != ""
+}
+
+// credential returns the user and group of the worker
+func (p Privileges) credential() (*syscall.Credential, error) {
+	u, err := user.Lookup(p.User)
+	if err != nil {
+		if u, err = user.LookupId(p.User); err != nil {
+			return nil, fmt.Errorf("unknown user \"%s\"", p.User)
+		}
+	}
+	groupID := u.Gid
+	if p.Group != "" {
+		g, err := user.LookupGroup(p.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(p.Group); err != nil {
+				return nil, fmt.Errorf("unknown group \"%s\"", p.Group)
+			}
+		}
+		groupID = g.Gid
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(groupID, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	if uid == 0 {
+		return nil, errors.New("the worker cannot run as root")
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{uint32(gid)}}, nil
+}
+
+// IsWorker returns whether the process is the worker started by the helper
+func IsWorker() bool {
+	return os.Getenv(workerListenerVariable) != ""
+}
+
+// workerListener returns the listener the helper bound for the worker
+func workerListener() (net.Listener, error) {
+	fd, err := strconv.Atoi(os.Getenv(workerListenerVariable))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", workerListenerVariable, err)
+	}
+	file := os.NewFile(uintptr(fd), "listener")
+	defer file.Close()
+
+	return net.FileListener(file)
+}
+
+// writablePaths returns the paths the worker writes to, besides those
+// of the command
+func (c *Config) writablePaths(paths ...string) []string {
+	for _, token := range c.Tokens {
+		if token.Repo != "" {
+			paths = append(paths, token.Repo)
+		}
+	}
+	if c.AuditLog != "" {
+		paths = append(paths, filepath.Dir(c.AuditLog))
+	}
+	if c.OfflineArtifacts.Dir != "" {
+		paths = append(paths, c.OfflineArtifacts.Dir)
+	}
+	paths = append(paths, os.TempDir())
+
+	return append(paths, c.Privileges.Writable...)
+}
+
+// RunHelper binds address and serves it with a worker running the same
+// command as the user of the configuration, if any, and in the sandbox,
+// then waits for the worker to exit, forwarding the signals it receives;
+// the worker writes to the repository at repoPath and to logFile, if any,
+// which is handed over to it
+func RunHelper(address string, config *Config, repoPath, logFile string) error {
+	var credential *syscall.Credential
+	if config.Privileges.Enabled() {
+		var err error
+		if credential, err = config.Privileges.credential(); err != nil {
+			return err
+		}
+	}
+
+	logger.Actionf("Binding %v", address)
+	listener, err := listen(address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	var file *os.File
+	switch l := listener.(type) {
+	case *net.TCPListener:
+		file, err = l.File()
+	case *net.UnixListener:
+		file, err = l.File()
+	default:
+		err = fmt.Errorf("cannot pass a %T to the worker", listener)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The worker appends to the log file the helper might have created
+	writable := []string{repoPath}
+	if logFile != "" {
+		if credential != nil {
+			if err := os.Chown(logFile, int(credential.Uid), int(credential.Gid)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		writable = append(writable, filepath.Dir(logFile))
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = nil
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{file}
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", workerListenerVariable, 3))
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	done, err := startWorker(cmd, config, config.writablePaths(writable...))
+	if err != nil {
+		return fmt.Errorf("failed to start the worker: %v", err)
+	}
+	if credential != nil {
+		logger.Infof("Serving as user %s with worker %d", config.Privileges.User, cmd.Process.Pid)
+	} else {
+		logger.Infof("Serving with worker %d", cmd.Process.Pid)
+	}
+
+	for {
+		select {
+		case sig := <-signals:
+			cmd.Process.Signal(sig)
+		case err := <-done:
+			if err != nil {
+				return fmt.Errorf("worker exited: %v", err)
+			}
+			return nil
+		}
+	}
+}
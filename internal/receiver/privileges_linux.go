@@ -0,0 +1,208 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// startWorker starts the worker, in a mount namespace where only the
+// writable paths can be written to with private mounts and only allowed
+// to write to them by Landlock when writes are restricted, and returns a
+// channel receiving the result of the worker once it exited
+func startWorker(cmd *exec.Cmd, config *Config, writable []string) (<-chan error, error) {
+	// The worker is told when its parent thread dies, and namespaces
+	// and Landlock rulesets belong to threads: start it from a thread of
+	// its own that is kept until the worker exits, and never runs
+	// anything else
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGTERM
+	started := make(chan error, 1)
+	done := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		if config.Privileges.PrivateMounts {
+			if err := syscall.Unshare(syscall.CLONE_NEWNS); err != nil {
+				started <- fmt.Errorf("cannot create a mount namespace: %v", err)
+				return
+			}
+			if err := restrictMounts(writable); err != nil {
+				started <- err
+				return
+			}
+		}
+		if config.Sandbox.RestrictWrites {
+			if err := restrictWrites(writable); err != nil {
+				started <- err
+				return
+			}
+		}
+
+		if err := cmd.Start(); err != nil {
+			started <- err
+			return
+		}
+		started <- nil
+		done <- cmd.Wait()
+	}()
+
+	if err := <-started; err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// mountPoint is a mount of the mount namespace
+type mountPoint struct {
+	path     string
+	flags    uintptr
+	readOnly bool
+}
+
+// Options of a mount that are kept when it's made read-only
+var mountFlags = map[string]uintptr{
+	"nosuid":      syscall.MS_NOSUID,
+	"nodev":       syscall.MS_NODEV,
+	"noexec":      syscall.MS_NOEXEC,
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+}
+
+// readMountPoints returns the mounts of the mount namespace of the
+// calling thread
+func readMountPoints() ([]mountPoint, error) {
+	file, err := os.Open("/proc/thread-self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mounts []mountPoint
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The mount point and its options are the fifth and the sixth fields
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		path, err := unescapeMountPath(fields[4])
+		if err != nil {
+			return nil, err
+		}
+
+		mount := mountPoint{path: path}
+		for _, option := range strings.Split(fields[5], ",") {
+			if option == "ro" {
+				mount.readOnly = true
+			}
+			mount.flags |= mountFlags[option]
+		}
+		mounts = append(mounts, mount)
+	}
+
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes of the paths of mountinfo
+func unescapeMountPath(path string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			value, err := strconv.ParseUint(path[i+1:i+4], 8, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid mount point %s", path)
+			}
+			b.WriteByte(byte(value))
+			i += 3
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+
+	return b.String(), nil
+}
+
+// existingPath returns the absolute path of the closest existing ancestor
+// of path, with symbolic links resolved as in mount points
+func existingPath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return resolved, nil
+		}
+		if !os.IsNotExist(err) || path == filepath.Dir(path) {
+			return "", err
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// isUnder returns whether path is dir or inside it
+func isUnder(path, dir string) bool {
+	return path == dir || dir == "/" || strings.HasPrefix(path, dir+"/")
+}
+
+// restrictMounts makes every mount of the mount namespace of the calling
+// thread read-only except for the writable paths, without changing the
+// mounts of the other namespaces
+func restrictMounts(writable []string) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("cannot make the mounts private: %v", err)
+	}
+
+	// Writable paths become mounts of their own, which stay writable
+	var dirs []string
+	for _, path := range writable {
+		dir, err := existingPath(path)
+		if err != nil {
+			return err
+		}
+		if err := syscall.Mount(dir, dir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("cannot bind %s: %v", dir, err)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	mounts, err := readMountPoints()
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		if mount.readOnly {
+			continue
+		}
+		keep := false
+		for _, dir := range dirs {
+			if isUnder(mount.path, dir) {
+				keep = true
+				break
+			}
+		}
+		if keep {
+			continue
+		}
+
+		flags := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | mount.flags
+		if err := syscall.Mount("", mount.path, "", flags, ""); err != nil {
+			return fmt.Errorf("cannot make %s read-only: %v", mount.path, err)
+		}
+	}
+
+	return nil
+}
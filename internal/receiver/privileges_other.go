@@ -0,0 +1,34 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build !linux
+// +build !linux
+
+package receiver
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// startWorker starts the worker and returns a channel receiving the result
+// of the worker once it exited; mount namespaces and Landlock are only
+// available on Linux
+func startWorker(cmd *exec.Cmd, config *Config, writable []string) (<-chan error, error) {
+	if config.Privileges.PrivateMounts {
+		return nil, errors.New("private mounts are only supported on Linux")
+	}
+	if config.Sandbox.RestrictWrites {
+		return nil, errors.New("restricting writes is only supported on Linux")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	return done, nil
+}
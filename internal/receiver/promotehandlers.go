@@ -0,0 +1,161 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// PromoteHandler points a branch to the commit of another branch of the
+// repository, for example from testing to stable, without uploading anything
+func PromoteHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	ctx := r.Context()
+	queue, ok := ctx.Value(KeyQueue).(*Queue)
+	if !ok {
+		logger.Error("Unable to retrieve queue object from context")
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
+		return
+	}
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+	config, ok := ctx.Value(KeyConfig).(*Config)
+	if !ok {
+		logger.Error("Unable to retrieve configuration from context")
+		httpError(w, r, "no configuration found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Decode request
+	var req common.PromoteRequest
+	err := DecodeJSONBody(w, r, &req)
+	if err != nil {
+		HandleDecodeError(w, r, err)
+		return
+	}
+	for _, branch := range []string{req.From, req.To} {
+		if err := ostree.ValidateRef(branch); err != nil {
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.From == req.To {
+		httpError(w, r, "cannot promote a branch to itself", http.StatusBadRequest)
+		return
+	}
+	if !checkTokenAccess(w, r, common.ScopePromote, req.To) {
+		return
+	}
+	if !checkBranchProtection(w, r, config, req.Confirm, req.To) {
+		return
+	}
+
+	// Don't race with a push of the same branch
+	err = queue.Walk(func(entry *QueueEntry) error {
+		if _, ok := entry.UpdateRefs[req.To]; ok {
+			return fmt.Errorf("branch \"%s\" is already being updated", req.To)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, http.StatusConflict, common.ErrorResponse{
+			Code:    common.ErrorCodeBranchBusy,
+			Message: err.Error(),
+			Details: map[string]string{"branch": req.To},
+		})
+		return
+	}
+
+	revs, err := repo.Refs()
+	if err != nil {
+		logger.Errorf("Failed to list revisions: %v", err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rev, ok := revs[req.From]
+	if !ok {
+		httpError(w, r, fmt.Sprintf("branch \"%s\" not found", req.From), http.StatusNotFound)
+		return
+	}
+	previousRev := revs[req.To]
+
+	// Only move the branch forward and to trusted commits
+	if previousRev != "" && previousRev != rev {
+		if err := checkAncestor(repo, previousRev, rev); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, common.ErrorResponse{
+				Code:    common.ErrorCodeUnprocessable,
+				Message: err.Error(),
+				Details: map[string]string{"branch": req.To, "rev": rev},
+			})
+			return
+		}
+	}
+	if config.VerifySignatures || config.requiresSignature(req.To) {
+		if err := repo.VerifyCommitSignature(rev); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, common.ErrorResponse{
+				Code:    common.ErrorCodeUnprocessable,
+				Message: fmt.Sprintf("commit %s is not signed by a trusted key: %v", rev, err),
+				Details: map[string]string{"branch": req.From, "rev": rev},
+			})
+			return
+		}
+	}
+
+	if previousRev != rev {
+		refs := map[string]common.RevisionPair{req.To: {Server: previousRev, Client: rev}}
+		if err := UpdateRefs(repo, refs); err != nil {
+			logger.Errorf("Failed to promote \"%s\" to \"%s\": %v", req.From, req.To, err)
+			httpError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Infof("Promoted branch \"%s\" to \"%s\" at %s", req.From, req.To, rev)
+
+		record := AuditRecord{Action: auditActionPromote, Repo: repo.Path(), Refs: refs}
+		if err := writeAuditRecord(config, record); err != nil {
+			logger.Errorf("Failed to write the audit log: %v", err)
+		}
+		tokenName := ""
+		if token, ok := r.Context().Value(KeyToken).(*Token); ok {
+			tokenName = token.Name
+		}
+		if err := writePublishRecords(repo, auditActionPromote, tokenName, "", refs); err != nil {
+			logger.Errorf("Failed to write the publish log: %v", err)
+		}
+		notifyUpdate(repo, config, auditActionPromote, "", refs)
+		publishToIPFS(repo, config, nil, refs)
+		if len(config.Notifications) > 0 {
+			announce(config, newAnnouncement(repo, auditActionPromote, "", refs, nil, nil))
+		}
+	}
+
+	object := common.PromoteResponse{Branch: req.To, Rev: rev, PreviousRev: previousRev}
+	EncodeJSONReply(w, r, object)
+}
+
+// checkAncestor returns an error unless ancestor is one of the parents of rev
+func checkAncestor(repo ostree.Repository, ancestor, rev string) error {
+	parent := rev
+	for parent != "" {
+		newParent, err := repo.GetParentRev(parent)
+		if err != nil {
+			return fmt.Errorf("cannot check whether %s descends from %s: %v", rev, ancestor, err)
+		}
+		if newParent == ancestor {
+			return nil
+		}
+		parent = newParent
+	}
+
+	return fmt.Errorf("commit %s doesn't descend from %s", rev, ancestor)
+}
@@ -0,0 +1,135 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// BranchProtection makes updates of the branches matching Refs harder, so
+// that production branches are not updated by accident
+type BranchProtection struct {
+	// Branches the rule applies to, written as for path.Match
+	Refs []string `yaml:"refs"`
+	// Clients have to repeat the name of the branch to update it
+	Confirm bool `yaml:"confirm,omitempty"`
+	// Scope that tokens have to list explicitly to update the branch
+	Scope string `yaml:"scope,omitempty"`
+	// Only update the branch to commits with a valid signature
+	VerifySignatures bool `yaml:"verify_signatures,omitempty"`
+}
+
+// protection returns the rules protecting the branch, all of them apply
+func (c *Config) protection(branch string) []BranchProtection {
+	var rules []BranchProtection
+	for _, rule := range c.ProtectedBranches {
+		if len(rule.Refs) > 0 && common.RefAllowed(rule.Refs, branch) {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// requiresSignature returns whether the branch can only point to signed commits
+func (c *Config) requiresSignature(branch string) bool {
+	for _, rule := range c.protection(branch) {
+		if rule.VerifySignatures {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkBranchProtection replies with an error and returns false unless the
+// request confirmed the update of the protected branches and the token in the
+// request context has the scopes they require
+func checkBranchProtection(w http.ResponseWriter, r *http.Request, config *Config, confirmed []string, branches ...string) bool {
+	token, ok := r.Context().Value(KeyToken).(*Token)
+	if !ok {
+		logger.Error("Unable to retrieve token from context")
+		httpError(w, r, "no token found", http.StatusUnprocessableEntity)
+		return false
+	}
+
+	isConfirmed := map[string]bool{}
+	for _, branch := range confirmed {
+		isConfirmed[branch] = true
+	}
+
+	for _, branch := range branches {
+		for _, rule := range config.protection(branch) {
+			// Tokens without scopes allow everything, which is not enough here
+			if rule.Scope != "" && !listsScope(token, rule.Scope) {
+				writeBranchProtected(w, r, branch, "scope", fmt.Sprintf("branch \"%s\" is protected, the token needs the %s scope", branch, rule.Scope))
+				return false
+			}
+			if rule.Confirm && !isConfirmed[branch] {
+				writeBranchProtected(w, r, branch, "confirm", fmt.Sprintf("branch \"%s\" is protected, confirm the update by passing its name", branch))
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// listsScope returns whether the scopes of the token include scope
+func listsScope(token *Token, scope string) bool {
+	for _, s := range token.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeBranchProtected reports that an update was refused by the protection
+// of the branch, reason is the rule that wasn't satisfied
+func writeBranchProtected(w http.ResponseWriter, r *http.Request, branch, reason, message string) {
+	logger.Errorf("Refusing to update branch \"%s\": %s", branch, message)
+	writeError(w, r, http.StatusForbidden, common.ErrorResponse{
+		Code:    common.ErrorCodeBranchProtected,
+		Message: message,
+		Details: map[string]string{"branch": branch, "reason": reason},
+	})
+}
+
+// checkEntrySignatures checks the signatures of the commits that the entry
+// is going to publish to branches that require them; the commits are moved
+// to the repository first, which is harmless since no branch points to them
+// until they are published
+func checkEntrySignatures(repo ostree.Repository, config *Config, entry *QueueEntry) error {
+	for branch, revPair := range entry.UpdateRefs {
+		if !config.requiresSignature(branch) {
+			continue
+		}
+
+		storage := getStorage(repo)
+		for _, objectName := range []string{revPair.Client + ".commit", revPair.Client + ".commitmeta"} {
+			if staged, err := storage.HasStaged(entry.ID, objectName); err != nil {
+				return err
+			} else if !staged {
+				continue
+			}
+			if err := storage.Promote(entry.ID, objectName, config.Durability.SyncObjects); err != nil {
+				return err
+			}
+		}
+
+		if err := repo.VerifyCommitSignature(revPair.Client); err != nil {
+			return &PolicyViolation{Branch: branch, Rev: revPair.Client, Reason: fmt.Sprintf("branch is protected and the commit is not signed by a trusted key: %v", err)}
+		}
+	}
+
+	return nil
+}
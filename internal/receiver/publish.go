@@ -0,0 +1,179 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Number of published objects between two progress messages
+const publishProgressInterval = 10000
+
+// Key of the detached metadata of commits where the build metadata is stored
+const commitMetadataKey = "ostree-upload.build"
+
+func publishBranches(repo ostree.Repository, config *Config, entry *QueueEntry) (err error) {
+	objects := entry.GetObjects()
+	log := logger.WithField("queue", entry.ID)
+	log.Infof("Publishing %d objects", len(objects))
+	entry.SetFinalizing(true)
+	entry.SetPublished(0)
+	defer entry.SetFinalizing(false)
+
+	emitQueueEvent(repo, common.EventQueueFinalizing, entry)
+	defer func() {
+		if err != nil {
+			emitEvent(repo, common.Event{Type: common.EventPublishFailed, QueueID: entry.ID, Refs: entry.UpdateRefs, Error: err.Error()})
+		}
+	}()
+
+	// Tell people about broken publishes too
+	if len(config.Notifications) > 0 {
+		defer func() {
+			announce(config, newAnnouncement(repo, auditActionPublish, entry.ID, entry.UpdateRefs, entry.Metadata, err))
+		}()
+	}
+
+	// Let the publish be completed or rolled back after a crash
+	if err := writePublishJournal(repo, entry); err != nil {
+		return fmt.Errorf("failed to write the publish journal: %v", err)
+	}
+
+	workers := config.FinalizeWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	storage := getStorage(repo)
+	objectsChan := make(chan string)
+	var errs []error
+	var promoted []string
+	var mutex sync.Mutex
+	var published int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			config.RunBackgroundJob(func() error {
+				for objectName := range objectsChan {
+					if err := storage.Promote(entry.ID, objectName, config.Durability.SyncObjects); err != nil {
+						log.Error(err)
+						mutex.Lock()
+						errs = append(errs, err)
+						mutex.Unlock()
+						continue
+					}
+
+					mutex.Lock()
+					promoted = append(promoted, objectName)
+					mutex.Unlock()
+
+					count := atomic.AddInt64(&published, 1)
+					entry.SetPublished(int(count))
+					if count%publishProgressInterval == 0 {
+						log.Infof("Published %d/%d objects", count, len(objects))
+					}
+					emitQueueProgress(repo, entry)
+				}
+				return nil
+			})
+		}()
+	}
+
+	for _, objectName := range objects {
+		objectsChan <- objectName
+	}
+	close(objectsChan)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to publish %d objects, first error: %v", len(errs), errs[0])
+	}
+
+	// Make published commits traceable back to their build
+	if config.CommitMetadata && len(entry.Metadata) > 0 {
+		for _, revPair := range entry.UpdateRefs {
+			if err := repo.SetDetachedMetadata(revPair.Client, commitMetadataKey, entry.Metadata); err != nil {
+				return fmt.Errorf("failed to store build metadata in commit %s: %v", revPair.Client, err)
+			}
+			promoted = append(promoted, revPair.Client+".commit")
+		}
+	}
+
+	// Make sure the objects are reachable after a crash before refs point to them
+	if config.Durability.SyncDirs {
+		if err := storage.SyncPromoted(promoted); err != nil {
+			return err
+		}
+	}
+
+	// Clients can change what end users see in the summary, which is
+	// regenerated with the branches
+	if len(entry.SummaryMetadata) > 0 {
+		if err := updateSummaryMetadata(repo, entry.SummaryMetadata); err != nil {
+			return fmt.Errorf("failed to update the summary metadata: %v", err)
+		}
+	}
+
+	// SBOMs are available as soon as the commits are
+	if err := publishSBOMs(repo, entry); err != nil {
+		return fmt.Errorf("failed to publish the SBOMs: %v", err)
+	}
+
+	// Update refs, and make them durable before anybody is told about them
+	if err := UpdateRefs(repo, entry.UpdateRefs); err != nil {
+		return err
+	}
+	if config.Durability.SyncRefs {
+		if err := syncRefs(repo, entry.UpdateRefs); err != nil {
+			return err
+		}
+	}
+
+	record := AuditRecord{Action: auditActionPublish, Repo: repo.Path(), QueueID: entry.ID, Refs: entry.UpdateRefs, Metadata: entry.Metadata}
+	if err := writeAuditRecord(config, record); err != nil {
+		log.Errorf("Failed to write the audit log: %v", err)
+	}
+	if err := writePublishRecords(repo, auditActionPublish, entry.Token, entry.ID, entry.UpdateRefs); err != nil {
+		log.Errorf("Failed to write the publish log: %v", err)
+	}
+	notifyUpdate(repo, config, auditActionPublish, entry.ID, entry.UpdateRefs)
+	publishToIPFS(repo, config, promoted, entry.UpdateRefs)
+	writeOfflineArtifacts(repo, config, entry.UpdateRefs)
+
+	return nil
+}
+
+// syncRefs flushes to disk the refs of branches and the directories
+// that contain them, refs of removed branches are gone
+func syncRefs(repo ostree.Repository, refs map[string]common.RevisionPair) error {
+	paths := map[string]bool{repo.Path(): true}
+	for branch := range refs {
+		ref := filepath.Join(repo.Path(), "refs", "heads", branch)
+		if _, err := os.Stat(ref); err == nil {
+			paths[ref] = true
+		}
+		paths[filepath.Dir(ref)] = true
+	}
+	for path := range paths {
+		if err := syncPath(path); err != nil {
+			return fmt.Errorf("failed to sync \"%s\": %v", path, err)
+		}
+	}
+
+	return nil
+}
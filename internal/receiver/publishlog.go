@@ -0,0 +1,179 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Path of the publish log relative to the repository, outside of the
+// temporary directory that OSTree cleans up
+const publishLogName = "ostree-upload/publishes.log"
+
+// Maximum number of publishes returned by PublishHistoryHandler
+const maxPublishHistoryLength = 1000
+
+// PublishRecord is a line of the publish log, one per updated branch
+type PublishRecord struct {
+	Time   string `json:"time"`
+	Action string `json:"action"`
+	Branch string `json:"branch"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to"`
+	// Name of the token that updated the branch
+	Token   string `json:"token,omitempty"`
+	QueueID string `json:"queue,omitempty"`
+}
+
+// Serializes writes to the publish logs
+var publishLogMutex sync.Mutex
+
+// publishLogPath returns the path of the publish log of the repository
+func publishLogPath(repo ostree.Repository) string {
+	return filepath.Join(repo.Path(), publishLogName)
+}
+
+// writePublishRecords appends a record for each branch to the publish log
+// of the repository, unlike the audit log it's always kept since rollbacks
+// and the history API rely on it
+func writePublishRecords(repo ostree.Repository, action, token, queueID string, refs map[string]common.RevisionPair) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	var data []byte
+	for branch, revPair := range refs {
+		record := PublishRecord{Time: now, Action: action, Branch: branch, From: revPair.Server, To: revPair.Client, Token: token, QueueID: queueID}
+		js, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		data = append(data, append(js, '\n')...)
+	}
+
+	publishLogMutex.Lock()
+	defer publishLogMutex.Unlock()
+
+	path := publishLogPath(repo)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// readPublishRecords returns the publishes of the branch, or of all of them
+// when branch is empty, from the newest, at most limit of them
+func readPublishRecords(repo ostree.Repository, branch string, limit int) ([]PublishRecord, error) {
+	publishLogMutex.Lock()
+	defer publishLogMutex.Unlock()
+
+	file, err := os.Open(publishLogPath(repo))
+	if os.IsNotExist(err) {
+		return []PublishRecord{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []PublishRecord{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record PublishRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A crash may leave a partial line behind
+			logger.Warnf("Skipping invalid line of the publish log: %v", err)
+			continue
+		}
+		if branch == "" || record.Branch == branch {
+			records = append(records, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Newest first
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	if len(records) > limit {
+		records = records[:limit]
+	}
+
+	return records, nil
+}
+
+// PublishHistoryHandler returns the publishes of a branch from the newest,
+// served at /history with API v1 and /publishes with API v2, where /history
+// returns the commits of the branch
+func PublishHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	repo, ok := r.Context().Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	branch := r.URL.Query().Get("ref")
+	if branch == "" {
+		httpError(w, r, "missing ref parameter", http.StatusBadRequest)
+		return
+	}
+	branch = mapRequestRef(r, branch)
+	if err := ostree.ValidateRef(branch); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := maxPublishHistoryLength
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			httpError(w, r, fmt.Sprintf("invalid limit \"%s\"", value), http.StatusBadRequest)
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	records, err := readPublishRecords(repo, branch, limit)
+	if err != nil {
+		logger.Errorf("Failed to read the publish log: %v", err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	object := common.PublishHistoryResponse{Branch: branch, Publishes: make([]common.PublishResponse, 0, len(records))}
+	for _, record := range records {
+		object.Publishes = append(object.Publishes, common.PublishResponse{
+			Time:   record.Time,
+			Action: record.Action,
+			From:   record.From,
+			To:     record.To,
+			Token:  record.Token,
+		})
+	}
+	EncodeJSONReply(w, r, object)
+}
@@ -5,6 +5,9 @@
 package receiver
 
 import (
+	"sync"
+	"time"
+
 	"github.com/hashicorp/go-memdb"
 
 	"github.com/lirios/ostree-upload/internal/common"
@@ -12,15 +15,248 @@ import (
 
 // QueueEntry represents an entry in the update queue
 type QueueEntry struct {
-	ID         string
-	UpdateRefs map[string]common.RevisionPair
-	Objects    []string
+	ID           string
+	UpdateRefs   map[string]common.RevisionPair
+	Objects      []string
+	DeferPublish bool
+	// Build information supplied by the client
+	Metadata map[string]string
+	// Metadata merged into the summary, as decoded from JSON
+	SummaryMetadata map[string]interface{}
+	Created         time.Time
+	// Name of the token that created the entry
+	Token string
+	// Objects are uploaded encrypted, they're decrypted when publishing
+	Encrypted bool
+
+	mutex      sync.RWMutex
+	objectSet  map[string]bool
+	queue      *Queue
+	uploads    map[string]*resumableUpload
+	finalizing bool
+	// Manifest of the push, once its signature was verified
+	manifest *common.QueueManifest
+	// Objects staged encrypted, until they're decrypted
+	encrypted map[string]bool
+
+	// Objects received in the staging area and their size, then objects
+	// published, for the progress of the push
+	received      int
+	receivedBytes int64
+	published     int
+}
+
+// SetFinalizing records whether the branches of the entry are being published
+func (e *QueueEntry) SetFinalizing(finalizing bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.finalizing = finalizing
+}
+
+// Finalizing returns whether the branches of the entry are being published
+func (e *QueueEntry) Finalizing() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.finalizing
+}
+
+// SetManifest records the manifest of the push signed by the builder
+func (e *QueueEntry) SetManifest(manifest *common.QueueManifest) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.manifest = manifest
+}
+
+// Manifest returns the manifest of the push signed by the builder, nil if
+// none was received
+func (e *QueueEntry) Manifest() *common.QueueManifest {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.manifest
+}
+
+// AddEncrypted records an object staged encrypted
+func (e *QueueEntry) AddEncrypted(objectName string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.encrypted == nil {
+		e.encrypted = map[string]bool{}
+	}
+	e.encrypted[objectName] = true
+}
+
+// SetDecrypted records that a staged object was decrypted
+func (e *QueueEntry) SetDecrypted(objectName string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	delete(e.encrypted, objectName)
+}
+
+// EncryptedObjects returns the objects that are staged encrypted
+func (e *QueueEntry) EncryptedObjects() []string {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	objects := make([]string, 0, len(e.encrypted))
+	for objectName := range e.encrypted {
+		objects = append(objects, objectName)
+	}
+	return objects
+}
+
+// AddReceived records an object of size bytes received in the staging area
+func (e *QueueEntry) AddReceived(size int64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.received++
+	e.receivedBytes += size
+}
+
+// SetPublished records the number of objects published so far
+func (e *QueueEntry) SetPublished(published int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.published = published
+}
+
+// Progress returns the number of objects received and their size, and the
+// number of objects published
+func (e *QueueEntry) Progress() (int, int64, int) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.received, e.receivedBytes, e.published
+}
+
+// resumableUpload is an object being uploaded in several requests
+type resumableUpload struct {
+	length int64
+	busy   bool
+}
+
+// StartUpload registers the upload of an object of the specified length,
+// it returns false if the object is already being uploaded
+func (e *QueueEntry) StartUpload(objectName string, length int64) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.uploads == nil {
+		e.uploads = map[string]*resumableUpload{}
+	}
+	if _, ok := e.uploads[objectName]; ok {
+		return false
+	}
+
+	e.uploads[objectName] = &resumableUpload{length: length}
+	return true
+}
+
+// UploadLength returns the length of the object being uploaded
+func (e *QueueEntry) UploadLength(objectName string) (int64, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	upload, ok := e.uploads[objectName]
+	if !ok {
+		return 0, false
+	}
+	return upload.length, true
+}
+
+// LockUpload makes sure only one request appends to an upload at a time,
+// it returns false if the upload doesn't exist or is locked
+func (e *QueueEntry) LockUpload(objectName string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	upload, ok := e.uploads[objectName]
+	if !ok || upload.busy {
+		return false
+	}
+	upload.busy = true
+	return true
+}
+
+// UnlockUpload lets other requests append to the upload
+func (e *QueueEntry) UnlockUpload(objectName string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if upload, ok := e.uploads[objectName]; ok {
+		upload.busy = false
+	}
+}
+
+// FinishUpload forgets the upload of an object
+func (e *QueueEntry) FinishUpload(objectName string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	delete(e.uploads, objectName)
+}
+
+// AddObjects appends objects to the list of objects needed by the entry,
+// ignoring those that were already added
+func (e *QueueEntry) AddObjects(objects []string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.objectSet == nil {
+		e.objectSet = map[string]bool{}
+		for _, objectName := range e.Objects {
+			e.objectSet[objectName] = true
+		}
+	}
+
+	added := []string{}
+	for _, objectName := range objects {
+		if !e.objectSet[objectName] {
+			e.objectSet[objectName] = true
+			e.Objects = append(e.Objects, objectName)
+			added = append(added, objectName)
+		}
+	}
+
+	if e.queue != nil {
+		e.queue.referenceObjects(added)
+	}
+}
+
+// uniqueObjects returns the objects without duplicates, in the same order;
+// branches pushed together often share most of their objects
+func uniqueObjects(objects []string) []string {
+	seen := make(map[string]bool, len(objects))
+	unique := make([]string, 0, len(objects))
+	for _, objectName := range objects {
+		if !seen[objectName] {
+			seen[objectName] = true
+			unique = append(unique, objectName)
+		}
+	}
+
+	return unique
+}
+
+// GetObjects returns a copy of the list of objects needed by the entry
+func (e *QueueEntry) GetObjects() []string {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return append([]string{}, e.Objects...)
+}
+
+// getQueue returns the queue the entry was added to, nil once removed
+func (e *QueueEntry) getQueue() *Queue {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.queue
 }
 
 // Queue represents the update queue
 type Queue struct {
 	schema *memdb.DBSchema
 	db     *memdb.MemDB
+
+	// Number of entries needing each object, objects staged for an entry
+	// are shared with the other entries needing them
+	objectRefs      map[string]int
+	objectRefsMutex sync.Mutex
 }
 
 // QueueWalkFn is a function prototype for Walk()
@@ -49,7 +285,7 @@ func NewQueue() (*Queue, error) {
 		return nil, err
 	}
 
-	return &Queue{schema, db}, nil
+	return &Queue{schema: schema, db: db, objectRefs: map[string]int{}}, nil
 }
 
 // AddEntry adds an entry to the queue
@@ -60,6 +296,12 @@ func (q *Queue) AddEntry(entry *QueueEntry) error {
 		return err
 	}
 	txn.Commit()
+
+	entry.mutex.Lock()
+	entry.queue = q
+	q.referenceObjects(entry.Objects)
+	entry.mutex.Unlock()
+
 	return nil
 }
 
@@ -71,9 +313,42 @@ func (q *Queue) RemoveEntry(entry *QueueEntry) error {
 		return err
 	}
 	txn.Commit()
+
+	entry.mutex.Lock()
+	entry.queue = nil
+	q.releaseObjects(entry.Objects)
+	entry.mutex.Unlock()
+
 	return nil
 }
 
+// IsObjectReferenced returns whether any entry in the queue needs the object
+func (q *Queue) IsObjectReferenced(objectName string) bool {
+	q.objectRefsMutex.Lock()
+	defer q.objectRefsMutex.Unlock()
+	return q.objectRefs[objectName] > 0
+}
+
+func (q *Queue) referenceObjects(objects []string) {
+	q.objectRefsMutex.Lock()
+	defer q.objectRefsMutex.Unlock()
+	for _, objectName := range objects {
+		q.objectRefs[objectName]++
+	}
+}
+
+func (q *Queue) releaseObjects(objects []string) {
+	q.objectRefsMutex.Lock()
+	defer q.objectRefsMutex.Unlock()
+	for _, objectName := range objects {
+		if q.objectRefs[objectName] <= 1 {
+			delete(q.objectRefs, objectName)
+		} else {
+			q.objectRefs[objectName]--
+		}
+	}
+}
+
 // GetEntry returns the entry corresponding to the specified ID
 func (q *Queue) GetEntry(ID string) (*QueueEntry, error) {
 	txn := q.db.Txn(false)
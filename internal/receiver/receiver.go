@@ -10,7 +10,7 @@ import (
 	"path/filepath"
 
 	"github.com/lirios/ostree-upload/internal/common"
-	"github.com/lirios/ostree-upload/internal/ostree"
+	"github.com/lirios/ostree-upload/pkg/ostree"
 )
 
 // ContextKey is a type that represent the key of a context
@@ -20,15 +20,24 @@ const (
 	// KeyQueue is the context key for the update queue
 	KeyQueue ContextKey = iota
 
-	// KeyRepository is the context key for the ostree.Repo instance
+	// KeyRepository is the context key for the ostree.Repository instance
 	KeyRepository ContextKey = iota
+
+	// KeyConfig is the context key for the configuration
+	KeyConfig ContextKey = iota
+
+	// KeyAPIVersion is the context key for the version of the API being called
+	KeyAPIVersion ContextKey = iota
+
+	// KeyToken is the context key for the token of the request
+	KeyToken ContextKey = iota
 )
 
 // Name of the temporary directory inside the OSTree repository
 const tempDirName = "tmp/ostree-upload"
 
 // CreateTempDirectory creates a temporary directory inside the repository, used to store the objects during the upload
-func CreateTempDirectory(r *ostree.Repo) error {
+func CreateTempDirectory(r ostree.Repository) error {
 	tempPath := filepath.Join(r.Path(), tempDirName)
 
 	// Check if the temporary directory already exist
@@ -44,23 +53,121 @@ func CreateTempDirectory(r *ostree.Repo) error {
 	return nil
 }
 
+// GetEntryTempDirectory returns the path to the directory where the objects
+// uploaded for a queue entry are stored
+func GetEntryTempDirectory(r ostree.Repository, queueID string) string {
+	return filepath.Join(r.Path(), tempDirName, queueID)
+}
+
+// CreateEntryTempDirectory creates the directory where the objects uploaded
+// for a queue entry are stored
+func CreateEntryTempDirectory(r ostree.Repository, queueID string) error {
+	return os.Mkdir(GetEntryTempDirectory(r, queueID), 0755)
+}
+
+// RemoveEntryTempDirectory removes the directory of a queue entry together
+// with the objects that were not published
+func RemoveEntryTempDirectory(r ostree.Repository, queueID string) error {
+	return os.RemoveAll(GetEntryTempDirectory(r, queueID))
+}
+
 // GetTempObjectPath returns the path to the OSTree object passed as argument
-// from the temporary directory
-func GetTempObjectPath(r *ostree.Repo, objectName string) string {
-	return filepath.Join(r.Path(), tempDirName, objectName)
+// from the temporary directory of a queue entry
+func GetTempObjectPath(r ostree.Repository, queueID, objectName string) string {
+	return filepath.Join(GetEntryTempDirectory(r, queueID), objectName)
 }
 
 // UpdateRefs points branches to the new checksum
-func UpdateRefs(r *ostree.Repo, refs map[string]common.RevisionPair) error {
+func UpdateRefs(r ostree.Repository, refs map[string]common.RevisionPair) error {
 	for branch, revPair := range refs {
 		if err := r.SetRefImmediate("", branch, revPair.Client); err != nil {
 			return fmt.Errorf("Failed to set branch %s from %s to %s: %v", branch, revPair.Server, revPair.Client, err)
 		}
 	}
 
-	if err := r.RegenerateSummary(); err != nil {
+	if err := regenerateSummary(r); err != nil {
 		return fmt.Errorf("Failed to regenerate summary: %v", err)
 	}
 
+	branches := make([]string, 0, len(refs))
+	for branch := range refs {
+		branches = append(branches, branch)
+	}
+	if err := publishRefs(r, branches); err != nil {
+		return fmt.Errorf("Failed to publish branches: %v", err)
+	}
+
 	return nil
 }
+
+// publishRefs hands the refs of the branches to the storage, together with
+// the summary unless its update is postponed
+func publishRefs(r ostree.Repository, branches []string) error {
+	names := make([]string, 0, len(branches)+len(summaryFiles))
+	for _, branch := range branches {
+		names = append(names, "refs/heads/"+branch)
+	}
+	if _, debounced := r.(*debouncedRepository); !debounced {
+		names = append(names, summaryFiles...)
+	}
+
+	return getStorage(r).PublishFiles(names)
+}
+
+// FindNeededObjects walks the commits the entry is going to publish, using the
+// metadata objects found in the repository or uploaded to the temporary directory
+// of the entry or of another entry, and returns the objects that still need to be uploaded; objects
+// that are waiting in the temporary directory are added to the entry
+func FindNeededObjects(r ostree.Repository, entry *QueueEntry) ([]string, error) {
+	pending := []string{}
+	for _, revPair := range entry.UpdateRefs {
+		pending = append(pending, fmt.Sprintf("%s.commit", revPair.Client))
+	}
+
+	storage := getStorage(r)
+	visited := map[string]bool{}
+	staged := []string{}
+	missing := []string{}
+
+	for len(pending) > 0 {
+		objectName := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if visited[objectName] {
+			continue
+		}
+		visited[objectName] = true
+
+		// Objects already published are complete with their children
+		if has, err := storage.HasObject(objectName); err == nil && has {
+			continue
+		}
+
+		if isStaged, err := storage.HasStaged(entry.ID, objectName); err == nil && !isStaged && !stageShared(storage, entry, objectName) {
+			missing = append(missing, objectName)
+			continue
+		}
+		staged = append(staged, objectName)
+
+		tempPath, err := storage.StagedPath(entry.ID, objectName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read object \"%s\": %v", objectName, err)
+		}
+
+		children, err := r.ReadObjectChildren(tempPath, objectName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read object \"%s\": %v", objectName, err)
+		}
+		// Children are looked up by name, uploaded objects must not
+		// reference paths outside of the repository
+		if err := validateObjectNames(r, children); err != nil {
+			return nil, fmt.Errorf("Object \"%s\" references an invalid object: %v", objectName, err)
+		}
+		pending = append(pending, children...)
+	}
+
+	entry.AddObjects(staged)
+	entry.AddObjects(missing)
+
+	return missing, nil
+}
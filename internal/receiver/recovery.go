@@ -0,0 +1,176 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Name of the journal written in the temporary directory of a queue entry
+// while it's published, the queue itself doesn't survive a restart
+const publishJournalName = "publish.json"
+
+// publishJournal is what is needed to complete a publish after a crash
+type publishJournal struct {
+	QueueID  string                         `json:"queue_id"`
+	Refs     map[string]common.RevisionPair `json:"refs"`
+	Objects  []string                       `json:"objects"`
+	Metadata map[string]string              `json:"metadata,omitempty"`
+	// Metadata merged into the summary
+	SummaryMetadata map[string]interface{} `json:"summary_metadata,omitempty"`
+}
+
+// writePublishJournal records that the entry is being published, the
+// journal is removed together with the temporary directory of the entry
+func writePublishJournal(repo ostree.Repository, entry *QueueEntry) error {
+	journal := publishJournal{
+		QueueID:  entry.ID,
+		Refs:     entry.UpdateRefs,
+		Objects:  entry.GetObjects(),
+		Metadata: entry.Metadata,
+		// The values are kept as decoded from JSON
+		SummaryMetadata: entry.SummaryMetadata,
+	}
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+
+	// Write the journal atomically, a partial one would be useless
+	path := filepath.Join(GetEntryTempDirectory(repo, entry.ID), publishJournalName)
+	if err := ioutil.WriteFile(path+".part", data, 0644); err != nil {
+		return err
+	}
+	if err := syncPath(path + ".part"); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".part", path); err != nil {
+		return err
+	}
+
+	return syncPath(filepath.Dir(path))
+}
+
+// readPublishJournal returns the journal of the queue entry, or nil
+// if the entry wasn't being published
+func readPublishJournal(repo ostree.Repository, queueID string) (*publishJournal, error) {
+	data, err := ioutil.ReadFile(filepath.Join(GetEntryTempDirectory(repo, queueID), publishJournalName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var journal publishJournal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return nil, err
+	}
+
+	return &journal, nil
+}
+
+// RecoverPublishes completes or rolls back the publishes that were interrupted
+// by a crash, it must be called before the repository is pruned.
+// A publish is completed when a branch was already updated or when all its
+// objects are still available, otherwise it's rolled back: branches that were
+// updated are pointed back to their previous commit and the objects that were
+// not published are removed.
+// Only publishes that started are recovered: the queue is kept in memory, so
+// entries that were still uploading or waiting to be published when the
+// receiver stopped are lost, clients push them again and CollectStaging
+// removes what they uploaded.
+func RecoverPublishes(repo ostree.Repository, config *Config) error {
+	dirs, err := ioutil.ReadDir(filepath.Join(repo.Path(), tempDirName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		journal, err := readPublishJournal(repo, dir.Name())
+		if err != nil {
+			return fmt.Errorf("failed to read the publish journal of queue entry %s: %v", dir.Name(), err)
+		}
+		if journal == nil {
+			continue
+		}
+
+		if err := recoverPublish(repo, config, journal); err != nil {
+			return fmt.Errorf("failed to recover the publish of queue entry %s: %v", journal.QueueID, err)
+		}
+		if err := removeEntryStaging(repo, journal.QueueID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recoverPublish completes or rolls back a single publish
+func recoverPublish(repo ostree.Repository, config *Config, journal *publishJournal) error {
+	log := logger.WithField("queue", journal.QueueID)
+
+	revs, err := repo.Refs()
+	if err != nil {
+		return err
+	}
+	updated := []string{}
+	for branch, revPair := range journal.Refs {
+		if revs[branch] == revPair.Client {
+			updated = append(updated, branch)
+		}
+	}
+
+	storage := getStorage(repo)
+	missing := 0
+	for _, objectName := range journal.Objects {
+		if has, err := storage.HasObject(objectName); err == nil && has {
+			continue
+		}
+		if staged, err := storage.HasStaged(journal.QueueID, objectName); err == nil && staged {
+			continue
+		}
+		missing++
+	}
+
+	if missing == 0 {
+		log.Infof("Completing the interrupted publish of %d branches", len(journal.Refs))
+		entry := &QueueEntry{ID: journal.QueueID, UpdateRefs: journal.Refs, Objects: journal.Objects, Metadata: journal.Metadata, SummaryMetadata: journal.SummaryMetadata}
+		return publishBranches(repo, config, entry)
+	}
+
+	log.Warnf("Rolling back the interrupted publish of %d branches, %d objects are missing", len(journal.Refs), missing)
+	for _, branch := range updated {
+		revPair := journal.Refs[branch]
+		if revPair.Server == "" {
+			log.Errorf("Branch \"%s\" was created and points to the incomplete commit %s", branch, revPair.Client)
+			continue
+		}
+		if err := repo.SetRefImmediate("", branch, revPair.Server); err != nil {
+			return fmt.Errorf("failed to set branch %s back to %s: %v", branch, revPair.Server, err)
+		}
+	}
+	if len(updated) > 0 {
+		if err := regenerateSummary(repo); err != nil {
+			return err
+		}
+		return publishRefs(repo, updated)
+	}
+
+	return nil
+}
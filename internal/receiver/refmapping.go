@@ -0,0 +1,158 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// RefMapping rewrites the names of the branches sent by the clients using
+// some tokens, so that pipelines sharing a repository don't clobber each
+// other's branches
+type RefMapping struct {
+	// Names of the tokens the rule applies to, all of them by default
+	Tokens []string `yaml:"tokens,omitempty"`
+	// Prefix of the branches the rule applies to, replaced by To; all the
+	// branches when empty
+	From string `yaml:"from,omitempty"`
+	To   string `yaml:"to"`
+}
+
+// appliesTo returns whether the rule rewrites the branches of the token
+func (m *RefMapping) appliesTo(token *Token) bool {
+	if len(m.Tokens) == 0 {
+		return true
+	}
+	if token == nil {
+		return false
+	}
+	for _, name := range m.Tokens {
+		if name == token.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mapRef returns the branch stored in the repository when a client using
+// the token names branch, the first rule that applies rewrites it
+func mapRef(config *Config, token *Token, branch string) string {
+	for i := range config.RefMappings {
+		m := &config.RefMappings[i]
+		if m.appliesTo(token) && strings.HasPrefix(branch, m.From) {
+			return m.To + strings.TrimPrefix(branch, m.From)
+		}
+	}
+
+	return branch
+}
+
+// unmapRef returns the name clients using the token give to branch of the
+// repository, branch itself when it's not rewritten
+func unmapRef(config *Config, token *Token, branch string) string {
+	for i := range config.RefMappings {
+		m := &config.RefMappings[i]
+		if !m.appliesTo(token) || !strings.HasPrefix(branch, m.To) {
+			continue
+		}
+		clientBranch := m.From + strings.TrimPrefix(branch, m.To)
+		if mapRef(config, token, clientBranch) == branch {
+			return clientBranch
+		}
+	}
+
+	return branch
+}
+
+// unmapRefs returns the branches of the repository as seen by clients using
+// the token: those they cannot name are left out and the rewritten ones are
+// listed with the names clients give them
+func unmapRefs(config *Config, token *Token, refs map[string]string) map[string]string {
+	if len(config.RefMappings) == 0 {
+		return refs
+	}
+
+	view := map[string]string{}
+	for branch, rev := range refs {
+		if mapRef(config, token, branch) == branch {
+			view[branch] = rev
+		}
+	}
+	for branch, rev := range refs {
+		if clientBranch := unmapRef(config, token, branch); clientBranch != branch {
+			view[clientBranch] = rev
+		}
+	}
+
+	return view
+}
+
+// requestMapping returns the configuration and token of the request, the
+// configuration is nil when branches are not rewritten
+func requestMapping(r *http.Request) (*Config, *Token) {
+	config, ok := r.Context().Value(KeyConfig).(*Config)
+	if !ok || len(config.RefMappings) == 0 {
+		return nil, nil
+	}
+	token, _ := r.Context().Value(KeyToken).(*Token)
+
+	return config, token
+}
+
+// mapRequestRef returns the branch of the repository named branch by the
+// client of the request
+func mapRequestRef(r *http.Request, branch string) string {
+	config, token := requestMapping(r)
+	if config == nil {
+		return branch
+	}
+
+	return mapRef(config, token, branch)
+}
+
+// mapRequestRefs rewrites the branches updated by the client of the request,
+// it fails when the new names are invalid or the same
+func mapRequestRefs(r *http.Request, refs map[string]common.RevisionPair) (map[string]common.RevisionPair, error) {
+	config, token := requestMapping(r)
+	if config == nil {
+		return refs, nil
+	}
+
+	mapped := make(map[string]common.RevisionPair, len(refs))
+	for branch, revPair := range refs {
+		mappedBranch := mapRef(config, token, branch)
+		if err := ostree.ValidateRef(mappedBranch); err != nil {
+			return nil, fmt.Errorf("branch \"%s\" is rewritten to an invalid name: %v", branch, err)
+		}
+		if _, ok := mapped[mappedBranch]; ok {
+			return nil, fmt.Errorf("more than one branch is rewritten to \"%s\"", mappedBranch)
+		}
+		mapped[mappedBranch] = revPair
+	}
+
+	return mapped, nil
+}
+
+// unmapRequestRefs returns the branches updated by a queue entry with the
+// names the client of the request gives them
+func unmapRequestRefs(r *http.Request, refs map[string]common.RevisionPair) map[string]common.RevisionPair {
+	config, token := requestMapping(r)
+	if config == nil {
+		return refs
+	}
+
+	unmapped := make(map[string]common.RevisionPair, len(refs))
+	for branch, revPair := range refs {
+		unmapped[unmapRef(config, token, branch)] = revPair
+	}
+
+	return unmapped
+}
@@ -0,0 +1,675 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chilts/sid"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Ways a secondary learns about the publishes of the primary
+const (
+	replicationModePoll    = "poll"
+	replicationModeWebhook = "webhook"
+)
+
+// Replication makes the receiver a secondary that mirrors the repository
+// of another receiver, the primary, after each of its publishes
+type Replication struct {
+	// URL of the primary, as passed to push with --address, replication
+	// is disabled without it
+	Primary string `yaml:"primary,omitempty"`
+	// Token of the primary, it needs the pull scope
+	Token string `yaml:"token,omitempty"`
+	// Branches replicated, written as for path.Match, all of them by default
+	Refs []string `yaml:"refs,omitempty"`
+	// Either "poll", waiting for publishes with long requests to the
+	// primary, or "webhook", when an update hook of the primary posts to
+	// the secondary; "poll" by default
+	Mode string `yaml:"mode,omitempty"`
+	// How often the primary is checked with webhooks, in case one is lost,
+	// 10 minutes by default
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Number of objects downloaded at the same time, as many as CPUs by
+	// default
+	Workers int `yaml:"workers,omitempty"`
+	// Replace the branches updated on the secondary with those of the
+	// primary, instead of leaving them alone
+	Overwrite bool `yaml:"overwrite,omitempty"`
+}
+
+// Path of the commits replicated so far relative to the repository, next
+// to the publish log
+const replicationStateName = "ostree-upload/replication.json"
+
+// Longest time a secondary waits for a publish, below the timeout of API
+// requests
+const maxReplicationWait = 50 * time.Second
+
+// Time secondaries wait for a publish when polling
+const replicationPollWait = 45 * time.Second
+
+// Time between the checks of the primary with webhooks by default
+const defaultReplicationInterval = 10 * time.Minute
+
+// Time before a secondary tries again after a failure
+const replicationRetryDelay = 30 * time.Second
+
+// Replications since the receiver started, for the metrics
+var (
+	replicationFailures    int64
+	replicationConflicts   int64
+	replicationLastSuccess int64
+)
+
+// replicationWatch wakes up the secondaries waiting for an update of a
+// repository
+type replicationWatch struct {
+	epoch   int64
+	updated chan struct{}
+}
+
+// Watches of the repositories, by path
+var (
+	replicationWatchesMutex sync.Mutex
+	replicationWatches      = map[string]*replicationWatch{}
+)
+
+// getReplicationWatch returns the watch of the repository, called with the
+// mutex held; the first epoch is the time the receiver started watching, so
+// that secondaries find out about a restart of the primary
+func getReplicationWatch(repo ostree.Repository) *replicationWatch {
+	watch, ok := replicationWatches[repo.Path()]
+	if !ok {
+		watch = &replicationWatch{epoch: time.Now().UnixNano(), updated: make(chan struct{})}
+		replicationWatches[repo.Path()] = watch
+	}
+
+	return watch
+}
+
+// wakeReplicas tells the secondaries waiting for an update of the
+// repository that it happened at epoch
+func wakeReplicas(repo ostree.Repository, epoch int64) {
+	replicationWatchesMutex.Lock()
+	defer replicationWatchesMutex.Unlock()
+
+	watch := getReplicationWatch(repo)
+	if epoch > watch.epoch {
+		watch.epoch = epoch
+	}
+	close(watch.updated)
+	watch.updated = make(chan struct{})
+}
+
+// ReplicationHandler describes the repository to secondaries; when they
+// pass the epoch of their last reply with since, it waits for the next
+// update first, for up to the seconds of the wait parameter
+func ReplicationHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	ctx := r.Context()
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+	if !checkTokenAccess(w, r, common.ScopePull) {
+		return
+	}
+
+	var since, waitSeconds int64
+	var err error
+	if value := r.URL.Query().Get("since"); value != "" {
+		if since, err = strconv.ParseInt(value, 10, 64); err != nil {
+			httpError(w, r, fmt.Sprintf("invalid since parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("wait"); value != "" {
+		if waitSeconds, err = strconv.ParseInt(value, 10, 64); err != nil || waitSeconds < 0 {
+			httpError(w, r, "invalid wait parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	wait := time.Duration(waitSeconds) * time.Second
+	if wait > maxReplicationWait {
+		wait = maxReplicationWait
+	}
+
+	replicationWatchesMutex.Lock()
+	watch := getReplicationWatch(repo)
+	epoch, updated := watch.epoch, watch.updated
+	replicationWatchesMutex.Unlock()
+
+	if since >= epoch && wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-updated:
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+
+		replicationWatchesMutex.Lock()
+		epoch = getReplicationWatch(repo).epoch
+		replicationWatchesMutex.Unlock()
+	}
+
+	mode, err := repo.GetMode()
+	if err != nil {
+		logger.Errorf("Failed to get repository mode: %v", err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	revs, err := repo.Refs()
+	if err != nil {
+		logger.Errorf("Failed to list revisions: %v", err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	object := common.ReplicationResponse{Epoch: epoch, Mode: mode, Revs: revs}
+	EncodeJSONReply(w, r, object)
+}
+
+// Secondaries waiting for a webhook, by repository path
+var (
+	replicationTriggersMutex sync.Mutex
+	replicationTriggers      = map[string]chan struct{}{}
+)
+
+// ReplicationNotifyHandler tells the secondary that the primary was
+// updated, it's the URL of an update hook of the primary
+func ReplicationNotifyHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	repo, ok := r.Context().Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+	if !checkTokenAccess(w, r, common.ScopePush) {
+		return
+	}
+
+	replicationTriggersMutex.Lock()
+	trigger, ok := replicationTriggers[repo.Path()]
+	replicationTriggersMutex.Unlock()
+	if !ok {
+		httpError(w, r, "the repository is not replicated", http.StatusNotFound)
+		return
+	}
+
+	// A replication is already due when the channel is full
+	select {
+	case trigger <- struct{}{}:
+	default:
+	}
+
+	EncodeJSONReplyWithStatus(w, r, http.StatusAccepted, struct{}{})
+}
+
+// replicationState is the commit each branch was last replicated to; a
+// branch pointing somewhere else was updated on the secondary
+type replicationState struct {
+	Refs map[string]string `json:"refs"`
+}
+
+// readReplicationState reads the state of the replication of the
+// repository, empty if it was never replicated
+func readReplicationState(repo ostree.Repository) (*replicationState, error) {
+	state := &replicationState{Refs: map[string]string{}}
+
+	data, err := ioutil.ReadFile(filepath.Join(repo.Path(), replicationStateName))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid replication state: %v", err)
+	}
+	if state.Refs == nil {
+		state.Refs = map[string]string{}
+	}
+
+	return state, nil
+}
+
+// save writes the state next to the publish log, atomically
+func (s *replicationState) save(repo ostree.Repository) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(repo.Path(), replicationStateName)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// replicator mirrors the repository of the primary to the one of the
+// receiver
+type replicator struct {
+	repo    ostree.Repository
+	queue   *Queue
+	config  *Config
+	primary string
+	client  *http.Client
+	trigger chan struct{}
+}
+
+// StartReplication mirrors the primary to the repository of the receiver,
+// for as long as it runs
+func (s *AppState) StartReplication() error {
+	config := s.Config.Replication
+	switch config.Mode {
+	case "", replicationModePoll, replicationModeWebhook:
+	default:
+		return fmt.Errorf("unknown replication mode \"%s\"", config.Mode)
+	}
+	if u, err := url.Parse(config.Primary); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid URL of the primary \"%s\"", config.Primary)
+	}
+
+	rep := &replicator{
+		repo:    s.Repo,
+		queue:   s.Queue,
+		config:  s.Config,
+		primary: strings.TrimSuffix(config.Primary, "/"),
+		client:  &http.Client{Timeout: maxReplicationWait + notifyTimeout},
+		trigger: make(chan struct{}, 1),
+	}
+	if config.Mode == replicationModeWebhook {
+		replicationTriggersMutex.Lock()
+		replicationTriggers[s.Repo.Path()] = rep.trigger
+		replicationTriggersMutex.Unlock()
+	}
+
+	logger.Infof("Replicating %s from %s", s.Repo.Path(), rep.primary)
+	go rep.run()
+
+	return nil
+}
+
+// run replicates the primary after each of its publishes
+func (rep *replicator) run() {
+	config := rep.config.Replication
+	interval := config.Interval
+	if interval <= 0 {
+		interval = defaultReplicationInterval
+	}
+
+	var epoch int64
+	for {
+		// The first request doesn't wait, so that the secondary catches up
+		var wait time.Duration
+		if config.Mode != replicationModeWebhook && epoch != 0 {
+			wait = replicationPollWait
+		}
+
+		response, err := rep.fetchState(epoch, wait)
+		if err == nil {
+			err = rep.replicate(response)
+		}
+		if err != nil {
+			atomic.AddInt64(&replicationFailures, 1)
+			logger.Errorf("Failed to replicate %s: %v", rep.primary, err)
+			time.Sleep(replicationRetryDelay)
+			continue
+		}
+		atomic.StoreInt64(&replicationLastSuccess, time.Now().Unix())
+		epoch = response.Epoch
+
+		if config.Mode == replicationModeWebhook {
+			select {
+			case <-rep.trigger:
+			case <-time.After(interval):
+			}
+		}
+	}
+}
+
+// get sends a request to the primary
+func (rep *replicator) get(path string) (*http.Response, error) {
+	request, err := http.NewRequest("GET", rep.primary+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rep.config.Replication.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+rep.config.Replication.Token)
+	}
+
+	return rep.client.Do(request)
+}
+
+// fetchState returns the repository of the primary, once it's updated
+// after epoch or wait passed
+func (rep *replicator) fetchState(epoch int64, wait time.Duration) (*common.ReplicationResponse, error) {
+	response, err := rep.get(fmt.Sprintf("/api/v2/replication?since=%d&wait=%d", epoch, int64(wait/time.Second)))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var errorResponse common.ErrorResponse
+		if err := json.NewDecoder(io.LimitReader(response.Body, 64*1024)).Decode(&errorResponse); err == nil && errorResponse.Message != "" {
+			return nil, fmt.Errorf("%s: %s", response.Status, errorResponse.Message)
+		}
+		return nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	var state common.ReplicationResponse
+	if err := json.NewDecoder(response.Body).Decode(&state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// fetchObject stages an object of the primary, it returns false if the
+// primary doesn't have it
+func (rep *replicator) fetchObject(queueID, objectName string) (bool, error) {
+	objectPath, err := filepath.Rel(rep.repo.Path(), rep.repo.GetObjectPath(objectName))
+	if err != nil {
+		return false, err
+	}
+
+	response, err := rep.get("/repo/" + filepath.ToSlash(objectPath))
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("failed to download %s: unexpected status %s", objectName, response.Status)
+	}
+
+	writer, err := getStorage(rep.repo).CreateStaged(queueID, objectName)
+	if err != nil {
+		return false, err
+	}
+	defer writer.Close()
+
+	if _, err := io.Copy(writer, response.Body); err != nil {
+		return false, fmt.Errorf("failed to download %s: %v", objectName, err)
+	}
+	if err := rep.repo.VerifyObject(writer.Path(), objectName); err != nil {
+		return false, fmt.Errorf("failed to verify %s: %v", objectName, err)
+	}
+
+	return true, writer.Commit()
+}
+
+// fetchObjects stages the objects of the primary, which must have them
+func (rep *replicator) fetchObjects(queueID string, objectNames []string) error {
+	workers := rep.config.Replication.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	objectsChan := make(chan string)
+	var errs []error
+	var mutex sync.Mutex
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for objectName := range objectsChan {
+				found, err := rep.fetchObject(queueID, objectName)
+				if err == nil && !found {
+					err = fmt.Errorf("the primary doesn't have %s", objectName)
+				}
+				if err != nil {
+					mutex.Lock()
+					errs = append(errs, err)
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, objectName := range objectNames {
+		objectsChan <- objectName
+	}
+	close(objectsChan)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to download %d objects, first error: %v", len(errs), errs[0])
+	}
+
+	return nil
+}
+
+// primaryHas returns whether the primary has the object
+func (rep *replicator) primaryHas(objectName string) (bool, error) {
+	objectPath, err := filepath.Rel(rep.repo.Path(), rep.repo.GetObjectPath(objectName))
+	if err != nil {
+		return false, err
+	}
+
+	request, err := http.NewRequest("HEAD", rep.primary+"/repo/"+filepath.ToSlash(objectPath), nil)
+	if err != nil {
+		return false, err
+	}
+	if rep.config.Replication.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+rep.config.Replication.Token)
+	}
+	response, err := rep.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status %s", response.Status)
+	}
+}
+
+// replicate updates the branches that differ from those of the primary,
+// unless they were updated on the secondary since they were last replicated
+func (rep *replicator) replicate(primary *common.ReplicationResponse) error {
+	config := rep.config.Replication
+
+	mode, err := rep.repo.GetMode()
+	if err != nil {
+		return err
+	}
+	if primary.Mode != mode {
+		return fmt.Errorf("the repository of the primary is in %s mode, this one is in %s mode", primary.Mode, mode)
+	}
+
+	state, err := readReplicationState(rep.repo)
+	if err != nil {
+		return err
+	}
+	revs, err := rep.repo.Refs()
+	if err != nil {
+		return err
+	}
+
+	// Pushes to the secondary are not interrupted
+	busy := map[string]bool{}
+	rep.queue.Walk(func(entry *QueueEntry) error {
+		for branch := range entry.UpdateRefs {
+			busy[branch] = true
+		}
+		return nil
+	})
+
+	updateRefs := map[string]common.RevisionPair{}
+	var conflicts int64
+	for branch, rev := range primary.Revs {
+		if !common.RefAllowed(config.Refs, branch) {
+			continue
+		}
+		if err := ostree.ValidateRef(branch); err != nil {
+			return err
+		}
+		if err := ostree.ValidateChecksum(rev); err != nil {
+			return err
+		}
+
+		current := revs[branch]
+		if current == rev {
+			state.Refs[branch] = rev
+			continue
+		}
+		if busy[branch] {
+			logger.Warnf("Branch \"%s\" is being pushed to, replicating it later", branch)
+			continue
+		}
+
+		// A branch the secondary had before replicating conflicts only
+		// when the primary doesn't have its commit
+		replicated, known := state.Refs[branch]
+		if current != "" && current != replicated && !config.Overwrite {
+			conflict := known
+			if !known {
+				has, err := rep.primaryHas(current + ".commit")
+				if err != nil {
+					return err
+				}
+				conflict = !has
+			}
+			if conflict {
+				conflicts++
+				logger.Errorf("Not replicating branch \"%s\": it was updated to %s here, the primary has %s", branch, current, rev)
+				continue
+			}
+		}
+
+		updateRefs[branch] = common.RevisionPair{Server: current, Client: rev}
+	}
+	atomic.StoreInt64(&replicationConflicts, conflicts)
+
+	if len(updateRefs) > 0 {
+		if err := rep.publish(updateRefs); err != nil {
+			return err
+		}
+		for branch, revPair := range updateRefs {
+			state.Refs[branch] = revPair.Client
+		}
+	}
+
+	return state.save(rep.repo)
+}
+
+// publish downloads the objects of the commits the repository doesn't have
+// and points the branches to them, as if the primary pushed them
+func (rep *replicator) publish(updateRefs map[string]common.RevisionPair) error {
+	entry := &QueueEntry{ID: sid.IdBase64(), UpdateRefs: updateRefs, Created: time.Now()}
+	log := logger.WithField("queue", entry.ID)
+
+	if err := createEntryStaging(rep.repo, entry.ID); err != nil {
+		return fmt.Errorf("failed to create the staging area: %v", err)
+	}
+	defer func() {
+		if err := removeEntryStaging(rep.repo, entry.ID); err != nil {
+			log.Errorf("Failed to remove the staging area: %v", err)
+		}
+	}()
+
+	// Pushes of the same branches wait for the replication
+	if err := rep.queue.AddEntry(entry); err != nil {
+		return err
+	}
+	emitQueueEvent(rep.repo, common.EventQueueCreated, entry)
+	defer func() {
+		if err := rep.queue.RemoveEntry(entry); err == nil {
+			emitQueueEvent(rep.repo, common.EventQueueRemoved, entry)
+		}
+	}()
+
+	for branch, revPair := range updateRefs {
+		log.Infof("Replicating branch \"%s\" to %s", branch, revPair.Client)
+
+		// Signatures are optional
+		found, err := rep.fetchObject(entry.ID, revPair.Client+".commitmeta")
+		if err != nil {
+			return err
+		}
+		if found {
+			entry.AddObjects([]string{revPair.Client + ".commitmeta"})
+		}
+	}
+
+	// Each round finds the children of the metadata objects of the previous
+	// one, objects the repository has are complete with their children
+	for {
+		missing, err := FindNeededObjects(rep.repo, entry)
+		if err != nil {
+			return err
+		}
+		if len(missing) == 0 {
+			break
+		}
+		log.Debugf("Downloading %d objects", len(missing))
+		if err := rep.fetchObjects(entry.ID, missing); err != nil {
+			return err
+		}
+	}
+
+	// The primary enforced its commit policy, which would refuse its
+	// rollbacks here
+	if err := checkEntryCommits(rep.repo, entry); err != nil {
+		return err
+	}
+	if err := checkEntrySignatures(rep.repo, rep.config, entry); err != nil {
+		return err
+	}
+
+	return publishBranches(rep.repo, rep.config, entry)
+}
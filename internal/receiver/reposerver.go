@@ -0,0 +1,175 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-chi/chi"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// ServeRepo serves the repository read-only to OSTree clients, so that
+// small deployments don't need another web server
+type ServeRepo struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Only serve clients with a valid token
+	RequireToken bool `yaml:"require_token,omitempty"`
+	// Cache-Control header of objects and deltas, which never change
+	ImmutableCacheControl string `yaml:"immutable_cache_control,omitempty"`
+	// Cache-Control header of the other files, such as refs and summary
+	MutableCacheControl string `yaml:"mutable_cache_control,omitempty"`
+}
+
+// Files and directories of the repository that clients pull, everything
+// else such as the staging area and the publish log stays private
+var (
+	repoFiles = map[string]bool{"config": true, "summary": true, "summary.sig": true}
+	repoDirs  = map[string]bool{"objects": true, "refs": true, "deltas": true, "delta-indexes": true, "summaries": true}
+)
+
+// Objects and deltas never change once written, unlike refs and summary,
+// by default CDNs and clients can cache them for a year
+const (
+	immutableCacheControl = "public, max-age=31536000, immutable"
+	mutableCacheControl   = "public, max-age=60"
+)
+
+// repoFilePath returns the path of a file that can be served relative to
+// the repository, or false if the path is not one
+func repoFilePath(urlPath string) (string, bool) {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if repoFiles[name] {
+		return name, true
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && repoDirs[parts[0]] {
+		return name, true
+	}
+
+	return "", false
+}
+
+// isImmutableRepoFile returns whether the content of the file of the
+// repository never changes, objects and deltas are named after their content
+func isImmutableRepoFile(name string) bool {
+	return strings.HasPrefix(name, "objects/") || strings.HasPrefix(name, "deltas/")
+}
+
+// repoCacheControl returns the Cache-Control header of a file of the
+// repository, by default responses that need a token are only cached by
+// clients
+func repoCacheControl(config ServeRepo, name string) string {
+	cacheControl, defaultCacheControl := config.MutableCacheControl, mutableCacheControl
+	if isImmutableRepoFile(name) {
+		cacheControl, defaultCacheControl = config.ImmutableCacheControl, immutableCacheControl
+	}
+	if cacheControl != "" {
+		return cacheControl
+	}
+
+	if config.RequireToken {
+		return strings.Replace(defaultCacheControl, "public", "private", 1)
+	}
+	return defaultCacheControl
+}
+
+// repoETag returns the entity tag of a file of the repository: objects are
+// identified by their name, other files by their size and modification time
+// since they are replaced rather than modified
+func repoETag(name string, info os.FileInfo) string {
+	if strings.HasPrefix(name, "objects/") {
+		return fmt.Sprintf("\"%s\"", strings.Replace(strings.TrimPrefix(name, "objects/"), "/", "", 1))
+	}
+
+	return fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+}
+
+// RepoFileHandler serves a file of the repository to OSTree clients
+func RepoFileHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	ctx := r.Context()
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+	config, ok := ctx.Value(KeyConfig).(*Config)
+	if !ok {
+		logger.Error("Unable to retrieve configuration from context")
+		httpError(w, r, "no configuration found", http.StatusUnprocessableEntity)
+		return
+	}
+	if config.ServeRepo.RequireToken && !checkTokenAccess(w, r, common.ScopePull) {
+		return
+	}
+
+	name, ok := repoFilePath(chi.URLParam(r, "*"))
+	if !ok {
+		httpError(w, r, "file not found", http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(repo.Path(), filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		httpError(w, r, "file not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logger.Errorf("Failed to open %s: %v", name, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		logger.Errorf("Failed to stat %s: %v", name, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if info.IsDir() {
+		httpError(w, r, "file not found", http.StatusNotFound)
+		return
+	}
+
+	// ServeContent answers conditional and range requests from the ETag
+	// and modification time
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", repoCacheControl(config.ServeRepo, name))
+	w.Header().Set("ETag", repoETag(name, info))
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+// skipRepoCompression returns whether a file of the repository is sent
+// as it is: file objects of archive repositories are already compressed,
+// and ranges must apply to the content as stored
+func skipRepoCompression(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, ".filez") || r.Header.Get("Range") != ""
+}
+
+// repoRouter serves the repository, of the token when one is required
+func repoRouter(appState *AppState) http.Handler {
+	r := chi.NewRouter()
+
+	if appState.Config.ServeRepo.RequireToken {
+		r.Use(TokenVerifier(appState))
+	}
+	r.Use(receiverContext(appState))
+	r.Use(compression(appState.Config.Compression, skipRepoCompression, "application/octet-stream"))
+	r.Get("/*", RepoFileHandler)
+	r.Head("/*", RepoFileHandler)
+
+	return r
+}
@@ -0,0 +1,171 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// RollbackHandler points a branch back to the revision it had before its
+// last publish, as recorded by the publish log
+func RollbackHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	ctx := r.Context()
+	queue, ok := ctx.Value(KeyQueue).(*Queue)
+	if !ok {
+		logger.Error("Unable to retrieve queue object from context")
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
+		return
+	}
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+	config, ok := ctx.Value(KeyConfig).(*Config)
+	if !ok {
+		logger.Error("Unable to retrieve configuration from context")
+		httpError(w, r, "no configuration found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Decode request
+	var req common.RollbackRequest
+	err := DecodeJSONBody(w, r, &req)
+	if err != nil {
+		HandleDecodeError(w, r, err)
+		return
+	}
+	if err := ostree.ValidateRef(req.Branch); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkTokenAccess(w, r, common.ScopeAdmin, req.Branch) {
+		return
+	}
+	if !checkBranchProtection(w, r, config, req.Confirm, req.Branch) {
+		return
+	}
+
+	// Don't race with a push of the same branch
+	err = queue.Walk(func(entry *QueueEntry) error {
+		if _, ok := entry.UpdateRefs[req.Branch]; ok {
+			return fmt.Errorf("branch \"%s\" is already being updated", req.Branch)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, http.StatusConflict, common.ErrorResponse{
+			Code:    common.ErrorCodeBranchBusy,
+			Message: err.Error(),
+			Details: map[string]string{"branch": req.Branch},
+		})
+		return
+	}
+
+	revs, err := repo.Refs()
+	if err != nil {
+		logger.Errorf("Failed to list revisions: %v", err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	currentRev, ok := revs[req.Branch]
+	if !ok {
+		httpError(w, r, fmt.Sprintf("branch \"%s\" not found", req.Branch), http.StatusNotFound)
+		return
+	}
+
+	records, err := readPublishRecords(repo, req.Branch, maxPublishHistoryLength)
+	if err != nil {
+		logger.Errorf("Failed to read the publish log: %v", err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rev, err := previousPublishedRev(records, currentRev)
+	if err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, common.ErrorResponse{
+			Code:    common.ErrorCodeUnprocessable,
+			Message: err.Error(),
+			Details: map[string]string{"branch": req.Branch, "rev": currentRev},
+		})
+		return
+	}
+
+	// Only move the branch back along its history
+	if err := checkAncestor(repo, rev, currentRev); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, common.ErrorResponse{
+			Code:    common.ErrorCodeUnprocessable,
+			Message: err.Error(),
+			Details: map[string]string{"branch": req.Branch, "rev": rev},
+		})
+		return
+	}
+
+	if config.requiresSignature(req.Branch) {
+		if err := repo.VerifyCommitSignature(rev); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, common.ErrorResponse{
+				Code:    common.ErrorCodeUnprocessable,
+				Message: fmt.Sprintf("commit %s is not signed by a trusted key: %v", rev, err),
+				Details: map[string]string{"branch": req.Branch, "rev": rev},
+			})
+			return
+		}
+	}
+
+	refs := map[string]common.RevisionPair{req.Branch: {Server: currentRev, Client: rev}}
+	if err := UpdateRefs(repo, refs); err != nil {
+		logger.Errorf("Failed to roll back \"%s\" to %s: %v", req.Branch, rev, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Clients must stop pulling the bad commit as soon as possible
+	if err := FlushSummary(repo); err != nil {
+		logger.Errorf("Failed to regenerate summary: %v", err)
+	}
+	logger.Infof("Rolled back branch \"%s\" from %s to %s", req.Branch, currentRev, rev)
+
+	record := AuditRecord{Action: auditActionRollback, Repo: repo.Path(), Refs: refs}
+	if err := writeAuditRecord(config, record); err != nil {
+		logger.Errorf("Failed to write the audit log: %v", err)
+	}
+	tokenName := ""
+	if token, ok := ctx.Value(KeyToken).(*Token); ok {
+		tokenName = token.Name
+	}
+	if err := writePublishRecords(repo, auditActionRollback, tokenName, "", refs); err != nil {
+		logger.Errorf("Failed to write the publish log: %v", err)
+	}
+	notifyUpdate(repo, config, auditActionRollback, "", refs)
+	publishToIPFS(repo, config, nil, refs)
+	if len(config.Notifications) > 0 {
+		announce(config, newAnnouncement(repo, auditActionRollback, "", refs, nil, nil))
+	}
+
+	object := common.RollbackResponse{Branch: req.Branch, Rev: rev, PreviousRev: currentRev}
+	EncodeJSONReply(w, r, object)
+}
+
+// previousPublishedRev returns the revision the branch had before the
+// publish that pointed it to rev, records are from the newest; rollbacks
+// are skipped so that consecutive rollbacks keep going back
+func previousPublishedRev(records []PublishRecord, rev string) (string, error) {
+	for _, record := range records {
+		if record.Action == auditActionRollback || record.To != rev {
+			continue
+		}
+		if record.From == "" {
+			return "", fmt.Errorf("branch was created at %s, there is no previous revision", rev)
+		}
+		return record.From, nil
+	}
+
+	return "", fmt.Errorf("no publish of %s is recorded", rev)
+}
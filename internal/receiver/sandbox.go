@@ -0,0 +1,45 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"github.com/lirios/ostree-upload/internal/logger"
+)
+
+// Sandbox confines the worker serving requests, so that a bug in the
+// handling of paths or uploads can't be used to write anywhere else than
+// the repositories or to run programs; Linux only
+type Sandbox struct {
+	// Only let the worker write to the repositories and their staging
+	// area, the log file, the audit log, the offline artifacts, the
+	// temporary directory and the writable paths of the privileges, with
+	// Landlock
+	RestrictWrites bool `yaml:"restrict_writes,omitempty"`
+	// Forbid the worker from running programs, with seccomp
+	BlockExec bool `yaml:"block_exec,omitempty"`
+}
+
+// Enabled returns whether the worker is sandboxed
+func (s Sandbox) Enabled() bool {
+	return s.RestrictWrites || s.BlockExec
+}
+
+// UsesWorker returns whether requests are served by a worker started by
+// the receive command, rather than by the command itself
+func (c *Config) UsesWorker() bool {
+	return c.Privileges.Enabled() || c.Sandbox.Enabled()
+}
+
+// EnterSandbox forbids the worker from running programs, if the
+// configuration wants it; it's done once the worker ran those it needs,
+// such as the identity command, and before it serves requests
+func EnterSandbox(config *Config) error {
+	if !IsWorker() || !config.Sandbox.BlockExec {
+		return nil
+	}
+
+	logger.Debug("Forbidding the worker from running programs")
+	return blockExec()
+}
@@ -0,0 +1,183 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Arguments of the Landlock system calls, from linux/landlock.h
+const (
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+
+	landlockAccessWriteFile  = 1 << 1
+	landlockAccessRemoveDir  = 1 << 4
+	landlockAccessRemoveFile = 1 << 5
+	landlockAccessMakeChar   = 1 << 6
+	landlockAccessMakeDir    = 1 << 7
+	landlockAccessMakeReg    = 1 << 8
+	landlockAccessMakeSock   = 1 << 9
+	landlockAccessMakeFifo   = 1 << 10
+	landlockAccessMakeBlock  = 1 << 11
+	landlockAccessMakeSym    = 1 << 12
+	landlockAccessRefer      = 1 << 13
+	landlockAccessTruncate   = 1 << 14
+
+	// Rights that apply to files rather than to directories
+	landlockAccessFile = landlockAccessWriteFile | landlockAccessTruncate
+)
+
+// landlockRulesetAttr is struct landlock_ruleset_attr
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+// landlockPathBeneathAttr is struct landlock_path_beneath_attr, which is
+// packed: the kernel doesn't read the padding
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+// restrictWrites only lets the calling thread, and the programs it runs,
+// write to the writable paths
+func restrictWrites(writable []string) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return fmt.Errorf("Landlock is not available: %v", errno)
+	}
+	// Staged objects are moved to the objects of the repository, which
+	// the first version of Landlock always forbids
+	if abi < 2 {
+		return fmt.Errorf("Landlock %d cannot move files between directories, Linux 5.19 or later is required", abi)
+	}
+
+	access := uint64(landlockAccessWriteFile | landlockAccessRemoveDir | landlockAccessRemoveFile |
+		landlockAccessMakeChar | landlockAccessMakeDir | landlockAccessMakeReg | landlockAccessMakeSock |
+		landlockAccessMakeFifo | landlockAccessMakeBlock | landlockAccessMakeSym | landlockAccessRefer)
+	if abi >= 3 {
+		access |= landlockAccessTruncate
+	}
+
+	attr := landlockRulesetAttr{handledAccessFS: access}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("cannot create the Landlock ruleset: %v", errno)
+	}
+	ruleset := int(fd)
+	defer unix.Close(ruleset)
+
+	// Libraries discard output by writing to the null device
+	for _, path := range append(writable, os.DevNull) {
+		dir, err := existingPath(path)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		allowed := access
+		if !info.IsDir() {
+			allowed &= landlockAccessFile
+		}
+
+		file, err := unix.Open(dir, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("cannot open %s: %v", dir, err)
+		}
+		rule := landlockPathBeneathAttr{allowedAccess: allowed, parentFd: int32(file)}
+		_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		unix.Close(file)
+		if errno != 0 {
+			return fmt.Errorf("cannot allow writing to %s: %v", dir, errno)
+		}
+	}
+
+	// Landlock requires that the thread can't gain privileges anymore,
+	// which the programs it runs inherit
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("cannot forbid gaining privileges: %v", err)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(ruleset), 0, 0); errno != 0 {
+		return fmt.Errorf("cannot enforce the Landlock ruleset: %v", errno)
+	}
+
+	return nil
+}
+
+// Arguments of seccomp(2)
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+
+	// Offsets of the fields of struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+
+	// Bit of the system calls of the x32 ABI, which have the same
+	// architecture as those of amd64
+	x32SyscallBit = 0x40000000
+)
+
+// Architectures of system calls by GOARCH, from linux/audit.h
+var auditArches = map[string]uint32{
+	"386":     0x40000003,
+	"amd64":   0xc000003e,
+	"arm":     0x40000028,
+	"arm64":   0xc00000b7,
+	"ppc64le": 0xc0000015,
+	"riscv64": 0xc00000f3,
+	"s390x":   0x80000016,
+}
+
+// blockExec makes every thread of the process fail to run programs,
+// as well as to make system calls of another architecture
+func blockExec() error {
+	arch, ok := auditArches[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("blocking exec is not supported on %s", runtime.GOARCH)
+	}
+
+	deny := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)}
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataArch},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch},
+		deny,
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataNr},
+		{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jt: 3, K: x32SyscallBit},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 2, K: unix.SYS_EXECVE},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: unix.SYS_EXECVEAT},
+		{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow},
+		deny,
+	}
+	program := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// The filter is installed on every thread, but only the calling
+	// one is checked for being unable to gain privileges
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("cannot forbid gaining privileges: %v", err)
+	}
+	tid, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&program)))
+	if errno != 0 {
+		return fmt.Errorf("cannot install the seccomp filter: %v", errno)
+	}
+	if tid != 0 {
+		return fmt.Errorf("cannot install the seccomp filter on thread %d", tid)
+	}
+
+	return nil
+}
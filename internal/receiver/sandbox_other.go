@@ -0,0 +1,17 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build !linux
+// +build !linux
+
+package receiver
+
+import (
+	"errors"
+)
+
+// blockExec is only available on Linux, which has seccomp
+func blockExec() error {
+	return errors.New("blocking exec is only supported on Linux")
+}
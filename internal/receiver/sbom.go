@@ -0,0 +1,312 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-chi/chi"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Directory of the SBOMs of the published commits, relative to the
+// repository, next to the publish log
+const sbomDirName = "ostree-upload/sbom"
+
+// Directory of the SBOMs of a queue entry, relative to its temporary directory
+const stagedSBOMDirName = "sbom"
+
+// Maximum size of an SBOM
+const maxSBOMSize = 32 * 1024 * 1024
+
+// sbomFormat is a format of SBOM the receiver stores
+type sbomFormat struct {
+	mediaType string
+	extension string
+}
+
+// Formats of SBOM, detected from the content rather than from what the
+// client says since they are served to everybody with a pull token
+var (
+	sbomSPDXJSON      = sbomFormat{mediaType: common.MediaTypeSPDXJSON, extension: ".spdx.json"}
+	sbomSPDXTagValue  = sbomFormat{mediaType: common.MediaTypeSPDXTagValue, extension: ".spdx"}
+	sbomCycloneDXJSON = sbomFormat{mediaType: common.MediaTypeCycloneDXJSON, extension: ".cdx.json"}
+	sbomCycloneDXXML  = sbomFormat{mediaType: common.MediaTypeCycloneDXXML, extension: ".cdx.xml"}
+	sbomFormats       = []sbomFormat{sbomSPDXJSON, sbomSPDXTagValue, sbomCycloneDXJSON, sbomCycloneDXXML}
+)
+
+// detectSBOMFormat returns the format of an SBOM, false if it's neither an
+// SPDX nor a CycloneDX document
+func detectSBOMFormat(data []byte) (sbomFormat, bool) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return sbomFormat{}, false
+	}
+
+	switch trimmed[0] {
+	case '{':
+		var document struct {
+			SPDXVersion string `json:"spdxVersion"`
+			BOMFormat   string `json:"bomFormat"`
+		}
+		if err := json.Unmarshal(trimmed, &document); err != nil {
+			return sbomFormat{}, false
+		}
+		if strings.HasPrefix(document.SPDXVersion, "SPDX-") {
+			return sbomSPDXJSON, true
+		}
+		if document.BOMFormat == "CycloneDX" {
+			return sbomCycloneDXJSON, true
+		}
+	case '<':
+		// Only the root element matters
+		decoder := xml.NewDecoder(bytes.NewReader(trimmed))
+		for {
+			token, err := decoder.Token()
+			if err != nil {
+				return sbomFormat{}, false
+			}
+			if element, ok := token.(xml.StartElement); ok {
+				if element.Name.Local == "bom" && strings.HasPrefix(element.Name.Space, "http://cyclonedx.org/schema/bom/") {
+					return sbomCycloneDXXML, true
+				}
+				return sbomFormat{}, false
+			}
+		}
+	default:
+		// Tag-value documents start with the version, after comments
+		scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if strings.HasPrefix(line, "SPDXVersion:") {
+				return sbomSPDXTagValue, true
+			}
+			break
+		}
+	}
+
+	return sbomFormat{}, false
+}
+
+// writeSBOM atomically writes the SBOM of rev to dir, replacing the SBOM
+// of rev in any other format
+func writeSBOM(dir, rev string, format sbomFormat, data []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, rev+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), filepath.Join(dir, rev+format.extension)); err != nil {
+		return err
+	}
+
+	return removeOtherSBOMs(dir, rev, format)
+}
+
+// removeOtherSBOMs removes the SBOMs of rev in dir that are not in format
+func removeOtherSBOMs(dir, rev string, format sbomFormat) error {
+	for _, other := range sbomFormats {
+		if other == format {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, rev+other.extension)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findSBOM returns the path and the format of the SBOM of rev in dir,
+// an empty path if there's none
+func findSBOM(dir, rev string) (string, sbomFormat, error) {
+	for _, format := range sbomFormats {
+		path := filepath.Join(dir, rev+format.extension)
+		if _, err := os.Stat(path); err == nil {
+			return path, format, nil
+		} else if !os.IsNotExist(err) {
+			return "", sbomFormat{}, err
+		}
+	}
+
+	return "", sbomFormat{}, nil
+}
+
+// publishSBOMs moves the SBOMs uploaded for a queue entry next to those of
+// the commits published before
+func publishSBOMs(repo ostree.Repository, entry *QueueEntry) error {
+	stagedDir := filepath.Join(GetEntryTempDirectory(repo, entry.ID), stagedSBOMDirName)
+	dir := filepath.Join(repo.Path(), sbomDirName)
+
+	for _, revPair := range entry.UpdateRefs {
+		path, format, err := findSBOM(stagedDir, revPair.Client)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			continue
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := moveFile(path, filepath.Join(dir, revPair.Client+format.extension)); err != nil {
+			return err
+		}
+		if err := removeOtherSBOMs(dir, revPair.Client, format); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SBOMUploadHandler stores the SBOM of a commit pushed with a queue entry,
+// it's published together with the branches
+func SBOMUploadHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if !limitRequestBody(w, r) {
+		return
+	}
+
+	// Get from context
+	ctx := r.Context()
+	queue, ok := ctx.Value(KeyQueue).(*Queue)
+	if !ok {
+		logger.Error("Unable to retrieve queue object from context")
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
+		return
+	}
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Get the entry from the queue
+	entry, ok := getEntry(w, r, queue)
+	if !ok {
+		return
+	}
+
+	// Only the commits pushed with the entry
+	rev := chi.URLParam(r, "rev")
+	if err := ostree.ValidateChecksum(rev); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pushed := false
+	for _, revPair := range entry.UpdateRefs {
+		if revPair.Client == rev {
+			pushed = true
+			break
+		}
+	}
+	if !pushed {
+		httpError(w, r, fmt.Sprintf("commit %s is not pushed with the queue entry", rev), http.StatusNotFound)
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSBOMSize+1))
+	if err != nil {
+		logger.Errorf("Failed to receive the SBOM of %s: %v", rev, err)
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxSBOMSize {
+		httpError(w, r, fmt.Sprintf("SBOM must not be larger than %d MiB", maxSBOMSize/1024/1024), http.StatusRequestEntityTooLarge)
+		return
+	}
+	format, ok := detectSBOMFormat(data)
+	if !ok {
+		httpError(w, r, "SBOM is neither an SPDX nor a CycloneDX document", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	dir := filepath.Join(GetEntryTempDirectory(repo, entry.ID), stagedSBOMDirName)
+	if err := writeSBOM(dir, rev, format, data); err != nil {
+		logger.Errorf("Failed to store the SBOM of %s: %v", rev, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.Debugf("Received the %s SBOM of %s", format.mediaType, rev)
+}
+
+// SBOMHandler returns the SBOM of a published commit
+func SBOMHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	repo, ok := r.Context().Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+	if !checkTokenAccess(w, r, common.ScopePull) {
+		return
+	}
+
+	rev := chi.URLParam(r, "rev")
+	if err := ostree.ValidateChecksum(rev); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	path, format, err := findSBOM(filepath.Join(repo.Path(), sbomDirName), rev)
+	if err != nil {
+		logger.Errorf("Failed to find the SBOM of %s: %v", rev, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if path == "" {
+		httpError(w, r, fmt.Sprintf("commit %s has no SBOM", rev), http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		logger.Errorf("Failed to open the SBOM of %s: %v", rev, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		logger.Errorf("Failed to stat the SBOM of %s: %v", rev, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.mediaType)
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
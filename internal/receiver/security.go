@@ -0,0 +1,61 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Browsers only use HTTPS for a year by default
+const defaultHSTSMaxAge = 365 * 24 * 60 * 60
+
+// defaultSecurityHeaders are sent with every response: the API only
+// returns data, which must never be sniffed, framed or run as a page,
+// and responses depend on the token so they must not be cached
+var defaultSecurityHeaders = map[string]string{
+	"Cache-Control":           "no-store",
+	"X-Content-Type-Options":  "nosniff",
+	"X-Frame-Options":         "DENY",
+	"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+	"Referrer-Policy":         "no-referrer",
+}
+
+// securityHeaders returns a middleware that adds the security headers from
+// the configuration to the responses, HSTS is only sent over TLS
+func securityHeaders(config SecurityHeaders) func(next http.Handler) http.Handler {
+	headers := map[string]string{}
+	for name, value := range defaultSecurityHeaders {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	for name, value := range config.Headers {
+		if value == "" {
+			delete(headers, http.CanonicalHeaderKey(name))
+		} else {
+			headers[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+
+	var hsts string
+	if config.HSTSMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", config.HSTSMaxAge)
+		if config.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			for name, value := range headers {
+				w.Header().Set(name, value)
+			}
+			if hsts != "" && r.TLS != nil {
+				w.Header().Set("Strict-Transport-Security", hsts)
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -6,40 +6,163 @@ package receiver
 
 import (
 	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 
 	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/internal/tracing"
 )
 
 func receiverContext(appState *AppState) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
-			ctx := context.WithValue(r.Context(), KeyQueue, appState.Queue)
-			ctx = context.WithValue(ctx, KeyRepository, appState.Repo)
+			// Each token might have its own repository
+			token, _ := r.Context().Value(KeyToken).(*Token)
+			repo, queue, err := appState.Repository(token)
+			if err != nil {
+				logger.Errorf("Unable to open repository: %v", err)
+				httpError(w, r, "repository not available", http.StatusInternalServerError)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), KeyQueue, queue)
+			ctx = context.WithValue(ctx, KeyRepository, repo)
+			ctx = context.WithValue(ctx, KeyConfig, appState.Config)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		}
 		return http.HandlerFunc(fn)
 	}
 }
 
-func v1Router(appState *AppState) http.Handler {
+func apiVersionContext(version int) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), KeyAPIVersion, version)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// Set a timeout value on the request context (ctx) of API requests, that
+// will signal through ctx.Done() that the request has timed out and further
+// processing should be stopped; publishing is not bounded
+const apiTimeout = 60 * time.Second
+
+func v1Router(appState *AppState, limits *serverLimits) http.Handler {
 	r := chi.NewRouter()
 
+	r.Use(apiVersionContext(1))
+	r.Use(TokenVerifier(appState))
 	r.Use(receiverContext(appState))
-	r.Get("/info", InfoHandler)
-	r.Post("/queue", CreateEntryHandler)
-	r.Delete("/queue/{queueID}", DeleteEntryHandler)
-	r.Get("/queue/{queueID}", ObjectsHandler)
-	r.Put("/queue/{queueID}", UploadHandler)
+	r.Use(validateRequests)
+	uploads := limits.limitConcurrency(limits.uploads)
+	finalizes := limits.limitConcurrency(limits.finalizes)
+
+	// Publishing takes as long as the objects take to be moved
+	r.With(finalizes).Post("/queue/{queueID}/done", DoneHandler)
+
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(apiTimeout))
+
+		r.Get("/info", InfoHandler)
+		r.Get("/whoami", WhoamiHandler)
+		r.Get("/inventory", InventoryHandler)
+		r.Get("/history", PublishHistoryHandler)
+		r.Get("/queue", FindEntryHandler)
+		r.Post("/queue", CreateEntryHandler)
+		r.Delete("/queue/{queueID}", DeleteEntryHandler)
+		r.Get("/queue/{queueID}", ObjectsHandler)
+		r.Post("/queue/{queueID}/objects", AddObjectsHandler)
+		r.Get("/queue/{queueID}/missing", MissingObjectsHandler)
+		r.Get("/objects/{objectName}/signature", SignatureHandler)
+		r.Get("/sbom/{rev}", SBOMHandler)
+		r.With(uploads).Put("/queue/{queueID}/delta/{objectName}", DeltaUploadHandler)
+		r.With(uploads).Put("/queue/{queueID}/sbom/{rev}", SBOMUploadHandler)
+		r.With(uploads).Put("/queue/{queueID}", UploadHandler)
+	})
 
 	return r
 }
 
-func router(appState *AppState) http.Handler {
+// v2Router serves API v2: state changes use POST and DELETE only, creating and
+// deleting entries reply with 201 and 204, publishing is always explicit and
+// errors are JSON objects
+func v2Router(appState *AppState, limits *serverLimits) http.Handler {
+	r := chi.NewRouter()
+
+	r.Use(apiVersionContext(2))
+	r.Use(TokenVerifier(appState))
+	r.Use(receiverContext(appState))
+	r.Use(validateRequests)
+	uploads := limits.limitConcurrency(limits.uploads)
+	finalizes := limits.limitConcurrency(limits.finalizes)
+
+	// Publishing takes as long as the objects take to be moved, clients
+	// follow it with the progress of the entry
+	r.With(finalizes).Post("/queue/{queueID}/commit", DoneHandler)
+	r.With(finalizes).Post("/promote", PromoteHandler)
+	r.With(finalizes).Post("/rollback", RollbackHandler)
+
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(apiTimeout))
+
+		r.Get("/info", InfoHandler)
+		r.Get("/whoami", WhoamiHandler)
+		r.Get("/inventory", InventoryHandler)
+		r.Get("/history", HistoryHandler)
+		r.Get("/status", StatusHandler)
+		r.Get("/queue/{queueID}/progress", QueueProgressHandler)
+		r.Get("/publishes", PublishHistoryHandler)
+		r.Get("/queue", FindEntryHandler)
+		r.Post("/queue", CreateEntryHandler)
+		r.Delete("/queue/{queueID}", DeleteEntryHandler)
+		r.Get("/queue/{queueID}", ObjectsHandler)
+		r.Post("/queue/{queueID}/objects", AddObjectsHandler)
+		r.Get("/queue/{queueID}/missing", MissingObjectsHandler)
+		r.With(uploads).Put("/queue/{queueID}/objects", UploadHandler)
+		r.With(uploads).Put("/queue/{queueID}/delta/{objectName}", DeltaUploadHandler)
+		r.With(uploads).Put("/queue/{queueID}/sbom/{rev}", SBOMUploadHandler)
+		r.Post("/queue/{queueID}/manifest", QueueManifestHandler)
+		r.Get("/objects", ObjectsSinceHandler)
+		r.Get("/objects/{objectName}/signature", SignatureHandler)
+		r.Get("/sbom/{rev}", SBOMHandler)
+		r.Post("/summary", FlushSummaryHandler)
+		r.Get("/replication", ReplicationHandler)
+		r.Post("/replication", ReplicationNotifyHandler)
+		r.Get("/integrity", IntegrityStatusHandler)
+		r.Post("/integrity", IntegrityCheckHandler)
+		r.With(tusResumable).Options("/queue/{queueID}/uploads", TusOptionsHandler)
+		r.With(tusResumable).Post("/queue/{queueID}/uploads", TusCreateHandler)
+		r.With(tusResumable).Head("/queue/{queueID}/uploads/{objectName}", TusOffsetHandler)
+		r.With(tusResumable, uploads).Patch("/queue/{queueID}/uploads/{objectName}", TusPatchHandler)
+	})
+
+	return r
+}
+
+// forwardedPrefix strips the prefix set by a reverse proxy with
+// X-Forwarded-Prefix, when it forwards the full path of the request
+func forwardedPrefix(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		prefix := strings.TrimSuffix(r.Header.Get("X-Forwarded-Prefix"), "/")
+		if prefix != "" && strings.HasPrefix(r.URL.Path, prefix+"/") {
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func router(basePath string, appState *AppState) http.Handler {
 	r := chi.NewRouter()
 
 	// A good base middleware stack
@@ -47,33 +170,113 @@ func router(appState *AppState) http.Handler {
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Compress(5, "gzip"))
-
-	// Set a timeout value on the request context (ctx), that will signal
-	// through ctx.Done() that the request has timed out and further
-	// processing should be stopped.
-	r.Use(middleware.Timeout(60 * time.Second))
+	r.Use(tracing.Middleware)
+	r.Use(forwardedPrefix)
+	r.Use(securityHeaders(appState.Config.SecurityHeaders))
 
-	// Protected routes
+	// API, routes are protected by tokens
+	limits := newServerLimits(appState.Config)
+	compress := compression(appState.Config.Compression, nil)
 	r.Group(func(r chi.Router) {
-		// Seek, verify and validate tokens
-		r.Use(TokenVerifier(appState))
+		r.Use(compress)
 
-		// API
-		r.Mount("/api/v1", v1Router(appState))
+		r.Mount("/api/v1", v1Router(appState, limits))
+		r.Mount("/api/v2", v2Router(appState, limits))
 	})
 
+	// Event streams last longer than API requests
+	r.With(apiVersionContext(2), TokenVerifier(appState), receiverContext(appState)).Get("/api/v2/events", EventsHandler)
+
+	// Repository for OSTree clients, large objects may take longer than
+	// API requests to download
+	if appState.Config.ServeRepo.Enabled {
+		r.Mount("/repo", repoRouter(appState))
+	}
+
 	// Public routes
-	r.Get("/ping", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte("{}"))
+	r.Group(func(r chi.Router) {
+		r.Use(compress)
+
+		r.Get("/ping", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{}"))
+		})
+		r.Get("/metrics", limits.MetricsHandler)
+		r.Get("/api/v1/openapi.json", OpenAPIHandler)
 	})
 
+	// Serve everything under the base path, for reverse proxies
+	// that don't strip it
+	basePath = strings.TrimSuffix(basePath, "/")
+	if basePath != "" {
+		root := chi.NewRouter()
+		root.Mount(basePath, r)
+		return root
+	}
+
 	return r
 }
 
-// StartServer starts the server
-func StartServer(address string, appState *AppState) error {
+// listen listens on a TCP address, or on a Unix domain socket when
+// the address is "unix:<PATH>"
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		return net.Listen("tcp", address)
+	}
+
+	// Remove the socket left behind by a previous run
+	path := strings.TrimPrefix(address, "unix:")
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Access is controlled by the permissions of the socket
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// StartServer starts the server, basePath is the path the API is mounted at
+func StartServer(address, basePath string, appState *AppState) error {
 	logger.Actionf("Starting server on %v", address)
-	return http.ListenAndServe(address, router(appState))
+
+	// The helper already bound the address of the worker
+	var listener net.Listener
+	var err error
+	if IsWorker() {
+		listener, err = workerListener()
+	} else {
+		listener, err = listen(address)
+	}
+	if err != nil {
+		return err
+	}
+
+	return Serve(listener, basePath, appState)
+}
+
+// Serve serves the API on listener until it's closed, basePath is the
+// path the API is mounted at
+func Serve(listener net.Listener, basePath string, appState *AppState) error {
+	tlsConfig := appState.Config.TLS
+	if tlsConfig.Cert != "" || tlsConfig.Key != "" {
+		logger.Info("Serving HTTPS")
+		server := &http.Server{
+			Handler:   router(basePath, appState),
+			TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+		}
+		return server.ServeTLS(listener, tlsConfig.Cert, tlsConfig.Key)
+	}
+
+	return http.Serve(listener, router(basePath, appState))
 }
@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Files of abandoned uploads older than this are removed by default
+const DefaultStagingMaxAge = 24 * time.Hour
+
+// StagingGCResult is what the garbage collection of the staging area removed
+type StagingGCResult struct {
+	Files int
+	Bytes int64
+}
+
+// CollectStaging removes the files uploaded for queue entries that are not
+// in queue anymore, such as pushes that were abandoned or interrupted by a
+// restart, when they weren't modified for maxAge; queue may be nil when the
+// receiver is not running.  Entries being published are left to
+// RecoverPublishes.  Nothing is removed with dryRun.
+func CollectStaging(repo ostree.Repository, queue *Queue, maxAge time.Duration, dryRun bool) (StagingGCResult, error) {
+	var result StagingGCResult
+
+	dirs, err := ioutil.ReadDir(filepath.Join(repo.Path(), tempDirName))
+	if os.IsNotExist(err) {
+		return result, nil
+	} else if err != nil {
+		return result, err
+	}
+
+	// Entries that might still be uploading
+	referenced := map[string]bool{}
+	if queue != nil {
+		err := queue.Walk(func(entry *QueueEntry) error {
+			referenced[entry.ID] = true
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+
+	for _, dir := range dirs {
+		if !dir.IsDir() || referenced[dir.Name()] {
+			continue
+		}
+		if journal, err := readPublishJournal(repo, dir.Name()); err != nil || journal != nil {
+			continue
+		}
+
+		dirPath := GetEntryTempDirectory(repo, dir.Name())
+		files, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			return result, err
+		}
+
+		kept := 0
+		for _, file := range files {
+			if file.IsDir() || file.ModTime().After(cutoff) {
+				kept++
+				continue
+			}
+
+			path := filepath.Join(dirPath, file.Name())
+			logger.Debugf("Removing staged file %s", path)
+			if !dryRun {
+				if err := os.Remove(path); err != nil {
+					return result, err
+				}
+			}
+			result.Files++
+			result.Bytes += file.Size()
+		}
+
+		if kept == 0 && !dryRun {
+			if err := os.Remove(dirPath); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// StartStagingGC removes the abandoned uploads of all the repositories
+// every interval, for as long as the receiver runs
+func (s *AppState) StartStagingGC(interval, maxAge time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			for _, t := range s.repositories() {
+				result, err := CollectStaging(t.repo, t.queue, maxAge, false)
+				if err != nil {
+					logger.Errorf("Failed to clean up the staging area of %s: %v", t.repo.Path(), err)
+					continue
+				}
+				if result.Files > 0 {
+					logger.Infof("Removed %d abandoned files from the staging area of %s, %d bytes reclaimed", result.Files, t.repo.Path(), result.Bytes)
+				}
+			}
+		}
+	}()
+}
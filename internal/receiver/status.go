@@ -0,0 +1,146 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// StatusHandler lists the entries of the update queue updating branches the
+// token allows, so that users can tell whether a push is stuck or running
+func StatusHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	ctx := r.Context()
+	queue, ok := ctx.Value(KeyQueue).(*Queue)
+	if !ok {
+		logger.Error("Unable to retrieve queue object from context")
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
+		return
+	}
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+	token, ok := ctx.Value(KeyToken).(*Token)
+	if !ok {
+		logger.Error("Unable to retrieve token from context")
+		httpError(w, r, "no token found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	entries := []*QueueEntry{}
+	err := queue.Walk(func(entry *QueueEntry) error {
+		for branch := range entry.UpdateRefs {
+			if !token.AllowsRef(branch) {
+				return nil
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("Failed to walk the queue: %v", err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+
+	object := common.StatusResponse{Entries: make([]common.QueueStatusResponse, 0, len(entries))}
+	for _, entry := range entries {
+		object.Entries = append(object.Entries, queueStatus(repo, entry))
+	}
+	EncodeJSONReply(w, r, object)
+}
+
+// QueueProgressHandler returns the progress of an entry of the update queue,
+// so that a push can be followed from anywhere
+func QueueProgressHandler(w http.ResponseWriter, r *http.Request) {
+	// Get from context
+	ctx := r.Context()
+	queue, ok := ctx.Value(KeyQueue).(*Queue)
+	if !ok {
+		logger.Error("Unable to retrieve queue object from context")
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
+		return
+	}
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+	token, ok := ctx.Value(KeyToken).(*Token)
+	if !ok {
+		logger.Error("Unable to retrieve token from context")
+		httpError(w, r, "no token found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Get the entry from the queue
+	queueID := chi.URLParam(r, "queueID")
+	entry, err := queue.GetEntry(queueID)
+	if err != nil {
+		logger.Errorf("Unable to retrieve queue entry: %v", err)
+		httpError(w, r, fmt.Sprintf("failed to get entry from queue: %v", err), http.StatusNotFound)
+		return
+	}
+
+	// Entries of other branches are not listed by StatusHandler either
+	allowed := entry != nil
+	if entry != nil {
+		for branch := range entry.UpdateRefs {
+			if !token.AllowsRef(branch) {
+				allowed = false
+			}
+		}
+	}
+	if !allowed {
+		httpError(w, r, "queue entry not found", http.StatusNotFound)
+		return
+	}
+
+	EncodeJSONReply(w, r, queueStatus(repo, entry))
+}
+
+// queueStatus describes the progress of an entry of the update queue
+func queueStatus(repo ostree.Repository, entry *QueueEntry) common.QueueStatusResponse {
+	objects := entry.GetObjects()
+	received, receivedBytes, published := entry.Progress()
+	status := common.QueueStatusResponse{
+		QueueID:          entry.ID,
+		Refs:             entry.UpdateRefs,
+		Created:          entry.Created.UTC().Format(time.RFC3339),
+		Objects:          len(objects),
+		Missing:          len(findMissingObjects(repo, entry, objects)),
+		ReceivedObjects:  received,
+		ReceivedBytes:    receivedBytes,
+		Finalizing:       entry.Finalizing(),
+		PublishedObjects: published,
+	}
+
+	if status.Objects > 0 {
+		done := status.Objects - status.Missing
+		if status.Finalizing {
+			done = status.PublishedObjects
+		}
+		status.Percent = math.Round(float64(done)*1000/float64(status.Objects)) / 10
+	}
+
+	return status
+}
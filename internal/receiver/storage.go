@@ -0,0 +1,372 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Storage places the objects uploaded by clients: they are written to the
+// staging area of their queue entry, then promoted to the repository when
+// the entry is published.  libostree verifies and parses objects, so the
+// backends hand out local files when it needs them.
+type Storage interface {
+	// CreateStaging creates the staging area of a queue entry
+	CreateStaging(queueID string) error
+	// RemoveStaging removes the staging area of a queue entry together
+	// with the objects that were not promoted
+	RemoveStaging(queueID string) error
+	// HasStaged returns whether the object was uploaded for the queue entry
+	HasStaged(queueID, objectName string) (bool, error)
+	// StagedPath returns a local file with the content of a staged object
+	StagedPath(queueID, objectName string) (string, error)
+	// CreateStaged starts writing an object uploaded for the queue entry,
+	// it's only seen in the staging area once committed
+	CreateStaged(queueID, objectName string) (StagedWriter, error)
+	// StageFile moves the complete object at path, a local file, to the
+	// staging area of the queue entry
+	StageFile(queueID, objectName, path string) error
+	// ShareStaged stages an object staged for a queue entry for another
+	// one too, either entry can then be removed without affecting the other
+	ShareStaged(fromQueueID, toQueueID, objectName string) error
+	// HasObject returns whether the repository has the object
+	HasObject(objectName string) (bool, error)
+	// OpenObject reads an object of the repository
+	OpenObject(objectName string) (ObjectReader, error)
+	// Promote moves a staged object to the repository unless it's already
+	// there, readers see either all of it or nothing; flush makes its
+	// content durable
+	Promote(queueID, objectName string, flush bool) error
+	// SyncPromoted makes the promoted objects reachable after a crash
+	SyncPromoted(objectNames []string) error
+	// PublishFiles makes the changes to the files of the repository seen by
+	// clients, such as refs and summary; names are relative to the repository
+	PublishFiles(names []string) error
+}
+
+// ObjectReader reads an object, in any order since it's the basis of deltas
+type ObjectReader interface {
+	io.ReadCloser
+	io.ReaderAt
+}
+
+// StagedWriter writes an object to the staging area of a queue entry
+type StagedWriter interface {
+	io.Writer
+	// Path returns a local file with the content written so far, so that
+	// it can be verified before it's committed
+	Path() string
+	// Commit makes the complete object seen in the staging area
+	Commit() error
+	// Close discards the object unless it was committed
+	Close() error
+}
+
+// StorageBackend creates the storage of a repository
+type StorageBackend func(repo ostree.Repository, config *Config) (Storage, error)
+
+// Name of the backend used when the configuration doesn't set one
+const defaultStorageBackend = "local"
+
+// Storage backends by name
+var storageBackends = map[string]StorageBackend{
+	defaultStorageBackend: func(repo ostree.Repository, config *Config) (Storage, error) {
+		return NewLocalStorage(repo), nil
+	},
+}
+
+// RegisterStorageBackend makes a backend available to the configuration
+func RegisterStorageBackend(name string, backend StorageBackend) {
+	storageBackends[name] = backend
+}
+
+// StorageConfig selects where objects are stored
+type StorageConfig struct {
+	// Name of the backend, "local" by default
+	Backend string `yaml:"backend,omitempty"`
+	// Settings of the gcs and azure backends
+	GCS   *GCSStorage   `yaml:"gcs,omitempty"`
+	Azure *AzureStorage `yaml:"azure,omitempty"`
+}
+
+// Storage of each repository, by path
+var (
+	storagesMutex sync.Mutex
+	storages      = map[string]Storage{}
+)
+
+// OpenStorage sets up the storage of the repository with the backend of
+// the configuration, before the repository receives objects
+func OpenStorage(repo ostree.Repository, config *Config) error {
+	name := config.Storage.Backend
+	if name == "" {
+		name = defaultStorageBackend
+	}
+	backend, ok := storageBackends[name]
+	if !ok {
+		return fmt.Errorf("unknown storage backend \"%s\"", name)
+	}
+
+	storage, err := backend(repo, config)
+	if err != nil {
+		return fmt.Errorf("failed to set up the %s storage: %v", name, err)
+	}
+
+	storagesMutex.Lock()
+	storages[repo.Path()] = storage
+	storagesMutex.Unlock()
+
+	return nil
+}
+
+// getStorage returns the storage of the repository, the local file system
+// unless OpenStorage chose another backend
+func getStorage(repo ostree.Repository) Storage {
+	storagesMutex.Lock()
+	defer storagesMutex.Unlock()
+
+	if storage, ok := storages[repo.Path()]; ok {
+		return storage
+	}
+
+	storage := NewLocalStorage(repo)
+	storages[repo.Path()] = storage
+	return storage
+}
+
+// createEntryStaging creates the temporary directory of a queue entry,
+// where the receiver keeps its state, and the staging area of the entry
+func createEntryStaging(repo ostree.Repository, queueID string) error {
+	if err := CreateEntryTempDirectory(repo, queueID); err != nil {
+		return err
+	}
+
+	return getStorage(repo).CreateStaging(queueID)
+}
+
+// removeEntryStaging removes the staging area of a queue entry and its
+// temporary directory
+func removeEntryStaging(repo ostree.Repository, queueID string) error {
+	if err := getStorage(repo).RemoveStaging(queueID); err != nil {
+		return err
+	}
+
+	return RemoveEntryTempDirectory(repo, queueID)
+}
+
+// stageShared stages for the entry an object staged for another entry of
+// the queue, so that clients pushing branches that share objects upload
+// them once; it returns whether the object is now staged for the entry
+func stageShared(storage Storage, entry *QueueEntry, objectName string) bool {
+	// Encrypted objects are only decrypted by the entry they were staged for
+	queue := entry.getQueue()
+	if queue == nil || entry.Encrypted || !queue.IsObjectReferenced(objectName) {
+		return false
+	}
+
+	shared := false
+	queue.Walk(func(other *QueueEntry) error {
+		if shared || other == entry || other.Encrypted {
+			return nil
+		}
+		if staged, err := storage.HasStaged(other.ID, objectName); err != nil || !staged {
+			return nil
+		}
+		if err := storage.ShareStaged(other.ID, entry.ID, objectName); err != nil {
+			logger.Warnf("Failed to share object %s of queue entry %s with %s: %v", objectName, other.ID, entry.ID, err)
+			return nil
+		}
+		shared = true
+		return nil
+	})
+
+	return shared
+}
+
+// LocalStorage stores objects in the repository directory, the staging
+// area of queue entries is their temporary directory
+type LocalStorage struct {
+	repo ostree.Repository
+}
+
+// LocalStorage implements Storage
+var _ Storage = (*LocalStorage)(nil)
+
+// NewLocalStorage returns the storage of the repository on the file system
+func NewLocalStorage(repo ostree.Repository) *LocalStorage {
+	return &LocalStorage{repo: repo}
+}
+
+// CreateStaging creates the temporary directory of the queue entry, unless
+// the receiver already did
+func (s *LocalStorage) CreateStaging(queueID string) error {
+	return os.MkdirAll(GetEntryTempDirectory(s.repo, queueID), 0755)
+}
+
+// RemoveStaging removes the temporary directory of the queue entry
+func (s *LocalStorage) RemoveStaging(queueID string) error {
+	return RemoveEntryTempDirectory(s.repo, queueID)
+}
+
+// exists returns whether there is a file at path
+func exists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// HasStaged returns whether the object is in the directory of the entry
+func (s *LocalStorage) HasStaged(queueID, objectName string) (bool, error) {
+	return exists(GetTempObjectPath(s.repo, queueID, objectName))
+}
+
+// StagedPath returns the path of the object in the directory of the entry
+func (s *LocalStorage) StagedPath(queueID, objectName string) (string, error) {
+	return GetTempObjectPath(s.repo, queueID, objectName), nil
+}
+
+// localStagedWriter writes to a partial file next to the object, that
+// is renamed once complete
+type localStagedWriter struct {
+	file       *os.File
+	objectPath string
+	committed  bool
+}
+
+func (w *localStagedWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *localStagedWriter) Path() string {
+	return w.file.Name()
+}
+
+func (w *localStagedWriter) Commit() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.file.Name(), w.objectPath); err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
+
+func (w *localStagedWriter) Close() error {
+	if w.committed {
+		return nil
+	}
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
+
+// CreateStaged writes the object to a partial file in the directory of the
+// entry, so that the object is only seen there when it's complete
+func (s *LocalStorage) CreateStaged(queueID, objectName string) (StagedWriter, error) {
+	objectPath := GetTempObjectPath(s.repo, queueID, objectName)
+	file, err := ioutil.TempFile(filepath.Dir(objectPath), objectName+".*.part")
+	if err != nil {
+		return nil, err
+	}
+	// Temporary files are only readable by their owner, while the objects
+	// promoted to the repository are served by other programs too
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return &localStagedWriter{file: file, objectPath: objectPath}, nil
+}
+
+// StageFile renames the file at path in the directory of the entry
+func (s *LocalStorage) StageFile(queueID, objectName, path string) error {
+	return os.Rename(path, GetTempObjectPath(s.repo, queueID, objectName))
+}
+
+// ShareStaged links the object in the directory of the other entry, it
+// stays there when either directory is removed
+func (s *LocalStorage) ShareStaged(fromQueueID, toQueueID, objectName string) error {
+	err := os.Link(GetTempObjectPath(s.repo, fromQueueID, objectName), GetTempObjectPath(s.repo, toQueueID, objectName))
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+// HasObject returns whether the object is in the repository directory
+func (s *LocalStorage) HasObject(objectName string) (bool, error) {
+	return exists(s.repo.GetObjectPath(objectName))
+}
+
+// OpenObject opens the object file of the repository
+func (s *LocalStorage) OpenObject(objectName string) (ObjectReader, error) {
+	return os.Open(s.repo.GetObjectPath(objectName))
+}
+
+// Promote moves the object from the directory of the entry to the
+// repository, with a rename when they are on the same file system
+func (s *LocalStorage) Promote(queueID, objectName string, flush bool) error {
+	// Create path where the object will be moved to
+	objectPath := s.repo.GetObjectPath(objectName)
+	path := filepath.Dir(objectPath)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("failed to create directory \"%s\" for the objects: %v", path, err)
+	}
+
+	// Move from the temporary location to the proper path only if it wasn't previously moved
+	if _, err := os.Stat(objectPath); os.IsNotExist(err) {
+		tempPath := GetTempObjectPath(s.repo, queueID, objectName)
+		if err := moveFile(tempPath, objectPath); err != nil {
+			return fmt.Errorf("unable to move \"%s\" to \"%s\": %v", tempPath, objectPath, err)
+		}
+	}
+
+	if flush {
+		if err := syncPath(objectPath); err != nil {
+			return fmt.Errorf("failed to sync \"%s\": %v", objectPath, err)
+		}
+	}
+
+	return nil
+}
+
+// SyncPromoted flushes the entries of the directories of the objects
+func (s *LocalStorage) SyncPromoted(objectNames []string) error {
+	dirs := map[string]bool{}
+	for _, objectName := range objectNames {
+		dirs[filepath.Dir(s.repo.GetObjectPath(objectName))] = true
+	}
+
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+
+	for _, dir := range sorted {
+		if err := syncPath(dir); err != nil {
+			return fmt.Errorf("failed to sync directory \"%s\": %v", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// PublishFiles does nothing, clients pull from the repository directory
+func (s *LocalStorage) PublishFiles(names []string) error {
+	return nil
+}
@@ -0,0 +1,276 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Files of the repository written when the summary is regenerated
+var summaryFiles = []string{"summary", "summary.sig"}
+
+// Path of the additional metadata of the summary sent by clients, relative
+// to the repository, next to the publish log
+const summaryMetadataName = "ostree-upload/summary-metadata.json"
+
+// Held while the additional metadata of a summary are updated
+var summaryMetadataMutex sync.Mutex
+
+// readSummaryMetadata returns the additional metadata of the summary sent
+// by clients so far
+func readSummaryMetadata(repo ostree.Repository) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(filepath.Join(repo.Path(), summaryMetadataName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var metadata map[string]interface{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("invalid summary metadata: %v", err)
+	}
+
+	return summaryMetadataValues(metadata)
+}
+
+// updateSummaryMetadata merges metadata into the additional metadata of
+// the summary, keys with a nil value are removed
+func updateSummaryMetadata(repo ostree.Repository, metadata map[string]interface{}) error {
+	summaryMetadataMutex.Lock()
+	defer summaryMetadataMutex.Unlock()
+
+	merged, err := readSummaryMetadata(repo)
+	if err != nil {
+		return err
+	}
+	if merged == nil {
+		merged = map[string]interface{}{}
+	}
+	for key, value := range metadata {
+		if value == nil {
+			delete(merged, key)
+		} else {
+			merged[key] = value
+		}
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+
+	// Write the metadata atomically
+	path := filepath.Join(repo.Path(), summaryMetadataName)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// summaryMetadataValues converts additional metadata of the summary decoded
+// from JSON to the types OSTree stores: integral numbers become integers and
+// lists become lists of strings, nil values are kept
+func summaryMetadataValues(metadata map[string]interface{}) (map[string]interface{}, error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+
+	values := make(map[string]interface{}, len(metadata))
+	for key, value := range metadata {
+		switch v := value.(type) {
+		case nil:
+			values[key] = nil
+			continue
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+				value = int64(v)
+			}
+		case []interface{}:
+			list := make([]string, 0, len(v))
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("summary metadata %s must be a list of strings", key)
+				}
+				list = append(list, s)
+			}
+			value = list
+		}
+		if err := ostree.CheckSummaryMetadata(map[string]interface{}{key: value}); err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+
+	return values, nil
+}
+
+// regenerateSummary regenerates the summary of repo with the additional
+// metadata sent by clients
+func regenerateSummary(repo ostree.Repository) error {
+	additional, err := readSummaryMetadata(repo)
+	if err != nil {
+		return fmt.Errorf("failed to read the summary metadata: %v", err)
+	}
+
+	return repo.RegenerateSummary(additional)
+}
+
+// debouncedRepository regenerates the summary once no publish happened for
+// a while, instead of after each publish of a burst
+type debouncedRepository struct {
+	ostree.Repository
+	delay time.Duration
+
+	mutex sync.Mutex
+	timer *time.Timer
+	// Additional metadata of the scheduled update
+	additional map[string]interface{}
+	// Held while the summary is regenerated
+	regenerating sync.Mutex
+}
+
+// DebounceSummary returns repo with summary updates postponed until delay
+// passed since the last one was requested, or repo itself when delay is 0
+func DebounceSummary(repo ostree.Repository, delay time.Duration) ostree.Repository {
+	if delay <= 0 {
+		return repo
+	}
+
+	return &debouncedRepository{Repository: repo, delay: delay}
+}
+
+// RegenerateSummary schedules the update of the summary, postponing the
+// one already scheduled
+func (d *debouncedRepository) RegenerateSummary(additional map[string]interface{}) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.additional = additional
+	d.timer = time.AfterFunc(d.delay, func() {
+		if err := d.FlushSummary(); err != nil {
+			logger.Errorf("Failed to regenerate summary of %s: %v", d.Path(), err)
+		}
+	})
+
+	return nil
+}
+
+// FlushSummary regenerates the summary right away if an update is scheduled
+func (d *debouncedRepository) FlushSummary() error {
+	d.mutex.Lock()
+	pending := d.timer != nil
+	if pending {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	additional := d.additional
+	d.mutex.Unlock()
+
+	if !pending {
+		return nil
+	}
+
+	d.regenerating.Lock()
+	defer d.regenerating.Unlock()
+
+	logger.Debugf("Regenerating summary of %s", d.Path())
+	if err := d.Repository.RegenerateSummary(additional); err != nil {
+		return err
+	}
+
+	return getStorage(d).PublishFiles(summaryFiles)
+}
+
+// RecoverSummary regenerates the summary when updates are postponed, since
+// one might have been scheduled when the server stopped
+func RecoverSummary(repo ostree.Repository, config *Config) error {
+	if config.SummaryDelay <= 0 {
+		return nil
+	}
+
+	if err := regenerateSummary(repo); err != nil {
+		return fmt.Errorf("failed to regenerate summary: %v", err)
+	}
+	if err := getStorage(repo).PublishFiles(summaryFiles); err != nil {
+		return fmt.Errorf("failed to publish summary: %v", err)
+	}
+
+	return nil
+}
+
+// FlushSummary regenerates the summary of repo if an update is scheduled
+func FlushSummary(repo ostree.Repository) error {
+	if d, ok := repo.(*debouncedRepository); ok {
+		return d.FlushSummary()
+	}
+
+	return nil
+}
+
+// FlushSummaries regenerates the summaries of all the repositories opened so
+// far whose update is scheduled
+func (s *AppState) FlushSummaries() error {
+	var firstErr error
+	for _, t := range s.repositories() {
+		if err := FlushSummary(t.repo); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// FlushSummaryHandler regenerates the summary of the repository right away,
+// when an update was postponed
+func FlushSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := r.Context().Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return
+	}
+	if !checkTokenAccess(w, r, common.ScopeAdmin) {
+		return
+	}
+
+	if err := FlushSummary(repo); err != nil {
+		logger.Errorf("Failed to regenerate summary: %v", err)
+		httpError(w, r, "failed to regenerate summary", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
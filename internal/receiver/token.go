@@ -5,17 +5,29 @@
 package receiver
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
 )
 
 // Token represents an API token
 type Token struct {
-	Token   string `yaml:"token"`
-	Created string `yaml:"created"`
+	Token   string   `yaml:"token"`
+	Name    string   `yaml:"name,omitempty"`
+	Created string   `yaml:"created"`
+	Expires string   `yaml:"expires,omitempty"`
+	Repo    string   `yaml:"repo,omitempty"`
+	Scopes  []string `yaml:"scopes,omitempty"`
+	Refs    []string `yaml:"refs,omitempty"`
 }
 
 // GenerateToken generates a new reandom API token
@@ -30,40 +42,145 @@ func GenerateToken() (*Token, error) {
 	return &Token{Token: tokenString, Created: time.Now().UTC().Format(time.RFC3339)}, nil
 }
 
+// Expired returns whether the token expired, tokens without an expiry never
+// expire and those with an invalid one are considered expired
+func (t *Token) Expired() bool {
+	if t.Expires == "" {
+		return false
+	}
+
+	expires, err := time.Parse(time.RFC3339, t.Expires)
+	return err != nil || time.Now().After(expires)
+}
+
+// HasScope returns whether the token allows the operation
+func (t *Token) HasScope(scope string) bool {
+	if len(t.Scopes) == 0 {
+		return true
+	}
+
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsRef returns whether the token allows to update the branch
+func (t *Token) AllowsRef(ref string) bool {
+	return common.RefAllowed(t.Refs, ref)
+}
+
 func tokenFromHeader(r *http.Request) string {
 	bearer := r.Header.Get("Authorization")
 	if len(bearer) > 7 && strings.ToUpper(bearer[0:6]) == "BEARER" {
 		return bearer[7:]
 	}
-	return ""
+	return r.Header.Get(common.TokenHeader)
 }
 
 // TokenVerifier HTTP middleware handler will verify token in a HTTP request
-// Checks if the HTTP request has 'Authorization: BEARER T' header.
+// Checks if the HTTP request has 'Authorization: BEARER T' header, or the token
+// header when a reverse proxy uses the Authorization header.
 func TokenVerifier(appState *AppState) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			tokenString := tokenFromHeader(r)
 			if tokenString == "" {
-				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				httpError(w, r, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
 			}
 
 			// Check if the token is valid
-			found := false
+			var found *Token
 			for _, token := range appState.Config.Tokens {
-				if token.Token == tokenString {
-					found = true
+				if subtle.ConstantTimeCompare([]byte(token.Token), []byte(tokenString)) == 1 {
+					found = token
 					break
 				}
 			}
-			if !found {
-				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			if found == nil {
+				httpError(w, r, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			if found.Expired() {
+				httpError(w, r, "token expired", http.StatusUnauthorized)
 				return
 			}
 
-			next.ServeHTTP(w, r)
+			ctx := context.WithValue(r.Context(), KeyToken, found)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		}
 		return http.HandlerFunc(fn)
 	}
 }
+
+// WhoamiHandler describes the token used to authenticate, so that clients
+// can warn about its expiry and check what it allows before pushing
+func WhoamiHandler(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(KeyToken).(*Token)
+	if !ok {
+		logger.Error("Unable to retrieve token from context")
+		httpError(w, r, "no token found", http.StatusUnprocessableEntity)
+		return
+	}
+
+	object := common.WhoamiResponse{
+		Name:    token.Name,
+		Created: token.Created,
+		Expires: token.Expires,
+		Scopes:  token.Scopes,
+		Refs:    token.Refs,
+	}
+
+	// Tell how much of the quota of the repository of the token is used
+	config, ok := r.Context().Value(KeyConfig).(*Config)
+	if ok && config.Quota > 0 {
+		repo, ok := r.Context().Value(KeyRepository).(ostree.Repository)
+		if !ok {
+			logger.Error("Unable to retrieve repository object from context")
+			httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+			return
+		}
+		used, err := repoUsage(repo)
+		if err != nil {
+			logger.Errorf("Cannot measure the repository: %v", err)
+			httpError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		object.QuotaUsed = used
+		object.QuotaLimit = config.Quota * 1024 * 1024
+	}
+
+	EncodeJSONReply(w, r, object)
+}
+
+// checkTokenAccess replies with an error and returns false unless the token
+// in the request context has the scope and allows to update all branches
+func checkTokenAccess(w http.ResponseWriter, r *http.Request, scope string, branches ...string) bool {
+	token, ok := r.Context().Value(KeyToken).(*Token)
+	if !ok {
+		logger.Error("Unable to retrieve token from context")
+		httpError(w, r, "no token found", http.StatusUnprocessableEntity)
+		return false
+	}
+
+	if !token.HasScope(scope) {
+		httpError(w, r, fmt.Sprintf("token doesn't allow to %s", scope), http.StatusForbidden)
+		return false
+	}
+	for _, branch := range branches {
+		if !token.AllowsRef(branch) {
+			writeError(w, r, http.StatusForbidden, common.ErrorResponse{
+				Code:    common.ErrorCodeForbidden,
+				Message: fmt.Sprintf("token doesn't allow to update branch \"%s\"", branch),
+				Details: map[string]string{"branch": branch},
+			})
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,282 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package receiver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Version of the tus resumable upload protocol we implement,
+// see https://tus.io/protocols/resumable-upload
+const tusVersion = "1.0.0"
+
+// Content type of the body of tus PATCH requests
+const tusContentType = "application/offset+octet-stream"
+
+// tusResumable checks that the client speaks our version of the tus
+// protocol and tells it which version we speak
+func tusResumable(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+
+		// Version discovery doesn't need the header
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			httpError(w, r, fmt.Sprintf("unsupported tus version, only %s is supported", tusVersion), http.StatusPreconditionFailed)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// tusUploadPath returns the path of the partial object uploaded with tus
+func tusUploadPath(repo ostree.Repository, queueID, objectName string) string {
+	return GetTempObjectPath(repo, queueID, objectName) + ".tus"
+}
+
+// parseTusMetadata decodes the Upload-Metadata header, a comma separated
+// list of keys followed by their base64 encoded value
+func parseTusMetadata(value string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if value == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		fields := strings.Fields(pair)
+		switch len(fields) {
+		case 1:
+			metadata[fields[0]] = ""
+		case 2:
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for metadata key \"%s\": %v", fields[0], err)
+			}
+			metadata[fields[0]] = string(decoded)
+		default:
+			return nil, fmt.Errorf("invalid metadata \"%s\"", pair)
+		}
+	}
+
+	return metadata, nil
+}
+
+// tusEntry returns the repository and the queue entry of the request,
+// replying with an error when they can't be found
+func tusEntry(w http.ResponseWriter, r *http.Request) (ostree.Repository, *QueueEntry, bool) {
+	// Get from context
+	ctx := r.Context()
+	queue, ok := ctx.Value(KeyQueue).(*Queue)
+	if !ok {
+		logger.Error("Unable to retrieve queue object from context")
+		httpError(w, r, "no queue found", http.StatusUnprocessableEntity)
+		return nil, nil, false
+	}
+	repo, ok := ctx.Value(KeyRepository).(ostree.Repository)
+	if !ok {
+		logger.Error("Unable to retrieve repository object from context")
+		httpError(w, r, "no repository found", http.StatusUnprocessableEntity)
+		return nil, nil, false
+	}
+
+	// Get the entry from the queue
+	entry, ok := getEntry(w, r, queue)
+	if !ok {
+		return nil, nil, false
+	}
+
+	return repo, entry, true
+}
+
+// TusOptionsHandler tells tus clients which protocol version and extensions we support
+func TusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusCreateHandler creates the upload of an object, whose name is passed
+// with the "filename" key of the Upload-Metadata header
+func TusCreateHandler(w http.ResponseWriter, r *http.Request) {
+	repo, entry, ok := tusEntry(w, r)
+	if !ok {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		httpError(w, r, "invalid Upload-Length header", http.StatusBadRequest)
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	objectName := metadata["filename"]
+	if err := validateObjectNames(repo, []string{objectName}); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if config, ok := r.Context().Value(KeyConfig).(*Config); ok && config.MaxObjectSize > 0 && length > config.MaxObjectSize*1024*1024 {
+		objectTooLarge(w, r, objectName)
+		return
+	}
+
+	// Clients that lost track of an upload continue it
+	if existingLength, ok := entry.UploadLength(objectName); ok && existingLength == length {
+		w.Header().Set("Location", "uploads/"+objectName)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	// Only one upload per object at a time
+	if !entry.StartUpload(objectName, length) {
+		httpError(w, r, fmt.Sprintf("object %s is already being uploaded", objectName), http.StatusConflict)
+		return
+	}
+	file, err := os.OpenFile(tusUploadPath(repo, entry.ID, objectName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		logger.Errorf("Unable to create upload of \"%s\": %v", objectName, err)
+		entry.FinishUpload(objectName)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	file.Close()
+
+	// Relative to the creation URL, so that it works behind proxies
+	w.Header().Set("Location", "uploads/"+objectName)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// TusOffsetHandler returns how much of an object was uploaded so far
+func TusOffsetHandler(w http.ResponseWriter, r *http.Request) {
+	repo, entry, ok := tusEntry(w, r)
+	if !ok {
+		return
+	}
+
+	objectName := chi.URLParam(r, "objectName")
+	length, ok := entry.UploadLength(objectName)
+	if !ok {
+		httpError(w, r, "upload not found", http.StatusNotFound)
+		return
+	}
+	fi, err := os.Stat(tusUploadPath(repo, entry.ID, objectName))
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(fi.Size(), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// TusPatchHandler appends data to an upload, the object is verified and
+// added to the queue entry once it's complete
+func TusPatchHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if !limitRequestBody(w, r) {
+		return
+	}
+
+	repo, entry, ok := tusEntry(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != tusContentType {
+		httpError(w, r, fmt.Sprintf("Content-Type header is not %s", tusContentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	objectName := chi.URLParam(r, "objectName")
+	length, ok := entry.UploadLength(objectName)
+	if !ok {
+		httpError(w, r, "upload not found", http.StatusNotFound)
+		return
+	}
+	if !entry.LockUpload(objectName) {
+		httpError(w, r, fmt.Sprintf("object %s is already being uploaded", objectName), http.StatusConflict)
+		return
+	}
+	defer entry.UnlockUpload(objectName)
+
+	uploadPath := tusUploadPath(repo, entry.ID, objectName)
+	file, err := os.OpenFile(uploadPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	// The client must continue from where the upload stopped
+	fi, err := file.Stat()
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != fi.Size() {
+		httpError(w, r, fmt.Sprintf("upload offset must be %d", fi.Size()), http.StatusConflict)
+		return
+	}
+
+	// Keep what we received even if the connection drops, that's the point
+	written, err := io.Copy(file, io.LimitReader(r.Body, length-offset))
+	offset += written
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if err != nil {
+		logger.Errorf("Upload of \"%s\" interrupted at %d/%d bytes: %v", objectName, offset, length, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	file.Close()
+
+	if offset == length {
+		// Remove the upload, the client will upload the object again
+		// from the start if it's corrupted
+		entry.FinishUpload(objectName)
+		if !entry.Encrypted {
+			if err := repo.VerifyObject(uploadPath, objectName); err != nil {
+				logger.Errorf("Failed to verify \"%s\": %v", objectName, err)
+				os.Remove(uploadPath)
+				writeChecksumMismatch(w, r, objectName)
+				return
+			}
+		}
+
+		if err := getStorage(repo).StageFile(entry.ID, objectName, uploadPath); err != nil {
+			logger.Errorf("Failed to stage \"%s\": %v", objectName, err)
+			httpError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if entry.Encrypted {
+			entry.AddEncrypted(objectName)
+		}
+		entry.AddObjects([]string{objectName})
+		entry.AddReceived(length)
+		logger.Debugf("Received \"%s\" with tus", objectName)
+		emitQueueProgress(repo, entry)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -5,11 +5,40 @@
 package receiver
 
 import (
+	"errors"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"syscall"
 )
 
+// moveFile moves source to destination with a rename when they are on the
+// same file system, otherwise it copies the file atomically and removes source
 func moveFile(source, destination string) error {
+	err := os.Rename(source, destination)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	return copyFile(source, destination)
+}
+
+// syncPath flushes the file or directory entries of path to disk
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// copyFile copies source next to destination, flushes the copy to disk
+// and renames it to destination, then it removes source: after a crash
+// destination is either complete or missing
+func copyFile(source, destination string) error {
 	src, err := os.Open(source)
 	if err != nil {
 		return err
@@ -21,16 +50,22 @@ func moveFile(source, destination string) error {
 		return err
 	}
 
-	perm := fi.Mode() & os.ModePerm
-	dst, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	dst, err := ioutil.TempFile(filepath.Dir(destination), filepath.Base(destination)+".*.part")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(dst.Name())
 	defer dst.Close()
 
+	if err = dst.Chmod(fi.Mode() & os.ModePerm); err != nil {
+		return err
+	}
+
 	if _, err = io.Copy(dst, src); err != nil {
-		dst.Close()
-		os.Remove(destination)
+		return err
+	}
+
+	if err = dst.Sync(); err != nil {
 		return err
 	}
 
@@ -38,6 +73,10 @@ func moveFile(source, destination string) error {
 		return err
 	}
 
+	if err = os.Rename(dst.Name(), destination); err != nil {
+		return err
+	}
+
 	if err = src.Close(); err != nil {
 		return err
 	}
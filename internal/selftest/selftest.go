@@ -0,0 +1,190 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package selftest pushes a synthetic commit to a receiver running in the
+// same process, to check that a deployment environment works
+package selftest
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/internal/push"
+	"github.com/lirios/ostree-upload/internal/receiver"
+	"github.com/lirios/ostree-upload/pkg/client"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Branch pushed by the self-test
+const branch = "ostree-upload/selftest"
+
+// Files of the synthetic commit, the large one is random so that it
+// doesn't compress and is sent in its own request
+var files = map[string]int{
+	"README":           0,
+	"usr/bin/hello":    0,
+	"usr/share/random": 4 * 1024 * 1024,
+}
+
+// Run creates a throwaway client and server repository in a temporary
+// directory, pushes a synthetic commit from one to the other through a
+// receiver listening on the loopback interface, and verifies the refs and
+// the objects of the server; the directory is removed unless keep is true
+func Run(keep bool) (err error) {
+	dir, err := ioutil.TempDir("", "ostree-upload-selftest-")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary directory: %w", err)
+	}
+	if keep {
+		logger.Infof("Repositories are kept in %s", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	// Client repository with a synthetic commit
+	logger.Action("Creating a commit...")
+	clientRepo, err := ostree.CreateRepo(filepath.Join(dir, "client"))
+	if err != nil {
+		return fmt.Errorf("Failed to create client repository: %w", err)
+	}
+	rev, err := createCommit(clientRepo, filepath.Join(dir, "tree"))
+	if err != nil {
+		return fmt.Errorf("Failed to create commit: %w", err)
+	}
+	logger.Infof("Created commit %s", rev)
+
+	// Server
+	logger.Action("Starting the receiver...")
+	server, err := StartReceiver(filepath.Join(dir, "server"))
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	// Push with the real client, in small batches to exercise several requests
+	options := push.Options{
+		BatchSize: 1024 * 1024,
+		Timeouts:  client.DefaultTimeouts,
+		AssumeYes: true,
+		Metadata:  map[string]string{"selftest": "true"},
+	}
+	if err := push.StartClient(server.URL, server.Token, clientRepo.Path(), []string{branch}, options); err != nil {
+		return fmt.Errorf("Failed to push: %w", err)
+	}
+
+	// Verify the server repository
+	logger.Action("Verifying the server repository...")
+	if err := verify(clientRepo, server.Repo, rev); err != nil {
+		return err
+	}
+
+	logger.Info("Self-test passed")
+
+	return nil
+}
+
+// Receiver is a receiver running in the process, listening on the
+// loopback interface
+type Receiver struct {
+	// URL of the server
+	URL string
+	// Token accepted by the server
+	Token string
+	// Repository of the server
+	Repo     ostree.Repository
+	listener net.Listener
+}
+
+// StartReceiver starts a receiver serving the repository at path,
+// which is created if it doesn't exist
+func StartReceiver(path string) (*Receiver, error) {
+	repo, err := receiver.OpenOrCreateRepo(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create server repository: %w", err)
+	}
+	queue, err := receiver.NewQueue()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create queue: %w", err)
+	}
+	token, err := receiver.GenerateToken()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate token: %w", err)
+	}
+	config := &receiver.Config{
+		Tokens:     []*receiver.Token{token},
+		Durability: receiver.Durability{SyncObjects: true, SyncDirs: true, SyncRefs: true},
+	}
+	appState := &receiver.AppState{Queue: queue, Repo: repo, Config: config}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen: %w", err)
+	}
+	go receiver.Serve(listener, "", appState)
+
+	return &Receiver{URL: fmt.Sprintf("http://%s", listener.Addr()), Token: token.Token, Repo: repo, listener: listener}, nil
+}
+
+// Close stops the receiver
+func (r *Receiver) Close() error {
+	return r.listener.Close()
+}
+
+// createCommit writes the files of the synthetic commit to path and
+// commits them to the branch
+func createCommit(repo *ostree.Repo, path string) (string, error) {
+	for name, size := range files {
+		filePath := filepath.Join(path, name)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return "", err
+		}
+
+		content := []byte(fmt.Sprintf("ostree-upload self-test file %s\n", name))
+		if size > 0 {
+			content = make([]byte, size)
+			if _, err := rand.Read(content); err != nil {
+				return "", err
+			}
+		}
+		if err := ioutil.WriteFile(filePath, content, 0644); err != nil {
+			return "", err
+		}
+	}
+
+	return repo.CommitDirectory(branch, "ostree-upload self-test", path)
+}
+
+// verify checks that the server branch points to rev and that the
+// server has all the objects of the commit, with the right content
+func verify(clientRepo, serverRepo ostree.Repository, rev string) error {
+	revs, err := serverRepo.Refs()
+	if err != nil {
+		return fmt.Errorf("Failed to list server branches: %w", err)
+	}
+	if revs[branch] != rev {
+		return fmt.Errorf("Server branch \"%s\" points to \"%s\" instead of %s", branch, revs[branch], rev)
+	}
+
+	objectNames, err := clientRepo.Traverse(rev, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to list the objects of %s: %w", rev, err)
+	}
+	for _, objectName := range objectNames {
+		objectPath := serverRepo.GetObjectPath(objectName)
+		if _, err := os.Stat(objectPath); err != nil {
+			return fmt.Errorf("Server is missing object %s: %w", objectName, err)
+		}
+		if err := serverRepo.VerifyObject(objectPath, objectName); err != nil {
+			return fmt.Errorf("Server has a corrupted object: %w", err)
+		}
+	}
+	logger.Infof("Server has all the %d objects of %s", len(objectNames), rev)
+
+	return nil
+}
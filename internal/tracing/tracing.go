@@ -0,0 +1,262 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package tracing records spans of the work done by the client and the
+// receiver with OpenTelemetry and propagates them over HTTP with the W3C
+// Trace Context headers.  Spans are sent with OTLP to the collector, such
+// as Jaeger or Tempo, configured by the standard OTEL_* environment
+// variables, and can be logged; nothing is recorded otherwise.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/internal/version"
+)
+
+// Name of the tracer and of the service when OTEL_SERVICE_NAME is not set
+const serviceName = "ostree-upload"
+
+// Global variables
+var mutex sync.Mutex
+var provider *sdktrace.TracerProvider
+
+func init() {
+	// Trace context is propagated even when nothing is recorded, so that
+	// the spans of the client and the server end up in the same trace
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// otlpEnabled returns whether the environment configures the OTLP exporter
+func otlpEnabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+
+	switch os.Getenv("OTEL_TRACES_EXPORTER") {
+	case "otlp":
+		return true
+	case "":
+		return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+	default:
+		return false
+	}
+}
+
+// newOTLPExporter returns the OTLP exporter with the protocol of the
+// environment, the other settings are read by the exporter itself
+func newOTLPExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+
+	switch protocol {
+	case "", "http/protobuf":
+		return otlptracehttp.New(ctx)
+	case "grpc":
+		return otlptracegrpc.New(ctx)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol \"%s\": expected http/protobuf or grpc", protocol)
+	}
+}
+
+// Setup sends spans to the OTLP collector of the environment, and to the
+// log with logSpans; shutdown flushes the spans that were not sent yet
+func Setup(ctx context.Context, logSpans bool) (shutdown func(context.Context) error, err error) {
+	options := []sdktrace.TracerProviderOption{}
+	if otlpEnabled() {
+		exporter, err := newOTLPExporter(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the OTLP exporter: %v", err)
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+	if logSpans {
+		options = append(options, sdktrace.WithSyncer(LogExporter{}))
+	}
+	if len(options) == 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName), attribute.String("service.version", version.Version)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv())
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the traced service: %v", err)
+	}
+	options = append(options, sdktrace.WithResource(res))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	provider = sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Record passes the spans ended until stop is called to processor as well,
+// recording spans even if Setup didn't enable tracing
+func Record(processor sdktrace.SpanProcessor) (stop func()) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if provider == nil {
+		provider = sdktrace.NewTracerProvider()
+		otel.SetTracerProvider(provider)
+	}
+	provider.RegisterSpanProcessor(processor)
+
+	p := provider
+	return func() {
+		p.UnregisterSpanProcessor(processor)
+	}
+}
+
+// Span is an operation being traced
+type Span struct {
+	span trace.Span
+}
+
+// StartSpan starts a span, child of the span in ctx if any, and returns
+// a context carrying it
+func StartSpan(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, *Span) {
+	ctx, span := otel.Tracer(serviceName).Start(ctx, name, options...)
+	return ctx, &Span{span: span}
+}
+
+// SetAttribute attaches a key-value pair to the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	var kv attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		kv = attribute.String(key, v)
+	case int:
+		kv = attribute.Int(key, v)
+	case int64:
+		kv = attribute.Int64(key, v)
+	case bool:
+		kv = attribute.Bool(key, v)
+	case float64:
+		kv = attribute.Float64(key, v)
+	default:
+		kv = attribute.String(key, fmt.Sprint(v))
+	}
+	s.span.SetAttributes(kv)
+}
+
+// End finishes the span, err is the outcome of the operation
+func (s *Span) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+// Inject adds the trace context of the span in ctx to the headers
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Extract returns a context whose spans are children of the remote span
+// in the headers, if any
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// statusRecorder remembers the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush sends the buffered data to the client, for streamed responses
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Middleware traces each request, continuing the trace of the client
+func Middleware(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := Extract(r.Context(), r.Header)
+		ctx, span := StartSpan(ctx, fmt.Sprintf("%s %s", r.Method, r.URL.Path), trace.WithSpanKind(trace.SpanKindServer))
+		if !span.span.IsRecording() {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			span.End(nil)
+			return
+		}
+
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttribute("http.response.status_code", recorder.status)
+		if recorder.status >= 500 {
+			span.End(fmt.Errorf("%s", http.StatusText(recorder.status)))
+		} else {
+			span.End(nil)
+		}
+	}
+	return http.HandlerFunc(fn)
+}
+
+// LogExporter logs finished spans with their timing
+type LogExporter struct{}
+
+// ExportSpans logs the spans
+func (LogExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	for _, span := range spans {
+		fields := logger.Fields{
+			"trace_id": span.SpanContext().TraceID().String(),
+			"span_id":  span.SpanContext().SpanID().String(),
+			"duration": span.EndTime().Sub(span.StartTime()).String(),
+		}
+		if span.Parent().IsValid() {
+			fields["parent_id"] = span.Parent().SpanID().String()
+		}
+		for _, kv := range span.Attributes() {
+			fields[string(kv.Key)] = kv.Value.Emit()
+		}
+		if span.Status().Code == codes.Error {
+			fields["error"] = span.Status().Description
+		}
+
+		logger.WithFields(fields).Infof("Span \"%s\"", span.Name())
+	}
+
+	return nil
+}
+
+// Shutdown does nothing, spans are logged as they end
+func (LogExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,24 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package version describes the build, its variables are set at link time:
+//
+//	go build -ldflags "-X github.com/lirios/ostree-upload/internal/version.Version=1.0.0"
+package version
+
+import "fmt"
+
+var (
+	// Version is the release the program was built from
+	Version = "unknown"
+	// Commit is the git commit the program was built from
+	Commit = "unknown"
+	// BuildDate is when the program was built
+	BuildDate = "unknown"
+)
+
+// UserAgent returns the identifier of the client sent to servers
+func UserAgent() string {
+	return fmt.Sprintf("ostree-upload/%s", Version)
+}
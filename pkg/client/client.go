@@ -0,0 +1,1100 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package client pushes the commits of an OSTree repository to an
+// ostree-upload receiver, for programs that embed pushes instead of running
+// the ostree-upload command
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/delta"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/internal/tracing"
+	"github.com/lirios/ostree-upload/internal/version"
+)
+
+// Timeouts controls how long the client waits for the server, a zero value
+// means no timeout; each is a deadline of an operation, added to the one of
+// the context of the call if any
+type Timeouts struct {
+	// Maximum time to establish a connection
+	Connect time.Duration
+	// Maximum time for a request that neither uploads objects nor
+	// publishes, including reading the response body
+	Request time.Duration
+	// Maximum time for a request that uploads objects
+	Upload time.Duration
+	// Maximum time for the server to publish the branches of a queue entry
+	Publish time.Duration
+	// Maximum time to wait for the response headers after sending a request
+	ResponseHeader time.Duration
+}
+
+// DefaultTimeouts are the timeouts used when none are specified
+var DefaultTimeouts = Timeouts{
+	Connect: 30 * time.Second,
+	Request: 5 * time.Minute,
+	Upload:  30 * time.Minute,
+	Publish: 30 * time.Minute,
+}
+
+// Client is used to upload objects to a receiver
+type Client struct {
+	baseURL    *url.URL
+	userAgent  string
+	httpClient *http.Client
+	timeouts   Timeouts
+	token      string
+	apiVersion int
+	// Credentials and headers required by a reverse proxy
+	username     string
+	password     string
+	headers      http.Header
+	capabilities map[string]bool
+	// Algorithm of the checksums sent with each object, if any
+	checksumAlgorithm string
+	// Limits of upload requests, 0 for no limit
+	maxObjectSize     int64
+	maxRequestObjects int
+	// Checksums of the uploaded objects, if they're recorded
+	uploadChecksums *UploadChecksums
+}
+
+// UploadChecksums are the checksums of the objects uploaded by a client,
+// computed as they're sent
+type UploadChecksums struct {
+	algorithm string
+	mutex     sync.Mutex
+	checksums map[string]string
+}
+
+// Get returns the checksum of the object as it was last uploaded
+func (u *UploadChecksums) Get(objectName string) (string, bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	checksum, ok := u.checksums[objectName]
+	return checksum, ok
+}
+
+// set records the checksum of an uploaded object
+func (u *UploadChecksums) set(objectName, checksum string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.checksums[objectName] = checksum
+}
+
+// RecordChecksums makes Upload compute the checksum of each object with
+// algorithm as it's sent, so that they don't have to be read again
+func (c *Client) RecordChecksums(algorithm string) (*UploadChecksums, error) {
+	if _, err := common.NewChecksumHash(algorithm); err != nil {
+		return nil, err
+	}
+
+	c.uploadChecksums = &UploadChecksums{algorithm: algorithm, checksums: map[string]string{}}
+	return c.uploadChecksums, nil
+}
+
+// New creates a client of the receiver at endpoint, which is an http or
+// https URL or "unix:<PATH>" for a Unix domain socket; each request is
+// canceled when the context passed to its method is done
+func New(endpoint, token string, options ...Option) (*Client, error) {
+	settings := settings{timeouts: DefaultTimeouts, userAgent: version.UserAgent()}
+	for _, option := range options {
+		option(&settings)
+	}
+	timeouts := settings.timeouts
+
+	dialer := &net.Dialer{Timeout: timeouts.Connect, KeepAlive: 30 * time.Second}
+	dialContext := dialer.DialContext
+	proxy := http.ProxyFromEnvironment
+
+	// Connect to a Unix domain socket with "unix:<PATH>", never through a proxy
+	if strings.HasPrefix(endpoint, "unix:") {
+		socketPath := strings.TrimPrefix(endpoint, "unix:")
+		dialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+		proxy = nil
+		endpoint = "http://unix/"
+	}
+
+	baseURL, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := newTLSConfig(settings.tls)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := parseHeaders(settings.request.Headers)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range settings.headers {
+		headers[name] = append(headers[name], values...)
+	}
+	username, password := settings.username, settings.password
+	if settings.request.BasicAuth != "" && username == "" {
+		username, password, err = parseBasicAuth(settings.request.BasicAuth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   timeouts.Connect,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+		DisableCompression:    false,
+	}
+	httpClient := &http.Client{Transport: transport}
+	if settings.http3 != "" && settings.http3 != HTTP3Never {
+		if settings.http3 == HTTP3Always && baseURL.Scheme != "https" {
+			return nil, fmt.Errorf("HTTP/3 requires an https endpoint")
+		}
+		http3Transport, err := newHTTP3Transport(settings.http3, transport, timeouts)
+		if err != nil {
+			return nil, err
+		}
+		httpClient.Transport = http3Transport
+	}
+
+	return &Client{baseURL: baseURL, userAgent: settings.userAgent, httpClient: httpClient, timeouts: timeouts, token: token, apiVersion: 2, username: username, password: password, headers: headers}, nil
+}
+
+// MaxObjectSize returns the size of the largest object accepted by the
+// server, 0 for no limit
+func (c *Client) MaxObjectSize() int64 {
+	return c.maxObjectSize
+}
+
+// APIVersion returns the version of the API used with the server, 1 for
+// servers released before API v2 that publish the branches of a queue
+// entry with the upload of its objects
+func (c *Client) APIVersion() int {
+	return c.apiVersion
+}
+
+// MaxRequestObjects returns the number of objects the server accepts in
+// an upload request, 0 for no limit
+func (c *Client) MaxRequestObjects() int {
+	return c.maxRequestObjects
+}
+
+// parseEndpoint returns the URL that API paths are relative to, the API
+// is mounted at the path of the endpoint, such as "/push/" for the
+// endpoint "https://example.com/push", with or without trailing slash
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	baseURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid endpoint \"%s\": %w", endpoint, err)
+	}
+	if (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+		return nil, fmt.Errorf("Invalid endpoint \"%s\": expected an http or https URL", endpoint)
+	}
+	// They would be dropped when resolving API paths
+	if baseURL.RawQuery != "" || baseURL.Fragment != "" {
+		return nil, fmt.Errorf("Invalid endpoint \"%s\": query and fragment are not supported", endpoint)
+	}
+
+	// Without trailing slash the last segment would be replaced
+	if !strings.HasSuffix(baseURL.Path, "/") {
+		baseURL.Path += "/"
+		if baseURL.RawPath != "" {
+			baseURL.RawPath += "/"
+		}
+	}
+
+	return baseURL, nil
+}
+
+// apiPath returns the path of an API call for the version supported by the server,
+// relative to the endpoint
+func (c *Client) apiPath(format string, a ...interface{}) string {
+	return fmt.Sprintf("api/v%d%s", c.apiVersion, fmt.Sprintf(format, a...))
+}
+
+// resolve returns the URL of a path relative to the endpoint
+func (c *Client) resolve(path string) (*url.URL, error) {
+	ref, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.baseURL.ResolveReference(ref), nil
+}
+
+// HasCapability returns whether the server advertised the capability,
+// servers that only support API v1 have none
+func (c *Client) HasCapability(capability string) bool {
+	return c.capabilities[capability]
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
+	u, err := c.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf io.ReadWriter
+	if body != nil {
+		buf = new(bytes.Buffer)
+		err := json.NewEncoder(buf).Encode(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, u.String(), buf)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	request.Header.Set("Accept", "application/json")
+	c.setHeaders(request)
+	return request, nil
+}
+
+// do sends a request that neither uploads objects nor publishes, and
+// decodes the JSON reply into v
+func (c *Client) do(request *http.Request, v interface{}) (*http.Response, error) {
+	return c.doWithin(c.timeouts.Request, request, v)
+}
+
+// doWithin sends a request that must be answered within timeout, or
+// without limit when it's 0, and decodes the JSON reply into v, unless v
+// is a *[]byte that takes the reply as it is
+func (c *Client) doWithin(timeout time.Duration, request *http.Request, v interface{}) (*http.Response, error) {
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(request.Context(), timeout)
+		defer cancel()
+		request = request.WithContext(ctx)
+	}
+	tracing.Inject(request.Context(), request.Header)
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		logger.Errorf("Cannot parse response: %v", err)
+		return response, err
+	}
+
+	bodyString := strings.TrimSuffix(string(body), "\n")
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		// API v2 errors are JSON objects, API v1 errors are plain text
+		var errorResponse common.ErrorResponse
+		if json.Unmarshal(body, &errorResponse) == nil && errorResponse.Message != "" {
+			return response, &APIError{StatusCode: response.StatusCode, Code: errorResponse.Code, Message: errorResponse.Message, Details: errorResponse.Details, Objects: errorResponse.Objects, RetryAfter: retryAfter(response)}
+		}
+		return response, &APIError{StatusCode: response.StatusCode, Message: bodyString, RetryAfter: retryAfter(response)}
+	}
+
+	if response.StatusCode == http.StatusNoContent {
+		return response, nil
+	}
+
+	if raw, ok := v.(*[]byte); ok {
+		*raw = body
+		return response, nil
+	}
+	if v != nil {
+		err = json.Unmarshal(body, v)
+		if err != nil {
+			logger.Errorf("Error decoding response: %v", err)
+			if e, ok := err.(*json.SyntaxError); ok {
+				logger.Errorf("Syntax error at byte offset %d", e.Offset)
+			}
+			logger.Infof("Response: %q", body)
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+// GetInfo retries remote repository information, and negotiates the API
+// version and capabilities falling back to API v1 for older servers
+func (c *Client) GetInfo(ctx context.Context) (*common.InfoResponse, error) {
+	request, err := c.newRequest(ctx, "GET", c.apiPath("/info"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var info common.InfoResponse
+	response, err := c.do(request, &info)
+	if err != nil && response != nil && response.StatusCode == http.StatusNotFound && c.apiVersion > 1 {
+		logger.Debugf("Server doesn't support API v%d, falling back to API v1", c.apiVersion)
+		c.apiVersion = 1
+		return c.GetInfo(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.capabilities = map[string]bool{}
+	for _, capability := range info.Capabilities {
+		c.capabilities[capability] = true
+	}
+	c.checksumAlgorithm = common.NegotiateChecksum(info.ChecksumAlgorithms)
+	c.maxObjectSize = info.MaxObjectSize
+	c.maxRequestObjects = info.MaxRequestObjects
+
+	return &info, err
+}
+
+// Whoami retrieves the description of the token
+func (c *Client) Whoami(ctx context.Context) (*common.WhoamiResponse, error) {
+	request, err := c.newRequest(ctx, "GET", c.apiPath("/whoami"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result common.WhoamiResponse
+	_, err = c.do(request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Status retrieves the entries of the update queue the token allows to see
+func (c *Client) Status(ctx context.Context) (*common.StatusResponse, error) {
+	request, err := c.newRequest(ctx, "GET", c.apiPath("/status"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result common.StatusResponse
+	_, err = c.do(request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Progress retrieves the progress of an entry of the update queue
+func (c *Client) Progress(ctx context.Context, queueID string) (*common.QueueStatusResponse, error) {
+	request, err := c.newRequest(ctx, "GET", c.apiPath("/queue/%s/progress", queueID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result common.QueueStatusResponse
+	_, err = c.do(request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Maximum size of an event of the event stream
+const maxEventSize = 1024 * 1024
+
+// Events follows the event stream of the server, only the events of the
+// queue entry queueID when it's not empty, and hands each event to handle
+// until it returns true or an error; lastEventID resumes a stream that was
+// interrupted.  It returns the identifier of the last event handled, and
+// whether handle stopped the stream, so that the caller can reconnect when
+// the server closed it or the connection was lost.
+func (c *Client) Events(ctx context.Context, queueID, lastEventID string, handle func(event *common.Event) (bool, error)) (string, bool, error) {
+	path := c.apiPath("/events")
+	if queueID != "" {
+		path += "?queue=" + url.QueryEscape(queueID)
+	}
+	request, err := c.newRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return lastEventID, false, err
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		request.Header.Set("Last-Event-ID", lastEventID)
+	}
+	tracing.Inject(request.Context(), request.Header)
+
+	// The stream lasts longer than any request
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return lastEventID, false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxEventSize))
+		var errorResponse common.ErrorResponse
+		if json.Unmarshal(body, &errorResponse) == nil && errorResponse.Message != "" {
+			return lastEventID, false, &APIError{StatusCode: response.StatusCode, Code: errorResponse.Code, Message: errorResponse.Message, Details: errorResponse.Details, RetryAfter: retryAfter(response)}
+		}
+		return lastEventID, false, &APIError{StatusCode: response.StatusCode, Message: strings.TrimSuffix(string(body), "\n"), RetryAfter: retryAfter(response)}
+	}
+
+	// Events are "field: value" lines ended by an empty line
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 4096), maxEventSize)
+	var id string
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(data) > 0 {
+				var event common.Event
+				if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &event); err != nil {
+					return lastEventID, false, fmt.Errorf("Invalid event: %w", err)
+				}
+				if id != "" {
+					lastEventID = id
+				}
+				if done, err := handle(&event); done || err != nil {
+					return lastEventID, true, err
+				}
+			}
+			id = ""
+			data = nil
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "":
+			// Comments keep the connection open
+		case "id":
+			id = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+
+	// The server closed the stream, or the connection was lost
+	if err := scanner.Err(); err != nil {
+		logger.Debugf("Event stream interrupted: %v", err)
+	}
+
+	return lastEventID, false, nil
+}
+
+// ClockSkew returns how far the clock of the server is ahead of the local
+// one, from the Date header of a reply; it's precise to about a second
+func (c *Client) ClockSkew(ctx context.Context) (time.Duration, error) {
+	request, err := c.newRequest(ctx, "GET", c.apiPath("/info"), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	response, err := c.do(request, nil)
+	if err != nil {
+		return 0, err
+	}
+	local := start.Add(time.Since(start) / 2)
+
+	date, err := http.ParseTime(response.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid Date header: %w", err)
+	}
+
+	return date.Sub(local).Round(time.Second), nil
+}
+
+// History retrieves the commits of a remote branch from the newest, at most
+// limit of them or as many as the server returns when limit is 0
+func (c *Client) History(ctx context.Context, branch string, limit int) (*common.HistoryResponse, error) {
+	path := c.apiPath("/history?ref=%s", url.QueryEscape(branch))
+	if limit > 0 {
+		path += fmt.Sprintf("&limit=%d", limit)
+	}
+	request, err := c.newRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result common.HistoryResponse
+	_, err = c.do(request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// ObjectsSince compares the objects of the commit the branch points to on
+// the server with those of the older commit since
+func (c *Client) ObjectsSince(ctx context.Context, branch, since string) (*common.ObjectsSinceResponse, error) {
+	request, err := c.newRequest(ctx, "GET", c.apiPath("/objects?ref=%s&since=%s", url.QueryEscape(branch), url.QueryEscape(since)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result common.ObjectsSinceResponse
+	_, err = c.do(request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Publishes retrieves the updates of a branch by the server, from the newest
+func (c *Client) Publishes(ctx context.Context, branch string, limit int) (*common.PublishHistoryResponse, error) {
+	path := c.apiPath("/publishes?ref=%s", url.QueryEscape(branch))
+	if limit > 0 {
+		path += fmt.Sprintf("&limit=%d", limit)
+	}
+	request, err := c.newRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result common.PublishHistoryResponse
+	_, err = c.do(request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// GetInventory retrieves a bloom filter of the objects in the remote repository
+func (c *Client) GetInventory(ctx context.Context) (*common.BloomFilter, error) {
+	request, err := c.newRequest(ctx, "GET", c.apiPath("/inventory"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var filter common.BloomFilter
+	_, err = c.do(request, &filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &filter, nil
+}
+
+// NewQueueEntry tells the server which branches need to be updated, with
+// the mode of the repository objects are pushed from and the protected
+// branches whose update is confirmed; unless the publish is deferred, the
+// server publishes the branches within the publish timeout
+func (c *Client) NewQueueEntry(ctx context.Context, req common.QueueRequest) (*common.QueueEntryResponse, error) {
+	// Servers that only support API v1 reject fields they don't know
+	if c.apiVersion < 2 {
+		req = common.QueueRequest{Refs: req.Refs, Objects: req.Objects}
+	}
+
+	request, err := c.newRequest(ctx, "POST", c.apiPath("/queue"), req)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := c.timeouts.Request
+	if !req.DeferPublish && c.apiVersion > 1 {
+		timeout = c.timeouts.Publish
+	}
+
+	var result common.UpdateResponse
+	_, err = c.doWithin(timeout, request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &common.QueueEntryResponse{QueueID: result.QueueID, Refs: req.Refs}, nil
+}
+
+// FindQueueEntry returns the queue entry updating the branch
+func (c *Client) FindQueueEntry(ctx context.Context, branch string) (*common.QueueEntryResponse, error) {
+	request, err := c.newRequest(ctx, "GET", c.apiPath("/queue?ref=%s", url.QueryEscape(branch)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result common.QueueEntryResponse
+	_, err = c.do(request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Promote points the remote branch to to the commit of the remote branch from,
+// confirm lists the protected branches whose update is confirmed
+func (c *Client) Promote(ctx context.Context, from, to string, confirm []string) (*common.PromoteResponse, error) {
+	req := common.PromoteRequest{From: from, To: to, Confirm: confirm}
+	request, err := c.newRequest(ctx, "POST", c.apiPath("/promote"), req)
+	if err != nil {
+		return nil, err
+	}
+
+	var result common.PromoteResponse
+	_, err = c.do(request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Rollback points the remote branch back to the revision it had before its
+// last publish, confirm lists the protected branches whose update is confirmed
+func (c *Client) Rollback(ctx context.Context, branch string, confirm []string) (*common.RollbackResponse, error) {
+	req := common.RollbackRequest{Branch: branch, Confirm: confirm}
+	request, err := c.newRequest(ctx, "POST", c.apiPath("/rollback"), req)
+	if err != nil {
+		return nil, err
+	}
+
+	var result common.RollbackResponse
+	_, err = c.do(request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// CheckIntegrity starts a check of the integrity of the remote repository,
+// follow it with Integrity
+func (c *Client) CheckIntegrity(ctx context.Context) (*common.IntegrityResponse, error) {
+	request, err := c.newRequest(ctx, "POST", c.apiPath("/integrity"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result common.IntegrityResponse
+	_, err = c.do(request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Integrity retrieves the result of the last integrity check of the remote
+// repository, or whether one is running
+func (c *Client) Integrity(ctx context.Context) (*common.IntegrityResponse, error) {
+	request, err := c.newRequest(ctx, "GET", c.apiPath("/integrity"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result common.IntegrityResponse
+	_, err = c.do(request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// DeleteQueueEntry removes the entry from the queue
+func (c *Client) DeleteQueueEntry(ctx context.Context, queueID string) error {
+	request, err := c.newRequest(ctx, "DELETE", c.apiPath("/queue/%s", queueID), nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(request, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SendObjectsList sends the list of missing objects to the server which will reply
+// with the list of objects that were not already submitted by a previous upload
+func (c *Client) SendObjectsList(ctx context.Context, queueID string) ([]string, error) {
+	request, err := c.newRequest(ctx, "GET", c.apiPath("/queue/%s", queueID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result common.ObjectsResponse
+	_, err = c.do(request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Objects, nil
+}
+
+// SendObjectsBatch sends a batch of objects needed by the queue entry to the server
+// which will reply with those that were not already submitted by a previous upload
+func (c *Client) SendObjectsBatch(ctx context.Context, queueID string, objects []string) ([]string, error) {
+	req := common.ObjectsRequest{Objects: objects}
+	request, err := c.newRequest(ctx, "POST", c.apiPath("/queue/%s/objects", queueID), req)
+	if err != nil {
+		return nil, err
+	}
+
+	var result common.ObjectsResponse
+	_, err = c.do(request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Objects, nil
+}
+
+// GetMissingObjects asks the server to traverse the commits of the queue entry
+// and returns the objects it still needs
+func (c *Client) GetMissingObjects(ctx context.Context, queueID string) ([]string, error) {
+	request, err := c.newRequest(ctx, "GET", c.apiPath("/queue/%s/missing", queueID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result common.ObjectsResponse
+	_, err = c.do(request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Objects, nil
+}
+
+// Done tells the server to publish the branches of the queue entry, and
+// waits for it within the publish timeout
+func (c *Client) Done(ctx context.Context, queueID string) error {
+	path := c.apiPath("/queue/%s/commit", queueID)
+	if c.apiVersion < 2 {
+		path = c.apiPath("/queue/%s/done", queueID)
+	}
+
+	request, err := c.newRequest(ctx, "POST", path, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.doWithin(c.timeouts.Publish, request, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UploadSBOM uploads the SBOM of a commit pushed with the queue entry,
+// an SPDX or CycloneDX document that the server publishes with the commit
+func (c *Client) UploadSBOM(ctx context.Context, queueID, rev string, r io.Reader) error {
+	u, err := c.resolve(c.apiPath("/queue/%s/sbom/%s", queueID, rev))
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "PUT", u.String(), r)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Accept", "application/json")
+	c.setHeaders(request)
+
+	_, err = c.doWithin(c.timeouts.Upload, request, nil)
+	return err
+}
+
+// GetSBOM retrieves the SBOM of a published commit and its media type
+func (c *Client) GetSBOM(ctx context.Context, rev string) ([]byte, string, error) {
+	u, err := c.resolve(c.apiPath("/sbom/%s", rev))
+	if err != nil {
+		return nil, "", err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	c.setHeaders(request)
+
+	// The SBOM isn't necessarily JSON, it's taken as it is
+	var sbom []byte
+	response, err := c.do(request, &sbom)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return sbom, response.Header.Get("Content-Type"), nil
+}
+
+// SendManifest signs the manifest of the queue entry with key and sends
+// it, the server then only publishes the objects it lists
+func (c *Client) SendManifest(ctx context.Context, queueID string, manifest common.QueueManifest, key ed25519.PrivateKey) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	u, err := c.resolve(c.apiPath("/queue/%s/manifest", queueID))
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set(common.SignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(key, data)))
+	c.setHeaders(request)
+
+	_, err = c.doWithin(c.timeouts.Upload, request, nil)
+	return err
+}
+
+// GetSignature retrieves the block signatures of an object in the remote repository
+func (c *Client) GetSignature(ctx context.Context, objectName string, blockSize int) (*delta.Signature, error) {
+	request, err := c.newRequest(ctx, "GET", c.apiPath("/objects/%s/signature?block_size=%d", objectName, blockSize), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var signature delta.Signature
+	_, err = c.do(request, &signature)
+	if err != nil {
+		return nil, err
+	}
+
+	return &signature, nil
+}
+
+// UploadDelta uploads an object as a delta against the basis object
+// whose signature was retrieved with GetSignature
+func (c *Client) UploadDelta(ctx context.Context, queueID string, object common.Object, basisName string, signature *delta.Signature) error {
+	file, err := os.Open(object.ObjectPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(delta.WriteDelta(w, signature, file))
+	}()
+
+	path := c.apiPath("/queue/%s/delta/%s?basis=%s&block_size=%d", queueID, object.ObjectName, url.QueryEscape(basisName), signature.BlockSize)
+	u, err := c.resolve(path)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "PUT", u.String(), r)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Accept", "application/json")
+	c.setHeaders(request)
+
+	_, err = c.doWithin(c.timeouts.Upload, request, nil)
+	return err
+}
+
+// UploadOrder returns the objects with file objects first and metadata
+// objects last, commits at the very end, so that a commit never arrives
+// on the server before the objects it references
+func UploadOrder(objects common.Objects) []common.Object {
+	ordered := make([]common.Object, 0, len(objects))
+	for _, object := range objects {
+		ordered = append(ordered, object)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		ri, rj := uploadRank(ordered[i].ObjectName), uploadRank(ordered[j].ObjectName)
+		if ri != rj {
+			return ri < rj
+		}
+		return ordered[i].ObjectName < ordered[j].ObjectName
+	})
+
+	return ordered
+}
+
+// uploadRank returns the position of the type of an object in the uploads
+func uploadRank(objectName string) int {
+	switch path.Ext(objectName) {
+	case ".file", ".filez":
+		return 0
+	case ".dirmeta":
+		return 1
+	case ".dirtree":
+		return 2
+	case ".commit":
+		return 4
+	}
+	return 3
+}
+
+// Upload uploads objects within the upload timeout, and checks that the
+// server accepted all of them; otherwise it returns an *UploadError with
+// the objects to upload again, together with the reply
+func (c *Client) Upload(ctx context.Context, queueID string, objects common.Objects) (*common.UploadResponse, error) {
+	r, w := io.Pipe()
+	writer := multipart.NewWriter(w)
+
+	go func() {
+		for _, object := range UploadOrder(objects) {
+			// Upload each object independently
+			part, err := writer.CreateFormFile("file", object.ObjectName)
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+
+			file, err := os.Open(object.ObjectPath)
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+
+			// Hash the object as it's sent, so that the server detects
+			// a corrupted transfer without reading it again
+			writers := []io.Writer{part}
+			var h, recorded hash.Hash
+			if c.checksumAlgorithm != "" {
+				h, _ = common.NewChecksumHash(c.checksumAlgorithm)
+				writers = append(writers, h)
+			}
+			if c.uploadChecksums != nil {
+				if c.uploadChecksums.algorithm == c.checksumAlgorithm {
+					recorded = h
+				} else {
+					recorded, _ = common.NewChecksumHash(c.uploadChecksums.algorithm)
+					writers = append(writers, recorded)
+				}
+			}
+
+			if _, err = io.Copy(io.MultiWriter(writers...), file); err != nil {
+				file.Close()
+				w.CloseWithError(err)
+				return
+			}
+
+			file.Close()
+
+			if h != nil {
+				if err := writer.WriteField("checksum", common.FormatChecksum(c.checksumAlgorithm, h.Sum(nil))); err != nil {
+					w.CloseWithError(err)
+					return
+				}
+			}
+			if recorded != nil {
+				c.uploadChecksums.set(object.ObjectName, common.FormatChecksum(c.uploadChecksums.algorithm, recorded.Sum(nil)))
+			}
+		}
+
+		w.CloseWithError(writer.Close())
+	}()
+
+	path := c.apiPath("/queue/%s/objects", queueID)
+	if c.apiVersion < 2 {
+		path = c.apiPath("/queue/%s", queueID)
+	}
+
+	u, err := c.resolve(path)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "PUT", u.String(), r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	request.Header.Set("Accept", "application/json")
+	if c.checksumAlgorithm != "" {
+		request.Header.Set(common.ChecksumHeader, c.checksumAlgorithm)
+	}
+	c.setHeaders(request)
+
+	// Servers that only support API v1 publish the branches once the
+	// objects are uploaded and reply without content
+	if c.apiVersion < 2 {
+		timeout := c.timeouts.Upload + c.timeouts.Publish
+		if c.timeouts.Upload == 0 || c.timeouts.Publish == 0 {
+			timeout = 0
+		}
+		_, err = c.doWithin(timeout, request, nil)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		result := &common.UploadResponse{Objects: []string{}}
+		for objectName := range objects {
+			result.Objects = append(result.Objects, objectName)
+		}
+		return result, nil
+	}
+
+	var result common.UploadResponse
+	_, err = c.doWithin(c.timeouts.Upload, request, &result)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure every object was received, the objects the server didn't
+	// report on were lost too
+	received := make(map[string]bool, len(result.Objects))
+	for _, objectName := range result.Objects {
+		received[objectName] = true
+	}
+	failed := common.Objects{}
+	for objectName, object := range objects {
+		if !received[objectName] {
+			failed[objectName] = object
+		}
+	}
+	if len(failed) > 0 {
+		return &result, &UploadError{Failed: failed, Results: result.Results}
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,258 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lirios/ostree-upload/internal/common"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		expected string
+		valid    bool
+	}{
+		{"https://example.com", "https://example.com/", true},
+		{"https://example.com/", "https://example.com/", true},
+		{"http://example.com:8080", "http://example.com:8080/", true},
+		{"https://example.com/ostree", "https://example.com/ostree/", true},
+		{"https://example.com/ostree/", "https://example.com/ostree/", true},
+		{"https://example.com/a/b/upload", "https://example.com/a/b/upload/", true},
+		{"https://example.com/a%2Fb", "https://example.com/a%2Fb/", true},
+		{"", "", false},
+		{"example.com", "", false},
+		{"ftp://example.com", "", false},
+		{"https://", "", false},
+		{"https://example.com/?token=secret", "", false},
+		{"https://example.com/#api", "", false},
+		{"https://example.com/%zz", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.endpoint, func(t *testing.T) {
+			baseURL, err := parseEndpoint(test.endpoint)
+			if !test.valid {
+				if err == nil {
+					t.Errorf("parseEndpoint(%q) = %s, want an error", test.endpoint, baseURL)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseEndpoint(%q) = %v, want no error", test.endpoint, err)
+			}
+			if baseURL.String() != test.expected {
+				t.Errorf("parseEndpoint(%q) = %s, want %s", test.endpoint, baseURL, test.expected)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		path     string
+		expected string
+	}{
+		{"https://example.com", "/info", "https://example.com/api/v2/info"},
+		{"https://example.com/", "/info", "https://example.com/api/v2/info"},
+		{"https://example.com/ostree", "/info", "https://example.com/ostree/api/v2/info"},
+		{"https://example.com/ostree/", "/info", "https://example.com/ostree/api/v2/info"},
+		{"https://example.com/a/b", "/queue/ID/missing", "https://example.com/a/b/api/v2/queue/ID/missing"},
+		{"https://example.com/a%2Fb", "/info", "https://example.com/a%2Fb/api/v2/info"},
+		{"unix:/run/ostree-upload.sock", "/info", "http://unix/api/v2/info"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.endpoint, func(t *testing.T) {
+			c, err := New(test.endpoint, "token")
+			if err != nil {
+				t.Fatalf("New(%q) = %v, want no error", test.endpoint, err)
+			}
+
+			u, err := c.resolve(c.apiPath(test.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.String() != test.expected {
+				t.Errorf("resolving %s from %s = %s, want %s", test.path, test.endpoint, u, test.expected)
+			}
+		})
+	}
+}
+
+func TestNewInvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"", "example.com/ostree", "https://example.com/?a=b"} {
+		if _, err := New(endpoint, "token"); err == nil {
+			t.Errorf("New(%q) = nil, want an error", endpoint)
+		}
+	}
+}
+
+func TestRequestsUnderSubPath(t *testing.T) {
+	var requested string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"name":"test"}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		endpoint string
+		expected string
+	}{
+		{"root", server.URL, "/api/v2/whoami"},
+		{"root with trailing slash", server.URL + "/", "/api/v2/whoami"},
+		{"sub-path", server.URL + "/ostree", "/ostree/api/v2/whoami"},
+		{"sub-path with trailing slash", server.URL + "/ostree/", "/ostree/api/v2/whoami"},
+		{"nested sub-path", server.URL + "/a/b", "/a/b/api/v2/whoami"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(test.endpoint, "token")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			requested = ""
+			if _, err := c.Whoami(context.Background()); err != nil {
+				t.Fatalf("Whoami() = %v, want no error", err)
+			}
+			if requested != test.expected {
+				t.Errorf("Whoami() with endpoint %s requested %s, want %s", test.endpoint, requested, test.expected)
+			}
+		})
+	}
+}
+
+// legacyServer serves API v1 as servers released before API v2, that
+// reject unknown fields and reply to uploads without content
+func legacyServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/info", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"mode":"archive","revs":{}}`))
+	})
+	mux.HandleFunc("/api/v1/queue", func(w http.ResponseWriter, r *http.Request) {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		var req struct {
+			Refs    map[string]common.RevisionPair `json:"refs"`
+			Objects []string                       `json:"objects"`
+		}
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"legacy"}`))
+	})
+	mux.HandleFunc("/api/v1/queue/legacy", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLegacyServer(t *testing.T) {
+	server := legacyServer(t)
+	c, err := New(server.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := c.GetInfo(ctx); err != nil {
+		t.Fatalf("GetInfo() = %v, want no error", err)
+	}
+	if c.APIVersion() != 1 {
+		t.Fatalf("API version is %d, want 1", c.APIVersion())
+	}
+	for _, capability := range []string{common.CapabilityInventory, common.CapabilityServerTraverse, common.CapabilityDeltas, common.CapabilityResume} {
+		if c.HasCapability(capability) {
+			t.Errorf("server released before API v2 has capability %s", capability)
+		}
+	}
+
+	// Fields of API v2 are not sent
+	entry, err := c.NewQueueEntry(ctx, common.QueueRequest{
+		Refs:         map[string]common.RevisionPair{"main": {Client: "rev"}},
+		Objects:      []string{"object"},
+		DeferPublish: true,
+		Mode:         "archive",
+		Metadata:     map[string]string{"key": "value"},
+	})
+	if err != nil {
+		t.Fatalf("NewQueueEntry() = %v, want no error", err)
+	}
+
+	// The upload is published without a reply
+	file := filepath.Join(t.TempDir(), "object")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := c.Upload(ctx, entry.QueueID, common.Objects{"object": {ObjectName: "object", ObjectPath: file}})
+	if err != nil {
+		t.Fatalf("Upload() = %v, want no error", err)
+	}
+	if !reflect.DeepEqual(result.Objects, []string{"object"}) {
+		t.Errorf("Upload() received %q, want %q", result.Objects, []string{"object"})
+	}
+}
+
+func TestRecordChecksums(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"objects":["object"]}`))
+	}))
+	defer server.Close()
+
+	c, err := New(server.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksums, err := c.RecordChecksums(common.ChecksumSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "object")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Upload(context.Background(), "ID", common.Objects{"object": {ObjectName: "object", ObjectPath: file}}); err != nil {
+		t.Fatalf("Upload() = %v, want no error", err)
+	}
+
+	expected, err := common.ChecksumFile(common.ChecksumSHA256, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum, ok := checksums.Get("object"); checksum != expected {
+		t.Errorf("recorded checksum is %q (%v), want %q", checksum, ok, expected)
+	}
+	if _, ok := checksums.Get("other"); ok {
+		t.Error("found a checksum of an object that was not uploaded")
+	}
+}
@@ -0,0 +1,182 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+)
+
+var (
+	// ErrBranchBusy is returned when another push is updating the same branches
+	ErrBranchBusy = errors.New("branch is already being updated")
+
+	// ErrUnauthorized is returned when the server rejects the token
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrForbidden is returned when the token doesn't allow the operation
+	ErrForbidden = errors.New("forbidden")
+
+	// ErrServerBusy is returned when the server serves too many requests
+	ErrServerBusy = errors.New("server busy")
+
+	// ErrChecksumMismatch is returned when the server received an object
+	// whose content doesn't match its name
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrBranchProtected is returned when the protection of a branch
+	// refused its update
+	ErrBranchProtected = errors.New("branch is protected")
+
+	// ErrIncompleteCommit is returned when publishing a commit whose
+	// objects were not all uploaded
+	ErrIncompleteCommit = errors.New("commit is incomplete")
+
+	// ErrPushTooLarge is returned when the commits to push have more
+	// objects or bytes than the server accepts
+	ErrPushTooLarge = errors.New("push is too large")
+
+	// ErrManifestRejected is returned when the server doesn't trust the
+	// signed manifest of a push or the push doesn't match it
+	ErrManifestRejected = errors.New("manifest rejected")
+
+	// ErrEncryptionRequired is returned when the server only accepts
+	// pushes whose objects are encrypted
+	ErrEncryptionRequired = errors.New("encryption required")
+)
+
+// APIError is an error reported by the server, use errors.Is to compare
+// it with ErrBranchBusy, ErrUnauthorized, ErrForbidden, ErrServerBusy, ErrChecksumMismatch,
+// ErrBranchProtected, ErrIncompleteCommit, ErrPushTooLarge, ErrManifestRejected
+// and ErrEncryptionRequired
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Details    map[string]string
+	// Objects the error is about
+	Objects []string
+	// How long the server asked to wait before trying again
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the error matching the code reported by the server
+func (e *APIError) Unwrap() error {
+	switch e.Code {
+	case common.ErrorCodeBranchBusy:
+		return ErrBranchBusy
+	case common.ErrorCodeUnauthorized:
+		return ErrUnauthorized
+	case common.ErrorCodeForbidden:
+		return ErrForbidden
+	case common.ErrorCodeServerBusy:
+		return ErrServerBusy
+	case common.ErrorCodeChecksumMismatch:
+		return ErrChecksumMismatch
+	case common.ErrorCodeBranchProtected:
+		return ErrBranchProtected
+	case common.ErrorCodeIncompleteCommit:
+		return ErrIncompleteCommit
+	case common.ErrorCodePushTooLarge:
+		return ErrPushTooLarge
+	case common.ErrorCodeManifestRejected:
+		return ErrManifestRejected
+	case common.ErrorCodeEncryptionRequired:
+		return ErrEncryptionRequired
+	}
+
+	// API v1 servers only report the status
+	if e.Code == "" && e.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	if e.Code == "" && e.StatusCode == http.StatusServiceUnavailable {
+		return ErrServerBusy
+	}
+
+	return nil
+}
+
+// UploadError is returned by Upload when the server didn't accept all the
+// objects, the others are stored and only the failed ones need to be
+// uploaded again
+type UploadError struct {
+	// Objects that were not accepted
+	Failed common.Objects
+	// What the server did with each object, empty for servers that only
+	// acknowledge the objects they accepted
+	Results []common.UploadResult
+}
+
+func (e *UploadError) Error() string {
+	reasons := make(map[string]string, len(e.Results))
+	for _, result := range e.Results {
+		reasons[result.Object] = result.Status
+	}
+
+	names := make([]string, 0, len(e.Failed))
+	for objectName := range e.Failed {
+		if reason, ok := reasons[objectName]; ok {
+			names = append(names, fmt.Sprintf("%s (%s)", objectName, reason))
+		} else {
+			names = append(names, objectName)
+		}
+	}
+	sort.Strings(names)
+
+	return fmt.Sprintf("server did not accept %d objects: %s", len(names), strings.Join(names, ", "))
+}
+
+// Is reports a checksum mismatch when the server received a corrupted object
+func (e *UploadError) Is(target error) bool {
+	if target != ErrChecksumMismatch {
+		return false
+	}
+	for _, result := range e.Results {
+		if result.Status == common.UploadStatusChecksumMismatch {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfter returns the delay in the Retry-After header, in seconds
+func retryAfter(response *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(response.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Attempts is the number of times a request that failed because of the
+// network or a busy server is made before giving up
+const Attempts = 3
+
+// Delay before making a request again, multiplied by the attempt number
+const retryBaseDelay = 5 * time.Second
+
+// RetryDelay returns how long to wait before the attempt, or longer if
+// the server asked so with err
+func RetryDelay(err error, attempt int) time.Duration {
+	delay := time.Duration(attempt) * retryBaseDelay
+
+	var apiError *APIError
+	if errors.As(err, &apiError) && apiError.RetryAfter > delay {
+		delay = apiError.RetryAfter
+	}
+
+	return delay
+}
@@ -0,0 +1,276 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/lirios/ostree-upload/internal/logger"
+)
+
+// When requests are sent over HTTP/3, on QUIC
+const (
+	// Never, the default
+	HTTP3Never = "never"
+	// Once the server advertised HTTP/3 with Alt-Svc, falling back to TCP
+	// when QUIC can't connect
+	HTTP3Auto = "auto"
+	// Always, even if the server didn't advertise it
+	HTTP3Always = "always"
+)
+
+// How long an alternative service is used when Alt-Svc has no max age
+const defaultAltSvcMaxAge = 24 * time.Hour
+
+// Interval of the packets keeping the QUIC connections alive while the
+// server publishes
+const quicKeepAlive = 15 * time.Second
+
+// alternative is the HTTP/3 endpoint of an origin
+type alternative struct {
+	address string
+	expires time.Time
+	// QUIC couldn't connect to the endpoint
+	broken bool
+}
+
+// http3Transport sends requests over HTTP/3 when the mode wants it and
+// over HTTP/1.1 or HTTP/2 otherwise
+type http3Transport struct {
+	mode       string
+	tcp        *http.Transport
+	quic       *http3.Transport
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	mutex      sync.Mutex
+	// HTTP/3 endpoints advertised by the servers, by address of the origin
+	alternatives map[string]*alternative
+	// Connections to the HTTP/3 endpoints, by address of the origin
+	conns     map[string]*http3.ClientConn
+	dialMutex sync.Mutex
+}
+
+// newHTTP3Transport returns a transport sending requests over HTTP/3
+// according to mode, or over tcp
+func newHTTP3Transport(mode string, tcp *http.Transport, timeouts Timeouts) (*http3Transport, error) {
+	switch mode {
+	case HTTP3Auto, HTTP3Always:
+	default:
+		return nil, fmt.Errorf("Invalid HTTP/3 mode \"%s\": expected %s, %s or %s", mode, HTTP3Never, HTTP3Auto, HTTP3Always)
+	}
+
+	tlsConfig := &tls.Config{}
+	if tcp.TLSClientConfig != nil {
+		tlsConfig = tcp.TLSClientConfig.Clone()
+	}
+	tlsConfig.NextProtos = []string{http3.NextProtoH3}
+	// Connections to the same server are resumed without a full handshake
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+
+	return &http3Transport{
+		mode:      mode,
+		tcp:       tcp,
+		quic:      &http3.Transport{},
+		tlsConfig: tlsConfig,
+		quicConfig: &quic.Config{
+			HandshakeIdleTimeout: timeouts.Connect,
+			KeepAlivePeriod:      quicKeepAlive,
+		},
+		alternatives: map[string]*alternative{},
+		conns:        map[string]*http3.ClientConn{},
+	}, nil
+}
+
+// originAddress returns the host and port of the origin of u
+func originAddress(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// connect returns a connection to the HTTP/3 endpoint at address of the
+// origin, reusing the one that is still open; the handshake is complete
+// so that a request is never lost when QUIC can't connect
+func (t *http3Transport) connect(ctx context.Context, origin, address string) (*http3.ClientConn, error) {
+	t.dialMutex.Lock()
+	defer t.dialMutex.Unlock()
+
+	t.mutex.Lock()
+	conn, ok := t.conns[origin]
+	t.mutex.Unlock()
+	if ok && conn.Context().Err() == nil {
+		return conn, nil
+	}
+
+	tlsConfig := t.tlsConfig.Clone()
+	tlsConfig.ServerName, _, _ = net.SplitHostPort(origin)
+	quicConn, err := quic.DialAddr(ctx, address, tlsConfig, t.quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	conn = t.quic.NewClientConn(quicConn)
+
+	t.mutex.Lock()
+	t.conns[origin] = conn
+	t.mutex.Unlock()
+	return conn, nil
+}
+
+// RoundTrip sends the request over HTTP/3 when the server supports it
+func (t *http3Transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	origin := originAddress(request.URL)
+	address := origin
+	if t.mode == HTTP3Auto {
+		var ok bool
+		if address, ok = t.alternativeAddress(request, origin); !ok {
+			return t.roundTripTCP(request, origin)
+		}
+	}
+
+	conn, err := t.connect(request.Context(), origin, address)
+	if err != nil {
+		if t.mode == HTTP3Always {
+			if request.Body != nil {
+				request.Body.Close()
+			}
+			return nil, fmt.Errorf("Cannot connect with HTTP/3: %w", err)
+		}
+
+		// Nothing was sent, UDP is probably blocked on the way
+		logger.Warnf("Cannot connect with HTTP/3, falling back to TCP: %v", err)
+		t.mutex.Lock()
+		if a, ok := t.alternatives[origin]; ok {
+			a.broken = true
+		}
+		t.mutex.Unlock()
+		return t.roundTripTCP(request, origin)
+	}
+
+	return conn.RoundTrip(request)
+}
+
+// roundTripTCP sends the request over HTTP/1.1 or HTTP/2, and records the
+// HTTP/3 endpoint the server advertises
+func (t *http3Transport) roundTripTCP(request *http.Request, origin string) (*http.Response, error) {
+	response, err := t.tcp.RoundTrip(request)
+	if err == nil && request.URL.Scheme == "https" {
+		t.learn(origin, response.Header.Values("Alt-Svc"))
+	}
+	return response, err
+}
+
+// alternativeAddress returns the address of the HTTP/3 endpoint the
+// origin advertised, if the request can be sent to it
+func (t *http3Transport) alternativeAddress(request *http.Request, origin string) (string, bool) {
+	if request.URL.Scheme != "https" {
+		return "", false
+	}
+	// QUIC can't go through an HTTP proxy
+	if t.tcp.Proxy != nil {
+		if proxy, err := t.tcp.Proxy(request); err != nil || proxy != nil {
+			return "", false
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	a, ok := t.alternatives[origin]
+	if !ok || a.broken {
+		return "", false
+	}
+	if time.Now().After(a.expires) {
+		delete(t.alternatives, origin)
+		return "", false
+	}
+	return a.address, true
+}
+
+// learn records the HTTP/3 endpoint advertised by the Alt-Svc headers of
+// a response of the origin
+func (t *http3Transport) learn(origin string, headers []string) {
+	if len(headers) == 0 {
+		return
+	}
+	address, maxAge, cleared := parseAltSvc(origin, headers)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if cleared {
+		delete(t.alternatives, origin)
+		return
+	}
+	if address == "" {
+		return
+	}
+	if a, ok := t.alternatives[origin]; ok && a.address == address {
+		// An endpoint that didn't work stays ignored
+		a.expires = time.Now().Add(maxAge)
+		return
+	}
+	logger.Debugf("Server advertises HTTP/3 at %s", address)
+	t.alternatives[origin] = &alternative{address: address, expires: time.Now().Add(maxAge)}
+}
+
+// parseAltSvc returns the address of the first HTTP/3 endpoint in the
+// Alt-Svc headers of origin and for how long it can be used, or whether
+// the alternatives of the origin are cleared (RFC 7838)
+func parseAltSvc(origin string, headers []string) (string, time.Duration, bool) {
+	originHost, _, _ := net.SplitHostPort(origin)
+
+	for _, header := range headers {
+		for _, value := range strings.Split(header, ",") {
+			params := strings.Split(strings.TrimSpace(value), ";")
+			if params[0] == "clear" {
+				return "", 0, true
+			}
+
+			parts := strings.SplitN(params[0], "=", 2)
+			if len(parts) != 2 || parts[0] != http3.NextProtoH3 {
+				continue
+			}
+			authority, err := strconv.Unquote(parts[1])
+			if err != nil {
+				continue
+			}
+			host, port, err := net.SplitHostPort(authority)
+			if err != nil {
+				continue
+			}
+			if host == "" {
+				host = originHost
+			}
+
+			maxAge := defaultAltSvcMaxAge
+			for _, param := range params[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) != 2 || kv[0] != "ma" {
+					continue
+				}
+				if seconds, err := strconv.ParseInt(kv[1], 10, 64); err == nil {
+					maxAge = time.Duration(seconds) * time.Second
+				}
+			}
+			return net.JoinHostPort(host, port), maxAge, false
+		}
+	}
+
+	return "", 0, false
+}
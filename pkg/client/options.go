@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package client
+
+import (
+	"net/http"
+)
+
+// settings are what the options of New change
+type settings struct {
+	timeouts  Timeouts
+	tls       TLSOptions
+	request   RequestOptions
+	headers   http.Header
+	username  string
+	password  string
+	userAgent string
+	http3     string
+}
+
+// Option changes how New creates a client
+type Option func(*settings)
+
+// WithTimeouts sets how long the client waits for the server instead of
+// DefaultTimeouts
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(s *settings) {
+		s.timeouts = timeouts
+	}
+}
+
+// WithTLS sets how the certificate of the server is verified and the
+// certificate of the client
+func WithTLS(options TLSOptions) Option {
+	return func(s *settings) {
+		s.tls = options
+	}
+}
+
+// WithRequestOptions adds the headers and credentials written as on the
+// command line to every request
+func WithRequestOptions(options RequestOptions) Option {
+	return func(s *settings) {
+		s.request = options
+	}
+}
+
+// WithHeader adds a header to every request
+func WithHeader(name, value string) Option {
+	return func(s *settings) {
+		if s.headers == nil {
+			s.headers = http.Header{}
+		}
+		s.headers.Add(name, value)
+	}
+}
+
+// WithBasicAuth sends credentials with HTTP basic authentication, for
+// servers behind a reverse proxy that requires them; the token is then
+// sent with its own header
+func WithBasicAuth(username, password string) Option {
+	return func(s *settings) {
+		s.username = username
+		s.password = password
+	}
+}
+
+// WithUserAgent identifies the tool embedding the client to the server
+// instead of ostree-upload
+func WithUserAgent(userAgent string) Option {
+	return func(s *settings) {
+		s.userAgent = userAgent
+	}
+}
+
+// WithHTTP3 sets when requests are sent over HTTP/3 instead of HTTP/1.1 or
+// HTTP/2, HTTP3Never, HTTP3Auto or HTTP3Always
+func WithHTTP3(mode string) Option {
+	return func(s *settings) {
+		s.http3 = mode
+	}
+}
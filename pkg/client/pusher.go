@@ -0,0 +1,767 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Pusher allows you to push missing objects to an OSTree repository
+type Pusher struct {
+	repo     ostree.Repository
+	branches map[string]string
+	workers  int
+
+	// Mode of the local and remote repositories, objects are named as
+	// in the remote repository and file objects are compressed when
+	// pushing from a bare repository to an archive one
+	localMode  string
+	remoteMode string
+	compress   bool
+	tempDir    string
+
+	// Recipients objects are encrypted to before the upload, if any
+	recipients []age.Recipient
+
+	// Objects the server is known to have, skipped when enumerating
+	serverObjects map[string]bool
+}
+
+// Maximum number of commits walked to find a commit of the server whose
+// objects are all in the local repository
+const maxAncestorSearch = 50
+
+// BranchFilter selects the local branches that are pushed when none is
+// given, patterns and metadata values are written as for path.Match
+type BranchFilter struct {
+	// Branches that are not pushed
+	ExcludeRefs []string
+	// Branches whose head commit has one of these metadata are not pushed
+	ExcludeMetadata map[string]string
+	// Only branches whose head commit has all of these metadata are pushed
+	MatchMetadata map[string]string
+}
+
+// empty returns whether the filter selects all the branches
+func (f BranchFilter) empty() bool {
+	return len(f.ExcludeRefs) == 0 && len(f.ExcludeMetadata) == 0 && len(f.MatchMetadata) == 0
+}
+
+// metadataMatches returns whether the value of key in metadata matches
+// pattern, keys that are missing never match
+func metadataMatches(metadata map[string]string, key, pattern string) bool {
+	value, ok := metadata[key]
+	if !ok {
+		return false
+	}
+	matched, _ := path.Match(pattern, value)
+	return matched
+}
+
+// selects returns whether the branch pointing to rev is pushed
+func (f BranchFilter) selects(repo ostree.Repository, branch, rev string) (bool, error) {
+	for _, pattern := range f.ExcludeRefs {
+		if matched, _ := path.Match(pattern, branch); matched {
+			logger.Infof("Skipping branch %s, excluded by %s", branch, pattern)
+			return false, nil
+		}
+	}
+	if len(f.ExcludeMetadata) == 0 && len(f.MatchMetadata) == 0 {
+		return true, nil
+	}
+
+	info, err := repo.GetCommitInfo(rev)
+	if err != nil {
+		return false, err
+	}
+	for key, pattern := range f.ExcludeMetadata {
+		if metadataMatches(info.Metadata, key, pattern) {
+			logger.Infof("Skipping branch %s, its commit has %s=%s", branch, key, info.Metadata[key])
+			return false, nil
+		}
+	}
+	for key, pattern := range f.MatchMetadata {
+		if !metadataMatches(info.Metadata, key, pattern) {
+			logger.Infof("Skipping branch %s, its commit doesn't match %s=%s", branch, key, pattern)
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// NewPusher creates a new Pusher object, that uses the specified number
+// of workers to enumerate objects or as many as CPUs if workers is 0;
+// all the branches selected by filter are pushed when refs is empty
+func NewPusher(repoPath string, refs []string, filter BranchFilter, workers int) (*Pusher, error) {
+	// Check if the repository path exist
+	repo, err := ostree.Open(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Enumerate branches to push
+	branches := map[string]string{}
+	if len(refs) == 0 {
+		revisions, err := repo.Refs()
+		if err != nil {
+			return nil, err
+		}
+
+		for branch, rev := range revisions {
+			selected, err := filter.selects(repo, branch, rev)
+			if err != nil {
+				return nil, err
+			}
+			if selected {
+				branches[branch] = rev
+			}
+		}
+	} else if !filter.empty() {
+		return nil, errors.New("branches cannot be filtered when they are given")
+	} else {
+		for _, ref := range refs {
+			rev, err := repo.ResolveRev(ref)
+			if err != nil {
+				return nil, err
+			}
+
+			branches[ref] = rev
+		}
+	}
+
+	return newPusher(repo, branches, workers)
+}
+
+// NewCommitPusher creates a new Pusher object that updates the remote
+// branch ref to the commit rev, whatever the local branches point to
+func NewCommitPusher(repoPath, rev, ref string, workers int) (*Pusher, error) {
+	repo, err := ostree.Open(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure we have the commit
+	resolvedRev, err := repo.ResolveRev(rev)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := repo.GetCommitInfo(resolvedRev); err != nil {
+		return nil, err
+	}
+
+	return newPusher(repo, map[string]string{ref: resolvedRev}, workers)
+}
+
+func newPusher(repo ostree.Repository, branches map[string]string, workers int) (*Pusher, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	mode, err := repo.GetMode()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pusher{repo: repo, branches: branches, workers: workers, localMode: mode, remoteMode: mode}, nil
+}
+
+// LocalMode returns the mode of the local repository
+func (p *Pusher) LocalMode() string {
+	return p.localMode
+}
+
+// RemoteMode returns the mode of the remote repository, objects are named
+// as in it
+func (p *Pusher) RemoteMode() string {
+	return p.remoteMode
+}
+
+// SetRemoteMode checks that objects can be pushed to a repository in that
+// mode and names them accordingly from now on
+func (p *Pusher) SetRemoteMode(mode string) error {
+	if err := ostree.CheckModeCompatibility(p.localMode, mode); err != nil {
+		return err
+	}
+
+	p.remoteMode = mode
+	p.compress = p.localMode != "archive" && mode == "archive"
+	return nil
+}
+
+// NeedsCompression returns whether file objects are compressed before the upload
+func (p *Pusher) NeedsCompression() bool {
+	return p.compress
+}
+
+// localObjectPath returns the path of the local object corresponding to
+// the remote object name
+func (p *Pusher) localObjectPath(objectName string) string {
+	return p.repo.GetObjectPath(ostree.ObjectNameForMode(objectName, p.localMode))
+}
+
+// PrepareObjects compresses the file objects that are going to be uploaded
+// to an archive repository from a bare one, the other objects are sent as they are
+func (p *Pusher) PrepareObjects(objects common.Objects) error {
+	if !p.compress {
+		return nil
+	}
+
+	if err := p.ensureTempDir(); err != nil {
+		return err
+	}
+
+	for objectName, object := range objects {
+		if !strings.HasSuffix(objectName, ".filez") {
+			continue
+		}
+
+		path := filepath.Join(p.tempDir, objectName)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := p.repo.ExportArchiveObject(objectName, path); err != nil {
+				return fmt.Errorf("failed to compress \"%s\": %v", objectName, err)
+			}
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		object.ObjectPath = path
+		object.Size = fi.Size()
+		objects[objectName] = object
+	}
+
+	return nil
+}
+
+// SetRecipients makes objects be encrypted to the age recipients before
+// the upload, so that only the server can read them
+func (p *Pusher) SetRecipients(recipients []string) error {
+	p.recipients = nil
+	for _, value := range recipients {
+		recipient, err := age.ParseX25519Recipient(value)
+		if err != nil {
+			return err
+		}
+		p.recipients = append(p.recipients, recipient)
+	}
+
+	return nil
+}
+
+// EncryptObjects encrypts the objects that are going to be uploaded when
+// there are recipients, after they were prepared
+func (p *Pusher) EncryptObjects(objects common.Objects) error {
+	if len(p.recipients) == 0 {
+		return nil
+	}
+
+	if err := p.ensureTempDir(); err != nil {
+		return err
+	}
+
+	for objectName, object := range objects {
+		path := filepath.Join(p.tempDir, "encrypted", objectName)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := p.encryptFile(object.ObjectPath, path); err != nil {
+				return fmt.Errorf("failed to encrypt \"%s\": %v", objectName, err)
+			}
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		object.ObjectPath = path
+		object.Size = fi.Size()
+		objects[objectName] = object
+	}
+
+	return nil
+}
+
+// encryptFile writes the content of src encrypted to dst, which is only
+// created once complete
+func (p *Pusher) encryptFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	writer, err := age.Encrypt(out, p.recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, in); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), dst)
+}
+
+// ensureTempDir creates the directory of the converted objects
+func (p *Pusher) ensureTempDir() error {
+	if p.tempDir != "" {
+		return nil
+	}
+
+	tempDir, err := ioutil.TempDir("", "ostree-upload-")
+	if err != nil {
+		return err
+	}
+	p.tempDir = tempDir
+	return nil
+}
+
+// Cleanup removes the compressed and encrypted objects
+func (p *Pusher) Cleanup() {
+	if p.tempDir != "" {
+		os.RemoveAll(p.tempDir)
+		p.tempDir = ""
+	}
+}
+
+// FindNeededCommits finds the commits of the local repository that the remove one doesn't have
+func (p *Pusher) FindNeededCommits(remoteRev, localRev string) ([]string, error) {
+	commits := []string{}
+
+	parent := localRev
+
+	for parent != remoteRev {
+		logger.Debugf("Parent commit %s", parent)
+		commits = append(commits, parent)
+
+		newParent, err := p.repo.GetParentRev(parent)
+		if err != nil {
+			return nil, err
+		}
+
+		if newParent == "" {
+			break
+		} else {
+			parent = newParent
+		}
+	}
+
+	if remoteRev != "" && parent != remoteRev {
+		return nil, fmt.Errorf("remote commit %v not descendent of commit %v", remoteRev, localRev)
+	}
+
+	return commits, nil
+}
+
+// CommitSummary describes a commit that is going to be pushed
+type CommitSummary struct {
+	ostree.CommitInfo
+	// Difference in bytes between the size of the objects of the commit and
+	// those of its parent, only valid when HasSizeDelta is true
+	SizeDelta    int64
+	HasSizeDelta bool
+}
+
+// DescribeCommits returns, for each branch, the commits that the remote
+// repository doesn't have from the newest to the oldest
+func (p *Pusher) DescribeCommits(updateRefs map[string]common.RevisionPair) (map[string][]CommitSummary, error) {
+	sizes := map[string]int64{}
+	summaries := map[string][]CommitSummary{}
+
+	for branch, revs := range updateRefs {
+		commits, err := p.FindNeededCommits(revs.Server, revs.Client)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rev := range commits {
+			info, err := p.repo.GetCommitInfo(rev)
+			if err != nil {
+				return nil, err
+			}
+
+			summary := CommitSummary{CommitInfo: *info}
+			size, err := p.commitSize(rev, sizes)
+			if err == nil {
+				var parentSize int64
+				if info.Parent != "" {
+					parentSize, err = p.commitSize(info.Parent, sizes)
+				}
+				if err == nil {
+					summary.SizeDelta = size - parentSize
+					summary.HasSizeDelta = true
+				}
+			}
+			if err != nil {
+				// Parent commits are often missing from the repositories of build machines
+				logger.Debugf("Cannot calculate the size of \"%s\": %v", rev, err)
+			}
+
+			summaries[branch] = append(summaries[branch], summary)
+		}
+	}
+
+	return summaries, nil
+}
+
+// commitSize returns the size of the local objects reachable from the
+// commit rev, without its parents, caching the result in sizes
+func (p *Pusher) commitSize(rev string, sizes map[string]int64) (int64, error) {
+	if size, ok := sizes[rev]; ok {
+		return size, nil
+	}
+
+	objectNames, err := p.repo.Traverse(rev, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, objectName := range objectNames {
+		fi, err := os.Stat(p.repo.GetObjectPath(objectName))
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+
+	sizes[rev] = size
+	return size, nil
+}
+
+// Maximum number of missing objects listed in the message of MissingObjectsError
+const maxListedMissingObjects = 10
+
+// MissingObjectsError is returned when objects of the commits to push are
+// missing from the local repository, for example after pruning it
+type MissingObjectsError struct {
+	// Commits with missing objects
+	Commits []string
+	// Missing objects, those of commits that cannot be traversed are unknown
+	Objects []string
+}
+
+func (e *MissingObjectsError) Error() string {
+	if len(e.Objects) == 0 {
+		return fmt.Sprintf("%d commits cannot be traversed in the local repository: %s", len(e.Commits), strings.Join(e.Commits, ", "))
+	}
+
+	listed := e.Objects
+	if len(listed) > maxListedMissingObjects {
+		listed = listed[:maxListedMissingObjects]
+	}
+	message := fmt.Sprintf("%d objects of %d commits are missing from the local repository: %s", len(e.Objects), len(e.Commits), strings.Join(listed, ", "))
+	if len(listed) < len(e.Objects) {
+		message += ", ..."
+	}
+	return message
+}
+
+// FindObjectsForCommits finds the objects corresponding to the revisions that needs to be pushed to the receiver,
+// all the objects that are missing from the local repository are reported together with a MissingObjectsError
+func (p *Pusher) FindObjectsForCommits(revs []string) (common.Objects, error) {
+	// Enumerate objects, only once when they are shared between commits
+	objectRevs := map[string]string{}
+	shared := 0
+	missing := &MissingObjectsError{}
+	for _, rev := range revs {
+		revObjects, err := p.repo.Traverse(rev, 0)
+		if err != nil {
+			// Metadata objects are missing, keep looking for the others
+			logger.Errorf("Cannot traverse commit %s: %v", rev, err)
+			missing.Commits = append(missing.Commits, rev)
+			continue
+		}
+
+		for _, objectName := range revObjects {
+			objectName = ostree.ObjectNameForMode(objectName, p.remoteMode)
+			if p.serverObjects[objectName] {
+				continue
+			}
+			if _, ok := objectRevs[objectName]; !ok {
+				objectRevs[objectName] = rev
+			} else {
+				shared++
+			}
+		}
+	}
+	if shared > 0 {
+		logger.Debugf("Skipped %d references to objects shared between commits", shared)
+	}
+
+	type result struct {
+		object  common.Object
+		missing bool
+		err     error
+	}
+
+	objectNames := make(chan string, p.workers*4)
+	results := make(chan result, p.workers*4)
+
+	// Stat objects in parallel
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for objectName := range objectNames {
+				path := p.localObjectPath(objectName)
+				fi, err := os.Stat(path)
+				if os.IsNotExist(err) {
+					results <- result{object: common.Object{Rev: objectRevs[objectName], ObjectName: objectName}, missing: true}
+					continue
+				} else if err != nil {
+					results <- result{err: err}
+					continue
+				}
+
+				object := common.Object{Rev: objectRevs[objectName], ObjectName: objectName, ObjectPath: path, Size: fi.Size()}
+				results <- result{object: object}
+			}
+		}()
+	}
+
+	go func() {
+		for objectName := range objectRevs {
+			objectNames <- objectName
+		}
+		close(objectNames)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	objects := make(common.Objects, len(objectRevs))
+	var firstErr error
+	missingCommits := map[string]bool{}
+	for _, rev := range missing.Commits {
+		missingCommits[rev] = true
+	}
+	for result := range results {
+		if result.err != nil {
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			continue
+		}
+		if result.missing {
+			logger.Debugf("Object %s of commit %s is missing", result.object.ObjectName, result.object.Rev)
+			missing.Objects = append(missing.Objects, result.object.ObjectName)
+			if !missingCommits[result.object.Rev] {
+				missingCommits[result.object.Rev] = true
+				missing.Commits = append(missing.Commits, result.object.Rev)
+			}
+			continue
+		}
+		objects[result.object.ObjectName] = result.object
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if len(missing.Commits) > 0 {
+		sort.Strings(missing.Objects)
+		return nil, missing
+	}
+
+	return objects, nil
+}
+
+// PullCommits fetches the objects of the commits that are missing from the
+// local repository from remote, one of its remotes
+func (p *Pusher) PullCommits(remote string, revs []string) error {
+	return p.repo.Pull(remote, revs)
+}
+
+// FindLocalAncestor walks the history of rev, a commit the server has, back
+// to the newest commit whose objects are all in the local repository and
+// returns it with its objects, named as in the remote repository; the
+// commit is empty when there's none, for example after a shallow pull
+func (p *Pusher) FindLocalAncestor(rev string) (string, []string) {
+	for i := 0; i < maxAncestorSearch && rev != ""; i++ {
+		objectNames, err := p.repo.Traverse(rev, 0)
+		if err == nil {
+			for j, objectName := range objectNames {
+				objectNames[j] = ostree.ObjectNameForMode(objectName, p.remoteMode)
+			}
+			return rev, objectNames
+		}
+		logger.Debugf("Cannot traverse commit %s: %v", rev, err)
+
+		parent, err := p.repo.GetParentRev(rev)
+		if err != nil {
+			// We don't have the commit, or only part of the history
+			logger.Debugf("Cannot find the parent of commit %s: %v", rev, err)
+			return "", nil
+		}
+		rev = parent
+	}
+
+	return "", nil
+}
+
+// AddServerObjects records objects the server has, so that they are not
+// enumerated again
+func (p *Pusher) AddServerObjects(objectNames []string) {
+	if p.serverObjects == nil {
+		p.serverObjects = map[string]bool{}
+	}
+	for _, objectName := range objectNames {
+		p.serverObjects[objectName] = true
+	}
+}
+
+// WithoutServerObjects returns the objects the server is not known to have
+func (p *Pusher) WithoutServerObjects(objects common.Objects) common.Objects {
+	remaining := make(common.Objects, len(objects))
+	for objectName, object := range objects {
+		if !p.serverObjects[objectName] {
+			remaining[objectName] = object
+		}
+	}
+
+	return remaining
+}
+
+// FindObjectsByName returns the local objects corresponding to the object names
+func (p *Pusher) FindObjectsByName(objectNames []string) (common.Objects, error) {
+	objects := make(common.Objects, len(objectNames))
+
+	for _, objectName := range objectNames {
+		path := p.localObjectPath(objectName)
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		objects[objectName] = common.Object{ObjectName: objectName, ObjectPath: path, Size: fi.Size()}
+	}
+
+	return objects, nil
+}
+
+// FindBasisObjects finds, for each file object of the new revisions, the object at the
+// same path in the revision the server has, to be used as the basis of a delta upload
+func (p *Pusher) FindBasisObjects(updateRefs map[string]common.RevisionPair) (map[string]string, error) {
+	basisObjects := map[string]string{}
+
+	for branch, revs := range updateRefs {
+		if revs.Server == "" {
+			continue
+		}
+
+		serverFiles, err := p.repo.ListFileObjects(revs.Server)
+		if err != nil {
+			// We might not have the server revision
+			logger.Debugf("Cannot list files of \"%s\" from branch \"%s\": %v", revs.Server, branch, err)
+			continue
+		}
+
+		clientFiles, err := p.repo.ListFileObjects(revs.Client)
+		if err != nil {
+			return nil, err
+		}
+
+		for path, objectName := range clientFiles {
+			if basisName, ok := serverFiles[path]; ok && basisName != objectName {
+				basisObjects[objectName] = basisName
+			}
+		}
+	}
+
+	return basisObjects, nil
+}
+
+// CheckUpdate returns a map whose key is a branch and the value contains the corresponding
+// revision in the remote and local repositories
+func (p *Pusher) CheckUpdate(remoteRefs map[string]string) (map[string]common.RevisionPair, error) {
+	updateRefs := make(map[string]common.RevisionPair)
+
+	for branch, rev := range p.branches {
+		remoteRev := remoteRefs[branch]
+		if rev != remoteRev {
+			updateRefs[branch] = common.RevisionPair{Server: remoteRev, Client: rev}
+		}
+	}
+
+	return updateRefs, nil
+}
+
+// Prune prunes the repository
+func (p *Pusher) Prune() error {
+	result, err := p.repo.Prune(ostree.PruneOptions{Depth: -1})
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Pruned %d/%d objects, %d bytes deleted", result.Pruned, result.Total, result.Size)
+
+	return nil
+}
+
+// FindObjectsToPush finds which objects need to be pushed
+func (p *Pusher) FindObjectsToPush(updateRefs map[string]common.RevisionPair) (common.Objects, error) {
+	var commits []string
+
+	// Branches often share commits, for example when a branch is pushed
+	// together with another one that was forked from it
+	seen := map[string]bool{}
+	for branch, revs := range updateRefs {
+		logger.Actionf("Finding commits on branch \"%s\"...", branch)
+		neededCommits, err := p.FindNeededCommits(revs.Server, revs.Client)
+		if err != nil {
+			return nil, err
+		}
+		for _, rev := range neededCommits {
+			if !seen[rev] {
+				seen[rev] = true
+				commits = append(commits, rev)
+			}
+		}
+	}
+
+	logger.Action("Enumerating objects to send (this might take a while)...")
+	neededObjects, err := p.FindObjectsForCommits(commits)
+	if err != nil {
+		return nil, err
+	}
+
+	return neededObjects, nil
+}
@@ -0,0 +1,341 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package client
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/pkg/ostree/ostreetest"
+)
+
+// newTestRepo returns an empty fake repository in mode
+func newTestRepo(t *testing.T, mode string) *ostreetest.FakeRepo {
+	t.Helper()
+
+	repo, err := ostreetest.NewFakeRepo(t.TempDir(), mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// addTestCommit adds a commit of parent with a file with the content to
+// repo, and returns its revision and the names of its objects
+func addTestCommit(t *testing.T, repo *ostreetest.FakeRepo, parent, content string) (string, []string) {
+	t.Helper()
+
+	fileType := "file"
+	if mode, _ := repo.GetMode(); mode == "archive" {
+		fileType = "filez"
+	}
+
+	objects := []string{}
+	add := func(content, objectType string) string {
+		objectName, err := repo.AddObject([]byte(content), objectType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, objectName)
+		return objectName
+	}
+	file := add(content, fileType)
+	dirtree := add("dirtree "+file, "dirtree")
+	dirmeta := add("dirmeta", "dirmeta")
+	commit := add("commit "+parent+" "+dirtree, "commit")
+	rev := strings.TrimSuffix(commit, ".commit")
+
+	repo.AddCommit(rev, ostreetest.Commit{
+		Parent:  parent,
+		Subject: "Add " + content,
+		Objects: []string{dirtree, dirmeta, file},
+		Files:   map[string]string{"/file": file},
+	})
+
+	sort.Strings(objects)
+	return rev, objects
+}
+
+// objectNames returns the sorted names of objects
+func objectNames(objects common.Objects) []string {
+	names := []string{}
+	for objectName := range objects {
+		names = append(names, objectName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCheckUpdate(t *testing.T) {
+	repo := newTestRepo(t, "archive")
+	rev1, _ := addTestCommit(t, repo, "", "one")
+	rev2, _ := addTestCommit(t, repo, rev1, "two")
+
+	pusher, err := newPusher(repo, map[string]string{"main": rev2, "stable": rev1, "new": rev1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updateRefs, err := pusher.CheckUpdate(map[string]string{"main": rev1, "stable": rev1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]common.RevisionPair{
+		"main": {Server: rev1, Client: rev2},
+		"new":  {Client: rev1},
+	}
+	if !reflect.DeepEqual(updateRefs, expected) {
+		t.Errorf("CheckUpdate() = %v, want %v", updateRefs, expected)
+	}
+}
+
+func TestFindNeededCommits(t *testing.T) {
+	repo := newTestRepo(t, "archive")
+	rev1, _ := addTestCommit(t, repo, "", "one")
+	rev2, _ := addTestCommit(t, repo, rev1, "two")
+	rev3, _ := addTestCommit(t, repo, rev2, "three")
+	other, _ := addTestCommit(t, repo, "", "other")
+
+	pusher, err := newPusher(repo, map[string]string{"main": rev3}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		remote   string
+		expected []string
+		valid    bool
+	}{
+		{"new branch", "", []string{rev3, rev2, rev1}, true},
+		{"parent on the server", rev2, []string{rev3}, true},
+		{"ancestor on the server", rev1, []string{rev3, rev2}, true},
+		{"up to date", rev3, []string{}, true},
+		{"unrelated commit on the server", other, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			commits, err := pusher.FindNeededCommits(test.remote, rev3)
+			if !test.valid {
+				if err == nil {
+					t.Errorf("FindNeededCommits(%s) = %q, want an error", test.remote, commits)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(commits, test.expected) {
+				t.Errorf("FindNeededCommits(%s) = %q, want %q", test.remote, commits, test.expected)
+			}
+		})
+	}
+}
+
+func TestFindObjectsToPush(t *testing.T) {
+	repo := newTestRepo(t, "archive")
+	rev1, objects1 := addTestCommit(t, repo, "", "one")
+	rev2, objects2 := addTestCommit(t, repo, rev1, "two")
+
+	pusher, err := newPusher(repo, map[string]string{"main": rev2}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the objects of the commits the server doesn't have
+	objects, err := pusher.FindObjectsToPush(map[string]common.RevisionPair{"main": {Server: rev1, Client: rev2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := objectNames(objects); !reflect.DeepEqual(names, objects2) {
+		t.Errorf("FindObjectsToPush() = %q, want %q", names, objects2)
+	}
+	for objectName, object := range objects {
+		if object.Rev != rev2 || object.ObjectPath != repo.GetObjectPath(objectName) || object.Size == 0 {
+			t.Errorf("object %s is %+v", objectName, object)
+		}
+	}
+
+	// Objects the server is known to have are skipped, such as the
+	// dirmeta shared by both commits
+	pusher.AddServerObjects(objects1)
+	objects, err = pusher.FindObjectsToPush(map[string]common.RevisionPair{"main": {Client: rev2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{}
+	for _, objectName := range objects2 {
+		if !strings.HasSuffix(objectName, ".dirmeta") {
+			expected = append(expected, objectName)
+		}
+	}
+	if names := objectNames(objects); !reflect.DeepEqual(names, expected) {
+		t.Errorf("FindObjectsToPush() without the server objects = %q, want %q", names, expected)
+	}
+}
+
+func TestWithoutServerObjects(t *testing.T) {
+	repo := newTestRepo(t, "archive")
+	rev1, objects1 := addTestCommit(t, repo, "", "one")
+	rev2, _ := addTestCommit(t, repo, rev1, "two")
+
+	pusher, err := newPusher(repo, map[string]string{"main": rev2}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := pusher.FindObjectsToPush(map[string]common.RevisionPair{"main": {Client: rev2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same objects as when they are skipped while enumerating
+	pusher.AddServerObjects(objects1)
+	expected, err := pusher.FindObjectsToPush(map[string]common.RevisionPair{"main": {Client: rev2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := objectNames(pusher.WithoutServerObjects(objects)); !reflect.DeepEqual(names, objectNames(expected)) {
+		t.Errorf("WithoutServerObjects() = %q, want %q", names, objectNames(expected))
+	}
+}
+
+func TestFindObjectsMissing(t *testing.T) {
+	repo := newTestRepo(t, "archive")
+	rev, objects := addTestCommit(t, repo, "", "one")
+
+	// The file object was pruned
+	var file string
+	for _, objectName := range objects {
+		if strings.HasSuffix(objectName, ".filez") {
+			file = objectName
+		}
+	}
+	if err := os.Remove(repo.GetObjectPath(file)); err != nil {
+		t.Fatal(err)
+	}
+
+	pusher, err := newPusher(repo, map[string]string{"main": rev}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pusher.FindObjectsForCommits([]string{rev})
+	var missing *MissingObjectsError
+	if !errors.As(err, &missing) {
+		t.Fatalf("FindObjectsForCommits() = %v, want a MissingObjectsError", err)
+	}
+	if !reflect.DeepEqual(missing.Objects, []string{file}) || !reflect.DeepEqual(missing.Commits, []string{rev}) {
+		t.Errorf("missing objects %q of commits %q, want %q of %q", missing.Objects, missing.Commits, file, rev)
+	}
+}
+
+func TestPushToArchive(t *testing.T) {
+	repo := newTestRepo(t, "bare")
+	rev, _ := addTestCommit(t, repo, "", "one")
+
+	pusher, err := newPusher(repo, map[string]string{"main": rev}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pusher.Cleanup()
+	if err := pusher.SetRemoteMode("archive"); err != nil {
+		t.Fatal(err)
+	}
+	if !pusher.NeedsCompression() {
+		t.Error("objects pushed from a bare repository to an archive one are not compressed")
+	}
+
+	// File objects are named as in the archive repository
+	objects, err := pusher.FindObjectsToPush(map[string]common.RevisionPair{"main": {Client: rev}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := 0
+	for objectName := range objects {
+		if strings.HasSuffix(objectName, ".file") {
+			t.Errorf("object %s is not named as in an archive repository", objectName)
+		}
+		if strings.HasSuffix(objectName, ".filez") {
+			files++
+		}
+	}
+	if files != 1 {
+		t.Errorf("found %d file objects, want 1", files)
+	}
+
+	if err := pusher.PrepareObjects(objects); err != nil {
+		t.Fatal(err)
+	}
+	for objectName, object := range objects {
+		if strings.HasSuffix(objectName, ".filez") && !strings.HasPrefix(object.ObjectPath, pusher.tempDir) {
+			t.Errorf("file object %s is uploaded from %s instead of its compressed copy", objectName, object.ObjectPath)
+		}
+	}
+}
+
+func TestSetRemoteMode(t *testing.T) {
+	tests := []struct {
+		local  string
+		remote string
+		valid  bool
+	}{
+		{"archive", "archive", true},
+		{"bare", "archive", true},
+		{"bare-user", "archive", true},
+		{"bare", "bare", true},
+		{"archive", "bare", false},
+		{"bare-user", "bare", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.local+" to "+test.remote, func(t *testing.T) {
+			pusher, err := newPusher(newTestRepo(t, test.local), map[string]string{}, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = pusher.SetRemoteMode(test.remote)
+			if test.valid && err != nil {
+				t.Errorf("SetRemoteMode(%s) = %v, want no error", test.remote, err)
+			} else if !test.valid && err == nil {
+				t.Errorf("SetRemoteMode(%s) = nil, want an error", test.remote)
+			}
+		})
+	}
+}
+
+func TestFindBasisObjects(t *testing.T) {
+	repo := newTestRepo(t, "archive")
+	rev1, _ := addTestCommit(t, repo, "", "one")
+	rev2, _ := addTestCommit(t, repo, rev1, "two")
+
+	pusher, err := newPusher(repo, map[string]string{"main": rev2}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	basisObjects, err := pusher.FindBasisObjects(map[string]common.RevisionPair{"main": {Server: rev1, Client: rev2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{ostreetest.ObjectName([]byte("two"), "filez"): ostreetest.ObjectName([]byte("one"), "filez")}
+	if !reflect.DeepEqual(basisObjects, expected) {
+		t.Errorf("FindBasisObjects() = %v, want %v", basisObjects, expected)
+	}
+
+	// New branches have no basis
+	basisObjects, err = pusher.FindBasisObjects(map[string]common.RevisionPair{"main": {Client: rev2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(basisObjects) > 0 {
+		t.Errorf("FindBasisObjects() for a new branch = %v, want none", basisObjects)
+	}
+}
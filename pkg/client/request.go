@@ -0,0 +1,64 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lirios/ostree-upload/internal/common"
+)
+
+// RequestOptions adds credentials and headers to every request, for servers
+// behind a reverse proxy that requires them
+type RequestOptions struct {
+	// Headers written as "Name: value"
+	Headers []string
+	// Credentials written as "user:password" sent with HTTP basic
+	// authentication, the token is then sent with its own header
+	BasicAuth string
+}
+
+// parseHeaders returns the headers of the options
+func parseHeaders(headers []string) (http.Header, error) {
+	result := http.Header{}
+
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("Invalid header \"%s\": expected \"Name: value\"", header)
+		}
+		result.Add(name, strings.TrimSpace(parts[1]))
+	}
+
+	return result, nil
+}
+
+// parseBasicAuth splits the credentials into user name and password
+func parseBasicAuth(credentials string) (string, string, error) {
+	parts := strings.SplitN(credentials, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("Invalid basic authentication credentials: expected \"user:password\"")
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// setHeaders adds the user agent, the credentials and the custom
+// headers to a request
+func (c *Client) setHeaders(request *http.Request) {
+	request.Header.Set("User-Agent", c.userAgent)
+	if c.username != "" {
+		request.SetBasicAuth(c.username, c.password)
+		request.Header.Set(common.TokenHeader, c.token)
+	} else {
+		request.Header.Set("Authorization", fmt.Sprintf("BEARER %s", c.token))
+	}
+	for name, values := range c.headers {
+		request.Header[name] = values
+	}
+}
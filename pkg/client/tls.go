@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/lirios/ostree-upload/internal/logger"
+)
+
+// TLSOptions controls which servers the client trusts
+type TLSOptions struct {
+	// Path of a PEM file with the certificate authorities to trust instead
+	// of the system ones
+	CACert string
+	// Base64 encoded SHA-256 digests of the subject public key info of the
+	// certificates the client accepts, one of them must be in the chain
+	PinnedKeys []string
+	// Don't verify the certificate chain, for local testing only
+	Insecure bool
+}
+
+// ErrPinMismatch is returned when no certificate of the server matches the pinned keys
+var ErrPinMismatch = errors.New("no certificate matches the pinned public keys")
+
+// parsePin decodes a pin, with or without the "sha256//" prefix used by curl
+func parsePin(pin string) ([]byte, error) {
+	digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256//"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid public key pin \"%s\": %w", pin, err)
+	}
+	if len(digest) != sha256.Size {
+		return nil, fmt.Errorf("Invalid public key pin \"%s\": not a SHA-256 digest", pin)
+	}
+
+	return digest, nil
+}
+
+// newTLSConfig returns the TLS configuration of the client, or nil
+// to use the defaults
+func newTLSConfig(options TLSOptions) (*tls.Config, error) {
+	if options.CACert == "" && len(options.PinnedKeys) == 0 && !options.Insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if options.CACert != "" {
+		data, err := ioutil.ReadFile(options.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read certificate authorities: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificate found in %s", options.CACert)
+		}
+		config.RootCAs = pool
+	}
+
+	if options.Insecure {
+		logger.Warn("TLS certificates of the server are not verified, anybody in the middle can read and change the transfer")
+		config.InsecureSkipVerify = true
+	}
+
+	if len(options.PinnedKeys) > 0 {
+		pins := make([][]byte, 0, len(options.PinnedKeys))
+		for _, pin := range options.PinnedKeys {
+			digest, err := parsePin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins = append(pins, digest)
+		}
+
+		// Called after the chain is verified, or right away when it isn't
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, rawCert := range rawCerts {
+				cert, err := x509.ParseCertificate(rawCert)
+				if err != nil {
+					return err
+				}
+				digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if string(digest[:]) == string(pin) {
+						return nil
+					}
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+
+	return config, nil
+}
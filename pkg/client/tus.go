@@ -0,0 +1,154 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/logger"
+)
+
+// Version of the tus resumable upload protocol we speak
+const tusVersion = "1.0.0"
+
+// newTusRequest creates a tus request for the URL
+func (c *Client) newTusRequest(ctx context.Context, method string, u *url.URL, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Tus-Resumable", tusVersion)
+	c.setHeaders(request)
+	return request, nil
+}
+
+// CreateUpload starts the resumable upload of an object and returns its URL
+func (c *Client) CreateUpload(ctx context.Context, queueID string, object common.Object) (*url.URL, error) {
+	u, err := c.resolve(c.apiPath("/queue/%s/uploads", queueID))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.newTusRequest(ctx, "POST", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Upload-Length", strconv.FormatInt(object.Size, 10))
+	request.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(object.ObjectName)))
+
+	response, err := c.do(request, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	location, err := url.Parse(response.Header.Get("Location"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload location: %w", err)
+	}
+	return u.ResolveReference(location), nil
+}
+
+// UploadOffset returns how much of the upload the server received
+func (c *Client) UploadOffset(ctx context.Context, u *url.URL) (int64, error) {
+	request, err := c.newTusRequest(ctx, "HEAD", u, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := c.do(request, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(response.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// PatchUpload sends at most size bytes of the object starting at offset,
+// or everything that's left when size is 0, and returns the new offset
+func (c *Client) PatchUpload(ctx context.Context, u *url.URL, object common.Object, offset, size int64) (int64, error) {
+	file, err := os.Open(object.ObjectPath)
+	if err != nil {
+		return offset, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	length := object.Size - offset
+	if size > 0 && size < length {
+		length = size
+	}
+
+	request, err := c.newTusRequest(ctx, "PATCH", u, io.LimitReader(file, length))
+	if err != nil {
+		return offset, err
+	}
+	request.ContentLength = length
+	request.Header.Set("Content-Type", "application/offset+octet-stream")
+	request.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	response, err := c.doWithin(c.timeouts.Upload, request, nil)
+	if err != nil {
+		return offset, err
+	}
+
+	return strconv.ParseInt(response.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// UploadResumable uploads an object with the tus protocol, in requests of
+// at most chunkSize bytes, continuing from where the server is when a
+// request fails
+func (c *Client) UploadResumable(ctx context.Context, queueID string, object common.Object, chunkSize int64) error {
+	u, err := c.CreateUpload(ctx, queueID, object)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	failures := 0
+	for offset < object.Size || object.Size == 0 {
+		newOffset, err := c.PatchUpload(ctx, u, object, offset, chunkSize)
+		if err == nil {
+			offset = newOffset
+			failures = 0
+			if object.Size == 0 {
+				break
+			}
+			continue
+		}
+
+		// Requests the server refused won't succeed by retrying, unless
+		// we are out of sync with the offset
+		var apiError *APIError
+		if errors.As(err, &apiError) && apiError.StatusCode < 500 && apiError.StatusCode != http.StatusConflict {
+			return err
+		}
+
+		failures++
+		if failures >= Attempts {
+			return err
+		}
+		logger.Warnf("Upload of \"%s\" interrupted at %d/%d bytes: %v", object.ObjectName, offset, object.Size, err)
+		time.Sleep(RetryDelay(err, failures))
+
+		if offset, err = c.UploadOffset(ctx, u); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package client
+
+import (
+	"github.com/lirios/ostree-upload/internal/common"
+	"github.com/lirios/ostree-upload/internal/delta"
+)
+
+// Types of the API used by the client, so that programs importing this
+// package can name them
+type (
+	Object                 = common.Object
+	Objects                = common.Objects
+	RevisionPair           = common.RevisionPair
+	Event                  = common.Event
+	QueueRequest           = common.QueueRequest
+	QueueManifest          = common.QueueManifest
+	UploadResponse         = common.UploadResponse
+	UploadResult           = common.UploadResult
+	InfoResponse           = common.InfoResponse
+	WhoamiResponse         = common.WhoamiResponse
+	StatusResponse         = common.StatusResponse
+	QueueStatusResponse    = common.QueueStatusResponse
+	QueueEntryResponse     = common.QueueEntryResponse
+	HistoryResponse        = common.HistoryResponse
+	ObjectsSinceResponse   = common.ObjectsSinceResponse
+	PublishHistoryResponse = common.PublishHistoryResponse
+	PromoteResponse        = common.PromoteResponse
+	RollbackResponse       = common.RollbackResponse
+	IntegrityResponse      = common.IntegrityResponse
+	BloomFilter            = common.BloomFilter
+	Signature              = delta.Signature
+)
+
+// Statuses of the objects in the results of Upload
+const (
+	UploadStatusAccepted         = common.UploadStatusAccepted
+	UploadStatusAlreadyPresent   = common.UploadStatusAlreadyPresent
+	UploadStatusChecksumMismatch = common.UploadStatusChecksumMismatch
+)
+
+// Types of the events streamed by Events
+const (
+	EventQueueCreated    = common.EventQueueCreated
+	EventQueueProgress   = common.EventQueueProgress
+	EventQueueFinalizing = common.EventQueueFinalizing
+	EventQueueRemoved    = common.EventQueueRemoved
+	EventPublished       = common.EventPublished
+	EventPublishFailed   = common.EventPublishFailed
+)
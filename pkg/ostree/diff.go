@@ -0,0 +1,82 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package ostree
+
+import (
+	"sort"
+)
+
+// Kinds of FileChange
+const (
+	FileAdded    = "A"
+	FileRemoved  = "D"
+	FileModified = "M"
+)
+
+// FileChange is a difference between the files of two commits
+type FileChange struct {
+	Kind string
+	Path string
+	// Size in the old and the new commit, 0 when the file doesn't exist
+	OldSize int64
+	NewSize int64
+}
+
+// Walker lists the files of a commit, it's implemented by Repo
+type Walker interface {
+	Walk(rev, path string, walkFn WalkFunc) error
+}
+
+// listFiles returns all the files of the commit rev by path
+func listFiles(repo Walker, rev string) (map[string]FileInfo, error) {
+	files := map[string]FileInfo{}
+	err := repo.Walk(rev, "/", func(info FileInfo) error {
+		files[info.Path] = info
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// DiffCommits returns the files added, removed or modified by the commit
+// newRev compared to oldRev, sorted by path; without oldRev all the files
+// of newRev are added
+func DiffCommits(repo Walker, oldRev, newRev string) ([]FileChange, error) {
+	oldFiles := map[string]FileInfo{}
+	if oldRev != "" {
+		var err error
+		if oldFiles, err = listFiles(repo, oldRev); err != nil {
+			return nil, err
+		}
+	}
+	newFiles, err := listFiles(repo, newRev)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []FileChange{}
+	for path, oldFile := range oldFiles {
+		newFile, ok := newFiles[path]
+		if !ok {
+			changes = append(changes, FileChange{Kind: FileRemoved, Path: path, OldSize: oldFile.Size})
+		} else if newFile.Checksum != oldFile.Checksum || newFile.Mode != oldFile.Mode || newFile.UID != oldFile.UID || newFile.GID != oldFile.GID {
+			changes = append(changes, FileChange{Kind: FileModified, Path: path, OldSize: oldFile.Size, NewSize: newFile.Size})
+		}
+	}
+	for path, newFile := range newFiles {
+		if _, ok := oldFiles[path]; !ok {
+			changes = append(changes, FileChange{Kind: FileAdded, Path: path, NewSize: newFile.Size})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes, nil
+}
@@ -0,0 +1,314 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+#pragma once
+
+#include <fcntl.h>
+#include <glib.h>
+
+static char *_g_error_get_message(GError *error) {
+  g_assert(error != NULL);
+  return error->message;
+}
+
+static gboolean _g_hash_table_iter_next_variant(GHashTableIter *iter,
+                                                GVariant **key,
+                                                GVariant **value) {
+  g_assert(iter != NULL);
+  return g_hash_table_iter_next(iter, (gpointer)key, (gpointer)value);
+}
+
+static void _g_variant_get_su(GVariant *v, const char **checksum,
+                              OstreeObjectType *objectType) {
+  g_assert(v != NULL);
+  g_variant_get(v, "(su)", checksum, objectType);
+}
+
+static const char *_g_strdup(gpointer string) { return g_strdup(string); }
+
+static gboolean _ostree_repo_file_ensure_resolved(GFile *file) {
+  return ostree_repo_file_ensure_resolved((OstreeRepoFile *)file, NULL);
+}
+
+static OstreeRepoFile *_ostree_repo_file(GFile *file) {
+  return OSTREE_REPO_FILE(file);
+}
+
+static gboolean _ostree_checksum_content_file(const char *path,
+                                              char **out_checksum,
+                                              GError **error) {
+  g_autoptr(GInputStream) input = NULL;
+  g_autoptr(GFileInfo) file_info = NULL;
+  g_autoptr(GVariant) xattrs = NULL;
+  if (!ostree_content_file_parse_at(TRUE, AT_FDCWD, path, FALSE, &input,
+                                    &file_info, &xattrs, NULL, error))
+    return FALSE;
+
+  g_autofree guchar *csum = NULL;
+  if (!ostree_checksum_file_from_input(file_info, xattrs, input,
+                                       OSTREE_OBJECT_TYPE_FILE, &csum, NULL,
+                                       error))
+    return FALSE;
+
+  *out_checksum = ostree_checksum_from_bytes(csum);
+  return TRUE;
+}
+
+static gboolean _ptr_array_add_object(GPtrArray *array, GVariant *csum_v,
+                                      OstreeObjectType type, GError **error) {
+  const guchar *csum = ostree_checksum_bytes_peek_validate(csum_v, error);
+  if (csum == NULL)
+    return FALSE;
+
+  g_autofree char *checksum = ostree_checksum_from_bytes(csum);
+  g_ptr_array_add(array, ostree_object_to_string(checksum, type));
+  return TRUE;
+}
+
+static GVariant *_ostree_load_commit_file(const char *path, GError **error) {
+  g_autofree char *contents = NULL;
+  gsize len = 0;
+  if (!g_file_get_contents(path, &contents, &len, error))
+    return NULL;
+
+  g_autoptr(GBytes) bytes = g_bytes_new_take(g_steal_pointer(&contents), len);
+  return g_variant_ref_sink(g_variant_new_from_bytes(
+      ostree_metadata_variant_type(OSTREE_OBJECT_TYPE_COMMIT), bytes, FALSE));
+}
+
+static char **_ostree_metadata_children(const char *path,
+                                        OstreeObjectType type,
+                                        GError **error) {
+  g_autofree char *contents = NULL;
+  gsize len = 0;
+  if (!g_file_get_contents(path, &contents, &len, error))
+    return NULL;
+
+  g_autoptr(GBytes) bytes = g_bytes_new_take(g_steal_pointer(&contents), len);
+  g_autoptr(GVariant) v = g_variant_ref_sink(
+      g_variant_new_from_bytes(ostree_metadata_variant_type(type), bytes, FALSE));
+
+  g_autoptr(GPtrArray) children = g_ptr_array_new_with_free_func(g_free);
+
+  if (type == OSTREE_OBJECT_TYPE_COMMIT) {
+    g_autofree char *parent = ostree_commit_get_parent(v);
+    if (parent != NULL)
+      g_ptr_array_add(children, ostree_object_to_string(
+                                    parent, OSTREE_OBJECT_TYPE_COMMIT));
+
+    g_autoptr(GVariant) tree_csum = NULL;
+    g_autoptr(GVariant) meta_csum = NULL;
+    g_variant_get_child(v, 6, "@ay", &tree_csum);
+    g_variant_get_child(v, 7, "@ay", &meta_csum);
+    if (!_ptr_array_add_object(children, tree_csum, OSTREE_OBJECT_TYPE_DIR_TREE,
+                               error))
+      return NULL;
+    if (!_ptr_array_add_object(children, meta_csum, OSTREE_OBJECT_TYPE_DIR_META,
+                               error))
+      return NULL;
+  } else if (type == OSTREE_OBJECT_TYPE_DIR_TREE) {
+    g_autoptr(GVariant) files = g_variant_get_child_value(v, 0);
+    g_autoptr(GVariant) dirs = g_variant_get_child_value(v, 1);
+    GVariantIter iter;
+    const char *name;
+
+    g_variant_iter_init(&iter, files);
+    while (TRUE) {
+      g_autoptr(GVariant) csum = NULL;
+      if (!g_variant_iter_next(&iter, "(&s@ay)", &name, &csum))
+        break;
+      if (!_ptr_array_add_object(children, csum, OSTREE_OBJECT_TYPE_FILE,
+                                 error))
+        return NULL;
+    }
+
+    g_variant_iter_init(&iter, dirs);
+    while (TRUE) {
+      g_autoptr(GVariant) csum = NULL;
+      g_autoptr(GVariant) meta_csum = NULL;
+      if (!g_variant_iter_next(&iter, "(&s@ay@ay)", &name, &csum, &meta_csum))
+        break;
+      if (!_ptr_array_add_object(children, csum, OSTREE_OBJECT_TYPE_DIR_TREE,
+                                 error))
+        return NULL;
+      if (!_ptr_array_add_object(children, meta_csum,
+                                 OSTREE_OBJECT_TYPE_DIR_META, error))
+        return NULL;
+    }
+  }
+
+  g_ptr_array_add(children, NULL);
+  return (char **)g_ptr_array_free(g_steal_pointer(&children), FALSE);
+}
+
+static const char *_ostree_version(void) { return OSTREE_VERSION_S; }
+
+static const char *_ostree_repo_file_get_checksum(GFile *file) {
+  return ostree_repo_file_get_checksum((OstreeRepoFile *)file);
+}
+
+static gboolean _ostree_repo_export_archive_z2(OstreeRepo *repo,
+                                               const char *checksum,
+                                               const char *path,
+                                               GError **error) {
+  g_autoptr(GInputStream) input = NULL;
+  g_autoptr(GFileInfo) file_info = NULL;
+  g_autoptr(GVariant) xattrs = NULL;
+  if (!ostree_repo_load_file(repo, checksum, &input, &file_info, &xattrs, NULL,
+                             error))
+    return FALSE;
+
+  g_autoptr(GInputStream) zstream = NULL;
+  if (!ostree_raw_file_to_archive_z2_stream(input, file_info, xattrs, &zstream,
+                                            NULL, error))
+    return FALSE;
+
+  g_autoptr(GFile) file = g_file_new_for_path(path);
+  g_autoptr(GFileOutputStream) output =
+      g_file_replace(file, NULL, FALSE, G_FILE_CREATE_NONE, NULL, error);
+  if (output == NULL)
+    return FALSE;
+
+  if (g_output_stream_splice(G_OUTPUT_STREAM(output), zstream,
+                             G_OUTPUT_STREAM_SPLICE_CLOSE_SOURCE |
+                                 G_OUTPUT_STREAM_SPLICE_CLOSE_TARGET,
+                             NULL, error) < 0)
+    return FALSE;
+
+  return TRUE;
+}
+
+static const char *_ostree_commit_get_subject(GVariant *commit) {
+  const char *subject = NULL;
+  g_variant_get_child(commit, 3, "&s", &subject);
+  return subject;
+}
+
+static char **_ostree_commit_get_string_metadata(GVariant *commit) {
+  g_autoptr(GVariant) metadata = g_variant_get_child_value(commit, 0);
+  g_autoptr(GPtrArray) pairs = g_ptr_array_new_with_free_func(g_free);
+
+  GVariantIter iter;
+  const char *key;
+  GVariant *value;
+  g_variant_iter_init(&iter, metadata);
+  while (g_variant_iter_next(&iter, "{&sv}", &key, &value)) {
+    if (g_variant_is_of_type(value, G_VARIANT_TYPE_STRING)) {
+      g_ptr_array_add(pairs, g_strdup(key));
+      g_ptr_array_add(pairs, g_variant_dup_string(value, NULL));
+    }
+    g_variant_unref(value);
+  }
+
+  g_ptr_array_add(pairs, NULL);
+  return (char **)g_ptr_array_free(g_steal_pointer(&pairs), FALSE);
+}
+
+static gboolean _ostree_repo_set_detached_metadata_strv(
+    OstreeRepo *repo, const char *checksum, const char *key, char **keys,
+    char **values, int n_keys, GError **error) {
+  g_autoptr(GVariant) old_metadata = NULL;
+  if (!ostree_repo_read_commit_detached_metadata(repo, checksum, &old_metadata,
+                                                 NULL, error))
+    return FALSE;
+
+  g_autoptr(GVariantDict) dict = g_variant_dict_new(old_metadata);
+
+  g_auto(GVariantBuilder) builder;
+  g_variant_builder_init(&builder, G_VARIANT_TYPE("a{ss}"));
+  for (int i = 0; i < n_keys; i++)
+    g_variant_builder_add(&builder, "{ss}", keys[i], values[i]);
+  g_variant_dict_insert_value(dict, key, g_variant_builder_end(&builder));
+
+  g_autoptr(GVariant) metadata = g_variant_ref_sink(g_variant_dict_end(dict));
+  return ostree_repo_write_commit_detached_metadata(repo, checksum, metadata,
+                                                    NULL, error);
+}
+
+static GVariantBuilder *_g_variant_builder_new_vardict(void) {
+  return g_variant_builder_new(G_VARIANT_TYPE_VARDICT);
+}
+
+static void _g_variant_builder_add_string(GVariantBuilder *builder,
+                                          const char *key, const char *value) {
+  g_variant_builder_add(builder, "{sv}", key, g_variant_new_string(value));
+}
+
+static void _g_variant_builder_add_boolean(GVariantBuilder *builder,
+                                           const char *key, gboolean value) {
+  g_variant_builder_add(builder, "{sv}", key, g_variant_new_boolean(value));
+}
+
+static void _g_variant_builder_add_int64(GVariantBuilder *builder,
+                                         const char *key, gint64 value) {
+  g_variant_builder_add(builder, "{sv}", key, g_variant_new_int64(value));
+}
+
+static void _g_variant_builder_add_double(GVariantBuilder *builder,
+                                          const char *key, gdouble value) {
+  g_variant_builder_add(builder, "{sv}", key, g_variant_new_double(value));
+}
+
+static void _g_variant_builder_add_strv(GVariantBuilder *builder,
+                                        const char *key, char **values,
+                                        int n_values) {
+  g_variant_builder_add(builder, "{sv}", key,
+                        g_variant_new_strv((const char *const *)values,
+                                           n_values));
+}
+
+static gboolean _ostree_repo_regenerate_summary(OstreeRepo *repo,
+                                                GVariantBuilder *builder,
+                                                GError **error) {
+  g_autoptr(GVariant) additional_metadata = NULL;
+  if (builder != NULL)
+    additional_metadata = g_variant_ref_sink(g_variant_builder_end(builder));
+
+  return ostree_repo_regenerate_summary(repo, additional_metadata, NULL, error);
+}
+
+static gboolean _ostree_repo_write_tree(OstreeRepo *repo,
+                                        OstreeMutableTree *mtree,
+                                        const char *kind, const char *value,
+                                        gboolean canonical_permissions,
+                                        GError **error) {
+  g_autoptr(OstreeRepoCommitModifier) modifier =
+      ostree_repo_commit_modifier_new(
+          canonical_permissions
+              ? OSTREE_REPO_COMMIT_MODIFIER_FLAGS_CANONICAL_PERMISSIONS
+              : OSTREE_REPO_COMMIT_MODIFIER_FLAGS_NONE,
+          NULL, NULL, NULL);
+
+  g_autoptr(GFile) root = NULL;
+  if (g_str_equal(kind, "dir")) {
+    root = g_file_new_for_path(value);
+  } else if (g_str_equal(kind, "ref")) {
+    if (!ostree_repo_read_commit(repo, value, &root, NULL, NULL, error))
+      return FALSE;
+  } else {
+    g_set_error(error, G_IO_ERROR, G_IO_ERROR_NOT_SUPPORTED,
+                "unsupported tree type \"%s\"", kind);
+    return FALSE;
+  }
+
+  return ostree_repo_write_directory_to_mtree(repo, root, mtree, modifier,
+                                              NULL, error);
+}
+
+static gboolean _ostree_repo_write_mtree_commit(
+    OstreeRepo *repo, OstreeMutableTree *mtree, const char *branch,
+    const char *parent, const char *subject, const char *body,
+    char **out_checksum, GError **error) {
+  g_autoptr(GFile) root = NULL;
+  if (!ostree_repo_write_mtree(repo, mtree, &root, NULL, error))
+    return FALSE;
+
+  if (!ostree_repo_write_commit(repo, parent, subject, body, NULL,
+                                OSTREE_REPO_FILE(root), out_checksum, NULL,
+                                error))
+    return FALSE;
+
+  ostree_repo_transaction_set_ref(repo, NULL, branch, *out_checksum);
+  return TRUE;
+}
@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build !cgo
+// +build !cgo
+
+package ostree
+
+import (
+	"errors"
+	"io"
+)
+
+// Without cgo there's no libostree: repositories can't be opened, but the
+// code that uses a Repository builds and can be tested with a fake
+
+// ErrNoLibostree is returned by the functions that need libostree
+var ErrNoLibostree = errors.New("built without libostree")
+
+// Repo represents a local ostree repository
+type Repo struct {
+	Repository
+}
+
+// Version returns the version of libostree the program was built with,
+// empty without libostree
+func Version() string {
+	return ""
+}
+
+// Open attempts to open the repo at the given path
+func Open(path string) (*Repo, error) {
+	return nil, ErrNoLibostree
+}
+
+// CreateRepo creates the repository from path and opens it.
+func CreateRepo(path string) (*Repo, error) {
+	return nil, ErrNoLibostree
+}
+
+// VerifyObject checks that the content of the object file at path matches
+// the checksum encoded in objectName
+func VerifyObject(path, objectName string) error {
+	return ErrNoLibostree
+}
+
+// CommitDirectory commits the content of the directory at path on top of
+// the branch head, if any, and points the branch to the new commit
+func (r *Repo) CommitDirectory(branch, subject, path string) (string, error) {
+	return "", ErrNoLibostree
+}
+
+// Commit writes a commit whose content is the trees laid over each other in
+// order, on top of the branch head, if any, and points the branch to it
+func (r *Repo) Commit(branch string, trees []string, options CommitOptions) (string, error) {
+	return "", ErrNoLibostree
+}
+
+// Checkout checks out the specified path from the revision rev
+func (r *Repo) Checkout(rev, path, destPath string, options CheckoutOptions) error {
+	return ErrNoLibostree
+}
+
+// Walk walks the path of the commit rev and calls walkFn for each file,
+// with the path itself when it's not a directory
+func (r *Repo) Walk(rev, path string, walkFn WalkFunc) error {
+	return ErrNoLibostree
+}
+
+// Cat writes the content of the file at path of the commit rev to w
+func (r *Repo) Cat(rev, path string, w io.Writer) error {
+	return ErrNoLibostree
+}
@@ -0,0 +1,141 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package ostree
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ParseObjectName splits an object name such as "<checksum>.commit" into
+// its checksum and object type; the object type of content objects stored
+// in archive repositories is "filez"
+func ParseObjectName(objectName string) (string, string, error) {
+	index := strings.LastIndex(objectName, ".")
+	if index < 0 {
+		return "", "", fmt.Errorf("object name \"%s\" has no type", objectName)
+	}
+
+	return objectName[:index], objectName[index+1:], nil
+}
+
+// Known object types, as they appear in object names
+var objectTypes = map[string]bool{
+	"file":             true,
+	"filez":            true,
+	"dirtree":          true,
+	"dirmeta":          true,
+	"commit":           true,
+	"tombstone-commit": true,
+	"commitmeta":       true,
+	"payload-link":     true,
+	"file-xattrs":      true,
+	"file-xattrs-link": true,
+}
+
+// ValidateChecksum checks that checksum is a SHA-256 checksum in lowercase hex
+func ValidateChecksum(checksum string) error {
+	if len(checksum) != 64 {
+		return fmt.Errorf("invalid checksum \"%s\"", checksum)
+	}
+	for _, c := range checksum {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return fmt.Errorf("invalid checksum \"%s\"", checksum)
+		}
+	}
+
+	return nil
+}
+
+// ValidateRef checks that ref is a valid branch name
+func ValidateRef(ref string) error {
+	if ref == "" {
+		return fmt.Errorf("invalid ref \"%s\"", ref)
+	}
+	for _, part := range strings.Split(ref, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid ref \"%s\"", ref)
+		}
+	}
+
+	return nil
+}
+
+// ValidateObjectName checks that objectName is a SHA-256 checksum in lowercase
+// hex followed by a known object type, so that it's safe to use in paths
+func ValidateObjectName(objectName string) error {
+	checksum, objectType, err := ParseObjectName(objectName)
+	if err != nil {
+		return err
+	}
+
+	if err := ValidateChecksum(checksum); err != nil {
+		return fmt.Errorf("object name \"%s\" has an invalid checksum", objectName)
+	}
+
+	if !objectTypes[objectType] {
+		return fmt.Errorf("object name \"%s\" has an unknown type", objectName)
+	}
+
+	return nil
+}
+
+// ObjectNameForMode returns the name that the object has in a repository
+// with the specified mode: content objects are "filez" in archive
+// repositories and "file" in the others
+func ObjectNameForMode(objectName, mode string) string {
+	switch {
+	case mode == "archive" && strings.HasSuffix(objectName, ".file"):
+		return objectName + "z"
+	case mode != "archive" && strings.HasSuffix(objectName, ".filez"):
+		return strings.TrimSuffix(objectName, "z")
+	}
+
+	return objectName
+}
+
+// CheckModeCompatibility returns an error if objects from a repository in
+// sourceMode cannot be pushed to a repository in destinationMode: archive
+// repositories accept objects from any repository once content objects are
+// compressed, the others store file ownership and extended attributes in
+// their own way and only accept objects from repositories in the same mode
+func CheckModeCompatibility(sourceMode, destinationMode string) error {
+	if sourceMode == destinationMode || destinationMode == "archive" {
+		return nil
+	}
+
+	return fmt.Errorf("cannot push from a repository in %s mode to one in %s mode", sourceMode, destinationMode)
+}
+
+// isMetadataObject returns whether objects of this type are stored
+// as the serialized variant whose SHA-256 is the object checksum
+func isMetadataObject(objectType string) bool {
+	switch objectType {
+	case "commit", "dirtree", "dirmeta":
+		return true
+	}
+
+	return false
+}
+
+// checksumFile calculates the SHA-256 checksum of the file and
+// returns the hex value
+func checksumFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
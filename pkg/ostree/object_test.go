@@ -0,0 +1,79 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package ostree
+
+import (
+	"strings"
+	"testing"
+)
+
+const testChecksum = "5ac9b8bc3a6e4c3b7c28c0e7c9f9cd6cbf7b3c6f0e2dd8d5be0e4a4d8b0e0f2a"
+
+func TestValidateObjectName(t *testing.T) {
+	tests := []struct {
+		name       string
+		objectName string
+		valid      bool
+	}{
+		{"commit", testChecksum + ".commit", true},
+		{"archive file", testChecksum + ".filez", true},
+		{"bare file", testChecksum + ".file", true},
+		{"dirtree", testChecksum + ".dirtree", true},
+		{"empty", "", false},
+		{"no type", testChecksum, false},
+		{"parent directory", "../" + testChecksum + ".commit", false},
+		{"parent directory in checksum", testChecksum[:61] + "/../.commit", false},
+		{"dot dot", "..", false},
+		{"absolute path", "/" + testChecksum[1:] + ".commit", false},
+		{"absolute path outside", "/etc/passwd", false},
+		{"short checksum", testChecksum[:63] + ".commit", false},
+		{"long checksum", testChecksum + "0.commit", false},
+		{"uppercase checksum", strings.ToUpper(testChecksum) + ".commit", false},
+		{"non hex checksum", "g" + testChecksum[1:] + ".commit", false},
+		{"unknown suffix", testChecksum + ".exe", false},
+		{"empty suffix", testChecksum + ".", false},
+		{"suffix with path", testChecksum + ".commit/../x", false},
+		{"double suffix", testChecksum + ".commit.commit", false},
+		{"NUL in checksum", testChecksum[:63] + "\x00.commit", false},
+		{"NUL in suffix", testChecksum + ".commit\x00", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateObjectName(test.objectName)
+			if test.valid && err != nil {
+				t.Errorf("ValidateObjectName(%q) = %v, want no error", test.objectName, err)
+			} else if !test.valid && err == nil {
+				t.Errorf("ValidateObjectName(%q) = nil, want an error", test.objectName)
+			}
+		})
+	}
+}
+
+func TestValidateChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum string
+		valid    bool
+	}{
+		{"valid", testChecksum, true},
+		{"empty", "", false},
+		{"short", testChecksum[:63], false},
+		{"uppercase", strings.ToUpper(testChecksum), false},
+		{"path", "../" + testChecksum[3:], false},
+		{"NUL", testChecksum[:63] + "\x00", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateChecksum(test.checksum)
+			if test.valid && err != nil {
+				t.Errorf("ValidateChecksum(%q) = %v, want no error", test.checksum, err)
+			} else if !test.valid && err == nil {
+				t.Errorf("ValidateChecksum(%q) = nil, want an error", test.checksum)
+			}
+		})
+	}
+}
@@ -0,0 +1,1116 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package ostree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// #cgo pkg-config: ostree-1
+// #include <glib.h>
+// #include <ostree.h>
+// #include "glibsupport.h"
+import "C"
+
+func convertGError(errC *C.GError) error {
+	if errC == nil {
+		return errors.New("nil GError")
+	}
+
+	err := errors.New(C.GoString((*C.char)(C._g_error_get_message(errC))))
+	defer C.g_error_free(errC)
+	return err
+}
+
+// Repo represents a local ostree repository
+type Repo struct {
+	path string
+	ptr  unsafe.Pointer
+}
+
+// Repo implements Repository with libostree
+var _ Repository = (*Repo)(nil)
+
+// Version returns the version of libostree the program was built with
+func Version() string {
+	return C.GoString(C._ostree_version())
+}
+
+// Open attempts to open the repo at the given path
+func Open(path string) (*Repo, error) {
+	if path == "" {
+		return nil, errors.New("empty path")
+	}
+
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+
+	repoPath := C.g_file_new_for_path(pathC)
+	defer C.g_object_unref(C.gpointer(repoPath))
+
+	repoC := C.ostree_repo_new(repoPath)
+	if repoC == nil {
+		return nil, errors.New("failed to open repository")
+	}
+
+	repo := &Repo{path, unsafe.Pointer(repoC)}
+
+	var errC *C.GError
+	if C.ostree_repo_open(repoC, nil, &errC) == C.FALSE {
+		return nil, convertGError(errC)
+	}
+
+	return repo, nil
+}
+
+// CreateRepo creates the repository from path and opens it.
+func CreateRepo(path string) (*Repo, error) {
+	if path == "" {
+		return nil, errors.New("empty path")
+	}
+
+	// Create path if it doesn't exist
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		os.Mkdir(path, 0755)
+	}
+
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+
+	repoPath := C.g_file_new_for_path(pathC)
+	defer C.g_object_unref(C.gpointer(repoPath))
+
+	repoC := C.ostree_repo_new(repoPath)
+	if repoC == nil {
+		return nil, errors.New("failed to open repository")
+	}
+
+	repo := &Repo{path, unsafe.Pointer(repoC)}
+
+	var errC *C.GError
+
+	if C.ostree_repo_create(repoC, C.OSTREE_REPO_MODE_ARCHIVE, nil, &errC) == C.FALSE {
+		return nil, convertGError(errC)
+	}
+
+	if C.ostree_repo_open(repoC, nil, &errC) == C.FALSE {
+		return nil, convertGError(errC)
+	}
+
+	return repo, nil
+}
+
+// native converts an ostree repo struct to its C equivalent
+func (r *Repo) native() *C.OstreeRepo {
+	if r.ptr == nil {
+		return nil
+	}
+	return (*C.OstreeRepo)(r.ptr)
+}
+
+// Path returns the repository path
+func (r *Repo) Path() string {
+	return r.path
+}
+
+// GetObjectPath returns the path to the OSTree object passed as argument
+func (r *Repo) GetObjectPath(objectName string) string {
+	return filepath.Join(r.path, "objects", objectName[:2], objectName[2:])
+}
+
+// GetMode returns the repository mode
+func (r *Repo) GetMode() (string, error) {
+	if r.ptr == nil {
+		return "", errors.New("repo not initialized")
+	}
+
+	mode := C.ostree_repo_get_mode(r.native())
+
+	switch mode {
+	case C.OSTREE_REPO_MODE_BARE:
+		return "bare", nil
+	case C.OSTREE_REPO_MODE_ARCHIVE:
+		return "archive", nil
+	case C.OSTREE_REPO_MODE_BARE_USER:
+		return "bare-user", nil
+	case C.OSTREE_REPO_MODE_BARE_USER_ONLY:
+		return "bare-user-only", nil
+	}
+
+	return "", errors.New("unknown repository mode")
+}
+
+// listRefs lists all the refs in the repository
+func (r *Repo) listRefs() ([]string, error) {
+	if r.ptr == nil {
+		return nil, errors.New("repo not initialized")
+	}
+
+	var refsC *C.GHashTable
+	var errC *C.GError
+	if C.ostree_repo_list_refs(r.native(), nil, &refsC, nil, &errC) == C.FALSE {
+		return nil, convertGError(errC)
+	}
+
+	var iter C.GHashTableIter
+	C.g_hash_table_iter_init(&iter, refsC)
+
+	refs := []string{}
+
+	var hkey C.gpointer
+	var hvalue C.gpointer
+	for C.g_hash_table_iter_next(&iter, &hkey, &hvalue) == C.TRUE {
+		refs = append(refs, C.GoString(C._g_strdup(hkey)))
+	}
+
+	return refs, nil
+}
+
+// Refs returns a dictionary whose keys are refs and values are the corresponding revisions
+func (r *Repo) Refs() (map[string]string, error) {
+	if r.ptr == nil {
+		return nil, errors.New("repo not initialized")
+	}
+
+	refs, err := r.listRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	revs := map[string]string{}
+
+	for _, ref := range refs {
+		rev, err := r.ResolveRev(ref)
+		if err != nil {
+			return nil, err
+		}
+		revs[ref] = rev
+	}
+
+	return revs, nil
+}
+
+// GetParentRev returns the revision of the parent commit, or an empty string if it doesn't have one
+func (r *Repo) GetParentRev(rev string) (string, error) {
+	if r.ptr == nil {
+		return "", errors.New("repo not initialized")
+	}
+
+	var variantC *C.GVariant
+	var errC *C.GError
+	if C.ostree_repo_load_variant_if_exists(r.native(), C.OSTREE_OBJECT_TYPE_COMMIT, C.CString(rev), &variantC, &errC) == C.FALSE {
+		return "", convertGError(errC)
+	}
+	if variantC == nil {
+		return "", fmt.Errorf("commit %s doesn't exist", rev)
+	}
+	return C.GoString(C.ostree_commit_get_parent(variantC)), nil
+}
+
+// GetCommitInfo returns the subject, timestamp and parent of the commit rev
+func (r *Repo) GetCommitInfo(rev string) (*CommitInfo, error) {
+	if r.ptr == nil {
+		return nil, errors.New("repo not initialized")
+	}
+
+	revC := C.CString(rev)
+	defer C.free(unsafe.Pointer(revC))
+
+	var variantC *C.GVariant
+	var errC *C.GError
+	if C.ostree_repo_load_variant_if_exists(r.native(), C.OSTREE_OBJECT_TYPE_COMMIT, revC, &variantC, &errC) == C.FALSE {
+		return nil, convertGError(errC)
+	}
+	if variantC == nil {
+		return nil, fmt.Errorf("commit %s doesn't exist", rev)
+	}
+	defer C.g_variant_unref(variantC)
+
+	return commitInfo(rev, variantC), nil
+}
+
+// ReadCommitInfo describes the commit rev stored in the file at path,
+// for commits that are not in the repository yet
+func (r *Repo) ReadCommitInfo(path, rev string) (*CommitInfo, error) {
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+
+	var errC *C.GError
+	variantC := C._ostree_load_commit_file(pathC, &errC)
+	if variantC == nil {
+		return nil, convertGError(errC)
+	}
+	defer C.g_variant_unref(variantC)
+
+	return commitInfo(rev, variantC), nil
+}
+
+// commitInfo describes the commit rev whose content is variantC
+func commitInfo(rev string, variantC *C.GVariant) *CommitInfo {
+	parentC := C.ostree_commit_get_parent(variantC)
+	defer C.g_free(C.gpointer(parentC))
+
+	// Keys and values alternate
+	pairsC := C._ostree_commit_get_string_metadata(variantC)
+	defer C.g_strfreev(pairsC)
+	length := C.g_strv_length(pairsC)
+	pairsSlice := (*[1 << 28]*C.char)(unsafe.Pointer(pairsC))[:length:length]
+	metadata := map[string]string{}
+	for i := 0; i+1 < len(pairsSlice); i += 2 {
+		metadata[C.GoString(pairsSlice[i])] = C.GoString(pairsSlice[i+1])
+	}
+
+	return &CommitInfo{
+		Rev:       rev,
+		Parent:    C.GoString(parentC),
+		Subject:   C.GoString(C._ostree_commit_get_subject(variantC)),
+		Timestamp: time.Unix(int64(C.ostree_commit_get_timestamp(variantC)), 0),
+		Metadata:  metadata,
+	}
+}
+
+// ResolveRev returns the revision corresponding to the specified branch
+func (r *Repo) ResolveRev(branch string) (string, error) {
+	if r.ptr == nil {
+		return "", errors.New("repo not initialized")
+	}
+
+	var revC *C.char
+	var errC *C.GError
+	if C.ostree_repo_resolve_rev(r.native(), C.CString(branch), C.FALSE, &revC, &errC) == C.FALSE {
+		return "", convertGError(errC)
+	}
+
+	return C.GoString(revC), nil
+}
+
+// Traverse returns an hash table with all the reachable objects from
+// the passed commit checksum, traversing maxDepth parent commits
+func (r *Repo) Traverse(rev string, maxDepth int) ([]string, error) {
+	if r.ptr == nil {
+		return nil, errors.New("repo not initialized")
+	}
+
+	revC := C.CString(rev)
+	maxDepthC := C.int(maxDepth)
+
+	var creachable *C.GHashTable
+	var errC *C.GError
+	if C.ostree_repo_traverse_commit(r.native(), revC, maxDepthC, &creachable, nil, &errC) == C.FALSE {
+		return nil, convertGError(errC)
+	}
+
+	var iter C.GHashTableIter
+	C.g_hash_table_iter_init(&iter, creachable)
+
+	objects := []string{}
+
+	var object *C.GVariant
+	for C._g_hash_table_iter_next_variant(&iter, &object, nil) == C.TRUE {
+		var cchecksum *C.char
+		var cobjectType C.OstreeObjectType
+		C._g_variant_get_su(object, &cchecksum, &cobjectType)
+
+		objectNameC := C.ostree_object_to_string(cchecksum, cobjectType)
+		objectName := C.GoString(objectNameC)
+
+		if cobjectType == C.OSTREE_OBJECT_TYPE_FILE {
+			if mode, _ := r.GetMode(); mode == "archive" {
+				// Append z for archive repositories
+				objects = append(objects, fmt.Sprintf("%sz", objectName))
+				continue
+			}
+		}
+
+		objects = append(objects, objectName)
+	}
+
+	return objects, nil
+}
+
+// Prune removes the objects that are no longer reachable, traversing at
+// most options.Depth parents of the commits of refs, or all of them when
+// it's -1
+func (r *Repo) Prune(options PruneOptions) (*PruneResult, error) {
+	if r.ptr == nil {
+		return nil, errors.New("repo not initialized")
+	}
+
+	var flags C.OstreeRepoPruneFlags = C.OSTREE_REPO_PRUNE_FLAGS_NONE
+	if options.DryRun {
+		flags |= C.OSTREE_REPO_PRUNE_FLAGS_NO_PRUNE
+	}
+	if options.RefsOnly {
+		flags |= C.OSTREE_REPO_PRUNE_FLAGS_REFS_ONLY
+	}
+
+	var total C.gint
+	var pruned C.gint
+	var size C.guint64
+	var errC *C.GError
+	if C.ostree_repo_prune(r.native(), flags, C.gint(options.Depth), &total, &pruned, &size, nil, &errC) == C.FALSE {
+		return nil, convertGError(errC)
+	}
+
+	return &PruneResult{Total: int(total), Pruned: int(pruned), Size: uint64(size)}, nil
+}
+
+// Attributes of the files passed to a WalkFunc
+const walkAttributes = "standard::name,standard::type,standard::size,standard::symlink-target,unix::mode,unix::uid,unix::gid"
+
+// fileInfo converts the attributes of file to a FileInfo
+func fileInfo(file *C.GFile, info *C.GFileInfo) FileInfo {
+	pathC := C.g_file_get_path(file)
+	defer C.g_free(C.gpointer(pathC))
+
+	modeAttrC := C.CString("unix::mode")
+	defer C.free(unsafe.Pointer(modeAttrC))
+	uidAttrC := C.CString("unix::uid")
+	defer C.free(unsafe.Pointer(uidAttrC))
+	gidAttrC := C.CString("unix::gid")
+	defer C.free(unsafe.Pointer(gidAttrC))
+
+	unixMode := uint32(C.g_file_info_get_attribute_uint32(info, modeAttrC))
+	mode := os.FileMode(unixMode & 0777)
+	if unixMode&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if unixMode&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if unixMode&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+
+	result := FileInfo{
+		Path: C.GoString(pathC),
+		Size: int64(C.g_file_info_get_size(info)),
+		UID:  uint32(C.g_file_info_get_attribute_uint32(info, uidAttrC)),
+		GID:  uint32(C.g_file_info_get_attribute_uint32(info, gidAttrC)),
+	}
+	switch C.g_file_info_get_file_type(info) {
+	case C.G_FILE_TYPE_DIRECTORY:
+		mode |= os.ModeDir
+	case C.G_FILE_TYPE_SYMBOLIC_LINK:
+		mode |= os.ModeSymlink
+		result.SymlinkTarget = C.GoString(C.g_file_info_get_symlink_target(info))
+	}
+	if mode&os.ModeDir == 0 {
+		result.Checksum = C.GoString(C._ostree_repo_file_get_checksum(file))
+	}
+	result.Mode = mode
+
+	return result
+}
+
+func (r *Repo) walkStart(root *C.GFile, path string, walkFn WalkFunc) error {
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+	f := C.g_file_resolve_relative_path(root, pathC)
+	defer C.g_object_unref(C.gpointer(f))
+
+	attributesC := C.CString(walkAttributes)
+	defer C.free(unsafe.Pointer(attributesC))
+
+	var errC *C.GError
+	info := C.g_file_query_info(f, attributesC, C.G_FILE_QUERY_INFO_NOFOLLOW_SYMLINKS, nil, &errC)
+	if info == nil {
+		return convertGError(errC)
+	}
+	defer C.g_object_unref(C.gpointer(info))
+
+	// The content of a directory is walked, other files are passed as they are
+	if C.g_file_info_get_file_type(info) != C.G_FILE_TYPE_DIRECTORY {
+		if err := walkFn(fileInfo(f, info)); err != nil && err != SkipDir {
+			return err
+		}
+		return nil
+	}
+
+	return r.walkRecurse(f, walkFn)
+}
+
+func (r *Repo) walkRecurse(root *C.GFile, walkFn WalkFunc) error {
+	attributesC := C.CString(walkAttributes)
+	defer C.free(unsafe.Pointer(attributesC))
+
+	var errC *C.GError
+	enumerator := C.g_file_enumerate_children(root, attributesC, C.G_FILE_QUERY_INFO_NOFOLLOW_SYMLINKS, nil, &errC)
+	if enumerator == nil {
+		return convertGError(errC)
+	}
+	defer C.g_object_unref(C.gpointer(enumerator))
+
+	for {
+		info := C.g_file_enumerator_next_file(enumerator, nil, &errC)
+		if info == nil {
+			if errC != nil {
+				return convertGError(errC)
+			}
+			return nil
+		}
+
+		if err := r.walkChild(enumerator, info, walkFn); err != nil {
+			return err
+		}
+	}
+}
+
+// walkChild calls walkFn for a file of a directory, and walks its content
+// if it's a directory too
+func (r *Repo) walkChild(enumerator *C.GFileEnumerator, info *C.GFileInfo, walkFn WalkFunc) error {
+	defer C.g_object_unref(C.gpointer(info))
+
+	child := C.g_file_enumerator_get_child(enumerator, info)
+	defer C.g_object_unref(C.gpointer(child))
+
+	err := walkFn(fileInfo(child, info))
+	if err == SkipDir {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if C.g_file_info_get_file_type(info) == C.G_FILE_TYPE_DIRECTORY {
+		return r.walkRecurse(child, walkFn)
+	}
+
+	return nil
+}
+
+// Walk walks the path of the commit rev and calls walkFn for each file,
+// with the path itself when it's not a directory
+func (r *Repo) Walk(rev, path string, walkFn WalkFunc) error {
+	if r.ptr == nil {
+		return errors.New("repo not initialized")
+	}
+
+	revC := C.CString(rev)
+	defer C.free(unsafe.Pointer(revC))
+
+	var root *C.GFile
+	var commitC *C.char
+	var errC *C.GError
+	if C.ostree_repo_read_commit(r.native(), revC, &root, &commitC, nil, &errC) == C.FALSE {
+		return convertGError(errC)
+	}
+	defer C.g_object_unref(C.gpointer(root))
+	defer C.g_free(C.gpointer(commitC))
+
+	return r.walkStart(root, path, walkFn)
+}
+
+// Cat writes the content of the file at path of the commit rev to w
+func (r *Repo) Cat(rev, path string, w io.Writer) error {
+	if r.ptr == nil {
+		return errors.New("repo not initialized")
+	}
+
+	revC := C.CString(rev)
+	defer C.free(unsafe.Pointer(revC))
+
+	var root *C.GFile
+	var commitC *C.char
+	var errC *C.GError
+	if C.ostree_repo_read_commit(r.native(), revC, &root, &commitC, nil, &errC) == C.FALSE {
+		return convertGError(errC)
+	}
+	defer C.g_object_unref(C.gpointer(root))
+	defer C.g_free(C.gpointer(commitC))
+
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+	f := C.g_file_resolve_relative_path(root, pathC)
+	defer C.g_object_unref(C.gpointer(f))
+
+	attributesC := C.CString(walkAttributes)
+	defer C.free(unsafe.Pointer(attributesC))
+	info := C.g_file_query_info(f, attributesC, C.G_FILE_QUERY_INFO_NOFOLLOW_SYMLINKS, nil, &errC)
+	if info == nil {
+		return convertGError(errC)
+	}
+	defer C.g_object_unref(C.gpointer(info))
+
+	switch C.g_file_info_get_file_type(info) {
+	case C.G_FILE_TYPE_DIRECTORY:
+		return fmt.Errorf("%s is a directory", path)
+	case C.G_FILE_TYPE_SYMBOLIC_LINK:
+		return fmt.Errorf("%s is a symbolic link to %s", path, C.GoString(C.g_file_info_get_symlink_target(info)))
+	}
+
+	stream := C.g_file_read(f, nil, &errC)
+	if stream == nil {
+		return convertGError(errC)
+	}
+	defer C.g_object_unref(C.gpointer(stream))
+
+	// The content is copied in chunks, files can be large
+	buffer := C.malloc(64 * 1024)
+	defer C.free(buffer)
+	for {
+		n := C.g_input_stream_read((*C.GInputStream)(unsafe.Pointer(stream)), buffer, 64*1024, nil, &errC)
+		if n < 0 {
+			return convertGError(errC)
+		} else if n == 0 {
+			return nil
+		}
+		if _, err := w.Write(C.GoBytes(buffer, C.int(n))); err != nil {
+			return err
+		}
+	}
+}
+
+// Checkout checks out the specified path from the revision rev
+func (r *Repo) Checkout(rev, path, destPath string, options CheckoutOptions) error {
+	if r.ptr == nil {
+		return errors.New("repo not initialized")
+	}
+
+	var modeC C.OstreeRepoCheckoutMode
+	switch options.Mode {
+	case "", CheckoutModeUser:
+		modeC = C.OSTREE_REPO_CHECKOUT_MODE_USER
+	case CheckoutModeNone:
+		modeC = C.OSTREE_REPO_CHECKOUT_MODE_NONE
+	default:
+		return fmt.Errorf("invalid checkout mode \"%s\"", options.Mode)
+	}
+	var overwriteC C.OstreeRepoCheckoutOverwriteMode = C.OSTREE_REPO_CHECKOUT_OVERWRITE_NONE
+	if options.Union {
+		overwriteC = C.OSTREE_REPO_CHECKOUT_OVERWRITE_UNION_FILES
+	}
+
+	revC := C.CString(rev)
+	defer C.free(unsafe.Pointer(revC))
+
+	var root *C.GFile
+	var commitC *C.char
+	var errC *C.GError
+	if C.ostree_repo_read_commit(r.native(), revC, &root, &commitC, nil, &errC) == C.FALSE {
+		return convertGError(errC)
+	}
+	defer C.g_object_unref(C.gpointer(root))
+	defer C.g_free(C.gpointer(commitC))
+
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+	subtree := C.g_file_resolve_relative_path(root, pathC)
+	defer C.g_object_unref(C.gpointer(subtree))
+
+	optsC := C.CString("standard::name,standard::type,standard::size,standard::is-symlink,standard::symlink-target,unix::device,unix::inode,unix::mode,unix::uid,unix::gid,unix::rdev")
+	defer C.free(unsafe.Pointer(optsC))
+	info := C.g_file_query_info(subtree, optsC, C.G_FILE_QUERY_INFO_NOFOLLOW_SYMLINKS, nil, &errC)
+	if info == nil {
+		return convertGError(errC)
+	}
+	defer C.g_object_unref(C.gpointer(info))
+
+	destPathC := C.CString(destPath)
+	defer C.free(unsafe.Pointer(destPathC))
+	dest := C.g_file_new_for_path(destPathC)
+	defer C.g_object_unref(C.gpointer(dest))
+
+	if C.ostree_repo_checkout_tree(r.native(), modeC, overwriteC, dest, C._ostree_repo_file(subtree), info, nil, &errC) == C.FALSE {
+		return convertGError(errC)
+	}
+
+	return nil
+}
+
+// CommitDirectory commits the content of the directory at path on top of
+// the branch head, if any, and points the branch to the new commit
+func (r *Repo) CommitDirectory(branch, subject, path string) (string, error) {
+	return r.Commit(branch, []string{"dir=" + path}, CommitOptions{Subject: subject, CanonicalPermissions: true})
+}
+
+// Commit writes a commit whose content is the trees laid over each other in
+// order, on top of the branch head, if any, and points the branch to it
+func (r *Repo) Commit(branch string, trees []string, options CommitOptions) (string, error) {
+	if r.ptr == nil {
+		return "", errors.New("repo not initialized")
+	}
+	if len(trees) == 0 {
+		return "", errors.New("nothing to commit")
+	}
+
+	var parentC *C.char
+	if revs, err := r.Refs(); err != nil {
+		return "", err
+	} else if parent, ok := revs[branch]; ok {
+		parentC = C.CString(parent)
+		defer C.free(unsafe.Pointer(parentC))
+	}
+
+	var errC *C.GError
+	if C.ostree_repo_prepare_transaction(r.native(), nil, nil, &errC) == C.FALSE {
+		return "", convertGError(errC)
+	}
+
+	checksum, err := r.writeCommit(branch, parentC, trees, options)
+	if err != nil {
+		C.ostree_repo_abort_transaction(r.native(), nil, nil)
+		return "", err
+	}
+
+	if C.ostree_repo_commit_transaction(r.native(), nil, nil, &errC) == C.FALSE {
+		return "", convertGError(errC)
+	}
+
+	return checksum, nil
+}
+
+// writeCommit writes the trees and the commit within a transaction
+func (r *Repo) writeCommit(branch string, parentC *C.char, trees []string, options CommitOptions) (string, error) {
+	mtreeC := C.ostree_mutable_tree_new()
+	defer C.g_object_unref(C.gpointer(mtreeC))
+
+	var canonicalC C.gboolean = C.FALSE
+	if options.CanonicalPermissions {
+		canonicalC = C.TRUE
+	}
+
+	var errC *C.GError
+	for _, tree := range trees {
+		kind, value, err := ParseTree(tree)
+		if err != nil {
+			return "", err
+		}
+
+		kindC := C.CString(kind)
+		defer C.free(unsafe.Pointer(kindC))
+		valueC := C.CString(value)
+		defer C.free(unsafe.Pointer(valueC))
+
+		if C._ostree_repo_write_tree(r.native(), mtreeC, kindC, valueC, canonicalC, &errC) == C.FALSE {
+			return "", convertGError(errC)
+		}
+	}
+
+	branchC := C.CString(branch)
+	defer C.free(unsafe.Pointer(branchC))
+	subjectC := C.CString(options.Subject)
+	defer C.free(unsafe.Pointer(subjectC))
+	var bodyC *C.char
+	if options.Body != "" {
+		bodyC = C.CString(options.Body)
+		defer C.free(unsafe.Pointer(bodyC))
+	}
+
+	var checksumC *C.char
+	if C._ostree_repo_write_mtree_commit(r.native(), mtreeC, branchC, parentC, subjectC, bodyC, &checksumC, &errC) == C.FALSE {
+		return "", convertGError(errC)
+	}
+	defer C.g_free(C.gpointer(checksumC))
+
+	return C.GoString(checksumC), nil
+}
+
+// SetRefImmediate points ref to checksum for the specified remote
+func (r *Repo) SetRefImmediate(remote, ref, checksum string) error {
+	if r.ptr == nil {
+		return errors.New("repo not initialized")
+	}
+
+	var remoteC *C.char
+	if remote != "" {
+		remoteC = C.CString(remote)
+	}
+
+	var errC *C.GError
+	if C.ostree_repo_set_ref_immediate(r.native(), remoteC, C.CString(ref), C.CString(checksum), nil, &errC) == C.FALSE {
+		return convertGError(errC)
+	}
+
+	return nil
+}
+
+// VerifyCommitSignature checks that the commit rev has a valid GPG
+// signature made with one of the keys trusted by the repository
+func (r *Repo) VerifyCommitSignature(rev string) error {
+	if r.ptr == nil {
+		return errors.New("repo not initialized")
+	}
+
+	revC := C.CString(rev)
+	defer C.free(unsafe.Pointer(revC))
+
+	var errC *C.GError
+	if C.ostree_repo_verify_commit(r.native(), revC, nil, nil, nil, &errC) == C.FALSE {
+		return convertGError(errC)
+	}
+
+	return nil
+}
+
+// SetDetachedMetadata stores the values under key in the detached metadata
+// of the commit rev, as a dictionary of strings, keeping the other entries
+// such as signatures
+func (r *Repo) SetDetachedMetadata(rev, key string, values map[string]string) error {
+	if r.ptr == nil {
+		return errors.New("repo not initialized")
+	}
+
+	revC := C.CString(rev)
+	defer C.free(unsafe.Pointer(revC))
+	keyC := C.CString(key)
+	defer C.free(unsafe.Pointer(keyC))
+
+	// Arrays of C strings have to be allocated by C
+	n := len(values)
+	keysC := (*[1 << 28]*C.char)(C.malloc(C.size_t(n+1) * C.size_t(unsafe.Sizeof(uintptr(0)))))[: n+1 : n+1]
+	defer C.free(unsafe.Pointer(&keysC[0]))
+	valuesC := (*[1 << 28]*C.char)(C.malloc(C.size_t(n+1) * C.size_t(unsafe.Sizeof(uintptr(0)))))[: n+1 : n+1]
+	defer C.free(unsafe.Pointer(&valuesC[0]))
+
+	i := 0
+	for k, v := range values {
+		keysC[i] = C.CString(k)
+		defer C.free(unsafe.Pointer(keysC[i]))
+		valuesC[i] = C.CString(v)
+		defer C.free(unsafe.Pointer(valuesC[i]))
+		i++
+	}
+
+	var errC *C.GError
+	if C._ostree_repo_set_detached_metadata_strv(r.native(), revC, keyC, &keysC[0], &valuesC[0], C.int(n), &errC) == C.FALSE {
+		return convertGError(errC)
+	}
+
+	return nil
+}
+
+// Pull fetches the objects of the commits revs that are missing from
+// remote, a remote configured in the repository
+func (r *Repo) Pull(remote string, revs []string) error {
+	if r.ptr == nil {
+		return errors.New("repo not initialized")
+	}
+
+	remoteC := C.CString(remote)
+	defer C.free(unsafe.Pointer(remoteC))
+
+	// Arrays of C strings have to be allocated by C, this one is
+	// terminated by NULL
+	n := len(revs)
+	revsC := (*[1 << 28]*C.char)(C.malloc(C.size_t(n+1) * C.size_t(unsafe.Sizeof(uintptr(0)))))[: n+1 : n+1]
+	defer C.free(unsafe.Pointer(&revsC[0]))
+	var errC *C.GError
+	for i, rev := range revs {
+		revsC[i] = C.CString(rev)
+		defer C.free(unsafe.Pointer(revsC[i]))
+
+		// Complete commits are not scanned again when pulled
+		if C.ostree_repo_mark_commit_partial(r.native(), revsC[i], C.TRUE, &errC) == C.FALSE {
+			return convertGError(errC)
+		}
+	}
+	revsC[n] = nil
+
+	if C.ostree_repo_pull(r.native(), remoteC, &revsC[0], C.OSTREE_REPO_PULL_FLAGS_NONE, nil, nil, &errC) == C.FALSE {
+		return convertGError(errC)
+	}
+
+	return nil
+}
+
+// RegenerateSummary updates the summary, with additional metadata when
+// it's not empty, see CheckSummaryMetadata for the types of the values
+func (r *Repo) RegenerateSummary(additional map[string]interface{}) error {
+	if r.ptr == nil {
+		return errors.New("repo not initialized")
+	}
+	if err := CheckSummaryMetadata(additional); err != nil {
+		return err
+	}
+
+	var builderC *C.GVariantBuilder
+	if len(additional) > 0 {
+		builderC = C._g_variant_builder_new_vardict()
+		defer C.g_variant_builder_unref(builderC)
+		for key, value := range additional {
+			addVariant(builderC, key, value)
+		}
+	}
+
+	var errC *C.GError
+	if C._ostree_repo_regenerate_summary(r.native(), builderC, &errC) == C.FALSE {
+		return convertGError(errC)
+	}
+
+	return nil
+}
+
+// addVariant adds value under key to a dictionary of variants, value has
+// one of the types accepted by CheckSummaryMetadata
+func addVariant(builderC *C.GVariantBuilder, key string, value interface{}) {
+	keyC := C.CString(key)
+	defer C.free(unsafe.Pointer(keyC))
+
+	switch v := value.(type) {
+	case string:
+		valueC := C.CString(v)
+		defer C.free(unsafe.Pointer(valueC))
+		C._g_variant_builder_add_string(builderC, keyC, valueC)
+	case bool:
+		var valueC C.gboolean = C.FALSE
+		if v {
+			valueC = C.TRUE
+		}
+		C._g_variant_builder_add_boolean(builderC, keyC, valueC)
+	case int:
+		C._g_variant_builder_add_int64(builderC, keyC, C.gint64(v))
+	case int64:
+		C._g_variant_builder_add_int64(builderC, keyC, C.gint64(v))
+	case float64:
+		C._g_variant_builder_add_double(builderC, keyC, C.gdouble(v))
+	case []string:
+		// Arrays of C strings have to be allocated by C
+		n := len(v)
+		valuesC := (*[1 << 28]*C.char)(C.malloc(C.size_t(n+1) * C.size_t(unsafe.Sizeof(uintptr(0)))))[: n+1 : n+1]
+		defer C.free(unsafe.Pointer(&valuesC[0]))
+		for i, s := range v {
+			valuesC[i] = C.CString(s)
+			defer C.free(unsafe.Pointer(valuesC[i]))
+		}
+		C._g_variant_builder_add_strv(builderC, keyC, &valuesC[0], C.int(n))
+	}
+}
+
+// VerifyObject checks that the content of the object file at path matches
+// the checksum encoded in objectName, parsing the archive framing of
+// compressed content objects; uncompressed content objects are not checked,
+// since the checksum covers the owner, mode and extended attributes that
+// bare repositories keep on the file rather than in it
+func VerifyObject(path, objectName string) error {
+	expected, objectType, err := ParseObjectName(objectName)
+	if err != nil {
+		return err
+	}
+
+	var actual string
+	switch {
+	case isMetadataObject(objectType):
+		actual, err = checksumFile(path)
+		if err != nil {
+			return err
+		}
+	case objectType == "filez":
+		pathC := C.CString(path)
+		defer C.free(unsafe.Pointer(pathC))
+
+		var checksumC *C.char
+		var errC *C.GError
+		if C._ostree_checksum_content_file(pathC, &checksumC, &errC) == C.FALSE {
+			return convertGError(errC)
+		}
+		defer C.g_free(C.gpointer(checksumC))
+
+		actual = C.GoString(checksumC)
+	default:
+		// Other objects, such as detached commit metadata, are not content-addressed,
+		// and uncompressed content objects lost their metadata on the way
+		return nil
+	}
+
+	if actual != expected {
+		return fmt.Errorf("object \"%s\" has a bad checksum %s", objectName, actual)
+	}
+
+	return nil
+}
+
+// VerifyObject checks that the content of the object file at path matches its name
+func (r *Repo) VerifyObject(path, objectName string) error {
+	return VerifyObject(path, objectName)
+}
+
+// ListObjects returns the names of all the objects stored in the repository
+func (r *Repo) ListObjects() ([]string, error) {
+	objectsPath := filepath.Join(r.path, "objects")
+	objects := []string{}
+
+	err := filepath.Walk(objectsPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		// Objects are stored as objects/<first 2 characters>/<rest of the name>
+		prefix := filepath.Base(filepath.Dir(path))
+		objects = append(objects, prefix+info.Name())
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// ExportArchiveObject writes the file object objectName, stored uncompressed
+// in a bare repository, to path in the compressed format of archive repositories
+func (r *Repo) ExportArchiveObject(objectName, path string) error {
+	if r.ptr == nil {
+		return errors.New("repo not initialized")
+	}
+
+	checksum, _, err := ParseObjectName(objectName)
+	if err != nil {
+		return err
+	}
+
+	checksumC := C.CString(checksum)
+	defer C.free(unsafe.Pointer(checksumC))
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+
+	var errC *C.GError
+	if C._ostree_repo_export_archive_z2(r.native(), checksumC, pathC, &errC) == C.FALSE {
+		return convertGError(errC)
+	}
+
+	return nil
+}
+
+// ReadObjectChildren parses the commit or dirtree object file at path and returns
+// the names of the objects it references: a commit references its root dirtree
+// and dirmeta plus the parent commit, a dirtree references files and subdirectories.
+// Other objects don't have any children.
+func (r *Repo) ReadObjectChildren(path, objectName string) ([]string, error) {
+	if r.ptr == nil {
+		return nil, errors.New("repo not initialized")
+	}
+
+	_, objectType, err := ParseObjectName(objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	var objectTypeC C.OstreeObjectType
+	switch objectType {
+	case "commit":
+		objectTypeC = C.OSTREE_OBJECT_TYPE_COMMIT
+	case "dirtree":
+		objectTypeC = C.OSTREE_OBJECT_TYPE_DIR_TREE
+	default:
+		return []string{}, nil
+	}
+
+	mode, err := r.GetMode()
+	if err != nil {
+		return nil, err
+	}
+
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+
+	var errC *C.GError
+	childrenC := C._ostree_metadata_children(pathC, objectTypeC, &errC)
+	if childrenC == nil {
+		return nil, convertGError(errC)
+	}
+	defer C.g_strfreev(childrenC)
+
+	length := C.g_strv_length(childrenC)
+	childrenSlice := (*[1 << 28]*C.char)(unsafe.Pointer(childrenC))[:length:length]
+
+	children := []string{}
+	for _, childC := range childrenSlice {
+		child := C.GoString(childC)
+		if mode == "archive" && strings.HasSuffix(child, ".file") {
+			// Append z for archive repositories
+			child = fmt.Sprintf("%sz", child)
+		}
+		children = append(children, child)
+	}
+
+	return children, nil
+}
+
+// ListFileObjects returns a dictionary whose keys are the paths of the files
+// in the commit rev and values are the corresponding file object names
+func (r *Repo) ListFileObjects(rev string) (map[string]string, error) {
+	if r.ptr == nil {
+		return nil, errors.New("repo not initialized")
+	}
+
+	mode, err := r.GetMode()
+	if err != nil {
+		return nil, err
+	}
+
+	revC := C.CString(rev)
+	defer C.free(unsafe.Pointer(revC))
+
+	var root *C.GFile
+	var commitC *C.char
+	var errC *C.GError
+	if C.ostree_repo_read_commit(r.native(), revC, &root, &commitC, nil, &errC) == C.FALSE {
+		return nil, convertGError(errC)
+	}
+	defer C.g_object_unref(C.gpointer(root))
+	defer C.g_free(C.gpointer(commitC))
+
+	files := map[string]string{}
+	if err := listFileObjects(root, "", mode == "archive", files); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func listFileObjects(dir *C.GFile, prefix string, archive bool, files map[string]string) error {
+	optsC := C.CString("standard::name,standard::type")
+	defer C.free(unsafe.Pointer(optsC))
+
+	var errC *C.GError
+	enumerator := C.g_file_enumerate_children(dir, optsC, C.G_FILE_QUERY_INFO_NOFOLLOW_SYMLINKS, nil, &errC)
+	if enumerator == nil {
+		return convertGError(errC)
+	}
+	defer C.g_object_unref(C.gpointer(enumerator))
+
+	for {
+		info := C.g_file_enumerator_next_file(enumerator, nil, &errC)
+		if info == nil {
+			if errC != nil {
+				return convertGError(errC)
+			}
+			return nil
+		}
+
+		child := C.g_file_enumerator_get_child(enumerator, info)
+		path := prefix + "/" + C.GoString(C.g_file_info_get_name(info))
+
+		var err error
+		if C.g_file_info_get_file_type(info) == C.G_FILE_TYPE_DIRECTORY {
+			err = listFileObjects(child, path, archive, files)
+		} else {
+			objectName := fmt.Sprintf("%s.file", C.GoString(C._ostree_repo_file_get_checksum(child)))
+			if archive {
+				// Append z for archive repositories
+				objectName = fmt.Sprintf("%sz", objectName)
+			}
+			files[path] = objectName
+		}
+
+		C.g_object_unref(C.gpointer(child))
+		C.g_object_unref(C.gpointer(info))
+
+		if err != nil {
+			return err
+		}
+	}
+}
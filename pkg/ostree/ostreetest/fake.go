@@ -0,0 +1,403 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package ostreetest provides a repository that doesn't need libostree,
+// to test the receiver and the pusher
+package ostreetest
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lirios/ostree-upload/pkg/ostree"
+)
+
+// Commit is a commit of a FakeRepo
+type Commit struct {
+	Parent    string
+	Subject   string
+	Timestamp time.Time
+	// String values of the commit metadata
+	Metadata map[string]string
+	// Objects reachable from the commit, without those of the parents
+	Objects []string
+	// File object of each path
+	Files map[string]string
+}
+
+// FakeRepo is a repository whose refs and commits are kept in memory,
+// objects are stored in files since callers read and move them; the
+// checksum of every object is the SHA-256 of its content
+type FakeRepo struct {
+	mutex     sync.Mutex
+	path      string
+	mode      string
+	refs      map[string]string
+	commits   map[string]*Commit
+	children  map[string][]string
+	signed    map[string]bool
+	metadata  map[string]map[string]map[string]string
+	summaries int
+	// Additional metadata of the last summary
+	summaryMetadata map[string]interface{}
+}
+
+// FakeRepo doesn't need libostree
+var _ ostree.Repository = (*FakeRepo)(nil)
+
+// NewFakeRepo creates a repository in mode whose objects are stored under path
+func NewFakeRepo(path, mode string) (*FakeRepo, error) {
+	if err := os.MkdirAll(filepath.Join(path, "objects"), 0755); err != nil {
+		return nil, err
+	}
+
+	return &FakeRepo{
+		path:     path,
+		mode:     mode,
+		refs:     map[string]string{},
+		commits:  map[string]*Commit{},
+		children: map[string][]string{},
+		signed:   map[string]bool{},
+		metadata: map[string]map[string]map[string]string{},
+	}, nil
+}
+
+// ObjectName returns the name of an object with the content and type
+func ObjectName(content []byte, objectType string) string {
+	return fmt.Sprintf("%x.%s", sha256.Sum256(content), objectType)
+}
+
+// AddObject stores an object and returns its name
+func (f *FakeRepo) AddObject(content []byte, objectType string) (string, error) {
+	objectName := ObjectName(content, objectType)
+	objectPath := f.GetObjectPath(objectName)
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		return "", err
+	}
+
+	return objectName, ioutil.WriteFile(objectPath, content, 0644)
+}
+
+// AddCommit adds the commit rev, its objects must be added separately
+func (f *FakeRepo) AddCommit(rev string, commit Commit) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.commits[rev] = &commit
+}
+
+// SetChildren sets the objects referenced by a commit or dirtree object,
+// as returned by ReadObjectChildren
+func (f *FakeRepo) SetChildren(objectName string, children []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.children[objectName] = children
+}
+
+// SignCommit gives the commit rev a valid signature
+func (f *FakeRepo) SignCommit(rev string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.signed[rev] = true
+}
+
+// DetachedMetadata returns what was stored under key for the commit rev
+func (f *FakeRepo) DetachedMetadata(rev, key string) map[string]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.metadata[rev][key]
+}
+
+// SummaryUpdates returns how many times the summary was regenerated
+func (f *FakeRepo) SummaryUpdates() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.summaries
+}
+
+// SummaryMetadata returns the additional metadata of the last summary
+func (f *FakeRepo) SummaryMetadata() map[string]interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.summaryMetadata
+}
+
+// Path returns the repository path
+func (f *FakeRepo) Path() string {
+	return f.path
+}
+
+// GetObjectPath returns the path where the object is stored
+func (f *FakeRepo) GetObjectPath(objectName string) string {
+	return filepath.Join(f.path, "objects", objectName[:2], objectName[2:])
+}
+
+// GetMode returns the repository mode
+func (f *FakeRepo) GetMode() (string, error) {
+	return f.mode, nil
+}
+
+// Refs returns the revision of each ref
+func (f *FakeRepo) Refs() (map[string]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	revs := map[string]string{}
+	for ref, rev := range f.refs {
+		revs[ref] = rev
+	}
+
+	return revs, nil
+}
+
+// ResolveRev returns the revision of a branch, or rev itself for a commit
+func (f *FakeRepo) ResolveRev(branch string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if rev, ok := f.refs[branch]; ok {
+		return rev, nil
+	}
+	if _, ok := f.commits[branch]; ok {
+		return branch, nil
+	}
+
+	return "", fmt.Errorf("refspec \"%s\" not found", branch)
+}
+
+// SetRefImmediate points ref to checksum, the remote is part of the ref name
+func (f *FakeRepo) SetRefImmediate(remote, ref, checksum string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if remote != "" {
+		ref = remote + ":" + ref
+	}
+	f.refs[ref] = checksum
+
+	return nil
+}
+
+// RegenerateSummary counts the summary updates and keeps their additional
+// metadata
+func (f *FakeRepo) RegenerateSummary(additional map[string]interface{}) error {
+	if err := ostree.CheckSummaryMetadata(additional); err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.summaries++
+	f.summaryMetadata = additional
+
+	return nil
+}
+
+// commit returns the commit rev, the mutex must be locked
+func (f *FakeRepo) commit(rev string) (*Commit, error) {
+	commit, ok := f.commits[rev]
+	if !ok {
+		return nil, fmt.Errorf("commit %s doesn't exist", rev)
+	}
+
+	return commit, nil
+}
+
+// GetParentRev returns the parent of a commit, if any
+func (f *FakeRepo) GetParentRev(rev string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	commit, err := f.commit(rev)
+	if err != nil {
+		return "", err
+	}
+
+	return commit.Parent, nil
+}
+
+// GetCommitInfo describes a commit
+func (f *FakeRepo) GetCommitInfo(rev string) (*ostree.CommitInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	commit, err := f.commit(rev)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ostree.CommitInfo{Rev: rev, Parent: commit.Parent, Subject: commit.Subject, Timestamp: commit.Timestamp, Metadata: commit.Metadata}, nil
+}
+
+// ReadCommitInfo describes the commit rev, which must have been added with
+// AddCommit, as long as the file at path exists
+func (f *FakeRepo) ReadCommitInfo(path, rev string) (*ostree.CommitInfo, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	return f.GetCommitInfo(rev)
+}
+
+// VerifyCommitSignature fails unless the commit was signed with SignCommit
+func (f *FakeRepo) VerifyCommitSignature(rev string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !f.signed[rev] {
+		return fmt.Errorf("no valid signature found for commit %s", rev)
+	}
+
+	return nil
+}
+
+// SetDetachedMetadata stores values under key for the commit rev
+func (f *FakeRepo) SetDetachedMetadata(rev, key string, values map[string]string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if _, err := f.commit(rev); err != nil {
+		return err
+	}
+	if f.metadata[rev] == nil {
+		f.metadata[rev] = map[string]map[string]string{}
+	}
+	f.metadata[rev][key] = values
+
+	return nil
+}
+
+// ListObjects returns the names of all the objects stored under the path
+func (f *FakeRepo) ListObjects() ([]string, error) {
+	objects := []string{}
+
+	err := filepath.Walk(filepath.Join(f.path, "objects"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		prefix := filepath.Base(filepath.Dir(path))
+		objects = append(objects, prefix+info.Name())
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(objects)
+
+	return objects, nil
+}
+
+// Traverse returns the commit objects and those of maxDepth
+// parents, or of all of them when maxDepth is negative
+func (f *FakeRepo) Traverse(rev string, maxDepth int) ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	objects := []string{}
+	for depth := 0; rev != "" && (maxDepth < 0 || depth <= maxDepth); depth++ {
+		commit, err := f.commit(rev)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, rev+".commit")
+		objects = append(objects, commit.Objects...)
+		rev = commit.Parent
+	}
+
+	return objects, nil
+}
+
+// ListFileObjects returns the file object of each path of a commit
+func (f *FakeRepo) ListFileObjects(rev string) (map[string]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	commit, err := f.commit(rev)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]string{}
+	for path, objectName := range commit.Files {
+		files[path] = objectName
+	}
+
+	return files, nil
+}
+
+// ReadObjectChildren returns the children set with SetChildren
+func (f *FakeRepo) ReadObjectChildren(path, objectName string) ([]string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]string{}, f.children[objectName]...), nil
+}
+
+// VerifyObject checks that the SHA-256 of the file at path is the
+// checksum in the object name
+func (f *FakeRepo) VerifyObject(path, objectName string) error {
+	expected, _, err := ostree.ParseObjectName(objectName)
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if actual := fmt.Sprintf("%x", sha256.Sum256(content)); actual != expected {
+		return fmt.Errorf("object \"%s\" has a bad checksum %s", objectName, actual)
+	}
+
+	return nil
+}
+
+// ExportArchiveObject copies a file object to path, fake objects
+// are not compressed; as with libostree, only the checksum of the
+// object name matters
+func (f *FakeRepo) ExportArchiveObject(objectName, path string) error {
+	if f.mode == "archive" {
+		return errors.New("objects can only be exported from a bare repository")
+	}
+
+	content, err := ioutil.ReadFile(f.GetObjectPath(ostree.ObjectNameForMode(objectName, f.mode)))
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// Prune doesn't remove anything
+func (f *FakeRepo) Prune(options ostree.PruneOptions) (*ostree.PruneResult, error) {
+	return &ostree.PruneResult{}, nil
+}
+
+// Pull does nothing, fakes have no remotes: tests add the objects
+func (f *FakeRepo) Pull(remote string, revs []string) error {
+	return nil
+}
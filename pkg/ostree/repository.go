@@ -0,0 +1,197 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package ostree binds the parts of libostree that ostree-upload uses:
+// Open a repository, list its Refs, Traverse the objects of a commit,
+// Checkout, Commit and Prune, and Pull commits from a remote.  Without cgo
+// the package builds but Open returns ErrNoLibostree, programs are then
+// tested against the Repository interface with the ostreetest package.
+package ostree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// FileInfo describes a file of a commit
+type FileInfo struct {
+	// Absolute path of the file in the commit
+	Path string
+	Mode os.FileMode
+	Size int64
+	UID  uint32
+	GID  uint32
+	// Target of symbolic links
+	SymlinkTarget string
+	// Checksum of the content and metadata of files other than directories
+	Checksum string
+}
+
+// SkipDir is returned by a WalkFunc to skip the content of a directory
+var SkipDir = errors.New("skip this directory")
+
+// WalkFunc is a function called by Walk() for each file
+type WalkFunc func(info FileInfo) error
+
+// CommitInfo describes a commit
+type CommitInfo struct {
+	Rev       string
+	Parent    string
+	Subject   string
+	Timestamp time.Time
+	// String values of the commit metadata, such as ostree.endoflife
+	Metadata map[string]string
+}
+
+// CommitOptions describes a commit written by Repo.Commit
+type CommitOptions struct {
+	Subject string
+	Body    string
+	// Record the files as owned by root with canonical permissions,
+	// instead of their ownership and permissions
+	CanonicalPermissions bool
+}
+
+// Checkout modes
+const (
+	// CheckoutModeUser checks files out owned by the current user
+	CheckoutModeUser = "user"
+	// CheckoutModeNone checks files out with the ownership recorded in the
+	// commit, which requires root privileges
+	CheckoutModeNone = "none"
+)
+
+// CheckoutOptions controls how Repo.Checkout writes files
+type CheckoutOptions struct {
+	// Mode is one of the checkout modes, CheckoutModeUser by default
+	Mode string
+	// Overwrite the files of an existing destination
+	Union bool
+}
+
+// PruneOptions controls what Repository.Prune removes
+type PruneOptions struct {
+	// Only count the objects that would be removed
+	DryRun bool
+	// Only keep the objects of the commits of refs, not those of the
+	// commits without refs
+	RefsOnly bool
+	// Number of parents of the commits of refs that are kept, -1 for all
+	// of them as ostree prune does by default
+	Depth int
+}
+
+// PruneResult tells what Repository.Prune removed
+type PruneResult struct {
+	// Number of objects in the repository
+	Total int
+	// Number of objects removed, or that would be with DryRun
+	Pruned int
+	// Bytes freed by removing the objects
+	Size uint64
+}
+
+// ParseTree splits a tree of a commit into its type and value, trees are
+// "dir=<PATH>" for a directory or "ref=<REV>" for the content of a commit
+func ParseTree(tree string) (string, string, error) {
+	parts := strings.SplitN(tree, "=", 2)
+	if len(parts) != 2 || parts[1] == "" || (parts[0] != "dir" && parts[0] != "ref") {
+		return "", "", fmt.Errorf("invalid tree \"%s\": expected dir=<PATH> or ref=<REV>", tree)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// History returns the commit rev and its parents, from the newest to the
+// oldest, at most limit of them or all when limit is 0; it stops at the first
+// parent that isn't in the repository, since repositories often only keep
+// the recent history
+func History(repo Repository, rev string, limit int) ([]CommitInfo, error) {
+	info, err := repo.GetCommitInfo(rev)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := []CommitInfo{*info}
+	for info.Parent != "" && (limit <= 0 || len(commits) < limit) {
+		if info, err = repo.GetCommitInfo(info.Parent); err != nil {
+			break
+		}
+		commits = append(commits, *info)
+	}
+
+	return commits, nil
+}
+
+// CheckSummaryMetadata checks that additional metadata of the summary are
+// strings, booleans, integers, floats or lists of strings, under keys that
+// OSTree doesn't use for the metadata it writes itself
+func CheckSummaryMetadata(metadata map[string]interface{}) error {
+	for key, value := range metadata {
+		if key == "" || strings.HasPrefix(key, "ostree.summary.") || key == "ostree.static-deltas" {
+			return fmt.Errorf("summary metadata key \"%s\" is reserved", key)
+		}
+		switch value.(type) {
+		case string, bool, int, int64, float64, []string:
+		default:
+			return fmt.Errorf("unsupported type %T of summary metadata %s", value, key)
+		}
+	}
+
+	return nil
+}
+
+// Repository is what the receiver and the pusher need from a repository,
+// it's implemented by Repo and by fakes that don't need libostree
+type Repository interface {
+	// Path returns the repository path
+	Path() string
+	// GetObjectPath returns the path where the object is stored
+	GetObjectPath(objectName string) string
+	// GetMode returns the repository mode
+	GetMode() (string, error)
+
+	// Refs returns the revision of each ref
+	Refs() (map[string]string, error)
+	// ResolveRev returns the revision of a branch
+	ResolveRev(branch string) (string, error)
+	// SetRefImmediate points ref to checksum for the specified remote
+	SetRefImmediate(remote, ref, checksum string) error
+	// RegenerateSummary updates the summary, with additional metadata
+	// when it's not empty
+	RegenerateSummary(additional map[string]interface{}) error
+
+	// GetParentRev returns the parent of a commit, if any
+	GetParentRev(rev string) (string, error)
+	// GetCommitInfo describes a commit
+	GetCommitInfo(rev string) (*CommitInfo, error)
+	// ReadCommitInfo describes the commit rev stored in the file at path
+	ReadCommitInfo(path, rev string) (*CommitInfo, error)
+	// VerifyCommitSignature checks that a commit is signed with a trusted key
+	VerifyCommitSignature(rev string) error
+	// SetDetachedMetadata stores values under key in the detached metadata of a commit
+	SetDetachedMetadata(rev, key string, values map[string]string) error
+
+	// ListObjects returns the names of all the objects
+	ListObjects() ([]string, error)
+	// Traverse returns the objects reachable from a commit
+	Traverse(rev string, maxDepth int) ([]string, error)
+	// ListFileObjects returns the file object of each path of a commit
+	ListFileObjects(rev string) (map[string]string, error)
+	// ReadObjectChildren returns the objects referenced by the object file at path
+	ReadObjectChildren(path, objectName string) ([]string, error)
+	// VerifyObject checks that the object file at path matches its name
+	VerifyObject(path, objectName string) error
+	// ExportArchiveObject writes a file object in the archive format to path
+	ExportArchiveObject(objectName, path string) error
+
+	// Prune removes the objects that are no longer reachable
+	Prune(options PruneOptions) (*PruneResult, error)
+	// Pull fetches the objects of the commits that are missing
+	// from remote, a remote of the repository
+	Pull(remote string, revs []string) error
+}